@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Stats are the cache counters GET /stats reports
+type Stats struct {
+	Items       int     `json:"items"`
+	Capacity    int     `json:"capacity"`
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	Evictions   uint64  `json:"evictions"`
+	Expirations uint64  `json:"expirations"`
+	HitRatio    float64 `json:"hitRatio"`
+	MemoryBytes int64   `json:"memoryBytes"`
+	HeapBytes   uint64  `json:"heapBytes"`
+}
+
+// Stats :: the counters of the cache
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	data, err := c.do(ctx, http.MethodGet, c.path("/stats"), nil)
+	if err != nil {
+		return stats, err
+	}
+	err = json.Unmarshal(data, &stats)
+	return stats, err
+}
+
+// Export :: the items of the default cache as GET /admin/cache/export
+// writes them, a JSON array Import takes
+func (c *Client) Export(ctx context.Context) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, "/admin/cache/export", nil)
+}
+
+// Import :: sets the items of an export in the default cache, returning how
+// many it received and how many were set
+func (c *Client) Import(ctx context.Context, export []byte) (received, imported int, err error) {
+	data, err := c.do(ctx, http.MethodPost, "/admin/cache/import", export)
+	if err != nil {
+		return 0, 0, err
+	}
+	var result struct{ Received, Imported int }
+	err = json.Unmarshal(data, &result)
+	return result.Received, result.Imported, err
+}
+
+// HotKey is one of the most looked up keys
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint32 `json:"count"`
+}
+
+// HotKeys :: the most looked up keys of the default cache over the window
+// the server counts them in, most first
+func (c *Client) HotKeys(ctx context.Context, limit int) (keys []HotKey, window string, err error) {
+	data, err := c.do(ctx, http.MethodGet, "/stats/hotkeys?limit="+strconv.Itoa(limit), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var body struct {
+		Window string   `json:"window"`
+		Keys   []HotKey `json:"keys"`
+	}
+	err = json.Unmarshal(data, &body)
+	return body.Keys, body.Window, err
+}
@@ -0,0 +1,360 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of a Client made by New
+const (
+	DefaultRetries      = 3
+	DefaultMinBackoff   = 100 * time.Millisecond
+	DefaultMaxBackoff   = 5 * time.Second
+	DefaultMaxIdleConns = 64 // kept open per server
+	DefaultMGetWorkers  = 8  // GETs MGet has in flight at once
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// ErrNotFound is returned for keys the cache does not hold
+var ErrNotFound = errors.New("client: key not found")
+
+// StatusError is a response the server refused a request with
+type StatusError struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // how long the server asked us to wait, if it did
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client talks to a cache server over its REST and WebSocket APIs. It is
+// safe for concurrent use and keeps its connections open between requests
+type Client struct {
+	baseURL     string
+	cache       string // the named cache used, "" for the default one
+	httpClient  *http.Client
+	apiKey      string
+	token       string
+	retries     int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	mgetWorkers int
+}
+
+// Option configures a Client made by New
+type Option func(*Client)
+
+// WithAPIKey :: authenticates with an API key
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithToken :: authenticates with a bearer token
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithCache :: uses the named cache served under /caches/{name}
+func WithCache(name string) Option {
+	return func(c *Client) { c.cache = name }
+}
+
+// WithHTTPClient :: sends requests with hc instead of a client of our own;
+// its transport's TLS settings are used for Watch too
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries :: how many times a request is retried after a network
+// error, 429 or 5xx; 0 turns retrying off
+func WithRetries(n int) Option {
+	return func(c *Client) { c.retries = n }
+}
+
+// WithBackoff :: the wait before the first retry, doubled for each one
+// after up to max. A server asking for a longer wait with Retry-After is
+// not retried
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) { c.minBackoff, c.maxBackoff = min, max }
+}
+
+// WithMGetWorkers :: how many GETs MGet has in flight at once
+func WithMGetWorkers(n int) Option {
+	return func(c *Client) { c.mgetWorkers = n }
+}
+
+// New :: a client of the server at baseURL, e.g. http://cache:8080
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("client: invalid server URL %q", baseURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConns
+	c := &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		httpClient:  &http.Client{Transport: transport},
+		retries:     DefaultRetries,
+		minBackoff:  DefaultMinBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		mgetWorkers: DefaultMGetWorkers,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.mgetWorkers < 1 {
+		c.mgetWorkers = 1
+	}
+	return c, nil
+}
+
+// path prefixes an API path with the named cache's, if one is used
+func (c *Client) path(p string) string {
+	if c.cache != "" {
+		return "/caches/" + url.PathEscape(c.cache) + p
+	}
+	return p
+}
+
+func (c *Client) authorize(header http.Header) {
+	if c.apiKey != "" {
+		header.Set(apiKeyHeader, c.apiKey)
+	}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
+// Get :: decodes the value of key into v, as json.Unmarshal does, or
+// returns ErrNotFound
+func (c *Client) Get(ctx context.Context, key string, v interface{}) error {
+	value, err := c.get(ctx, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
+
+func (c *Client) get(ctx context.Context, key string) (json.RawMessage, error) {
+	data, err := c.do(ctx, http.MethodGet, c.path("/cache/"+url.PathEscape(key)), nil)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	return body.Value, nil
+}
+
+// MGet :: the values of keys, left out of the map when not cached
+func (c *Client) MGet(ctx context.Context, keys []string) (map[string]json.RawMessage, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	values := make(map[string]json.RawMessage, len(keys))
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < c.mgetWorkers && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				value, err := c.get(ctx, key)
+				mutex.Lock()
+				if err == nil {
+					values[key] = value
+				} else if err != ErrNotFound && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- key
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return values, nil
+}
+
+// Item is a cached value with its expiry, as GET /cache lists it
+type Item struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+}
+
+// Items :: every live item the caller may read, by key
+func (c *Client) Items(ctx context.Context) (map[string]Item, error) {
+	data, err := c.do(ctx, http.MethodGet, c.path("/cache"), nil)
+	if err != nil {
+		return nil, err
+	}
+	var items map[string]Item
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// Set :: sets key to value, which is sent as JSON, for ttl rounded up to
+// the second; a zero ttl takes the server's CACHE_DEFAULT_TTL
+func (c *Client) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"key":        key,
+		"value":      value,
+		"expiration": int(math.Ceil(ttl.Seconds())),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, http.MethodPost, c.path("/cache"), body)
+	return err
+}
+
+// Touch :: decodes the value of key into v, as Get does, and makes it
+// expire ttl, rounded up to the second, from now, for sliding expiry; a zero
+// ttl takes the server's CACHE_DEFAULT_TTL. Named caches have no touch, as
+// they have no data types
+func (c *Client) Touch(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"expiration": int(math.Ceil(ttl.Seconds()))})
+	if err != nil {
+		return err
+	}
+	data, err := c.do(ctx, http.MethodPost, c.path("/cache/"+url.PathEscape(key)+"/touch"), body)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var reply struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+	return json.Unmarshal(reply.Value, v)
+}
+
+// Delete :: removes key, which need not be cached
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, c.path("/cache/"+url.PathEscape(key)), nil)
+	return err
+}
+
+// do sends a request, retrying it as configured, and returns the body of a
+// 2xx response
+func (c *Client) do(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		data, err := c.send(ctx, method, path, body)
+		if err == nil {
+			return data, nil
+		}
+		wait := c.backoff(attempt)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			if !retryable(statusErr.StatusCode) || statusErr.RetryAfter > c.maxBackoff {
+				return nil, err
+			}
+			wait = max(wait, statusErr.RetryAfter)
+		}
+		if attempt >= c.retries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.authorize(req.Header)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		statusErr := &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			statusErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, statusErr
+	}
+	return data, nil
+}
+
+// retryable reports whether a request answered with status may succeed
+// when sent again
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || (status >= 500 && status != http.StatusNotImplemented)
+}
+
+// backoff is the wait before retry attempt+1: minBackoff doubled attempt
+// times, up to maxBackoff, with jitter so clients retrying together spread
+// out
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.maxBackoff
+	if attempt < 20 && c.minBackoff<<attempt < c.maxBackoff {
+		wait = c.minBackoff << attempt
+	}
+	if wait <= 1 {
+		return wait
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)))
+}
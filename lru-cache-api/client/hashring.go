@@ -0,0 +1,107 @@
+// Package client contains helpers for programs talking to the cache servers.
+package client
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultReplicas is the number of virtual points each node gets on the ring
+const DefaultReplicas = 160
+
+// HashRing maps keys onto nodes using consistent hashing, so adding or
+// removing a node only moves the keys that belonged to it
+type HashRing struct {
+	replicas int
+	mutex    sync.RWMutex
+	points   []uint32
+	owners   map[uint32]string
+}
+
+// NewHashRing creates a ring with the given number of virtual points per node
+func NewHashRing(replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	return &HashRing{
+		replicas: replicas,
+		owners:   make(map[uint32]string),
+	}
+}
+
+// Add :: places the nodes on the ring
+func (r *HashRing) Add(nodes ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, node := range nodes {
+		for i := 0; i < r.replicas; i++ {
+			point := hashKey(strconv.Itoa(i) + node)
+			if _, taken := r.owners[point]; !taken {
+				r.points = append(r.points, point)
+			}
+			r.owners[point] = node
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove :: takes the nodes off the ring
+func (r *HashRing) Remove(nodes ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	gone := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		gone[node] = true
+	}
+
+	points := r.points[:0]
+	for _, point := range r.points {
+		if gone[r.owners[point]] {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// Get returns the node owning key, or "" when the ring is empty
+func (r *HashRing) Get(key string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Nodes returns the distinct nodes on the ring
+func (r *HashRing) Nodes() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, node := range r.owners {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
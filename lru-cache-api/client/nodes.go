@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Node is a cache server as reported by GET /cluster/nodes
+type Node struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// FetchNodes asks any cache server for the members of its cluster
+func FetchNodes(ctx context.Context, baseURL string) ([]Node, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(baseURL, "/")+"/cluster/nodes", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching nodes: %s", resp.Status)
+	}
+
+	var body struct {
+		Nodes []Node `json:"nodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Nodes, nil
+}
+
+// NodeRing places keys on cache servers the way the servers place them
+// on each other: by node ID on the hash ring, so a key goes straight to
+// its owner rather than through a forwarding hop
+type NodeRing struct {
+	*HashRing
+	addrs map[string]string // by node ID
+}
+
+// RingFromNodes builds a hash ring keyed by node ID, ready for Get and Addr
+func RingFromNodes(nodes []Node) *NodeRing {
+	r := &NodeRing{HashRing: NewHashRing(DefaultReplicas), addrs: make(map[string]string, len(nodes))}
+	for _, node := range nodes {
+		r.Add(node.ID)
+		r.addrs[node.ID] = node.Addr
+	}
+	return r
+}
+
+// Addr returns the address of the node owning key, "" when there are none
+func (r *NodeRing) Addr(key string) string {
+	return r.addrs[r.Get(key)]
+}
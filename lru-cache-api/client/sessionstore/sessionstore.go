@@ -0,0 +1,192 @@
+// Package sessionstore keeps the sessions of web apps in the cache: Store
+// is a gorilla/sessions store, and Sessions a SessionStore for other
+// frameworks. A session is the key {prefix}{id} and expires once it has not
+// been loaded or saved for its TTL, as loading touches it, reading it and
+// resetting its expiry in one step. Sessions live in the default cache, as
+// named caches have no touch
+package sessionstore
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"lru-cache-api/client"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Defaults of Sessions
+const (
+	DefaultPrefix = "session:"
+	DefaultTTL    = 30 * time.Minute
+)
+
+// SessionStore keeps the values of sessions by ID
+type SessionStore interface {
+	// Load returns the values of session id, nil when there is none, and
+	// keeps it alive
+	Load(ctx context.Context, id string) (map[string]interface{}, error)
+	// Save stores the values of session id, keeping it alive
+	Save(ctx context.Context, id string, values map[string]interface{}) error
+	// Delete ends session id, which need not exist
+	Delete(ctx context.Context, id string) error
+}
+
+// Sessions is a SessionStore in the cache, each session expiring TTL after
+// it was last loaded or saved
+type Sessions struct {
+	Client *client.Client
+	Prefix string        // DefaultPrefix when empty
+	TTL    time.Duration // DefaultTTL when zero
+}
+
+var _ SessionStore = (*Sessions)(nil)
+
+// key returns the key holding session id
+func (s *Sessions) key(id string) string {
+	if s.Prefix == "" {
+		return DefaultPrefix + id
+	}
+	return s.Prefix + id
+}
+
+// ttl returns how long sessions live unused
+func (s *Sessions) ttl() time.Duration {
+	if s.TTL == 0 {
+		return DefaultTTL
+	}
+	return s.TTL
+}
+
+// Load :: the values of session id, nil when it has expired or never
+// existed, resetting its expiry
+func (s *Sessions) Load(ctx context.Context, id string) (map[string]interface{}, error) {
+	var values map[string]interface{}
+	err := s.Client.Touch(ctx, s.key(id), s.ttl(), &values)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil, nil
+	}
+	return values, err
+}
+
+// Save :: stores the values of session id, sent as JSON
+func (s *Sessions) Save(ctx context.Context, id string, values map[string]interface{}) error {
+	return s.Client.Set(ctx, s.key(id), values, s.ttl())
+}
+
+// Delete :: removes session id
+func (s *Sessions) Delete(ctx context.Context, id string) error {
+	return s.Client.Delete(ctx, s.key(id))
+}
+
+// NewID returns a random session ID
+func NewID() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+// Store is a gorilla/sessions store keeping sessions in Sessions, and only
+// their ID, signed and optionally encrypted by Codecs, in the cookie.
+// Session values are gob encoded, so their types must be registered with
+// gob.Register as for gorilla's own stores
+type Store struct {
+	Codecs   []securecookie.Codec
+	Options  *sessions.Options // the defaults of new sessions
+	Sessions *Sessions
+}
+
+var _ sessions.Store = (*Store)(nil)
+
+// NewStore returns a Store keeping sessions in the cache c talks to, for
+// DefaultTTL since they were last used. keyPairs are as for
+// sessions.NewCookieStore: an authentication key, optionally followed by an
+// encryption key, for each key in rotation, newest first
+func NewStore(c *client.Client, keyPairs ...[]byte) *Store {
+	return &Store{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   86400 * 30,
+			HttpOnly: true,
+		},
+		Sessions: &Sessions{Client: c},
+	}
+}
+
+// Get :: the session called name for r, loaded once per request
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New :: the session whose ID the cookie called name carries, or a new one
+// when there is no cookie or its session has expired. An error is returned
+// with a new session when the cookie does not decode
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+	found, err := s.load(r.Context(), session)
+	if err != nil {
+		return session, err
+	}
+	session.IsNew = !found
+	return session, nil
+}
+
+// Save :: stores session and sets its cookie, or deletes it and clears the
+// cookie when its MaxAge is negative
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.Sessions.Delete(r.Context(), session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = NewID()
+	}
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{"gob": base64.StdEncoding.EncodeToString(data)}
+	if err := s.Sessions.Save(r.Context(), session.ID, values); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// load reads the values of session, reporting false when it has expired
+func (s *Store) load(ctx context.Context, session *sessions.Session) (bool, error) {
+	values, err := s.Sessions.Load(ctx, session.ID)
+	if err != nil || values == nil {
+		return false, err
+	}
+	encoded, _ := values["gob"].(string)
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false, err
+	}
+	return true, securecookie.GobEncoder{}.Deserialize(data, &session.Values)
+}
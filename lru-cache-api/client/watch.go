@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event is a change to a key as /ws sends it: its Type is set, delete,
+// expire, evict or flush. The current items sent on connecting are set
+// events with no Seq
+type Event struct {
+	Type      string          `json:"type"`
+	Reason    string          `json:"reason,omitempty"`
+	Cache     string          `json:"cache,omitempty"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	RequestID string          `json:"requestId,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
+}
+
+// isEvent reports whether a message of type t is a change to a key rather
+// than a reply such as synced or subscribed
+func isEvent(t string) bool {
+	switch t {
+	case "set", "delete", "expire", "evict", "flush":
+		return true
+	}
+	return false
+}
+
+// watcher follows /ws for Watch, resuming where it left off after the
+// connection drops
+type watcher struct {
+	client   *Client
+	patterns []string
+	seq      uint64
+	epoch    string
+}
+
+// Watch :: streams the changes to the keys matching patterns, shell
+// patterns such as users:*, or to every key when there are none. The
+// current items come first, as set events. A dropped connection is opened
+// again, with backoff, catching up on what was missed. The channel is
+// closed once ctx is done
+func (c *Client) Watch(ctx context.Context, patterns ...string) (<-chan Event, error) {
+	w := &watcher{client: c, patterns: patterns}
+	conn, err := w.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan Event, 64)
+	go w.run(ctx, conn, events)
+	return events, nil
+}
+
+func (w *watcher) run(ctx context.Context, conn *websocket.Conn, events chan<- Event) {
+	defer close(events)
+	for {
+		w.read(ctx, conn, events)
+		for attempt := 0; ; attempt++ {
+			timer := time.NewTimer(w.client.backoff(attempt))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			var err error
+			if conn, err = w.dial(ctx); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// read passes the events of conn on until it fails or ctx is done
+func (w *watcher) read(ctx context.Context, conn *websocket.Conn, events chan<- Event) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	for {
+		var msg struct {
+			Event
+			Epoch string `json:"epoch"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg.Type == "synced" {
+			w.seq, w.epoch = msg.Seq, msg.Epoch
+			continue
+		}
+		if !isEvent(msg.Type) {
+			continue
+		}
+		if msg.Seq > w.seq {
+			w.seq = msg.Seq
+		}
+		select {
+		case events <- msg.Event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dial opens /ws, subscribed to the patterns and resuming after the last
+// event seen
+func (w *watcher) dial(ctx context.Context) (*websocket.Conn, error) {
+	c := w.client
+	target := "ws" + strings.TrimPrefix(c.baseURL, "http") + c.path("/ws")
+	query := url.Values{}
+	if len(w.patterns) > 0 {
+		query.Set("subscribe", strings.Join(w.patterns, ","))
+	}
+	if w.epoch != "" {
+		query.Set("since", strconv.FormatUint(w.seq, 10))
+		query.Set("epoch", w.epoch)
+	}
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     []string{"cache.v1"},
+	}
+	if transport, ok := c.httpClient.Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+	header := http.Header{}
+	c.authorize(header)
+	conn, resp, err := dialer.DialContext(ctx, target, header)
+	if err == websocket.ErrBadHandshake && resp != nil {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Message: "opening the WebSocket"}
+	}
+	return conn, err
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lru-cache-api/client"
+)
+
+// benchConfig is the load bench puts on the server
+type benchConfig struct {
+	duration    time.Duration
+	concurrency int
+	keys        int
+	dist        string  // uniform or zipfian
+	zipfS       float64 // the zipfian skew, above 1
+	reads       float64 // the share of operations that are GETs
+	valueSize   int     // bytes per value set
+	prefix      string
+	ttl         time.Duration
+	fill        bool // set every key before measuring
+}
+
+// benchOp is what a worker saw of one kind of operation
+type benchOp struct {
+	latencies []time.Duration
+	errors    int
+	misses    int // GETs of keys not cached
+}
+
+// benchResult is a row of the bench report
+type benchResult struct {
+	Op        string  `json:"op"`
+	Count     int     `json:"count"`
+	PerSecond float64 `json:"opsPerSecond"`
+	Errors    int     `json:"errors"`
+	Misses    int     `json:"misses,omitempty"`
+	P50       float64 `json:"p50Ms"`
+	P90       float64 `json:"p90Ms"`
+	P99       float64 `json:"p99Ms"`
+	P999      float64 `json:"p999Ms"`
+	Max       float64 `json:"maxMs"`
+}
+
+// benchCommand :: runs --concurrency workers getting and setting keys
+// picked from --keys as --dist says for --duration, then reports the
+// throughput and latency percentiles of GETs, SETs and both
+func benchCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 0, 0, "bench"); err != nil {
+		return err
+	}
+	cfg := c.bench
+	value := strings.Repeat("x", cfg.valueSize)
+	if cfg.fill {
+		if err := benchFill(ctx, c, value); err != nil {
+			return fmt.Errorf("filling the keys: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.duration)
+	defer cancel()
+	gets := make([]benchOp, cfg.concurrency)
+	sets := make([]benchOp, cfg.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			benchWorker(ctx, c, value, rand.New(rand.NewSource(start.UnixNano()+int64(i))), &gets[i], &sets[i])
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	get, set := mergeBenchOps(gets), mergeBenchOps(sets)
+	results := []benchResult{
+		get.result("get", elapsed),
+		set.result("set", elapsed),
+		mergeBenchOps([]benchOp{get, set}).result("all", elapsed),
+	}
+	if c.json {
+		return c.printJSON(map[string]interface{}{
+			"duration":    elapsed.Seconds(),
+			"concurrency": cfg.concurrency,
+			"keys":        cfg.keys,
+			"dist":        cfg.dist,
+			"reads":       cfg.reads,
+			"valueSize":   cfg.valueSize,
+			"results":     results,
+		})
+	}
+	fmt.Fprintf(c.out, "%s for %s, %d workers, %d %s keys, %.0f%% reads, %d byte values\n\n",
+		c.server, elapsed.Round(time.Millisecond), cfg.concurrency, cfg.keys, cfg.dist, cfg.reads*100, cfg.valueSize)
+	t := c.table()
+	fmt.Fprintln(t, "OP\tCOUNT\tOPS/S\tERRORS\tMISSES\tP50\tP90\tP99\tP99.9\tMAX")
+	for _, r := range results {
+		fmt.Fprintf(t, "%s\t%d\t%.0f\t%d\t%d\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%.2fms\n",
+			r.Op, r.Count, r.PerSecond, r.Errors, r.Misses, r.P50, r.P90, r.P99, r.P999, r.Max)
+	}
+	return t.Flush()
+}
+
+// benchFill sets every key once, with the workers, so reads hit
+func benchFill(ctx context.Context, c *cli, value string) error {
+	keys := make(chan int)
+	errs := make(chan error, c.bench.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < c.bench.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keys {
+				if err := c.client.Set(ctx, c.bench.key(k), value, c.bench.ttl); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	var err error
+	for k := 0; k < c.bench.keys && err == nil; k++ {
+		select {
+		case keys <- k:
+		case err = <-errs:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	close(keys)
+	wg.Wait()
+	if err == nil && len(errs) > 0 {
+		err = <-errs
+	}
+	return err
+}
+
+// benchWorker gets and sets keys until ctx ends, noting what it saw
+func benchWorker(ctx context.Context, c *cli, value string, rnd *rand.Rand, get, set *benchOp) {
+	cfg := c.bench
+	next := func() int { return rnd.Intn(cfg.keys) }
+	if cfg.dist == "zipfian" {
+		zipf := rand.NewZipf(rnd, cfg.zipfS, 1, uint64(cfg.keys-1))
+		next = func() int { return int(zipf.Uint64()) }
+	}
+	var discard json.RawMessage
+	for ctx.Err() == nil {
+		key := cfg.key(next())
+		op, begin := get, time.Now()
+		var err error
+		if rnd.Float64() < cfg.reads {
+			err = c.client.Get(ctx, key, &discard)
+		} else {
+			op, err = set, c.client.Set(ctx, key, value, cfg.ttl)
+		}
+		took := time.Since(begin)
+		switch {
+		case ctx.Err() != nil:
+			return // cut short by the end of the run, not measured
+		case errors.Is(err, client.ErrNotFound):
+			op.misses++
+		case err != nil:
+			op.errors++
+			continue
+		}
+		op.latencies = append(op.latencies, took)
+	}
+}
+
+// key returns the name of the k'th key
+func (cfg benchConfig) key(k int) string {
+	return fmt.Sprintf("%s%d", cfg.prefix, k)
+}
+
+// mergeBenchOps returns what the workers saw together, latencies sorted
+func mergeBenchOps(ops []benchOp) benchOp {
+	var merged benchOp
+	for _, op := range ops {
+		merged.latencies = append(merged.latencies, op.latencies...)
+		merged.errors += op.errors
+		merged.misses += op.misses
+	}
+	sort.Slice(merged.latencies, func(i, j int) bool { return merged.latencies[i] < merged.latencies[j] })
+	return merged
+}
+
+// result returns the row of op, whose latencies are sorted
+func (op benchOp) result(name string, elapsed time.Duration) benchResult {
+	percentile := func(p float64) float64 {
+		if len(op.latencies) == 0 {
+			return 0
+		}
+		i := int(p * float64(len(op.latencies)))
+		return float64(op.latencies[min(i, len(op.latencies)-1)]) / float64(time.Millisecond)
+	}
+	return benchResult{
+		Op:        name,
+		Count:     len(op.latencies),
+		PerSecond: float64(len(op.latencies)) / elapsed.Seconds(),
+		Errors:    op.errors,
+		Misses:    op.misses,
+		P50:       percentile(0.5),
+		P90:       percentile(0.9),
+		P99:       percentile(0.99),
+		P999:      percentile(0.999),
+		Max:       percentile(1),
+	}
+}
+
+// validate reports the first flag out of range
+func (cfg benchConfig) validate() error {
+	switch {
+	case cfg.duration <= 0:
+		return errors.New("the duration must be positive")
+	case cfg.concurrency < 1:
+		return errors.New("the concurrency must be at least 1")
+	case cfg.keys < 1:
+		return errors.New("there must be at least 1 key")
+	case cfg.dist != "uniform" && cfg.dist != "zipfian":
+		return fmt.Errorf("unknown distribution %q, expected uniform or zipfian", cfg.dist)
+	case cfg.zipfS <= 1:
+		return errors.New("the zipf-s skew must be above 1")
+	case cfg.reads < 0 || cfg.reads > 1:
+		return errors.New("reads must be between 0 and 1")
+	case cfg.valueSize < 0:
+		return errors.New("the value size must not be negative")
+	case cfg.ttl < time.Second:
+		return errors.New("the ttl must be at least 1s")
+	}
+	return nil
+}
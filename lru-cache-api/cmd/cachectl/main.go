@@ -0,0 +1,378 @@
+// Command cachectl talks to a running cache server: it gets, sets and
+// deletes keys, lists them, shows the stats, follows changes and moves items
+// in and out, printing tables for people or JSON for scripts
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"lru-cache-api/client"
+)
+
+// command is a cachectl subcommand; run gets the arguments left after the
+// flags
+type command struct {
+	usage   string
+	summary string
+	run     func(ctx context.Context, c *cli, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":    {"get key", "print the value of key", getCommand},
+		"set":    {"set [--ttl 5m] key value", "set key to value, taken as JSON when it parses as JSON and as a string otherwise, for --ttl or the server's CACHE_DEFAULT_TTL", setCommand},
+		"del":    {"del key...", "delete keys", delCommand},
+		"keys":   {"keys [pattern]", "list the keys matching a shell pattern such as users:*, all by default", keysCommand},
+		"stats":  {"stats", "show the cache counters", statsCommand},
+		"watch":  {"watch [pattern...]", "print changes to the keys matching the patterns as they happen", watchCommand},
+		"export": {"export [--out file]", "write every item as JSON, to stdout by default", exportCommand},
+		"import": {"import [file]", "set the items of an export, read from file or stdin", importCommand},
+		"top":    {"top [--interval 1s]", "show live stats, hot keys and the latest changes until interrupted", topCommand},
+		"bench":  {"bench [--duration 10s] [--concurrency 16] [--keys 10000] [--dist uniform|zipfian] [--reads 0.9] [--value-size 100]", "load the server with GETs and SETs and report the throughput and latency percentiles", benchCommand},
+	}
+}
+
+var commandOrder = []string{"get", "set", "del", "keys", "stats", "watch", "export", "import", "top", "bench"}
+
+// cli holds the settings every command shares
+type cli struct {
+	client *client.Client
+	server string
+	json   bool
+	out    io.Writer
+
+	ttl      time.Duration // set
+	outFile  string        // export
+	interval time.Duration // top
+	bench    benchConfig   // bench
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: cachectl <command> [flags] [args]\n\ncommands:\n")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-28s %s\n", commands[name].usage, commands[name].summary)
+	}
+	fmt.Fprint(os.Stderr, `
+Every command takes:
+  --server url     the server, CACHECTL_SERVER or http://localhost:8080
+  --api-key key    authenticate with an API key, CACHECTL_API_KEY
+  --token token    authenticate with a bearer token, CACHECTL_TOKEN
+  --cache name     use a named cache
+  -o table|json    print tables (the default) or JSON
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	c, args, err := parseFlags(name, os.Args[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "cachectl:", err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.run(ctx, c, args); err != nil {
+		if errors.Is(err, client.ErrNotFound) {
+			err = errors.New("not found")
+		}
+		fmt.Fprintln(os.Stderr, "cachectl:", err)
+		os.Exit(1)
+	}
+}
+
+// parseFlags reads the shared flags and those of the command, returning
+// the arguments after them
+func parseFlags(name string, args []string) (*cli, []string, error) {
+	c := &cli{out: os.Stdout}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: cachectl %s\n\n%s\n", commands[name].usage, commands[name].summary)
+	}
+	server := flags.String("server", envOr("CACHECTL_SERVER", "http://localhost:8080"), "")
+	apiKey := flags.String("api-key", os.Getenv("CACHECTL_API_KEY"), "")
+	token := flags.String("token", os.Getenv("CACHECTL_TOKEN"), "")
+	cacheName := flags.String("cache", "", "")
+	output := flags.String("o", "table", "")
+	switch name {
+	case "set":
+		flags.DurationVar(&c.ttl, "ttl", 0, "")
+	case "export":
+		flags.StringVar(&c.outFile, "out", "", "")
+	case "top":
+		flags.DurationVar(&c.interval, "interval", time.Second, "")
+	case "bench":
+		flags.DurationVar(&c.bench.duration, "duration", 10*time.Second, "")
+		flags.IntVar(&c.bench.concurrency, "concurrency", 16, "")
+		flags.IntVar(&c.bench.keys, "keys", 10000, "")
+		flags.StringVar(&c.bench.dist, "dist", "uniform", "")
+		flags.Float64Var(&c.bench.zipfS, "zipf-s", 1.1, "")
+		flags.Float64Var(&c.bench.reads, "reads", 0.9, "")
+		flags.IntVar(&c.bench.valueSize, "value-size", 100, "")
+		flags.StringVar(&c.bench.prefix, "prefix", "bench:", "")
+		flags.DurationVar(&c.bench.ttl, "ttl", 10*time.Minute, "")
+		flags.BoolVar(&c.bench.fill, "fill", true, "")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	switch *output {
+	case "table":
+	case "json":
+		c.json = true
+	default:
+		return nil, nil, fmt.Errorf("unknown output %q, expected table or json", *output)
+	}
+	if name == "top" && c.interval <= 0 {
+		return nil, nil, errors.New("the interval must be positive")
+	}
+	if name == "bench" {
+		if err := c.bench.validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+	c.server = *server
+	opts := []client.Option{client.WithAPIKey(*apiKey), client.WithToken(*token)}
+	if *cacheName != "" {
+		opts = append(opts, client.WithCache(*cacheName))
+	}
+	if name == "bench" {
+		// A retried request would hide the error and skew its latency
+		opts = append(opts, client.WithRetries(0))
+	}
+	var err error
+	if c.client, err = client.New(*server, opts...); err != nil {
+		return nil, nil, err
+	}
+	return c, flags.Args(), nil
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// printJSON writes v as one line of JSON
+func (c *cli) printJSON(v interface{}) error {
+	return json.NewEncoder(c.out).Encode(v)
+}
+
+// table returns a writer lining up tab separated columns; flush it when done
+func (c *cli) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+}
+
+// display is how a value is shown in tables: strings as they are, anything
+// else as JSON
+func display(value json.RawMessage) string {
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return s
+	}
+	return string(value)
+}
+
+func wantArgs(args []string, min, max int, name string) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return fmt.Errorf("usage: cachectl %s", commands[name].usage)
+	}
+	return nil
+}
+
+func getCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 1, 1, "get"); err != nil {
+		return err
+	}
+	var value json.RawMessage
+	if err := c.client.Get(ctx, args[0], &value); err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]interface{}{"key": args[0], "value": value})
+	}
+	_, err := fmt.Fprintln(c.out, display(value))
+	return err
+}
+
+func setCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 2, 2, "set"); err != nil {
+		return err
+	}
+	var value interface{} = args[1]
+	if json.Valid([]byte(args[1])) {
+		value = json.RawMessage(args[1])
+	}
+	return c.client.Set(ctx, args[0], value, c.ttl)
+}
+
+func delCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 1, -1, "del"); err != nil {
+		return err
+	}
+	for _, key := range args {
+		if err := c.client.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keysCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 0, 1, "keys"); err != nil {
+		return err
+	}
+	pattern := "*"
+	if len(args) == 1 {
+		pattern = args[0]
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("bad pattern %q", pattern)
+	}
+	items, err := c.client.Items(ctx)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if c.json {
+		type keyInfo struct {
+			Key       string    `json:"key"`
+			ExpiresAt time.Time `json:"expiresAt"`
+		}
+		list := make([]keyInfo, len(keys))
+		for i, key := range keys {
+			list[i] = keyInfo{key, items[key].ExpiresAt}
+		}
+		return c.printJSON(list)
+	}
+	w := c.table()
+	fmt.Fprintln(w, "KEY\tTTL")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", key, time.Until(items[key].ExpiresAt).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func statsCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 0, 0, "stats"); err != nil {
+		return err
+	}
+	stats, err := c.client.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(stats)
+	}
+	w := c.table()
+	fmt.Fprintf(w, "items\t%d\n", stats.Items)
+	fmt.Fprintf(w, "capacity\t%d\n", stats.Capacity)
+	fmt.Fprintf(w, "hits\t%d\n", stats.Hits)
+	fmt.Fprintf(w, "misses\t%d\n", stats.Misses)
+	fmt.Fprintf(w, "hit ratio\t%.3f\n", stats.HitRatio)
+	fmt.Fprintf(w, "evictions\t%d\n", stats.Evictions)
+	fmt.Fprintf(w, "expirations\t%d\n", stats.Expirations)
+	fmt.Fprintf(w, "memory bytes\t%d\n", stats.MemoryBytes)
+	fmt.Fprintf(w, "heap bytes\t%d\n", stats.HeapBytes)
+	return w.Flush()
+}
+
+func watchCommand(ctx context.Context, c *cli, args []string) error {
+	events, err := c.client.Watch(ctx, args...)
+	if err != nil {
+		return err
+	}
+	for event := range events {
+		if c.json {
+			err = c.printJSON(event)
+		} else {
+			line := fmt.Sprintf("%s  %-6s  %s", time.Now().Format("15:04:05"), event.Type, event.Key)
+			if event.Type == "set" {
+				line += "  " + display(event.Value)
+			}
+			_, err = fmt.Fprintln(c.out, line)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 0, 0, "export"); err != nil {
+		return err
+	}
+	data, err := c.client.Export(ctx)
+	if err != nil {
+		return err
+	}
+	if c.outFile == "" || c.outFile == "-" {
+		_, err = c.out.Write(data)
+		return err
+	}
+	return os.WriteFile(c.outFile, data, 0o600)
+}
+
+func importCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 0, 1, "import"); err != nil {
+		return err
+	}
+	var data []byte
+	var err error
+	if len(args) == 0 || args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	received, imported, err := c.client.Import(ctx, data)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]int{"received": received, "imported": imported})
+	}
+	fmt.Fprintf(os.Stderr, "imported %d of %d items\n", imported, received)
+	return nil
+}
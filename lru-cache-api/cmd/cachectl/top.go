@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lru-cache-api/client"
+)
+
+// Sizes of the top screen
+const (
+	topHotKeys = 10
+	topEvents  = 10
+)
+
+// topState is what the top screen shows, refreshed every interval
+type topState struct {
+	mutex     sync.Mutex
+	events    []client.Event // the latest last
+	changes   int            // events since the last refresh
+	eventsErr error
+
+	stats, last  client.Stats
+	lastAt       time.Time
+	statsErr     error
+	hotKeys      []client.HotKey
+	hotKeyWindow string
+	hotKeysErr   error
+}
+
+// topCommand :: redraws the live stats, hot keys and latest changes every
+// --interval until interrupted
+func topCommand(ctx context.Context, c *cli, args []string) error {
+	if err := wantArgs(args, 0, 0, "top"); err != nil {
+		return err
+	}
+	state := &topState{}
+	// Without the WebSocket the screen still shows the stats
+	if events, err := c.client.Watch(ctx); err != nil {
+		state.eventsErr = err
+	} else {
+		go state.follow(events)
+	}
+
+	fmt.Fprint(c.out, "\x1b[?25l") // hide the cursor
+	defer fmt.Fprint(c.out, "\x1b[?25h")
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		state.refresh(ctx, c)
+		state.render(c.out, c.server)
+		select {
+		case <-ctx.Done():
+			fmt.Fprintln(c.out)
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// follow keeps the latest events, skipping the current items sent first
+func (s *topState) follow(events <-chan client.Event) {
+	for event := range events {
+		if event.Seq == 0 {
+			continue
+		}
+		s.mutex.Lock()
+		s.changes++
+		s.events = append(s.events, event)
+		if len(s.events) > topEvents {
+			s.events = s.events[len(s.events)-topEvents:]
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func (s *topState) refresh(ctx context.Context, c *cli) {
+	ctx, cancel := context.WithTimeout(ctx, c.interval)
+	defer cancel()
+
+	stats, err := c.client.Stats(ctx)
+	keys, window, hotErr := c.client.HotKeys(ctx, topHotKeys)
+	var statusErr *client.StatusError
+	if errors.As(hotErr, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		hotErr = errors.New("hot key tracking is off")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statsErr, s.hotKeysErr = err, hotErr
+	if err == nil {
+		s.last, s.stats = s.stats, stats
+	}
+	if hotErr == nil {
+		s.hotKeys, s.hotKeyWindow = keys, window
+	}
+}
+
+func (s *topState) render(w io.Writer, server string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J") // home, clear
+	fmt.Fprintf(&b, "cachectl top  %s  %s\n\n", server, time.Now().Format("15:04:05"))
+
+	now := time.Now()
+	elapsed := now.Sub(s.lastAt).Seconds()
+	first := s.lastAt.IsZero()
+	s.lastAt = now
+	changes := s.changes
+	s.changes = 0
+
+	if s.statsErr != nil {
+		fmt.Fprintf(&b, "stats: %v\n", s.statsErr)
+	} else {
+		st := s.stats
+		fmt.Fprintf(&b, "items        %d / %d\n", st.Items, st.Capacity)
+		fmt.Fprintf(&b, "hit ratio    %.3f overall", st.HitRatio)
+		lookups := (st.Hits + st.Misses) - (s.last.Hits + s.last.Misses)
+		if !first && lookups > 0 && st.Hits >= s.last.Hits {
+			fmt.Fprintf(&b, ", %.3f now", float64(st.Hits-s.last.Hits)/float64(lookups))
+		}
+		b.WriteString("\n")
+		if first {
+			b.WriteString("ops/sec      -\n")
+		} else {
+			fmt.Fprintf(&b, "ops/sec      %.1f lookups, %.1f changes\n", float64(lookups)/elapsed, float64(changes)/elapsed)
+		}
+		fmt.Fprintf(&b, "evictions    %d   expirations %d\n", st.Evictions, st.Expirations)
+		fmt.Fprintf(&b, "memory       %s of values, %s heap\n", byteSize(st.MemoryBytes), byteSize(int64(st.HeapBytes)))
+	}
+
+	fmt.Fprintf(&b, "\nHOT KEYS")
+	if s.hotKeyWindow != "" {
+		fmt.Fprintf(&b, " (lookups over %s)", s.hotKeyWindow)
+	}
+	b.WriteString("\n")
+	if s.hotKeysErr != nil {
+		fmt.Fprintf(&b, "  %v\n", s.hotKeysErr)
+	}
+	for _, hot := range s.hotKeys {
+		fmt.Fprintf(&b, "  %8d  %s\n", hot.Count, hot.Key)
+	}
+
+	b.WriteString("\nRECENT EVENTS\n")
+	if s.eventsErr != nil {
+		fmt.Fprintf(&b, "  %v\n", s.eventsErr)
+	}
+	for i := len(s.events) - 1; i >= 0; i-- {
+		event := s.events[i]
+		line := fmt.Sprintf("  %-6s  %-8s  %s", event.Type, event.Reason, event.Key)
+		if event.Type == "set" {
+			line += "  " + display(event.Value)
+		}
+		b.WriteString(truncate(line, columns()) + "\n")
+	}
+	io.WriteString(w, b.String())
+}
+
+// columns is the terminal width, from $COLUMNS, 100 when it is not set
+func columns() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return 100
+}
+
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,9 @@
+// Command lru-cache-server serves the cache over HTTP and WebSocket; see
+// pkg/server for its settings
+package main
+
+import "lru-cache-api/pkg/server"
+
+func main() {
+	server.Main()
+}
@@ -0,0 +1,80 @@
+package lru
+
+import "sync/atomic"
+
+// Reads do not reorder the recency list themselves, which would take the
+// shard's write lock on every Get. As in Caffeine, a Get notes the entry in
+// its shard's access buffer, a lossy ring written without locks, and the
+// entries noted are moved to the front in batches: by a goroutine of the
+// cache when a buffer fills, and by writers before they change the list, so
+// evictions see the reads made up to then. Accesses overwritten before they
+// are drained are lost, which makes the order approximately LRU, as
+// sharding already does
+
+// accessBufferSize is how many accesses a shard buffers between drains
+const accessBufferSize = 128
+
+// accessBuffer is a shard's ring of the entries read since the last drain
+type accessBuffer struct {
+	slots   [accessBufferSize]atomic.Pointer[entry]
+	next    atomic.Uint64 // the slot written next, counting from the start
+	drained uint64        // next as of the last drain, under the write lock
+}
+
+// record notes a read of e, reporting whether that filled the buffer
+func (b *accessBuffer) record(e *entry) bool {
+	i := b.next.Add(1) - 1
+	b.slots[i%accessBufferSize].Store(e)
+	return i%accessBufferSize == accessBufferSize-1
+}
+
+// drain moves the entries read since the last drain to the front of the
+// shard's list, oldest read first; callers hold the shard's write lock.
+// Entries deleted since are unlinked and skipped
+func (s *shard) drain() {
+	next := s.reads.next.Load()
+	for i := max(s.reads.drained, next-min(next, accessBufferSize)); i < next; i++ {
+		e := s.reads.slots[i%accessBufferSize].Swap(nil)
+		if e != nil && e.prev != nil {
+			s.list.MoveToFront(e)
+		}
+	}
+	s.reads.drained = next
+}
+
+// forget drops the accesses noted, for a shard whose list was emptied
+// without unlinking its entries one by one; callers hold its write lock
+func (b *accessBuffer) forget() {
+	for i := range b.slots {
+		b.slots[i].Store(nil)
+	}
+	b.drained = b.next.Load()
+}
+
+// recordAccess notes a read of e in s, asking the drainer to drain s when
+// its buffer is full
+func (c *LRUCache) recordAccess(s *shard, e *entry) {
+	if s.reads.record(e) {
+		select {
+		case c.drains <- s:
+		default: // the drainer is behind; writers drain too
+		}
+	}
+}
+
+// drainLoop drains the shards whose buffers fill, and evicts from those
+// past their high watermark, until the cache is closed
+func (c *LRUCache) drainLoop() {
+	for {
+		select {
+		case s := <-c.drains:
+			s.mutex.Lock()
+			s.drain()
+			s.mutex.Unlock()
+		case s := <-c.evicts:
+			c.evictDown(s)
+		case <-c.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package lru
+
+import "time"
+
+// Cache is what the server needs from a cache backend. LRUCache is one;
+// sharded, tiered or distributed ones can stand in for it behind the same
+// API
+type Cache interface {
+	// Get returns the value of key, or ErrNotFound or ErrExpired
+	Get(key string) (interface{}, error)
+	// Set adds or replaces key, expiring it after expiration, or returns
+	// ErrTooLarge or ErrCapacityZero
+	Set(key string, value interface{}, expiration time.Duration) error
+	// Delete removes key, doing nothing when it is missing
+	Delete(key string)
+	// Len is the number of items held, expired ones included until removed
+	Len() int
+	// Stats returns the current counters
+	Stats() Stats
+	// Range calls fn with every live item until it returns false
+	Range(fn func(item CacheItem) bool)
+	// Close releases the cache; it must not be used after
+	Close() error
+}
+
+var _ Cache = (*LRUCache)(nil)
+
+// Len :: the number of items held, expired ones included until removed
+func (c *LRUCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		n += s.list.Len()
+		s.mutex.RUnlock()
+	}
+	return n
+}
+
+// Clock :: the clock the cache expires items by
+func (c *LRUCache) Clock() Clock {
+	return c.clock
+}
+
+// Close :: drops every item and stops the goroutine draining the access
+// buffers
+func (c *LRUCache) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.Clear()
+	return nil
+}
@@ -0,0 +1,78 @@
+package lru
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time a cache expires items by. SystemClock is the real one;
+// tests and simulations use a ManualClock to move time on themselves
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After sends the time on the channel once d has passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the wall clock, the one caches use by default
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ManualClock is a Clock standing still until Advance moves it, for testing
+// expiry without sleeping. It is safe for concurrent use
+type ManualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
+}
+
+type manualWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewManualClock :: a clock showing start until it is advanced
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now :: the time the clock was last advanced to
+func (m *ManualClock) Now() time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.now
+}
+
+// After :: a channel sent the time once the clock is advanced d past now
+func (m *ManualClock) After(d time.Duration) <-chan time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- m.now
+		return ch
+	}
+	m.waiters = append(m.waiters, manualWaiter{m.now.Add(d), ch})
+	return ch
+}
+
+// Advance :: moves the clock d forward, firing the After channels due by
+// then
+func (m *ManualClock) Advance(d time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = m.now.Add(d)
+	waiting := m.waiters[:0]
+	for _, w := range m.waiters {
+		if w.at.After(m.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- m.now
+		}
+	}
+	m.waiters = waiting
+}
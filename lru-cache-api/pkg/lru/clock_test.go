@@ -0,0 +1,149 @@
+package lru
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newClockedCache(t *testing.T, opts ...Option) (*LRUCache, *ManualClock) {
+	t.Helper()
+	clock := NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c, err := NewCache(append([]Option{WithClock(clock)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, clock
+}
+
+func TestExpiryFollowsClock(t *testing.T) {
+	c, clock := newClockedCache(t, WithCapacity(10), WithStaleWindow(time.Minute))
+	for key, ttl := range map[string]time.Duration{"short": time.Second, "long": time.Hour} {
+		if err := c.Set(key, key, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		advance   time.Duration
+		key       string
+		getErr    error
+		staleOK   bool
+		removable bool
+	}{
+		{0, "short", nil, true, false},
+		{time.Second, "short", nil, true, false}, // expires after, not at, its time
+		{time.Millisecond, "short", ErrExpired, true, false},
+		{time.Minute, "short", ErrExpired, false, true}, // past the stale window
+		{0, "long", nil, true, false},
+		{59 * time.Minute, "long", ErrExpired, true, false}, // an hour and a second in
+	}
+	for _, tt := range steps {
+		clock.Advance(tt.advance)
+		if _, err := c.Get(tt.key); !errors.Is(err, tt.getErr) {
+			t.Errorf("after %s: Get(%q) = %v, want %v", tt.advance, tt.key, err, tt.getErr)
+		}
+		if _, _, err := c.GetStale(tt.key); (err == nil) != tt.staleOK {
+			t.Errorf("after %s: GetStale(%q) = %v, want ok %v", tt.advance, tt.key, err, tt.staleOK)
+		}
+		if dead := c.dead(c.shardFor(tt.key).items[tt.key], clock.Now()); dead != tt.removable {
+			t.Errorf("after %s: %q removable = %v, want %v", tt.advance, tt.key, dead, tt.removable)
+		}
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    []string
+	}{
+		{"none yet", 0, nil},
+		{"some", 2 * time.Second, []string{"a", "b"}},
+		{"all", time.Hour, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, clock := newClockedCache(t, WithCapacity(10), WithShards(4))
+			c.Set("a", 1, time.Second)
+			c.Set("b", 2, time.Second)
+			c.Set("c", 3, time.Minute)
+			clock.Advance(tt.advance)
+
+			got := c.RemoveExpired()
+			sort.Strings(got)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("RemoveExpired = %v, want %v", got, tt.want)
+			}
+			if c.Len() != 3-len(tt.want) {
+				t.Errorf("Len = %d, want %d", c.Len(), 3-len(tt.want))
+			}
+			if again := c.RemoveExpired(); len(again) != 0 {
+				t.Errorf("second RemoveExpired = %v, want none", again)
+			}
+		})
+	}
+}
+
+// waitForWaiter waits until something is blocked in clock.After, so that
+// advancing the clock fires it
+func waitForWaiter(t *testing.T, clock *ManualClock) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		clock.mutex.Lock()
+		n := len(clock.waiters)
+		clock.mutex.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("nothing waited on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestJanitorFollowsClock(t *testing.T) {
+	c, clock := newClockedCache(t, WithCapacity(10))
+	c.Set("a", 1, 30*time.Second)
+	c.Set("b", 2, 90*time.Second)
+
+	// A janitor as servers run one: every interval of the cache's clock
+	const interval = time.Minute
+	removed := make(chan []string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-clock.After(interval):
+			case <-done:
+				return
+			}
+			select {
+			case removed <- c.RemoveExpired():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for i, want := range []string{"a", "b"} {
+		waitForWaiter(t, clock)
+		select {
+		case keys := <-removed:
+			t.Fatalf("janitor ran before the clock moved, removing %v", keys)
+		default:
+		}
+		clock.Advance(interval)
+		if keys := <-removed; len(keys) != 1 || keys[0] != want {
+			t.Errorf("janitor round %d removed %v, want [%s]", i+1, keys, want)
+		}
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len = %d after the janitor, want 0", c.Len())
+	}
+}
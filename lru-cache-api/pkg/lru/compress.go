@@ -0,0 +1,95 @@
+package lru
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// With WithCompression(n), strings, byte slices and raw values of n bytes or
+// more are kept DEFLATE compressed and decompressed whenever they are read,
+// so callers never see the difference, the type of the value included. A
+// value that does not get smaller is kept as it is, and so are other types:
+// encoding them would not give the same value back. Compressing trades the
+// CPU of every set and get of a large value for memory, which pays for the
+// large, repetitive documents caches often hold
+
+// compressed is a value as the cache holds it compressed
+type compressed struct {
+	kind        byte // one of the kinds below
+	contentType string
+	data        []byte
+	size        int // bytes before compressing
+}
+
+const (
+	compressedString = iota
+	compressedBytes
+	compressedRaw
+)
+
+// flateWriters are compressors to reuse, as each holds a large window
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// pack returns value as the cache keeps it: compressed when it is large
+// enough and compresses, as it is otherwise
+func (c *LRUCache) pack(value interface{}) interface{} {
+	if c.compressMin == 0 || estimateSize(value) < c.compressMin {
+		return value
+	}
+	packed := compressed{kind: compressedString}
+	var data []byte
+	switch v := value.(type) {
+	case string:
+		data = []byte(v)
+	case []byte:
+		packed.kind, data = compressedBytes, v
+	case RawValue:
+		packed.kind, packed.contentType, data = compressedRaw, v.ContentType, v.Data
+	default:
+		return value
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(data)
+	w.Close()
+	flateWriters.Put(w)
+	if buf.Len() >= len(data) {
+		return value
+	}
+	packed.data, packed.size = bytes.Clone(buf.Bytes()), len(data)
+	return packed
+}
+
+// unpack returns the value the cache was given for one it keeps; it cannot
+// fail for data pack compressed
+func unpack(value interface{}) interface{} {
+	packed, ok := value.(compressed)
+	if !ok {
+		return value
+	}
+	data := make([]byte, 0, packed.size)
+	buf := bytes.NewBuffer(data)
+	if _, err := io.Copy(buf, flate.NewReader(bytes.NewReader(packed.data))); err != nil {
+		return nil
+	}
+	switch packed.kind {
+	case compressedBytes:
+		return buf.Bytes()
+	case compressedRaw:
+		return RawValue{ContentType: packed.contentType, Data: buf.Bytes()}
+	}
+	return buf.String()
+}
+
+// unpacked returns item with the value the cache was given
+func unpacked(item CacheItem) CacheItem {
+	item.Value = unpack(item.Value)
+	return item
+}
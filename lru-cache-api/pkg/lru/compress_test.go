@@ -0,0 +1,47 @@
+package lru
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressionKeepsTypes(t *testing.T) {
+	type point struct{ X, Y int }
+	long := strings.Repeat("abc", 100)
+
+	tests := []struct {
+		name       string
+		value      interface{}
+		compressed bool
+	}{
+		{"string", long, true},
+		{"bytes", []byte(long), true},
+		{"raw", RawValue{ContentType: "text/html", Data: []byte(long)}, true},
+		{"short string", "abc", false},
+		{"incompressible", "the quick brown fox", false},
+		{"object", map[string]interface{}{"n": 1, "s": long}, false},
+		{"array", []interface{}{long, 2}, false},
+		{"struct", point{1, 2}, false},
+	}
+	c, err := NewCache(WithCapacity(len(tests)), WithCompression(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.Set(tt.name, tt.value, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			_, isCompressed := c.shardFor(tt.name).items[tt.name].Value.(compressed)
+			if isCompressed != tt.compressed {
+				t.Errorf("kept compressed = %v, want %v", isCompressed, tt.compressed)
+			}
+			got, err := c.Get(tt.name)
+			if err != nil || !reflect.DeepEqual(got, tt.value) {
+				t.Errorf("Get = %#v, %v, want %#v", got, err, tt.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package lru
+
+import "time"
+
+// entry is an item in its shard's recency list. The list is linked through
+// the entries themselves, so an item costs one allocation rather than an
+// item and a list element, and entries are pooled: one leaving the cache is
+// reused by a later set, keeping the garbage of sustained churn down. Each
+// shard has its own pool, so an entry only ever belongs to one shard, whose
+// lock guards it
+type entry struct {
+	CacheItem
+	prev, next *entry
+
+	space                *space // its namespace, when that has a quota
+	spacePrev, spaceNext *entry
+
+	size int64 // estimated size of its key and value, as counted in its shard's usage
+}
+
+// newEntry returns a pooled entry holding the item
+func (s *shard) newEntry(key string, value interface{}, expiresAt time.Time) *entry {
+	e, _ := s.entries.Get().(*entry)
+	if e == nil {
+		e = new(entry)
+	}
+	e.CacheItem = CacheItem{Key: key, Value: value, ExpiresAt: expiresAt}
+	e.space = s.spaceOf(key)
+	e.size = int64(len(key)) + estimateSize(value)
+	s.usage.add(e, 1)
+	return e
+}
+
+// setValue replaces the value of e, which the shard holds
+func (s *shard) setValue(e *entry, value interface{}) {
+	s.usage.add(e, -1)
+	e.Value, e.size = value, int64(len(e.Key))+estimateSize(value)
+	s.usage.add(e, 1)
+}
+
+// releaseEntry returns e to the pool. Callers must have unlinked it and
+// dropped it from the map, under the write lock; the access buffer may
+// still hold it, and skips it unless it is reused by then
+func (s *shard) releaseEntry(e *entry) {
+	s.usage.add(e, -1)
+	*e = entry{} // let the key and value be collected
+	s.entries.Put(e)
+}
+
+// recency is a shard's list of entries, most recently used first. The zero
+// value is empty, and the root links the front and back into a ring.
+// Entries of a namespace with a quota are kept in its list too, in the same
+// order
+type recency struct {
+	root entry
+	len  int
+}
+
+// lazyInit makes the ring of an empty zero list
+func (l *recency) lazyInit() {
+	if l.root.next == nil {
+		l.root.next, l.root.prev = &l.root, &l.root
+	}
+}
+
+// Init empties the list, leaving the entries it held to the collector
+func (l *recency) Init() {
+	l.root.next, l.root.prev = &l.root, &l.root
+	l.len = 0
+}
+
+// Len is the number of entries
+func (l *recency) Len() int { return l.len }
+
+// Back returns the least recently used entry, nil when there is none
+func (l *recency) Back() *entry {
+	if l.len == 0 {
+		return nil
+	}
+	return l.root.prev
+}
+
+// PushFront links e in as the most recently used entry
+func (l *recency) PushFront(e *entry) {
+	l.lazyInit()
+	e.prev, e.next = &l.root, l.root.next
+	e.prev.next, e.next.prev = e, e
+	l.len++
+	if e.space != nil {
+		e.space.pushFront(e)
+	}
+}
+
+// Remove unlinks e, which must be in the list
+func (l *recency) Remove(e *entry) {
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.prev, e.next = nil, nil
+	l.len--
+	if e.space != nil {
+		e.space.remove(e)
+	}
+}
+
+// MoveToFront makes e, which must be in the list, the most recently used
+func (l *recency) MoveToFront(e *entry) {
+	if l.root.next == e {
+		return
+	}
+	e.prev.next, e.next.prev = e.next, e.prev
+	e.prev, e.next = &l.root, l.root.next
+	e.prev.next, e.next.prev = e, e
+	if e.space != nil {
+		e.space.moveToFront(e)
+	}
+}
+
+// Prev returns the entry used next more recently than e, nil at the front
+func (l *recency) Prev(e *entry) *entry {
+	if e.prev == &l.root {
+		return nil
+	}
+	return e.prev
+}
@@ -0,0 +1,24 @@
+package lru
+
+import "errors"
+
+// Errors returned by the cache; compare with errors.Is, as some are wrapped
+// with details
+var (
+	// ErrNotFound is returned for keys the cache does not hold
+	ErrNotFound = errors.New("lru: key not found")
+	// ErrExpired is returned for keys held past their expiry, until the
+	// janitor or a write removes them
+	ErrExpired = errors.New("lru: key expired")
+	// ErrExists is returned by Add for keys already live
+	ErrExists = errors.New("lru: key exists")
+	// ErrTooLarge is returned for items larger than WithMaxItemSize allows
+	ErrTooLarge = errors.New("lru: item too large")
+	// ErrCapacityZero is returned when there is no room for any item: by
+	// NewCache for a capacity below 1, and by writes to a shard left empty
+	// by Resize
+	ErrCapacityZero = errors.New("lru: no capacity")
+	// ErrNotLocked is returned by UpdateMany for changes to keys it was not
+	// given
+	ErrNotLocked = errors.New("lru: key not locked")
+)
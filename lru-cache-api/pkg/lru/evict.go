@@ -0,0 +1,53 @@
+package lru
+
+// By default a set into a full shard evicts one item itself. With
+// WithEvictionBatch(f), a shard filling past its high watermark, f/2 of its
+// capacity short of full, asks the cache's goroutine to evict down to its
+// low watermark, f of its capacity short of full, in chunks of evictChunk
+// items with the lock let go in between. Sets then find room already made
+// and a burst of them does not pay for the evictions one by one; only when
+// the goroutine falls behind and the shard is full does a set evict for
+// itself. The cost is that the cache holds up to f fewer items than it could
+
+// evictChunk is how many items the goroutine evicts per hold of the lock
+const evictChunk = 256
+
+// batch is how many items below its capacity s's low watermark is
+func (c *LRUCache) batch(s *shard) int {
+	return max(1, int(c.evictBatch*float64(s.capacity)))
+}
+
+// overHigh reports whether s filled past its high watermark, with the
+// write lock held
+func (c *LRUCache) overHigh(s *shard) bool {
+	return c.evictBatch > 0 && s.list.Len() >= s.capacity-c.batch(s)/2
+}
+
+// requestEviction asks the goroutine to evict from s, unless it was asked
+// already; callers hold its write lock
+func (c *LRUCache) requestEviction(s *shard) {
+	if !s.evicting {
+		s.evicting = true
+		c.evicts <- s // never blocks, with room for every shard once
+	}
+}
+
+// evictDown evicts from s down to its low watermark a chunk at a time
+func (c *LRUCache) evictDown(s *shard) {
+	for {
+		s.mutex.Lock()
+		s.drain()
+		low := s.capacity - c.batch(s)
+		for i := 0; i < evictChunk && s.list.Len() > low; i++ {
+			c.evict(s)
+		}
+		done := s.list.Len() <= low
+		if done {
+			s.evicting = false
+		}
+		s.mutex.Unlock()
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,566 @@
+// Package lru is an in-memory cache with expiring items that evicts the
+// least recently used item when full. It is safe for concurrent use and
+// depends on nothing outside the standard library.
+package lru
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheItem to represents the cache item
+type CacheItem struct {
+	Key       string
+	Value     interface{}
+	ExpiresAt time.Time
+}
+
+// EvictLRU is the eviction policy: the least recently used item makes room
+const EvictLRU = "lru"
+
+// LRUCache implements
+type LRUCache struct {
+	shards      []*shard
+	defaultTTL  time.Duration
+	stale       time.Duration
+	maxItem     int64   // largest item in bytes, 0 for no limit
+	evictBatch  float64 // share of a shard evicted at once, 0 for one item per set
+	compressMin int64   // smallest value compressed in bytes, 0 for none
+	clock       Clock
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+
+	// OnLookup are told about every Get; set them up before using the cache
+	OnLookup []func(key string, hit bool)
+	// OnOp are told how long every Get, Set and Delete took
+	OnOp []func(op, key string, took time.Duration)
+	// OnEvict are told about every key evicted, with the write lock held, so
+	// they must not wait
+	OnEvict []func(key string)
+
+	drains    chan *shard // shards whose access buffers filled
+	evicts    chan *shard // shards past their high watermark
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// shard holds the keys hashing to it, with its own lock, capacity and
+// recency order: a full shard evicts its least recently used item, which
+// need not be the least recently used of the whole cache
+type shard struct {
+	capacity int
+	items    map[string]*entry
+	list     recency
+	reads    accessBuffer
+	entries  sync.Pool         // entries to reuse
+	evicting bool              // in evicts or being evicted from, under the write lock
+	spaces   map[string]*space // the namespaces with quotas
+	usage    usage             // what its items take
+	mutex    sync.RWMutex
+}
+
+// shardFor returns the shard holding key
+func (c *LRUCache) shardFor(key string) *shard {
+	return c.shards[c.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard holding key, by its FNV-1a hash
+func (c *LRUCache) shardIndex(key string) int {
+	if len(c.shards) == 1 {
+		return 0
+	}
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(c.shards)))
+}
+
+// shardCapacity is shard i's part of capacity, the remainder going to the
+// first shards
+func (c *LRUCache) shardCapacity(capacity, i int) int {
+	n := len(c.shards)
+	if i < capacity%n {
+		return capacity/n + 1
+	}
+	return capacity / n
+}
+
+// Get retrieves an item from the cache, or returns ErrNotFound or ErrExpired
+func (c *LRUCache) Get(key string) (interface{}, error) {
+	if len(c.OnOp) > 0 {
+		defer c.timeOp("get", key, time.Now())
+	}
+	s := c.shardFor(key)
+	s.mutex.RLock()
+	item, exists := s.items[key]
+	if !exists {
+		s.mutex.RUnlock()
+		c.misses.Add(1)
+		c.lookup(key, false)
+		return nil, ErrNotFound
+	}
+	if c.clock.Now().After(item.ExpiresAt) {
+		s.mutex.RUnlock()
+		c.misses.Add(1)
+		c.lookup(key, false)
+		return nil, ErrExpired
+	}
+	c.recordAccess(s, item)
+	value := item.Value
+	s.mutex.RUnlock()
+
+	c.hits.Add(1)
+	c.lookup(key, true)
+	return unpack(value), nil // outside the lock, as it may decompress
+}
+
+// GetStale :: the value of key and when it expires, held even if expired
+// within the stale window of WithStaleWindow, or ErrNotFound. Unlike Get it
+// counts neither a hit nor a miss, being meant for after Get failed
+func (c *LRUCache) GetStale(key string) (interface{}, time.Time, error) {
+	s := c.shardFor(key)
+	s.mutex.RLock()
+	item, exists := s.items[key]
+	if !exists || c.dead(item, c.clock.Now()) {
+		s.mutex.RUnlock()
+		return nil, time.Time{}, ErrNotFound
+	}
+	c.recordAccess(s, item)
+	value, expiresAt := item.Value, item.ExpiresAt
+	s.mutex.RUnlock()
+	return unpack(value), expiresAt, nil
+}
+
+// dead reports whether e expired longer ago than the stale window, so it
+// may be removed
+func (c *LRUCache) dead(e *entry, now time.Time) bool {
+	return now.After(e.ExpiresAt.Add(c.stale))
+}
+
+func (c *LRUCache) lookup(key string, hit bool) {
+	for _, hook := range c.OnLookup {
+		hook(key, hit)
+	}
+}
+
+func (c *LRUCache) timeOp(op, key string, start time.Time) {
+	took := time.Since(start)
+	for _, hook := range c.OnOp {
+		hook(op, key, took)
+	}
+}
+
+// Set :: adding or updating an item in the cache; it expires after the
+// default TTL when expiration is zero. Returns ErrTooLarge or ErrCapacityZero
+// when the item cannot be held
+func (c *LRUCache) Set(key string, value interface{}, expiration time.Duration) error {
+	if len(c.OnOp) > 0 {
+		defer c.timeOp("set", key, time.Now())
+	}
+	if err := c.checkSize(key, value); err != nil {
+		return err
+	}
+	value = c.pack(value)
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return c.set(s, key, value, expiration)
+}
+
+// checkSize returns ErrTooLarge for items over the size limit
+func (c *LRUCache) checkSize(key string, value interface{}) error {
+	if c.maxItem == 0 {
+		return nil
+	}
+	if size := int64(len(key)) + estimateSize(value); size > c.maxItem {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrTooLarge, size, c.maxItem)
+	}
+	return nil
+}
+
+// set :: Set without locking, callers must hold the shard's write lock and
+// have packed value
+func (c *LRUCache) set(s *shard, key string, value interface{}, expiration time.Duration) error {
+	if s.capacity < 1 {
+		return ErrCapacityZero
+	}
+	if expiration == 0 {
+		expiration = c.defaultTTL
+	}
+	s.drain()
+	if item, exists := s.items[key]; exists {
+		s.list.MoveToFront(item)
+		s.setValue(item, value)
+		item.ExpiresAt = c.clock.Now().Add(expiration)
+	} else {
+		if s.list.Len() >= s.capacity {
+			c.evict(s)
+		}
+		item := s.newEntry(key, value, c.clock.Now().Add(expiration))
+		s.list.PushFront(item)
+		s.items[key] = item
+		if c.overHigh(s) {
+			c.requestEviction(s)
+		}
+	}
+	return nil
+}
+
+// Add :: sets key only when it is not already cached, returning ErrExists
+// when it is, or the errors of Set
+func (c *LRUCache) Add(key string, value interface{}, expiration time.Duration) error {
+	if err := c.checkSize(key, value); err != nil {
+		return err
+	}
+	value = c.pack(value)
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if item, exists := s.items[key]; exists && c.clock.Now().Before(item.ExpiresAt) {
+		return ErrExists
+	}
+	return c.set(s, key, value, expiration)
+}
+
+// Update :: changes the value of key atomically. fn gets the current value,
+// or nil and false when the key is missing or expired, and returns the new
+// one; a nil value deletes the key. A key fn creates expires after
+// expiration, 0 taking the default TTL, and an existing one keeps its
+// expiry. fn runs with the shard locked, so it must not use the cache, and
+// must not change the value it gets in place, as readers may hold it. An
+// error from fn leaves the key as it was. Returns the item as left, with no
+// Key when it was deleted
+func (c *LRUCache) Update(key string, expiration time.Duration, fn func(value interface{}, found bool) (interface{}, error)) (CacheItem, error) {
+	return c.update(key, expiration, false, fn)
+}
+
+// UpdateTTL :: Update, except that the key as left expires after
+// expiration whether fn created it or not, as a lease its holder renews
+func (c *LRUCache) UpdateTTL(key string, expiration time.Duration, fn func(value interface{}, found bool) (interface{}, error)) (CacheItem, error) {
+	return c.update(key, expiration, true, fn)
+}
+
+func (c *LRUCache) update(key string, expiration time.Duration, renew bool, fn func(value interface{}, found bool) (interface{}, error)) (CacheItem, error) {
+	if len(c.OnOp) > 0 {
+		defer c.timeOp("update", key, time.Now())
+	}
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	item, found := s.items[key]
+	var current interface{}
+	if found {
+		if c.clock.Now().After(item.ExpiresAt) {
+			found = false
+		} else {
+			current = unpack(item.Value)
+		}
+	}
+	value, err := fn(current, found)
+	if err != nil {
+		return CacheItem{}, err
+	}
+	if value == nil {
+		if item != nil {
+			s.list.Remove(item)
+			delete(s.items, key)
+			s.releaseEntry(item)
+		}
+		return CacheItem{}, nil
+	}
+	if err := c.checkSize(key, value); err != nil {
+		return CacheItem{}, err
+	}
+	if found && renew {
+		found = false // set takes the new expiry
+	}
+	if found {
+		s.drain()
+		s.list.MoveToFront(item)
+		s.setValue(item, c.pack(value))
+		return CacheItem{Key: key, Value: value, ExpiresAt: item.ExpiresAt}, nil
+	}
+	if err := c.set(s, key, c.pack(value), expiration); err != nil {
+		return CacheItem{}, err
+	}
+	return CacheItem{Key: key, Value: value, ExpiresAt: s.items[key].ExpiresAt}, nil
+}
+
+// Delete :: removes an item from the cache
+func (c *LRUCache) Delete(key string) {
+	if len(c.OnOp) > 0 {
+		defer c.timeOp("delete", key, time.Now())
+	}
+	s := c.shardFor(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if item, exists := s.items[key]; exists {
+		s.list.Remove(item)
+		delete(s.items, key)
+		s.releaseEntry(item)
+	}
+}
+
+// evict :-> removes the least recently used item from the shard, of the
+// namespace furthest over its quota if any is
+func (c *LRUCache) evict(s *shard) {
+	if item := s.victim(); item != nil {
+		s.list.Remove(item)
+		delete(s.items, item.Key)
+		c.evictions.Add(1)
+		for _, hook := range c.OnEvict {
+			hook(item.Key)
+		}
+		s.releaseEntry(item)
+	}
+}
+
+// Flush :: removes every item, returning the keys it held
+func (c *LRUCache) Flush() []string {
+	var keys []string
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for key := range s.items {
+			keys = append(keys, key)
+		}
+		s.items = make(map[string]*entry)
+		s.list.Init()
+		s.resetSpaces()
+		s.usage = usage{}
+		s.reads.forget()
+		s.mutex.Unlock()
+	}
+	return keys
+}
+
+// Clear :: removes every item from the cache
+func (c *LRUCache) Clear() {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		s.items = make(map[string]*entry)
+		s.list.Init()
+		s.resetSpaces()
+		s.usage = usage{}
+		s.reads.forget()
+		s.mutex.Unlock()
+	}
+}
+
+// Resize :: changes the capacity, evicting the least recently used items
+// that no longer fit; returns how many were evicted
+func (c *LRUCache) Resize(capacity int) int {
+	evicted := 0
+	for i, s := range c.shards {
+		s.mutex.Lock()
+		s.capacity = c.shardCapacity(capacity, i)
+		c.setQuotas(s, i)
+		s.drain()
+		for s.list.Len() > s.capacity {
+			c.evict(s)
+			evicted++
+		}
+		s.mutex.Unlock()
+	}
+	return evicted
+}
+
+// EvictFraction :: evicts the least recently used share f of each shard's
+// items, at least one from any shard holding some, and returns how many
+// were evicted; the capacity stays as it was
+func (c *LRUCache) EvictFraction(f float64) int {
+	if f <= 0 {
+		return 0
+	}
+	evicted := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		s.drain()
+		n := int(math.Ceil(min(f, 1) * float64(s.list.Len())))
+		for i := 0; i < n; i++ {
+			c.evict(s)
+		}
+		evicted += n
+		s.mutex.Unlock()
+	}
+	return evicted
+}
+
+// RemoveExpired :: removes the expired items, past the stale window if
+// any, returning their keys
+func (c *LRUCache) RemoveExpired() []string {
+	var expired []string
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		now := c.clock.Now()
+		for key, item := range s.items {
+			if c.dead(item, now) {
+				s.list.Remove(item)
+				delete(s.items, key)
+				c.expirations.Add(1)
+				expired = append(expired, key)
+				s.releaseEntry(item)
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return expired
+}
+
+// RemoveExpiredSample :: looks at up to n items of each shard, taken in no
+// particular order, and removes those expired, returning their keys and how
+// many items were looked at. Unlike RemoveExpired, it holds a shard's lock
+// for n items however large the cache is, so calling it often with a small
+// n keeps expired items few without long pauses
+func (c *LRUCache) RemoveExpiredSample(n int) (expired []string, sampled int) {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		now := c.clock.Now()
+		seen := 0
+		// Map iteration starts at a random place, which makes the sample
+		for key, item := range s.items {
+			if seen == n {
+				break
+			}
+			seen++
+			if c.dead(item, now) {
+				s.list.Remove(item)
+				delete(s.items, key)
+				c.expirations.Add(1)
+				expired = append(expired, key)
+				s.releaseEntry(item)
+			}
+		}
+		sampled += seen
+		s.mutex.Unlock()
+	}
+	return expired, sampled
+}
+
+// Range :: calls fn with every item that has not expired, in no particular
+// order, until it returns false. Each shard is read locked while its items
+// are visited, so fn must not change the cache
+func (c *LRUCache) Range(fn func(item CacheItem) bool) {
+	for _, s := range c.shards {
+		if !c.rangeShard(s, fn) {
+			return
+		}
+	}
+}
+
+func (c *LRUCache) rangeShard(s *shard, fn func(item CacheItem) bool) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := c.clock.Now()
+	for _, item := range s.items {
+		if now.Before(item.ExpiresAt) && !fn(unpacked(item.CacheItem)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Walk :: calls fn with every item that has not expired, in no particular
+// order, until it returns false, like Range, but holds a shard's read lock
+// only while copying batch items at a time. fn may so take its time, say
+// writing to a slow client, without holding up writers, and may change the
+// cache; an item changed during the walk may be seen as it was before or
+// after, or not at all when it was added or deleted
+func (c *LRUCache) Walk(batch int, fn func(item CacheItem) bool) {
+	batch = max(batch, 1)
+	items := make([]CacheItem, 0, batch)
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		keys := make([]string, 0, len(s.items))
+		for key := range s.items {
+			keys = append(keys, key)
+		}
+		s.mutex.RUnlock()
+
+		for len(keys) > 0 {
+			n := min(batch, len(keys))
+			items = items[:0]
+			s.mutex.RLock()
+			now := c.clock.Now()
+			for _, key := range keys[:n] {
+				if item, ok := s.items[key]; ok && now.Before(item.ExpiresAt) {
+					items = append(items, item.CacheItem)
+				}
+			}
+			s.mutex.RUnlock()
+			keys = keys[n:]
+
+			for _, item := range items {
+				if !fn(unpacked(item)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Keys :: returns the live keys matching pattern, as path.Match takes it
+func (c *LRUCache) Keys(pattern string) []string {
+	var keys []string
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		now := c.clock.Now()
+		for key, item := range s.items {
+			if ok, _ := path.Match(pattern, key); ok && now.Before(item.ExpiresAt) {
+				keys = append(keys, key)
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	return keys
+}
+
+// Snapshot :: returns a copy of the cache items, least recently used first
+// within each shard, which is the order Restore keeps
+func (c *LRUCache) Snapshot() []CacheItem {
+	var items []CacheItem
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		s.drain()
+		for item := s.list.Back(); item != nil; item = s.list.Prev(item) {
+			items = append(items, item.CacheItem)
+		}
+		s.mutex.Unlock()
+	}
+	for i := range items {
+		items[i] = unpacked(items[i])
+	}
+	if items == nil {
+		items = []CacheItem{}
+	}
+	return items
+}
+
+// Restore :: loads items into the cache, skipping the ones already expired
+// and those it cannot hold; returns how many were loaded
+func (c *LRUCache) Restore(items []CacheItem) int {
+	now := c.clock.Now()
+	loaded := 0
+	for _, item := range items {
+		if now.After(item.ExpiresAt) {
+			continue
+		}
+		if c.Set(item.Key, item.Value, item.ExpiresAt.Sub(now)) == nil {
+			loaded++
+		}
+	}
+	return loaded
+}
@@ -0,0 +1,107 @@
+package lru
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Change is a change UpdateMany makes to a key: a nil Value deletes it. A
+// key set lives for TTL from now or, when TTL is zero, keeps its expiry if
+// it is cached and takes the default TTL if not
+type Change struct {
+	Key   string
+	Value interface{}
+	TTL   time.Duration
+}
+
+// UpdateMany :: changes several keys atomically, as Update does one: the
+// shards of keys stay locked while fn runs, so no other write to them comes
+// between what fn reads and what it changes. fn gets the values of the keys
+// that are cached and returns the changes to make, which may only be to
+// keys; the rules of Update's fn hold for it, and it should be quick, as it
+// holds up every key in the shards it locks. The changes are all made or,
+// when one cannot be, for ErrNotLocked, ErrTooLarge or ErrCapacityZero,
+// none. Returns the items changed as left, in the order of the changes,
+// with a nil Value for those deleted
+func (c *LRUCache) UpdateMany(keys []string, fn func(values map[string]interface{}) ([]Change, error)) ([]CacheItem, error) {
+	if len(c.OnOp) > 0 {
+		defer c.timeOp("update", strings.Join(keys, " "), time.Now())
+	}
+	locked := make(map[string]*shard, len(keys))
+	var indexes []int
+	for _, key := range keys {
+		i := c.shardIndex(key)
+		if !containsIndex(indexes, i) {
+			indexes = append(indexes, i)
+		}
+		locked[key] = c.shards[i]
+	}
+	// Always in the same order, so two calls cannot wait for each other
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		c.shards[i].mutex.Lock()
+		defer c.shards[i].mutex.Unlock()
+	}
+
+	now := c.clock.Now()
+	values := make(map[string]interface{}, len(keys))
+	for key, s := range locked {
+		if item, ok := s.items[key]; ok && !now.After(item.ExpiresAt) {
+			values[key] = unpack(item.Value)
+		}
+	}
+	changes, err := fn(values)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		s, ok := locked[change.Key]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotLocked, change.Key)
+		}
+		if change.Value == nil {
+			continue
+		}
+		if err := c.checkSize(change.Key, change.Value); err != nil {
+			return nil, err
+		}
+		if s.capacity < 1 {
+			return nil, ErrCapacityZero
+		}
+	}
+
+	items := make([]CacheItem, 0, len(changes))
+	for _, change := range changes {
+		s := locked[change.Key]
+		item, found := s.items[change.Key]
+		switch {
+		case change.Value == nil:
+			if found {
+				s.list.Remove(item)
+				delete(s.items, change.Key)
+				s.releaseEntry(item)
+				items = append(items, CacheItem{Key: change.Key})
+			}
+			continue
+		case found && change.TTL == 0 && !now.After(item.ExpiresAt):
+			s.drain()
+			s.list.MoveToFront(item)
+			s.setValue(item, c.pack(change.Value))
+		default:
+			c.set(s, change.Key, c.pack(change.Value), change.TTL) // checked above
+		}
+		items = append(items, CacheItem{Key: change.Key, Value: change.Value, ExpiresAt: s.items[change.Key].ExpiresAt})
+	}
+	return items, nil
+}
+
+func containsIndex(indexes []int, i int) bool {
+	for _, index := range indexes {
+		if index == i {
+			return true
+		}
+	}
+	return false
+}
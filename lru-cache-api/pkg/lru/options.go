@@ -0,0 +1,155 @@
+package lru
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultCapacity is how many items a cache made without WithCapacity holds
+const DefaultCapacity = 100
+
+// Option configures a cache made by NewCache
+type Option func(*options)
+
+type options struct {
+	capacity   int
+	policy     string
+	defaultTTL time.Duration
+	maxItem    int64
+	evictBatch float64
+	compress   int64
+	stale      time.Duration
+	quotas     map[string]Quota
+	onEvict    []func(key string)
+	clock      Clock
+	shards     int
+}
+
+// WithCapacity :: how many items the cache holds before evicting
+func WithCapacity(capacity int) Option {
+	return func(o *options) { o.capacity = capacity }
+}
+
+// WithPolicy :: which item makes room for a new one; EvictLRU is the only
+// policy
+func WithPolicy(policy string) Option {
+	return func(o *options) { o.policy = policy }
+}
+
+// WithDefaultTTL :: how long items set with a zero expiration live; without
+// it they expire at once
+func WithDefaultTTL(ttl time.Duration) Option {
+	return func(o *options) { o.defaultTTL = ttl }
+}
+
+// WithMaxItemSize :: refuses items whose key and estimated value size add up
+// to more than n bytes with ErrTooLarge; 0, the default, is no limit
+func WithMaxItemSize(n int64) Option {
+	return func(o *options) { o.maxItem = n }
+}
+
+// WithEvictionBatch :: evicts from a shard nearly full in the background,
+// making room for a share f of its capacity at once rather than evicting
+// one item in every set; 0, the default, evicts in the sets
+func WithEvictionBatch(f float64) Option {
+	return func(o *options) { o.evictBatch = f }
+}
+
+// WithCompression :: keeps strings, byte slices and raw values of n bytes
+// or more compressed; 0, the default, compresses nothing
+func WithCompression(n int64) Option {
+	return func(o *options) { o.compress = n }
+}
+
+// WithStaleWindow :: keeps expired items for d more before removing them,
+// for GetStale; 0, the default, removes them as soon as they expire
+func WithStaleWindow(d time.Duration) Option {
+	return func(o *options) { o.stale = d }
+}
+
+// WithQuotas :: gives namespaces, the part of keys before the first colon,
+// a quota of the capacity; a full cache evicts from those furthest over
+// theirs first
+func WithQuotas(quotas map[string]Quota) Option {
+	return func(o *options) { o.quotas = quotas }
+}
+
+// WithOnEvict :: adds a hook told about every key evicted, see
+// LRUCache.OnEvict
+func WithOnEvict(hook func(key string)) Option {
+	return func(o *options) { o.onEvict = append(o.onEvict, hook) }
+}
+
+// WithClock :: the clock expiry is checked against, SystemClock by default
+func WithClock(clock Clock) Option {
+	return func(o *options) { o.clock = clock }
+}
+
+// WithShards :: splits the cache into n parts with their own locks, so
+// writes to different keys contend less. The capacity is split between
+// them and each evicts on its own, which makes eviction approximately LRU
+func WithShards(n int) Option {
+	return func(o *options) { o.shards = n }
+}
+
+// NewCache :: a cache with the given options, DefaultCapacity items with
+// the EvictLRU policy and one shard when there are none
+func NewCache(opts ...Option) (*LRUCache, error) {
+	o := options{capacity: DefaultCapacity, policy: EvictLRU, clock: SystemClock, shards: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	switch {
+	case o.capacity < 1:
+		return nil, fmt.Errorf("%w: capacity %d, it must be at least 1", ErrCapacityZero, o.capacity)
+	case o.policy != EvictLRU:
+		return nil, fmt.Errorf("lru: unknown eviction policy %q, only %s is supported", o.policy, EvictLRU)
+	case o.maxItem < 0:
+		return nil, fmt.Errorf("lru: negative maximum item size %d", o.maxItem)
+	case o.evictBatch < 0 || o.evictBatch >= 1:
+		return nil, fmt.Errorf("lru: eviction batch %g, it must be at least 0 and below 1", o.evictBatch)
+	case o.compress < 0:
+		return nil, fmt.Errorf("lru: negative compression threshold %d", o.compress)
+	case o.stale < 0:
+		return nil, fmt.Errorf("lru: negative stale window %s", o.stale)
+	case o.defaultTTL < 0:
+		return nil, fmt.Errorf("lru: negative default TTL %s", o.defaultTTL)
+	case o.shards < 1 || o.shards > o.capacity:
+		return nil, fmt.Errorf("lru: %d shards, there must be between 1 and the capacity", o.shards)
+	case o.clock == nil:
+		return nil, fmt.Errorf("lru: no clock")
+	}
+	if err := checkQuotas(o.quotas); err != nil {
+		return nil, err
+	}
+
+	c := &LRUCache{
+		shards:      make([]*shard, o.shards),
+		defaultTTL:  o.defaultTTL,
+		maxItem:     o.maxItem,
+		evictBatch:  o.evictBatch,
+		compressMin: o.compress,
+		stale:       o.stale,
+		clock:       o.clock,
+		OnEvict:     o.onEvict,
+		drains:      make(chan *shard, o.shards),
+		evicts:      make(chan *shard, o.shards),
+		closed:      make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard{
+			capacity: c.shardCapacity(o.capacity, i),
+			items:    make(map[string]*entry),
+		}
+		if len(o.quotas) > 0 {
+			c.shards[i].spaces = make(map[string]*space, len(o.quotas))
+			for namespace, quota := range o.quotas {
+				c.shards[i].spaces[namespace] = &space{quota: quota}
+			}
+			c.setQuotas(c.shards[i], i)
+			c.shards[i].resetSpaces()
+		}
+	}
+	go c.drainLoop()
+	return c, nil
+}
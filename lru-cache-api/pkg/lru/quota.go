@@ -0,0 +1,126 @@
+package lru
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A namespace is the part of a key before its first colon, as in
+// users:42. With WithQuotas, a namespace may be given a quota of the
+// capacity, which it can exceed while there is room: when a shard must
+// evict, it evicts the least recently used item of the namespace furthest
+// over its quota, and only when none is over, its least recently used item.
+// The entries of such a namespace are also linked into a list of their own,
+// in the same order as the shard's, so finding that item takes no search
+
+// Quota is how much of a cache's capacity a namespace is meant to hold
+type Quota struct {
+	Items int     // at most this many items, when not 0
+	Share float64 // at most this share of the capacity, when not 0
+}
+
+// NamespaceStats is what a namespace with a quota holds against it
+type NamespaceStats struct {
+	Items int `json:"items"`
+	Quota int `json:"quota"`
+}
+
+// namespaceOf returns the namespace of key, "" when it has none
+func namespaceOf(key string) string {
+	namespace, _, ok := strings.Cut(key, ":")
+	if !ok {
+		return ""
+	}
+	return namespace
+}
+
+// checkQuotas returns an error for quotas NewCache cannot take
+func checkQuotas(quotas map[string]Quota) error {
+	for namespace, q := range quotas {
+		switch {
+		case namespace == "" || strings.Contains(namespace, ":"):
+			return fmt.Errorf("lru: invalid namespace %q for a quota", namespace)
+		case q.Items < 0 || q.Share < 0 || q.Share > 1:
+			return fmt.Errorf("lru: quota of %s out of range", namespace)
+		case (q.Items == 0) == (q.Share == 0):
+			return fmt.Errorf("lru: the quota of %s needs either items or a share", namespace)
+		}
+	}
+	return nil
+}
+
+// space is a namespace with a quota, as a shard holds it
+type space struct {
+	quota Quota
+	limit int   // its part of the quota in this shard
+	root  entry // links the front and back of its entries into a ring
+	len   int
+}
+
+// setQuotas works out shard i's part of each quota, for its capacity
+func (c *LRUCache) setQuotas(s *shard, i int) {
+	for _, sp := range s.spaces {
+		if sp.quota.Items > 0 {
+			sp.limit = c.shardCapacity(sp.quota.Items, i)
+		} else {
+			sp.limit = int(sp.quota.Share * float64(s.capacity))
+		}
+	}
+}
+
+// resetSpaces empties the namespace lists, for a shard whose list was
+// emptied without unlinking its entries one by one
+func (s *shard) resetSpaces() {
+	for _, sp := range s.spaces {
+		sp.root.spaceNext, sp.root.spacePrev = &sp.root, &sp.root
+		sp.len = 0
+	}
+}
+
+// spaceOf returns the space key belongs in, nil for namespaces without a
+// quota
+func (s *shard) spaceOf(key string) *space {
+	if len(s.spaces) == 0 {
+		return nil
+	}
+	return s.spaces[namespaceOf(key)]
+}
+
+// victim returns the entry to evict: the least recently used of the
+// namespace furthest over its quota, or of the whole shard
+func (s *shard) victim() *entry {
+	var over *space
+	most := 0
+	for _, sp := range s.spaces {
+		if n := sp.len - sp.limit; n > most {
+			over, most = sp, n
+		}
+	}
+	if over != nil {
+		return over.root.spacePrev
+	}
+	return s.list.Back()
+}
+
+// pushFront links e in as the most recently used entry of its namespace
+func (sp *space) pushFront(e *entry) {
+	if sp.root.spaceNext == nil {
+		sp.root.spaceNext, sp.root.spacePrev = &sp.root, &sp.root
+	}
+	e.spacePrev, e.spaceNext = &sp.root, sp.root.spaceNext
+	e.spacePrev.spaceNext, e.spaceNext.spacePrev = e, e
+	sp.len++
+}
+
+// remove unlinks e from its namespace's list
+func (sp *space) remove(e *entry) {
+	e.spacePrev.spaceNext, e.spaceNext.spacePrev = e.spaceNext, e.spacePrev
+	e.spacePrev, e.spaceNext = nil, nil
+	sp.len--
+}
+
+// moveToFront makes e the most recently used of its namespace
+func (sp *space) moveToFront(e *entry) {
+	sp.remove(e)
+	sp.pushFront(e)
+}
@@ -0,0 +1,9 @@
+package lru
+
+// RawValue is a value kept as the bytes a client sent instead of decoded
+// from JSON, to be served back as they are. In JSON, as snapshots, replicas
+// and events carry it, it is {"contentType": "...", "raw": "<base64>"}
+type RawValue struct {
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"raw"`
+}
@@ -0,0 +1,122 @@
+package lru
+
+import "fmt"
+
+// Stats is a point in time view of the cache counters
+type Stats struct {
+	Items       int     `json:"items"`
+	Capacity    int     `json:"capacity"`
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	Evictions   uint64  `json:"evictions"`
+	Expirations uint64  `json:"expirations"`
+	HitRatio    float64 `json:"hitRatio"`
+	MemoryBytes int64   `json:"memoryBytes"` // estimated size of keys and values
+
+	// The values kept compressed, with their size as kept and before
+	CompressedItems   int   `json:"compressedItems,omitempty"`
+	CompressedBytes   int64 `json:"compressedBytes,omitempty"`
+	UncompressedBytes int64 `json:"uncompressedBytes,omitempty"`
+
+	// The namespaces with quotas, by name
+	Namespaces map[string]NamespaceStats `json:"namespaces,omitempty"`
+}
+
+// usage is what a shard's items take, counted as they are set and removed
+// so that Stats need not look at every item
+type usage struct {
+	bytes             int64 // estimated size of keys and values, as kept
+	compressedItems   int
+	compressedBytes   int64
+	uncompressedBytes int64
+}
+
+// add counts e in, or out for sign -1
+func (u *usage) add(e *entry, sign int64) {
+	u.bytes += sign * e.size
+	if packed, ok := e.Value.(compressed); ok {
+		u.compressedItems += int(sign)
+		u.compressedBytes += sign * int64(len(packed.data))
+		u.uncompressedBytes += sign * int64(packed.size)
+	}
+}
+
+// Capacity :: how many items the cache holds before evicting
+func (c *LRUCache) Capacity() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		n += s.capacity
+		s.mutex.RUnlock()
+	}
+	return n
+}
+
+// Stats :: returns the current cache counters, from ones kept as the
+// cache changes rather than by looking at every item
+func (c *LRUCache) Stats() Stats {
+	var stats Stats
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		stats.Items += s.list.Len()
+		stats.Capacity += s.capacity
+		for namespace, sp := range s.spaces {
+			if stats.Namespaces == nil {
+				stats.Namespaces = make(map[string]NamespaceStats, len(s.spaces))
+			}
+			ns := stats.Namespaces[namespace]
+			ns.Items += sp.len
+			ns.Quota += sp.limit
+			stats.Namespaces[namespace] = ns
+		}
+		stats.MemoryBytes += s.usage.bytes
+		stats.CompressedItems += s.usage.compressedItems
+		stats.CompressedBytes += s.usage.compressedBytes
+		stats.UncompressedBytes += s.usage.uncompressedBytes
+		s.mutex.RUnlock()
+	}
+
+	stats.Hits = c.hits.Load()
+	stats.Misses = c.misses.Load()
+	stats.Evictions = c.evictions.Load()
+	stats.Expirations = c.expirations.Load()
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// estimateSize roughly sizes a value decoded from JSON or a RawValue, and
+// those compressed as kept
+func estimateSize(v interface{}) int64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case bool:
+		return 1
+	case float64:
+		return 8
+	case []byte:
+		return int64(len(v))
+	case RawValue:
+		return int64(len(v.ContentType) + len(v.Data))
+	case compressed:
+		return int64(len(v.contentType) + len(v.data))
+	case []interface{}:
+		var size int64
+		for _, e := range v {
+			size += estimateSize(e)
+		}
+		return size
+	case map[string]interface{}:
+		var size int64
+		for k, e := range v {
+			size += int64(len(k)) + estimateSize(e)
+		}
+		return size
+	default:
+		return int64(len(fmt.Sprint(v)))
+	}
+}
@@ -0,0 +1,98 @@
+package lru
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// recount works out the sizes Stats reports by looking at every item
+func recount(c *LRUCache) Stats {
+	var stats Stats
+	for _, s := range c.shards {
+		s.mutex.RLock()
+		for key, item := range s.items {
+			stats.Items++
+			stats.MemoryBytes += int64(len(key)) + estimateSize(item.Value)
+			if packed, ok := item.Value.(compressed); ok {
+				stats.CompressedItems++
+				stats.CompressedBytes += int64(len(packed.data))
+				stats.UncompressedBytes += int64(packed.size)
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	return stats
+}
+
+func TestStatsCounters(t *testing.T) {
+	long := strings.Repeat("value ", 20)
+	c, clock := newClockedCache(t, WithCapacity(4), WithShards(2), WithCompression(32))
+
+	steps := []struct {
+		name string
+		do   func()
+	}{
+		{"set", func() { c.Set("a", "x", time.Minute) }},
+		{"set compressed", func() { c.Set("b", long, time.Minute) }},
+		{"overwrite", func() { c.Set("b", 42.0, time.Minute) }},
+		{"object", func() { c.Set("c", map[string]interface{}{"k": long}, time.Second) }},
+		{"update", func() {
+			c.Update("a", 0, func(interface{}, bool) (interface{}, error) { return long + long, nil })
+		}},
+		{"update many", func() {
+			c.UpdateMany([]string{"a", "d"}, func(map[string]interface{}) ([]Change, error) {
+				return []Change{{Key: "a", Value: "y"}, {Key: "d", Value: []byte(long), TTL: time.Minute}}, nil
+			})
+		}},
+		{"evict", func() {
+			for _, key := range []string{"e", "f", "g", "h"} {
+				c.Set(key, long, time.Minute)
+			}
+		}},
+		{"delete", func() { c.Delete("h") }},
+		{"update deletes", func() {
+			c.Update("g", 0, func(interface{}, bool) (interface{}, error) { return nil, nil })
+		}},
+		{"expire", func() {
+			c.Set("c", "short", time.Second)
+			clock.Advance(2 * time.Second)
+			c.RemoveExpired()
+		}},
+		{"resize", func() { c.Resize(2) }},
+		{"flush", func() { c.Flush() }},
+		{"after flush", func() { c.Set("a", long, time.Minute) }},
+	}
+	for _, step := range steps {
+		step.do()
+		got, want := c.Stats(), recount(c)
+		if got.Items != want.Items || got.MemoryBytes != want.MemoryBytes ||
+			got.CompressedItems != want.CompressedItems || got.CompressedBytes != want.CompressedBytes ||
+			got.UncompressedBytes != want.UncompressedBytes {
+			t.Errorf("after %s: Stats = %+v, recounted %+v", step.name, got, want)
+		}
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		capacity, shards, resize int
+	}{
+		{10, 1, 3},
+		{10, 4, 7},
+		{4, 4, 9},
+	}
+	for _, tt := range tests {
+		c, err := NewCache(WithCapacity(tt.capacity), WithShards(tt.shards))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Capacity(); got != tt.capacity || got != c.Stats().Capacity {
+			t.Errorf("Capacity() = %d, want %d", got, tt.capacity)
+		}
+		c.Resize(tt.resize)
+		if got := c.Capacity(); got != tt.resize {
+			t.Errorf("Capacity() after Resize(%d) = %d", tt.resize, got)
+		}
+	}
+}
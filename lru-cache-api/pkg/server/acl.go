@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tenantPlaceholder in a rule prefix is replaced with the caller's tenant
+const tenantPlaceholder = "{tenant}"
+
+// ACLRule grants a principal operations on the keys starting with Prefix
+type ACLRule struct {
+	Principal string   `json:"principal"` // API key name, token subject or * for everyone
+	Prefix    string   `json:"prefix"`    // a trailing * is optional, "a:*" equals "a:"
+	Ops       []string `json:"ops"`       // read and/or write
+}
+
+func (rule *ACLRule) allows(p *Principal, key, op string) bool {
+	if rule.Principal != "*" && rule.Principal != p.Name {
+		return false
+	}
+	prefix := strings.TrimSuffix(rule.Prefix, "*")
+	if strings.Contains(prefix, tenantPlaceholder) {
+		if p.Tenant == "" {
+			return false
+		}
+		prefix = strings.ReplaceAll(prefix, tenantPlaceholder, p.Tenant)
+	}
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	for _, o := range rule.Ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// aclSet holds the rules loaded from CACHE_ACL_FILE
+type aclSet struct {
+	mutex   sync.RWMutex
+	rules   []ACLRule
+	modTime time.Time
+}
+
+var acls = &aclSet{}
+
+// loadACLs :: (re)reads the rules file
+func loadACLs(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Rules []ACLRule `json:"rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, rule := range file.Rules {
+		if rule.Principal == "" {
+			return fmt.Errorf("%s: rule for prefix %q has no principal", path, rule.Prefix)
+		}
+		for _, op := range rule.Ops {
+			if op != ScopeRead && op != ScopeWrite {
+				return fmt.Errorf("%s: unknown op %q", path, op)
+			}
+		}
+	}
+
+	acls.mutex.Lock()
+	acls.rules = file.Rules
+	acls.modTime = info.ModTime()
+	acls.mutex.Unlock()
+	return nil
+}
+
+// watchACLs reloads the rules file whenever it changes
+func watchACLs(path string) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Warn("acl: checking rules file", "err", err)
+			continue
+		}
+		acls.mutex.RLock()
+		changed := !info.ModTime().Equal(acls.modTime)
+		acls.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := loadACLs(path); err != nil {
+			slog.Error("acl: reloading rules, keeping the previous ones", "err", err)
+			continue
+		}
+		slog.Info("acl: reloaded rules", "path", path)
+	}
+}
+
+// unrestricted reports whether p bypasses the ACLs: nobody is restricted
+// without a rules file, and admins and other servers never are
+func unrestricted(p *Principal) bool {
+	return config.ACLFile == "" || p == nil || p.HasScope(ScopeAdmin) || p.HasScope(ScopeCluster)
+}
+
+// canAccess :: reports whether the caller behind ctx may perform op on key
+func canAccess(ctx context.Context, key, op string) bool {
+	return allowed(principalFrom(ctx), key, op)
+}
+
+// allowed reports whether p may perform op on key
+func allowed(p *Principal, key, op string) bool {
+	if unrestricted(p) {
+		return true
+	}
+	acls.mutex.RLock()
+	defer acls.mutex.RUnlock()
+	for i := range acls.rules {
+		if acls.rules[i].allows(p, key, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestKey finds the key a request is about: the path of /cache/{key},
+// the key of /locks/{name} or /ratelimit/{bucket} or the body of POST
+// /cache, which is put back for the handler, in the default cache or a
+// named one
+func requestKey(r *http.Request) (string, bool) {
+	_, path := namedCachePath(r.URL.Path)
+	if key, ok := strings.CutPrefix(path, "/cache/"); ok {
+		key, _, _ = strings.Cut(key, "/") // e.g. /cache/{key}/list/push
+		return key, true
+	}
+	if name, ok := strings.CutPrefix(path, "/locks/"); ok {
+		return lockKey(name), true
+	}
+	if bucket, ok := strings.CutPrefix(path, "/ratelimit/"); ok {
+		return rateLimitKey(bucket), true
+	}
+	if channel, ok := strings.CutPrefix(path, "/publish/"); ok {
+		return channelKey(channel), true
+	}
+	if path == "/cache" && r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			r.Body = io.NopCloser(errorReader{err})
+			return "", false
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		var data struct {
+			Key string `json:"key"`
+		}
+		json.Unmarshal(body, &data)
+		return data.Key, true
+	}
+	return "", false
+}
+
+// aclMiddleware enforces the ACLs on requests for a single key. Listing
+// and /ws leave out what the caller cannot read
+func aclMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || unrestricted(principalFrom(r.Context())) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		op := ScopeWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			op = ScopeRead
+		}
+		if key, ok := requestKey(r); ok && !canAccess(r.Context(), key, op) {
+			loggerFrom(r.Context()).Warn("acl: denied", "op", op, "key", key, "principal", principalFrom(r.Context()).Name, "client_ip", clientIP(r))
+			http.Error(w, fmt.Sprintf("Not allowed to %s %q", op, key), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package server
+
+import "testing"
+
+func TestACLRuleAllows(t *testing.T) {
+	alice := &Principal{Name: "alice", Tenant: "acme"}
+	bob := &Principal{Name: "bob"}
+
+	tests := []struct {
+		name string
+		rule ACLRule
+		p    *Principal
+		key  string
+		op   string
+		want bool
+	}{
+		{"prefix", ACLRule{"alice", "users:", []string{ScopeRead}}, alice, "users:1", ScopeRead, true},
+		{"trailing star", ACLRule{"alice", "users:*", []string{ScopeRead}}, alice, "users:1", ScopeRead, true},
+		{"star is not a wildcard inside", ACLRule{"alice", "u*:", []string{ScopeRead}}, alice, "users:1", ScopeRead, false},
+		{"other prefix", ACLRule{"alice", "users:", []string{ScopeRead}}, alice, "orders:1", ScopeRead, false},
+		{"prefix without separator", ACLRule{"alice", "user", []string{ScopeRead}}, alice, "users:1", ScopeRead, true},
+		{"other op", ACLRule{"alice", "users:", []string{ScopeRead}}, alice, "users:1", ScopeWrite, false},
+		{"other principal", ACLRule{"alice", "users:", []string{ScopeRead}}, bob, "users:1", ScopeRead, false},
+		{"everyone", ACLRule{"*", "public:", []string{ScopeRead}}, bob, "public:home", ScopeRead, true},
+		{"empty prefix", ACLRule{"*", "", []string{ScopeWrite}}, bob, "anything", ScopeWrite, true},
+		{"tenant", ACLRule{"*", "t:{tenant}:", []string{ScopeRead}}, alice, "t:acme:1", ScopeRead, true},
+		{"other tenant", ACLRule{"*", "t:{tenant}:", []string{ScopeRead}}, alice, "t:evil:1", ScopeRead, false},
+		{"no tenant", ACLRule{"*", "t:{tenant}:", []string{ScopeRead}}, bob, "t::1", ScopeRead, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.allows(tt.p, tt.key, tt.op); got != tt.want {
+				t.Errorf("allows(%s, %q, %s) = %v, want %v", tt.p.Name, tt.key, tt.op, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	saved, savedRules := config, acls.rules
+	config = &Config{ACLFile: "acls.json"}
+	acls.rules = []ACLRule{{"alice", "users:", []string{ScopeRead}}}
+	t.Cleanup(func() { config, acls.rules = saved, savedRules })
+
+	tests := []struct {
+		name string
+		p    *Principal
+		key  string
+		op   string
+		want bool
+	}{
+		{"rule", &Principal{Name: "alice"}, "users:1", ScopeRead, true},
+		{"no rule", &Principal{Name: "alice"}, "users:1", ScopeWrite, false},
+		{"admin", &Principal{Name: "root", Scopes: []string{ScopeAdmin}}, "users:1", ScopeWrite, true},
+		{"cluster", &Principal{Name: "node", Scopes: []string{ScopeCluster}}, "users:1", ScopeWrite, true},
+		{"scoped but not admin", &Principal{Name: "bob", Scopes: []string{ScopeWrite}}, "users:1", ScopeWrite, false},
+	}
+	for _, tt := range tests {
+		if got := allowed(tt.p, tt.key, tt.op); got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	config = &Config{}
+	if !allowed(&Principal{Name: "bob"}, "users:1", ScopeWrite) {
+		t.Error("without CACHE_ACL_FILE, allowed = false, want true")
+	}
+}
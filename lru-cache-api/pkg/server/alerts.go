@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertMetrics are the values alert rules can watch. Ratios and rates are
+// over the last evaluation interval, not since start
+var alertMetrics = map[string]bool{
+	"hit_ratio":       true,
+	"eviction_rate":   true, // evictions per second
+	"expiration_rate": true, // expirations per second
+	"memory_bytes":    true,
+	"heap_bytes":      true,
+	"items":           true,
+}
+
+// AlertRule fires when Metric compares to Threshold per Op for at least For
+type AlertRule struct {
+	Metric    string
+	Op        string // < or >
+	Threshold float64
+	For       time.Duration
+}
+
+func (r AlertRule) String() string {
+	s := r.Metric + r.Op + strconv.FormatFloat(r.Threshold, 'g', -1, 64)
+	if r.For > 0 {
+		s += " for " + r.For.String()
+	}
+	return s
+}
+
+func (r AlertRule) breached(value float64) bool {
+	if r.Op == "<" {
+		return value < r.Threshold
+	}
+	return value > r.Threshold
+}
+
+// parseAlertRules :: parses rules such as "hit_ratio<0.8 for 5m",
+// "eviction_rate>100" or "memory_bytes>5e8"
+func parseAlertRules(specs []string) ([]AlertRule, error) {
+	var rules []AlertRule
+	for _, spec := range specs {
+		expr, duration, _ := strings.Cut(spec, " for ")
+		i := strings.IndexAny(expr, "<>")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid alert rule %q, expected e.g. hit_ratio<0.8 for 5m", spec)
+		}
+		rule := AlertRule{Metric: strings.TrimSpace(expr[:i]), Op: expr[i : i+1]}
+		if !alertMetrics[rule.Metric] {
+			return nil, fmt.Errorf("invalid alert rule %q, unknown metric %q", spec, rule.Metric)
+		}
+		var err error
+		if rule.Threshold, err = strconv.ParseFloat(strings.TrimSpace(expr[i+1:]), 64); err != nil {
+			return nil, fmt.Errorf("invalid alert rule %q, bad threshold", spec)
+		}
+		if duration != "" {
+			if rule.For, err = time.ParseDuration(strings.TrimSpace(duration)); err != nil {
+				return nil, fmt.Errorf("invalid alert rule %q, bad duration", spec)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// AlertState is what GET /admin/alerts reports about a rule
+type AlertState struct {
+	Rule           string     `json:"rule"`
+	Value          *float64   `json:"value,omitempty"`
+	Firing         bool       `json:"firing"`
+	BreachingSince *time.Time `json:"breachingSince,omitempty"`
+	LastNotified   *time.Time `json:"lastNotified,omitempty"`
+}
+
+type alertState struct {
+	rule           AlertRule
+	value          *float64
+	firing         bool
+	breachingSince time.Time
+	lastNotified   time.Time
+}
+
+var (
+	alertMutex  sync.Mutex
+	alertStates []*alertState
+	alertClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// startAlerts :: evaluates CACHE_ALERT_RULES every CACHE_ALERT_INTERVAL
+func startAlerts(cfg *Config) {
+	for _, rule := range cfg.AlertRules {
+		alertStates = append(alertStates, &alertState{rule: rule})
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.AlertInterval)
+		defer ticker.Stop()
+
+		last := statsOf(cache)
+		lastAt := time.Now()
+		for range ticker.C {
+			stats := statsOf(cache)
+			values := alertValues(last, stats, time.Since(lastAt))
+			last, lastAt = stats, time.Now()
+			evaluateAlerts(cfg, values)
+		}
+	}()
+}
+
+// alertValues derives the watched values from two Stats taken elapsed apart
+func alertValues(prev, cur CacheStats, elapsed time.Duration) map[string]float64 {
+	values := map[string]float64{
+		"eviction_rate":   float64(cur.Evictions-prev.Evictions) / elapsed.Seconds(),
+		"expiration_rate": float64(cur.Expirations-prev.Expirations) / elapsed.Seconds(),
+		"memory_bytes":    float64(cur.MemoryBytes),
+		"heap_bytes":      float64(cur.HeapBytes),
+		"items":           float64(cur.Items),
+	}
+	// Without lookups there is no hit ratio, and no reason to alert on it
+	hits, misses := cur.Hits-prev.Hits, cur.Misses-prev.Misses
+	if hits+misses > 0 {
+		values["hit_ratio"] = float64(hits) / float64(hits+misses)
+	}
+	return values
+}
+
+func evaluateAlerts(cfg *Config, values map[string]float64) {
+	alertMutex.Lock()
+	defer alertMutex.Unlock()
+
+	now := time.Now()
+	for _, state := range alertStates {
+		value, ok := values[state.rule.Metric]
+		if !ok {
+			state.value = nil
+			continue
+		}
+		state.value = &value
+
+		if !state.rule.breached(value) {
+			state.breachingSince = time.Time{}
+			if state.firing {
+				state.firing = false
+				notifyAlert(cfg, state, "resolved", value)
+			}
+			continue
+		}
+		if state.breachingSince.IsZero() {
+			state.breachingSince = now
+		}
+		if now.Sub(state.breachingSince) < state.rule.For {
+			continue
+		}
+		state.firing = true
+		if now.Sub(state.lastNotified) >= cfg.AlertCooldown {
+			state.lastNotified = now
+			notifyAlert(cfg, state, "firing", value)
+		}
+	}
+}
+
+// notifyAlert logs the change and posts it to the webhook. The body has a
+// "text" field so Slack incoming webhooks can take it as is
+func notifyAlert(cfg *Config, state *alertState, status string, value float64) {
+	text := fmt.Sprintf("[%s] %s on %s: %s is %g", strings.ToUpper(status), state.rule, cfg.Node.ID, state.rule.Metric, value)
+	slog.Warn("alert: "+status, "rule", state.rule.String(), "value", value)
+	if cfg.AlertWebhook == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"text":      text,
+		"status":    status,
+		"rule":      state.rule.String(),
+		"metric":    state.rule.Metric,
+		"value":     value,
+		"threshold": state.rule.Threshold,
+		"node":      cfg.Node.ID,
+	})
+	go func() {
+		resp, err := alertClient.Post(cfg.AlertWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("alert: posting notification", "err", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("alert: posting notification", "status", resp.Status)
+		}
+	}()
+}
+
+// alertsHandler serves GET /admin/alerts, the rules and where they stand
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	alertMutex.Lock()
+	states := make([]AlertState, 0, len(alertStates))
+	for _, state := range alertStates {
+		s := AlertState{Rule: state.rule.String(), Value: state.value, Firing: state.firing}
+		if !state.breachingSince.IsZero() {
+			since := state.breachingSince
+			s.BreachingSince = &since
+		}
+		if !state.lastNotified.IsZero() {
+			notified := state.lastNotified
+			s.LastNotified = &notified
+		}
+		states = append(states, s)
+	}
+	alertMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"alerts": states})
+}
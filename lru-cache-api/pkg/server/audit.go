@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	auditRecent    = 1000 // entries kept in memory for GET /admin/audit
+	auditQueueSize = 10000
+)
+
+// AuditEntry records one mutation and who made it
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal,omitempty"`
+	ClientIP  string    `json:"clientIp"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key,omitempty"`
+	Cache     string    `json:"cache,omitempty"` // the named cache, "" for the default one
+	Status    int       `json:"status"`
+	Node      string    `json:"node"`
+	RequestID string    `json:"requestId,omitempty"`
+	Changes   []string  `json:"changes,omitempty"` // settings changed, as "name=new (was old)"
+}
+
+// auditLog keeps the latest entries in memory and writes every entry to the
+// audit file and webhook, when configured
+type auditLog struct {
+	mutex  sync.Mutex
+	recent []AuditEntry
+	next   int
+	file   *rotatingFile
+	queue  chan AuditEntry
+}
+
+var (
+	audit       = &auditLog{}
+	auditClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// openAudit :: opens the audit file, if any
+func openAudit(cfg *Config) error {
+	if cfg.AuditFile == "" {
+		return nil
+	}
+	file, err := openRotatingFile(cfg.AuditFile, cfg.AuditMaxBytes, cfg.AuditMaxFiles)
+	if err != nil {
+		return err
+	}
+	audit.mutex.Lock()
+	audit.file = file
+	audit.mutex.Unlock()
+	return nil
+}
+
+// closeAudit closes the audit file again, when setting up the server fails
+func closeAudit() {
+	audit.mutex.Lock()
+	if audit.file != nil {
+		audit.file.Close()
+		audit.file = nil
+	}
+	audit.mutex.Unlock()
+}
+
+// startAudit :: starts the webhook shipper
+func startAudit(cfg *Config) {
+	if cfg.AuditWebhook != "" {
+		audit.queue = make(chan AuditEntry, auditQueueSize)
+		go shipAuditEntries(cfg.AuditWebhook, audit.queue)
+	}
+}
+
+func (a *auditLog) record(entry AuditEntry) {
+	line, _ := json.Marshal(entry)
+
+	a.mutex.Lock()
+	if len(a.recent) < auditRecent {
+		a.recent = append(a.recent, entry)
+	} else {
+		a.recent[a.next] = entry
+	}
+	a.next = (a.next + 1) % auditRecent
+	if a.file != nil {
+		if err := a.file.Write(append(line, '\n')); err != nil {
+			slog.Error("audit: writing log file", "err", err)
+		}
+	}
+	a.mutex.Unlock()
+
+	if a.queue != nil {
+		select {
+		case a.queue <- entry:
+		default:
+			slog.Warn("audit: webhook queue full, dropping entry", "key", entry.Key)
+		}
+	}
+}
+
+// entries returns the kept entries, newest first
+func (a *auditLog) entries() []AuditEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	entries := make([]AuditEntry, 0, len(a.recent))
+	for i := 1; i <= len(a.recent); i++ {
+		entries = append(entries, a.recent[(a.next-i+len(a.recent))%len(a.recent)])
+	}
+	return entries
+}
+
+// shipAuditEntries posts entries to the webhook in batches
+func shipAuditEntries(url string, queue <-chan AuditEntry) {
+	for {
+		batch := []AuditEntry{<-queue}
+		timeout := time.After(time.Second)
+	collect:
+		for len(batch) < 100 {
+			select {
+			case entry := <-queue:
+				batch = append(batch, entry)
+			case <-timeout:
+				break collect
+			}
+		}
+
+		body, _ := json.Marshal(map[string]interface{}{"entries": batch})
+		resp, err := auditClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Error("audit: posting entries", "entries", len(batch), "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Error("audit: posting entries", "entries", len(batch), "status", resp.Status)
+		}
+	}
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets WebSocket upgrades through the recorder
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+type auditKey struct{}
+
+// noteAudit adds changes to the audit entry of the request ctx belongs to
+func noteAudit(ctx context.Context, changes ...string) {
+	if entry, ok := ctx.Value(auditKey{}).(*AuditEntry); ok {
+		entry.Changes = append(entry.Changes, changes...)
+	}
+}
+
+// auditMiddleware records every mutation made by a client, including the
+// ones that were refused; replication between servers is not audited
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if requiredScope(r) == ScopeCluster {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := AuditEntry{Time: time.Now(), ClientIP: clientIP(r), Node: config.Node.ID, RequestID: requestID(r.Context())}
+		if p := principalFrom(r.Context()); p != nil {
+			entry.Principal = p.Name
+		}
+		entry.Key, _ = requestKey(r)
+		var path string
+		entry.Cache, path = namedCachePath(r.URL.Path)
+		switch {
+		case r.Method == http.MethodPost && path == "/cache":
+			entry.Op = "set"
+		case r.Method == http.MethodDelete && entry.Key != "":
+			entry.Op = "delete"
+		case r.URL.Path == "/admin/cache/flush":
+			entry.Op = "flush"
+		case r.URL.Path == "/admin/config":
+			entry.Op = "config"
+		default:
+			entry.Op = r.Method + " " + r.URL.Path
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, &entry)))
+		entry.Status = recorder.status
+		audit.record(entry)
+	})
+}
+
+// auditHandler serves GET /admin/audit, newest first, filtered by
+// ?principal=, ?key= and ?op=, at most ?limit= entries (default 100)
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	entries := []AuditEntry{}
+	for _, entry := range audit.entries() {
+		if len(entries) == limit {
+			break
+		}
+		if p := query.Get("principal"); p != "" && p != entry.Principal {
+			continue
+		}
+		if k := query.Get("key"); k != "" && k != entry.Key {
+			continue
+		}
+		if op := query.Get("op"); op != "" && op != entry.Op {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
+
+// clientIP returns the address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rotatingFile is an append only file that is rotated once it reaches
+// maxBytes, keeping maxFiles old copies as name.1 (newest) to name.N
+type rotatingFile struct {
+	name     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openRotatingFile(name string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxBytes: maxBytes, maxFiles: maxFiles}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Write :: appends p, rotating first when it would not fit
+func (f *rotatingFile) Write(p []byte) error {
+	if f.size > 0 && f.size+int64(len(p)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.name, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+	}
+	if f.maxFiles > 0 {
+		if err := os.Rename(f.name, f.name+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.name); err != nil {
+		return err
+	}
+	return f.open()
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// API key scopes
+const (
+	ScopeRead    = "read"
+	ScopeWrite   = "write"
+	ScopeAdmin   = "admin"
+	ScopeCluster = "cluster" // node to node traffic
+	ScopeReveal  = "reveal"  // see sensitive values unredacted
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// accessRoles bundle scopes so keys and tokens can be given a role instead;
+// the admin role is the admin scope
+var accessRoles = map[string][]string{
+	"viewer": {ScopeRead},
+	"editor": {ScopeRead, ScopeWrite},
+}
+
+// APIKey is a credential and the scopes it grants
+type APIKey struct {
+	Name   string   `json:"name"`
+	Key    string   `json:"key"`
+	Scopes []string `json:"scopes"`
+}
+
+// Principal is who a request was authenticated as
+type Principal struct {
+	Name   string   `json:"name"` // API key name or token subject
+	Scopes []string `json:"scopes"`
+	Tenant string   `json:"tenant,omitempty"`
+
+	ExpiresAt time.Time `json:"-"` // when the token runs out, zero for API keys
+}
+
+// HasScope reports whether the principal holds scope, directly or through a
+// role; admin grants everything but cluster traffic
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || (s == ScopeAdmin && scope != ScopeCluster) {
+			return true
+		}
+		for _, granted := range accessRoles[s] {
+			if granted == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// principalFrom returns who made the request, nil when authentication is
+// disabled
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// keyring holds the accepted keys, indexed by their SHA-256 so lookups do
+// not leak timing information about the secrets
+type keyring struct {
+	mutex   sync.RWMutex
+	keys    map[[32]byte]*APIKey
+	modTime time.Time
+}
+
+var apiKeys = &keyring{}
+
+func (k *keyring) enabled() bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return len(k.keys) > 0
+}
+
+func (k *keyring) lookup(secret string) *APIKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return k.keys[sha256.Sum256([]byte(secret))]
+}
+
+func (k *keyring) set(keys []APIKey) {
+	index := make(map[[32]byte]*APIKey, len(keys))
+	for i := range keys {
+		index[sha256.Sum256([]byte(keys[i].Key))] = &keys[i]
+	}
+	k.mutex.Lock()
+	k.keys = index
+	k.mutex.Unlock()
+}
+
+// parseAPIKeys :: parses CACHE_API_KEYS, comma separated name:key:scope|scope entries
+func parseAPIKeys(s string) ([]APIKey, error) {
+	var keys []APIKey
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid API key entry %q, expected name:key:scopes", entry)
+		}
+		keys = append(keys, APIKey{Name: parts[0], Key: parts[1], Scopes: strings.Split(parts[2], "|")})
+	}
+	return keys, nil
+}
+
+// loadAPIKeys :: (re)loads the keys from the environment and the keys file
+func loadAPIKeys(cfg *Config) error {
+	keys := append([]APIKey{}, cfg.APIKeys...)
+	if cfg.ClusterKey != "" {
+		keys = append(keys, APIKey{Name: "cluster", Key: cfg.ClusterKey, Scopes: []string{ScopeCluster, ScopeAdmin}})
+	}
+
+	if cfg.APIKeysFile != "" {
+		info, err := os.Stat(cfg.APIKeysFile)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(cfg.APIKeysFile)
+		if err != nil {
+			return err
+		}
+		var file struct {
+			Keys []APIKey `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("%s: %w", cfg.APIKeysFile, err)
+		}
+		keys = append(keys, file.Keys...)
+
+		apiKeys.mutex.Lock()
+		apiKeys.modTime = info.ModTime()
+		apiKeys.mutex.Unlock()
+	}
+
+	apiKeys.set(keys)
+	return nil
+}
+
+// watchAPIKeysFile reloads the keys file whenever it changes
+func watchAPIKeysFile(cfg *Config) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(cfg.APIKeysFile)
+		if err != nil {
+			slog.Warn("auth: checking keys file", "err", err)
+			continue
+		}
+		apiKeys.mutex.RLock()
+		changed := !info.ModTime().Equal(apiKeys.modTime)
+		apiKeys.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := loadAPIKeys(cfg); err != nil {
+			slog.Error("auth: reloading keys, keeping the previous ones", "err", err)
+			continue
+		}
+		slog.Info("auth: reloaded keys", "path", cfg.APIKeysFile)
+	}
+}
+
+// requiredScope maps a request onto the scope it needs
+func requiredScope(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/admin/"), strings.HasPrefix(path, "/debug/"):
+		return ScopeAdmin
+	case path == "/cluster/keys", strings.HasPrefix(path, "/geo/replicate"), strings.HasPrefix(path, "/raft/"):
+		return ScopeCluster
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// authenticate resolves the bearer token or API key on r. Browsers cannot
+// set headers on WebSocket connections, so /ws also takes them as the
+// bearer.<token> or apikey.<key> subprotocol, or as ?access_token= and
+// ?api_key=, which end up in proxy logs
+func authenticate(r *http.Request) (*Principal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == r.Header.Get("Authorization") {
+		token = ""
+	}
+	secret := r.Header.Get(apiKeyHeader)
+	_, path := namedCachePath(r.URL.Path)
+	if path == "/ws" && token == "" && secret == "" {
+		token, secret = subprotocolCredentials(r)
+	}
+	if path == "/ws" && token == "" && secret == "" {
+		token = r.URL.Query().Get("access_token")
+		secret = r.URL.Query().Get("api_key")
+	}
+
+	if token != "" {
+		if jwtAuth == nil {
+			return nil, errors.New("Bearer tokens are not accepted")
+		}
+		return jwtAuth.verify(token)
+	}
+	key := apiKeys.lookup(secret)
+	if key == nil {
+		return nil, errors.New("Missing or invalid API key")
+	}
+	return &Principal{Name: key.Name, Scopes: key.Scopes}, nil
+}
+
+// subprotocolCredentials finds a token or API key offered as a WebSocket
+// subprotocol. The server never selects those, only wsProtocol
+func subprotocolCredentials(r *http.Request) (token, secret string) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if t, ok := strings.CutPrefix(protocol, "bearer."); ok {
+			token = t
+		} else if s, ok := strings.CutPrefix(protocol, "apikey."); ok {
+			secret = s
+		}
+	}
+	return token, secret
+}
+
+// authMiddleware enforces authentication once API keys or JWT validation
+// are configured
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (!apiKeys.enabled() && jwtAuth == nil) || probePath(r.URL.Path) || signedPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if authThrottled(w, r) {
+			return
+		}
+		principal, err := authenticate(r)
+		if err != nil {
+			authFailed(r)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if scope := requiredScope(r); !principal.HasScope(scope) {
+			loggerFrom(r.Context()).Warn("auth: denied", "principal", principal.Name, "client_ip", clientIP(r), "scope", scope)
+			http.Error(w, fmt.Sprintf("%s lacks the %q scope", principal.Name, scope), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// clusterTransport adds the cluster key to requests sent to other nodes and
+// presents our client certificate under mutual TLS
+type clusterTransport struct{}
+
+func (clusterTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if config.ClusterKey != "" {
+		r = r.Clone(r.Context())
+		r.Header.Set(apiKeyHeader, config.ClusterKey)
+	}
+	return nodeTransport{}.RoundTrip(r)
+}
+
+// clusterHeader returns the headers to dial other nodes' WebSockets with
+func clusterHeader() http.Header {
+	header := http.Header{}
+	if config.ClusterKey != "" {
+		header.Set(apiKeyHeader, config.ClusterKey)
+	}
+	return header
+}
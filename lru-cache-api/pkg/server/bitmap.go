@@ -0,0 +1,270 @@
+package server
+
+import (
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Bitmaps are byte strings addressed by bit, bit 0 being the highest bit of
+// the first byte, for flags such as a user's activity by day at a bit each.
+// They are JSON objects holding the bytes in base64, {"bitmap": "gAE="}
+
+// maxBitOffset keeps a bitmap within 64 MiB, however far a bit is set
+const maxBitOffset = 64<<23 - 1
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"setbit":   {fn: bitmapSetBit},
+		"bitop":    {fn: bitmapOp},
+		"getbit":   {fn: bitmapGetBit, read: true},
+		"bitcount": {fn: bitmapCount, read: true},
+	})
+}
+
+// asBitmap returns the bytes of the bitmap held by a key, nil when it is not
+// cached
+func asBitmap(value interface{}) ([]byte, error) {
+	return asBytes(value, "bitmap")
+}
+
+// argOffset returns args[0] as a bit offset
+func argOffset(args []interface{}) (int, error) {
+	offset, err := argInt(args, 0)
+	if err != nil || offset < 0 || offset > maxBitOffset {
+		return 0, argError("offset must be from 0 to %d", maxBitOffset)
+	}
+	return offset, nil
+}
+
+// bitmapSetBit :: SetBit: sets bit args[0] to args[1], 0 or 1, growing the
+// bitmap as needed, and replies with what it was
+func bitmapSetBit(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	bitmap, err := asBitmap(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset, err := argOffset(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	bit, err := argInt(args, 1)
+	if err != nil || (bit != 0 && bit != 1) {
+		return nil, nil, argError("bit must be 0 or 1")
+	}
+	i, mask := offset/8, byte(0x80>>(offset%8))
+	previous := 0
+	if i < len(bitmap) && bitmap[i]&mask != 0 {
+		previous = 1
+	}
+	if i < len(bitmap) && previous == bit {
+		return previous, noChange, nil
+	}
+	set := make([]byte, max(len(bitmap), i+1))
+	copy(set, bitmap)
+	if bit == 1 {
+		set[i] |= mask
+	} else {
+		set[i] &^= mask
+	}
+	return previous, bytesValue(set, "bitmap"), nil
+}
+
+// bitmapGetBit :: GetBit: bit args[0], 0 past the end
+func bitmapGetBit(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	bitmap, err := asBitmap(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	offset, err := argOffset(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if i := offset / 8; i < len(bitmap) && bitmap[i]&(0x80>>(offset%8)) != 0 {
+		return 1, value, nil
+	}
+	return 0, value, nil
+}
+
+// bitmapCount :: BitCount: how many bits are set in bytes args[0] to
+// args[1], both included; negative indexes count from the end, -1 being the
+// last byte
+func bitmapCount(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	bitmap, err := asBitmap(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	start, err := argInt(args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if start < 0 {
+		start = max(len(bitmap)+start, 0)
+	}
+	if stop < 0 {
+		stop = len(bitmap) + stop
+	}
+	stop = min(stop, len(bitmap)-1)
+	count := 0
+	for i := start; i <= stop; i++ {
+		count += bits.OnesCount8(bitmap[i])
+	}
+	return count, value, nil
+}
+
+// bitmapOp :: BitOp: replaces the key with args[0], and, or, xor or not, of
+// the bitmaps in the other args, base64 as stored or nil for none. Shorter
+// bitmaps count as padded with zeros; not takes one. It replies with the
+// length in bytes, and an empty result deletes the key
+func bitmapOp(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	if len(args) < 2 {
+		return nil, nil, argError("no keys given")
+	}
+	op, _ := args[0].(string)
+	sources := make([][]byte, len(args)-1)
+	length := 0
+	for i, arg := range args[1:] {
+		if arg != nil {
+			bitmap, err := asBitmap(map[string]interface{}{"bitmap": arg})
+			if err != nil {
+				return nil, nil, argError("not a bitmap")
+			}
+			sources[i] = bitmap
+		}
+		length = max(length, len(sources[i]))
+	}
+	if op == "not" && len(sources) != 1 {
+		return nil, nil, argError("not takes one key")
+	}
+
+	result := make([]byte, length)
+	copy(result, sources[0])
+	for _, source := range sources[1:] {
+		for i := range result {
+			var b byte
+			if i < len(source) {
+				b = source[i]
+			}
+			switch op {
+			case "and":
+				result[i] &= b
+			case "or":
+				result[i] |= b
+			case "xor":
+				result[i] ^= b
+			}
+		}
+	}
+	if op == "not" {
+		for i := range result {
+			result[i] = ^result[i]
+		}
+	}
+	if length == 0 {
+		return 0, nil, nil
+	}
+	return length, bytesValue(result, "bitmap"), nil
+}
+
+// registerBitmapRoutes :: mounts /cache/{key}/bitmap
+func registerBitmapRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/bitmap/count", withConsistency(bitmapCountHandler)).Methods("GET")
+	r.Handle("/cache/{key}/bitmap/op", typeWrite(bitmapOpHandler)).Methods("POST")
+	r.Handle("/cache/{key}/bitmap/{offset:[0-9]+}", withConsistency(bitmapGetBitHandler)).Methods("GET")
+	r.Handle("/cache/{key}/bitmap/{offset:[0-9]+}", typeWrite(bitmapSetBitHandler)).Methods("POST")
+}
+
+// bitmapSetBitHandler serves POST /cache/{key}/bitmap/{offset}: sets the
+// bit to {"value": 0 or 1}
+func bitmapSetBitHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	offset, _ := strconv.Atoi(mux.Vars(r)["offset"])
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	if data.Value == nil {
+		http.Error(w, "value is required", http.StatusBadRequest)
+		return
+	}
+	previous, err := runTypeOp(r, key, typeOp{Name: "setbit", Args: []interface{}{offset, data.Value}}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"offset": offset, "previous": previous})
+}
+
+// bitmapGetBitHandler serves GET /cache/{key}/bitmap/{offset}; a key not
+// cached has every bit 0
+func bitmapGetBitHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	offset, _ := strconv.Atoi(mux.Vars(r)["offset"])
+	bit, err := runTypeOp(r, key, typeOp{Name: "getbit", Args: []interface{}{offset}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"offset": offset, "value": bit})
+}
+
+// bitmapCountHandler serves GET /cache/{key}/bitmap/count?start=0&stop=-1,
+// counting the bits set in the whole bitmap by default
+func bitmapCountHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	start, stop := 0, -1
+	var err error
+	if s := r.URL.Query().Get("start"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "start must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.URL.Query().Get("stop"); s != "" {
+		if stop, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "stop must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	count, err := runTypeOp(r, key, typeOp{Name: "bitcount", Args: []interface{}{start, stop}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"count": count})
+}
+
+// bitmapOpHandler serves POST /cache/{key}/bitmap/op: stores {"op": "and",
+// "keys": [...]} in the key, whatever it held
+func bitmapOpHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	op := strings.ToLower(data.Op)
+	if op != "and" && op != "or" && op != "xor" && op != "not" {
+		http.Error(w, "op must be and, or, xor or not", http.StatusBadRequest)
+		return
+	}
+	sources, ok := sourceArgs(w, r, data.Keys, "bitmap", func(value interface{}) error {
+		_, err := asBitmap(value)
+		return err
+	})
+	if !ok {
+		return
+	}
+	length, err := runTypeOp(r, key, typeOp{Name: "bitop", Args: append([]interface{}{op}, sources...)}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"length": length})
+}
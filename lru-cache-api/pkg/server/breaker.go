@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Calls to remotes the server depends on, the origins of loaders, the
+// stores of writers, the primary a replica follows and the regions writes
+// are shipped to, go through a circuit breaker per remote. After
+// CACHE_BREAKER_FAILURES failures in a row it opens, and calls fail at once
+// with errBreakerOpen rather than each waiting out a timeout. After
+// CACHE_BREAKER_COOLDOWN it is half open: one call goes through as a probe,
+// closing it when it succeeds and opening it again when it fails, while the
+// others keep failing at once
+
+// Breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// errBreakerOpen fails calls to a remote whose breaker is open
+var errBreakerOpen = errors.New("circuit breaker open after repeated failures")
+
+// BreakerStats is a breaker as GET /stats serves it
+type BreakerStats struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"` // in a row
+	Trips    uint64 `json:"trips"`    // times it opened
+	Rejected uint64 `json:"rejected"` // calls failed at once while open
+}
+
+type breaker struct {
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+	trips    uint64
+	rejected uint64
+}
+
+var (
+	breakers      = make(map[string]*breaker)
+	breakersMutex sync.Mutex
+)
+
+// breakerFor returns the breaker of the remote called name, such as
+// "loader users:*"
+func breakerFor(name string) *breaker {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	b, ok := breakers[name]
+	if !ok {
+		b = &breaker{state: BreakerClosed}
+		breakers[name] = b
+	}
+	return b
+}
+
+// do :: calls fn unless the breaker is open. Errors count as failures,
+// except ErrOriginNotFound, which the remote answered, and cancellations by
+// the caller
+func (b *breaker) do(fn func() error) error {
+	if config.BreakerFailures == 0 {
+		return fn()
+	}
+	if !b.allow() {
+		return errBreakerOpen
+	}
+	err := fn()
+	b.record(err == nil || errors.Is(err, ErrOriginNotFound) || errors.Is(err, context.Canceled))
+	return err
+}
+
+// allow reports whether a call may go through, making it the probe of a
+// breaker whose cooldown is over
+func (b *breaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerOpen && clock.Now().Sub(b.openedAt) >= config.BreakerCooldown {
+		b.state = BreakerHalfOpen
+	}
+	switch {
+	case b.state == BreakerClosed:
+		return true
+	case b.state == BreakerHalfOpen && !b.probing:
+		b.probing = true
+		return true
+	}
+	b.rejected++
+	return false
+}
+
+// record counts the outcome of a call that went through
+func (b *breaker) record(ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	wasProbe := b.state == BreakerHalfOpen
+	if wasProbe {
+		b.probing = false
+	}
+	if ok {
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+	b.failures++
+	if wasProbe || (b.state == BreakerClosed && b.failures >= config.BreakerFailures) {
+		b.state, b.openedAt = BreakerOpen, clock.Now()
+		b.trips++
+	}
+}
+
+// breakerStats :: the breakers called so far, nil when there are none
+func breakerStats() map[string]BreakerStats {
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	if len(breakers) == 0 {
+		return nil
+	}
+	stats := make(map[string]BreakerStats, len(breakers))
+	for name, b := range breakers {
+		b.mutex.Lock()
+		state := b.state
+		if state == BreakerOpen && clock.Now().Sub(b.openedAt) >= config.BreakerCooldown {
+			state = BreakerHalfOpen
+		}
+		stats[name] = BreakerStats{State: state, Failures: b.failures, Trips: b.trips, Rejected: b.rejected}
+		b.mutex.Unlock()
+	}
+	return stats
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+)
+
+// flushCache empties the cache and tells WebSocket clients and replicas
+func flushCache(requestID string) int {
+	keys := cache.Flush()
+	keyTags.reset()
+	for _, key := range keys {
+		publish(removal(key, EventFlush, ReasonRequest, requestID))
+	}
+	return len(keys)
+}
+
+// flushHandler serves POST /admin/cache/flush
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	if raftCluster() {
+		if raftNode.State() != raft.Leader {
+			forwardToLeader(w, r)
+			return
+		}
+		if err := applyCommand(raftCommand{Op: opFlush, RequestID: requestID(r.Context())}); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"message": "Cache flushed"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Cache flushed", "removed": flushCache(requestID(r.Context()))})
+}
+
+// resizeHandler serves PUT /admin/cache/capacity; the capacity is per node
+func resizeHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Capacity int `json:"capacity"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if data.Capacity <= 0 {
+		http.Error(w, "capacity must be positive", http.StatusBadRequest)
+		return
+	}
+
+	evicted := cache.Resize(data.Capacity)
+	json.NewEncoder(w).Encode(map[string]interface{}{"capacity": data.Capacity, "evicted": evicted})
+}
+
+// exportHandler serves GET /admin/cache/export, the items least recently
+// used first, in the format POST /admin/cache/import takes
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := sealItems(cache.Snapshot())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, items)
+}
+
+// importHandler serves POST /admin/cache/import, setting every item that
+// has not expired yet
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if raftCluster() && raftNode.State() != raft.Leader {
+		forwardToLeader(w, r)
+		return
+	}
+
+	var items []lru.CacheItem
+	if err := readJSON(r, &items); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := openItems(items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// validate everything first, a bad entry must not leave half an import
+	for _, item := range items {
+		if err := validateKey(item.Key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateValue(item.Value); err != nil {
+			http.Error(w, fmt.Sprintf("key %q: %v", item.Key, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	imported := 0
+	for _, item := range items {
+		if clock.Now().After(item.ExpiresAt) {
+			continue
+		}
+		update := CacheUpdate{Type: EventSet, Reason: ReasonImport, Key: item.Key, Value: item.Value, ExpiresAt: item.ExpiresAt, RequestID: requestID(r.Context())}
+		if raftCluster() {
+			cmd := raftCommand{Op: opSet, Key: item.Key, Value: item.Value, ExpiresAt: item.ExpiresAt, RequestID: update.RequestID, Reason: ReasonImport}
+			if err := applyCommand(cmd); refused(err) {
+				continue
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			if cache.Set(item.Key, item.Value, item.ExpiresAt.Sub(clock.Now())) != nil {
+				continue // refused, too large
+			}
+			keyTags.remove(item.Key)
+			publishInvalidation(item.Key)
+			publish(update)
+		}
+		shipToRegions(update)
+		imported++
+	}
+
+	json.NewEncoder(w).Encode(map[string]int{"received": len(items), "imported": imported})
+}
+
+// primaryWrite routes changes to the whole data set to the node taking
+// writes: replicas pass them to their primary, and in auto mode only the
+// elected primary accepts them. Raft clusters are handled by the handlers
+func primaryWrite(h http.HandlerFunc) http.Handler {
+	switch config.Role {
+	case RoleReplica:
+		return forwardToPrimary(config.PrimaryAddr)
+	case RoleAuto:
+		return primaryOnly(h)
+	}
+	return h
+}
+
+// registerCacheAdminRoutes :: mounts the /admin/cache API
+func registerCacheAdminRoutes(r *mux.Router) {
+	r.Handle("/admin/cache/flush", rejectWhileDraining(primaryWrite(flushHandler))).Methods("POST")
+	r.Handle("/admin/cache/import", rejectWhileDraining(primaryWrite(importHandler))).Methods("POST")
+	r.HandleFunc("/admin/cache/capacity", resizeHandler).Methods("PUT")
+	r.HandleFunc("/admin/cache/export", exportHandler).Methods("GET")
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Channels carry messages applications publish to each other, such as
+// "deploy finished" or "reload your config", over the connections they
+// already hold for cache events, without tying them to a key. Messages go
+// through the broadcast queue and the hub like changes, as updates of type
+// message, but are not numbered, kept in the event history, batched or
+// coalesced: subscribers not connected when one is published never get it.
+// Publishing to a channel needs write access to the key channel:{name} and
+// receiving its messages read access, so ACLs on channel:* cover channels.
+// Messages reach the subscribers of the node they were published to
+
+// EventMessage is the type of the updates carrying channel messages
+const EventMessage = "message"
+
+// channelKey returns the key the ACLs of channel are checked against
+func channelKey(channel string) string {
+	return "channel:" + channel
+}
+
+// channelMessage is a message as subscribers get it
+type channelMessage struct {
+	Type      string      `json:"type"` // message
+	Channel   string      `json:"channel"`
+	Message   interface{} `json:"message"`
+	RequestID string      `json:"requestId,omitempty"` // of the request publishing it
+}
+
+// onWire returns what clients are sent for update
+func onWire(update CacheUpdate) interface{} {
+	if update.Type != EventMessage {
+		return update
+	}
+	return channelMessage{Type: EventMessage, Channel: update.Channel, Message: update.Value, RequestID: update.RequestID}
+}
+
+// validatePatterns returns an error naming the first malformed pattern
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// channelListener is a GET /subscribe/{channel} stream
+type channelListener struct {
+	principal *Principal
+	pattern   string
+	queue     *sendBuffer
+}
+
+// wants reports whether the listener follows the channel of message and
+// may read it
+func (l *channelListener) wants(message CacheUpdate) bool {
+	ok, _ := path.Match(l.pattern, message.Channel)
+	return ok && allowed(l.principal, channelKey(message.Channel), ScopeRead)
+}
+
+// registerChannelRoutes :: mounts /publish/{channel} and /subscribe/{channel}
+func registerChannelRoutes(r *mux.Router) {
+	r.HandleFunc("/publish/{channel}", publishHandler).Methods("POST")
+	r.HandleFunc("/subscribe/{channel}", subscribeHandler).Methods("GET")
+}
+
+// publishHandler serves POST /publish/{channel}: {"message": ...} sends any
+// JSON value to the channel's subscribers, answering 202 once it is queued
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	channel := mux.Vars(r)["channel"]
+	if err := validateKey(channel); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var data struct {
+		Message interface{} `json:"message"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	publish(CacheUpdate{Type: EventMessage, Channel: channel, Value: data.Message, RequestID: requestID(r.Context())})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// subscribeHandler serves GET /subscribe/{channel} as server-sent events,
+// one per message published to the channel, which may be a shell pattern
+// such as jobs.*, until the client goes away. Each event's data is the
+// message as WebSocket clients get it
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	pattern := mux.Vars(r)["channel"]
+	if err := validatePatterns([]string{pattern}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	listener := &channelListener{
+		principal: principalFrom(r.Context()),
+		pattern:   pattern,
+		queue:     newSendBuffer(config.WSBufferSize, config.WSSlowClientPolicy),
+	}
+	if !wsHub.listen(listener) {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer wsHub.unlisten(listener)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher := http.NewResponseController(w)
+	if err := flusher.Flush(); err != nil {
+		return
+	}
+
+	// Comments keep proxies from closing the stream while it is quiet
+	ticker := time.NewTicker(config.WSPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-listener.queue.wake:
+			messages, closed := listener.queue.take()
+			for _, message := range messages {
+				data, err := jsonCodec.Marshal(onWire(message))
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "event: message\ndata: %s\n\n", data)
+			}
+			if closed {
+				flusher.Flush()
+				return
+			}
+		case <-ticker.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := flusher.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of the server binary
+type command struct {
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":    {"serve [--config file] [--setting value ...]", "run the server (the default)", serve},
+		"export":   {"export [--server url] [--out file]", "write the items of a running server as JSON", exportCommand},
+		"import":   {"import [--server url] [file]", "set the items of an export, read from file or stdin, on a running server", importCommand},
+		"snapshot": {"snapshot [--server url] [--out file]", "save a running server's items as a snapshot, to CACHE_SNAPSHOT_PATH by default", snapshotCommand},
+		"restore":  {"restore [--server url] [file]", "load a snapshot, CACHE_SNAPSHOT_PATH by default, into a running server", restoreCommand},
+		"help":     {"help", "show this help", func([]string) error { return flag.ErrHelp }},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, name := range []string{"serve", "export", "import", "snapshot", "restore", "help"} {
+		fmt.Fprintf(os.Stderr, "  %-45s %s\n", commands[name].usage, commands[name].summary)
+	}
+	fmt.Fprint(os.Stderr, `
+Every command takes --config and every setting as a flag: --ws-batch-window 20ms
+sets CACHE_WS_BATCH_WINDOW. Flags override the environment, which overrides the
+config file. Give boolean flags as --name=true. The other commands talk to the
+server at --server, authenticating with --api-key or --token.
+`)
+}
+
+// parseCommandLine :: reads a command's arguments into its own flags, in
+// own, and the settings, returning the config they make up and the
+// arguments left over
+func parseCommandLine(args []string, own map[string]*string) (*Config, []string, error) {
+	path := os.Getenv("CACHE_CONFIG")
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-h" || arg == "-help" || arg == "--help" {
+			return nil, nil, flag.ErrHelp
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			rest = append(rest, arg)
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				i++
+				value = args[i]
+			} else {
+				value = "true"
+			}
+		}
+		if name == "config" {
+			path = value
+		} else if target := own[name]; target != nil {
+			*target = value
+		} else {
+			flagSettings[settingName(name)] = value
+		}
+	}
+
+	cfg, err := loadConfig(path)
+	return cfg, rest, err
+}
+
+// cliClient talks to a running server for the export, import, snapshot and
+// restore commands
+type cliClient struct {
+	server string
+	apiKey string
+	token  string
+}
+
+// parseClientCommandLine reads the arguments of a command talking to a
+// server: the client, the config, the value of --out and the other arguments
+func parseClientCommandLine(args []string) (*cliClient, *Config, string, []string, error) {
+	client := &cliClient{}
+	var out string
+	own := map[string]*string{"server": &client.server, "api-key": &client.apiKey, "token": &client.token, "out": &out}
+	cfg, rest, err := parseCommandLine(args, own)
+	if err != nil {
+		return nil, nil, "", nil, err
+	}
+	if client.server == "" {
+		scheme := "http"
+		if cfg.TLSCert != "" {
+			scheme = "https"
+		}
+		client.server = fmt.Sprintf("%s://localhost:%d", scheme, cfg.Port)
+	}
+	return client, cfg, out, rest, nil
+}
+
+// do sends a request to the server, returning the body of a 2xx response
+func (c *cliClient) do(method, path string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(c.server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set(apiKeyHeader, c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// exportCommand :: writes GET /admin/cache/export to --out or stdout
+func exportCommand(args []string) error {
+	client, _, out, _, err := parseClientCommandLine(args)
+	if err != nil {
+		return err
+	}
+	data, err := client.do(http.MethodGet, "/admin/cache/export", nil)
+	if err != nil {
+		return err
+	}
+	if out == "" || out == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(out, data, 0o600)
+}
+
+// importCommand :: posts an export, from the file argument or stdin, to
+// POST /admin/cache/import
+func importCommand(args []string) error {
+	client, _, _, rest, err := parseClientCommandLine(args)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if len(rest) == 0 || rest[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(rest[0])
+	}
+	if err != nil {
+		return err
+	}
+	return client.importItems(data)
+}
+
+// snapshotCommand :: saves a running server's export as a snapshot file,
+// encrypted with CACHE_SNAPSHOT_KEY when one is set
+func snapshotCommand(args []string) error {
+	client, cfg, out, _, err := parseClientCommandLine(args)
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		out = cfg.SnapshotPath
+	}
+	if out == "" {
+		return errors.New("give the snapshot file with --out or CACHE_SNAPSHOT_PATH")
+	}
+
+	data, err := client.do(http.MethodGet, "/admin/cache/export", nil)
+	if err != nil {
+		return err
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	if err := writeSnapshotFile(out, data, cfg.SnapshotKey); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "saved %d items to %s\n", len(items), out)
+	return nil
+}
+
+// restoreCommand :: loads a snapshot file into a running server
+func restoreCommand(args []string) error {
+	client, cfg, _, rest, err := parseClientCommandLine(args)
+	if err != nil {
+		return err
+	}
+	path := cfg.SnapshotPath
+	if len(rest) > 0 {
+		path = rest[0]
+	}
+	if path == "" {
+		return errors.New("give the snapshot file as an argument or CACHE_SNAPSHOT_PATH")
+	}
+
+	data, err := readSnapshotFile(path, cfg.SnapshotKey)
+	if err != nil {
+		return err
+	}
+	return client.importItems(data)
+}
+
+// importItems posts items to the server and prints how many it set
+func (c *cliClient) importItems(items []byte) error {
+	data, err := c.do(http.MethodPost, "/admin/cache/import", bytes.NewReader(items))
+	if err != nil {
+		return err
+	}
+	var result struct{ Received, Imported int }
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d of %d items\n", result.Imported, result.Received)
+	return nil
+}
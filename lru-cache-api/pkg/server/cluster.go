@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node identifies a cache server taking part in a cluster
+type Node struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// parsePeers :: parses a comma separated list of id=addr pairs
+func parsePeers(s string) ([]Node, error) {
+	var peers []Node
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, addr, ok := strings.Cut(entry, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, expected id=addr", entry)
+		}
+		peers = append(peers, Node{ID: id, Addr: strings.TrimRight(addr, "/")})
+	}
+	return peers, nil
+}
+
+// peerClient is used for requests to other nodes and remote clusters
+var peerClient = &http.Client{Timeout: 10 * time.Second, Transport: clusterTransport{}}
+
+var (
+	// peers holds the configured peers plus the ones added through the admin API
+	peers      []Node
+	peersMutex sync.RWMutex
+)
+
+// clusterNodes returns this node and its configured and discovered peers, ordered by id
+func clusterNodes() []Node {
+	peersMutex.RLock()
+	known := append([]Node{}, peers...)
+	peersMutex.RUnlock()
+
+	nodes := []Node{config.Node}
+	seen := map[string]bool{config.Node.ID: true}
+	for _, peer := range append(known, gossipMembers()...) {
+		if !seen[peer.ID] {
+			seen[peer.ID] = true
+			nodes = append(nodes, peer)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+func clusterNodesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"self":  config.Node.ID,
+		"nodes": clusterNodes(),
+	})
+}
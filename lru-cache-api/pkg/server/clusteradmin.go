@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// draining is set while this node hands its keys over before maintenance
+	draining  atomic.Bool
+	startedAt = time.Now() // set again by newHandler, by its clock
+)
+
+// nodeStatus is what a node reports about itself to the cluster admin API
+type nodeStatus struct {
+	ID       string  `json:"id"`
+	Addr     string  `json:"addr"`
+	Role     string  `json:"role"`
+	Draining bool    `json:"draining"`
+	LagMs    int64   `json:"lagMs"`
+	Items    int     `json:"items"`
+	Uptime   float64 `json:"uptimeSeconds"`
+}
+
+func localStatus() nodeStatus {
+	return nodeStatus{
+		ID:       config.Node.ID,
+		Addr:     config.Node.Addr,
+		Role:     config.Role,
+		Draining: draining.Load(),
+		LagMs:    localLag().Milliseconds(),
+		Items:    cache.Len(),
+		Uptime:   clock.Now().Sub(startedAt).Seconds(),
+	}
+}
+
+func selfStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(localStatus())
+}
+
+// nodeHealth is one node's entry in GET /admin/cluster
+type nodeHealth struct {
+	Node
+	Healthy   bool        `json:"healthy"`
+	LatencyMs int64       `json:"latencyMs"`
+	Status    *nodeStatus `json:"status,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// clusterHealthHandler asks every node for its status
+func clusterHealthHandler(w http.ResponseWriter, r *http.Request) {
+	nodes := clusterNodes()
+	health := make([]nodeHealth, len(nodes))
+
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node Node) {
+			defer wg.Done()
+			h := nodeHealth{Node: node}
+			start := time.Now()
+			if node.ID == config.Node.ID {
+				status := localStatus()
+				h.Status = &status
+			} else {
+				h.Status, h.Error = fetchNodeStatus(node)
+			}
+			h.Healthy = h.Status != nil
+			h.LatencyMs = time.Since(start).Milliseconds()
+			health[i] = h
+		}(i, node)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"nodes": health})
+}
+
+func fetchNodeStatus(node Node) (*nodeStatus, string) {
+	resp, err := statsClient.Get(node.Addr + "/admin/cluster/self")
+	if err != nil {
+		return nil, err.Error()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Sprintf("status returned %s", resp.Status)
+	}
+	var status nodeStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err.Error()
+	}
+	return &status, ""
+}
+
+// addNodeHandler adds a peer to this node's view of the cluster
+func addNodeHandler(w http.ResponseWriter, r *http.Request) {
+	var node Node
+	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if node.ID == "" || node.Addr == "" {
+		http.Error(w, "id and addr are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := url.Parse(node.Addr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	for _, peer := range peers {
+		if peer.ID == node.ID {
+			http.Error(w, "Node already exists", http.StatusConflict)
+			return
+		}
+	}
+	peers = append(peers, node)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Node added successfully"})
+}
+
+// removeNodeHandler removes a peer from this node's view of the cluster
+func removeNodeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	peersMutex.Lock()
+	defer peersMutex.Unlock()
+	for i, peer := range peers {
+		if peer.ID == id {
+			peers = append(peers[:i], peers[i+1:]...)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Node removed successfully"})
+			return
+		}
+	}
+	http.Error(w, "Node not found", http.StatusNotFound)
+}
+
+// drainHandler stops this node accepting writes and hands its keys to the
+// nodes that own them once it is gone; DELETE undoes it
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		draining.Store(false)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Node is accepting writes again"})
+		return
+	}
+
+	if draining.Swap(true) {
+		http.Error(w, "Node is already draining", http.StatusConflict)
+		return
+	}
+	go rebalanceKeys(clusterNodes(), RebalanceCopy)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Draining started, see /admin/cluster/rebalance"})
+}
+
+// drainNodeHandler passes a drain request on to the node it is meant for
+func drainNodeHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if id == config.Node.ID {
+		drainHandler(w, r)
+		return
+	}
+
+	for _, node := range clusterNodes() {
+		if node.ID == id {
+			target, err := url.Parse(node.Addr)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			r.URL.Path = "/admin/cluster/drain"
+			newForwardingProxy(target).ServeHTTP(w, r)
+			return
+		}
+	}
+	http.Error(w, "Node not found", http.StatusNotFound)
+}
+
+// rejectWhileDraining answers writes with 503 once the node is draining
+func rejectWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Node is draining", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registerClusterAdminRoutes :: mounts the /admin/cluster API
+func registerClusterAdminRoutes(r *mux.Router) {
+	r.HandleFunc("/admin/cluster", clusterHealthHandler).Methods("GET")
+	r.HandleFunc("/admin/cluster/self", selfStatusHandler).Methods("GET")
+	r.HandleFunc("/admin/cluster/rebalance", rebalanceStatusHandler).Methods("GET")
+	r.HandleFunc("/admin/cluster/nodes", addNodeHandler).Methods("POST")
+	r.HandleFunc("/admin/cluster/nodes/{id}", removeNodeHandler).Methods("DELETE")
+	r.HandleFunc("/admin/cluster/nodes/{id}/drain", drainNodeHandler).Methods("POST", "DELETE")
+	r.HandleFunc("/admin/cluster/drain", drainHandler).Methods("POST", "DELETE")
+	r.HandleFunc("/admin/audit", auditHandler).Methods("GET")
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+)
+
+// Concurrent proxy GETs of the same key that miss the cache go upstream
+// once: the first one is passed on and the others wait for its response,
+// which they are sent a copy of with X-Cache: COALESCED. Unlike the fills
+// of the read-through cache, which share the value loaded, this shares the
+// whole HTTP response, and also those the proxy does not store, such as
+// errors. The response is only shared when it could be stored for anyone
+// and fits in CACHE_PROXY_MAX_BODY_BYTES; otherwise, or when the first
+// response is cut short, the others go upstream themselves
+
+// proxyFlight is a proxy GET on its way upstream
+type proxyFlight struct {
+	done chan struct{}
+	resp *proxyResponse // set before done is closed when it can be shared
+}
+
+var (
+	proxyFlightsMutex sync.Mutex
+	proxyFlights      = map[string]*proxyFlight{}
+)
+
+// coalesceProxy serves r through next, or through the response to the
+// request for key already in flight
+func coalesceProxy(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	proxyFlightsMutex.Lock()
+	flight, waiting := proxyFlights[key]
+	if !waiting {
+		flight = &proxyFlight{done: make(chan struct{})}
+		proxyFlights[key] = flight
+	}
+	proxyFlightsMutex.Unlock()
+
+	if waiting {
+		select {
+		case <-flight.done:
+		case <-r.Context().Done():
+			return
+		}
+		if flight.resp != nil {
+			writeProxyResponse(w, *flight.resp, "COALESCED")
+			return
+		}
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	recorder := &responseCopier{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		// Also when the proxy panics to abort a response cut short
+		proxyFlightsMutex.Lock()
+		delete(proxyFlights, key)
+		proxyFlightsMutex.Unlock()
+		close(flight.done)
+	}()
+	next.ServeHTTP(recorder, r)
+	if !recorder.overflow && shareable(w.Header()) {
+		header := w.Header().Clone()
+		header.Del("X-Cache")
+		flight.resp = &proxyResponse{status: recorder.status, header: header, body: recorder.body.Bytes()}
+	}
+}
+
+// responseCopier keeps a copy of the response it writes, up to
+// CACHE_PROXY_MAX_BODY_BYTES of body
+type responseCopier struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool // the body was longer than the copy
+}
+
+func (c *responseCopier) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCopier) Write(p []byte) (int, error) {
+	if !c.overflow {
+		if int64(c.body.Len()+len(p)) > config.ProxyMaxBodyBytes {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(p)
+		}
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (c *responseCopier) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
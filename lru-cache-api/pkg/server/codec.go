@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Codec encodes and decodes the JSON of the data path: the bodies of gets,
+// sets and the type endpoints, item listings, imports and WebSocket events.
+// The standard library's is used unless Options.Codec gives a faster one
+// behaving the same, such as jsoniter.ConfigCompatibleWithStandardLibrary or
+// sonic.ConfigStd. Unmarshal must not keep data, whose buffer is reused
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// stdCodec is encoding/json
+type stdCodec struct{}
+
+func (stdCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (stdCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// jsonCodec is the Codec in use, set before serving
+var jsonCodec Codec = stdCodec{}
+
+// buffers hold request bodies while they are decoded and messages while
+// they are encoded and written, so a busy server does not make garbage of a
+// buffer per request, update and client
+var buffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// maxPooledBuffer is the largest buffer put back in buffers; a rare huge
+// body should not keep its memory
+const maxPooledBuffer = 64 << 10
+
+func getBuffer() *bytes.Buffer {
+	return buffers.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		buf.Reset()
+		buffers.Put(buf)
+	}
+}
+
+// readJSON decodes the request body into v with the codec
+func readJSON(r *http.Request, v interface{}) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := buf.ReadFrom(r.Body); err != nil {
+		return err
+	}
+	return jsonCodec.Unmarshal(buf.Bytes(), v)
+}
+
+// writeJSON answers with v encoded by the codec, ending in a newline as
+// json.Encoder's output does
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	data, err := jsonCodec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,560 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// Config holds the server settings
+type Config struct {
+	Node  Node
+	Peers []Node
+
+	Port           int
+	Capacity       int
+	EvictionPolicy string
+	EvictionBatch  float64
+	CompressMin    int64
+	Quotas         map[string]lru.Quota
+	DefaultTTL     time.Duration
+
+	JanitorInterval time.Duration
+	ExpiryStrategy  string
+	MemoryLimit     int64
+
+	Caches []NamedCacheConfig
+
+	// The subsystems that can be switched off, for hardened deployments
+	ReadOnly        bool
+	WSEnabled       bool
+	MetricsEnabled  bool
+	SnapshotEnabled bool
+
+	LogLevel  string
+	LogFormat string
+
+	APIKeys     []APIKey
+	APIKeysFile string
+	ClusterKey  string
+	ACLFile     string
+
+	AllowedOrigins []string
+
+	MetricsNamespaces    bool
+	MetricsMaxNamespaces int
+	MetricsMaxTenants    int
+
+	OTLPEndpoint     string
+	ServiceName      string
+	TraceSampleRatio float64
+
+	MaxBodyBytes int64
+	MaxKeyLength int
+	MaxItemBytes int64
+	MaxURLLength int
+
+	MaxClusterBodyBytes int64
+
+	AuditFile     string
+	AuditMaxBytes int64
+	AuditMaxFiles int
+	AuditWebhook  string
+
+	SlowlogThreshold time.Duration
+	SlowlogMaxLen    int
+
+	HotKeysWindow time.Duration
+	HotKeysTop    int
+
+	EventHistory int
+
+	WSPingInterval time.Duration
+	WSPongTimeout  time.Duration
+	WSWriteTimeout time.Duration
+
+	WSBufferSize       int
+	WSSlowClientPolicy string
+	WSBatchWindow      time.Duration
+
+	WSCompression        bool
+	WSCompressionMinSize int
+
+	BroadcastBuffer   int
+	BroadcastOverflow string
+
+	InvalidationRules []InvalidationRule
+
+	InvalidationSecret string
+
+	AlertRules    []AlertRule
+	AlertInterval time.Duration
+	AlertCooldown time.Duration
+	AlertWebhook  string
+
+	ReadRateLimit  RateLimit
+	WriteRateLimit RateLimit
+
+	AuthFailureLimit RateLimit
+
+	TLSCert       string
+	TLSKey        string
+	TLSClientCA   string
+	TLSClientAuth string
+
+	JWTSecret      string
+	JWTJWKSURL     string
+	JWTJWKSRefresh time.Duration
+	JWTIssuer      string
+	JWTAudience    string
+	JWTRolesClaim  string
+	JWTTenantClaim string
+	JWTRoleScopes  map[string][]string
+
+	Role         string
+	PrimaryAddr  string
+	MaxStaleness time.Duration
+
+	GossipAddr  string
+	GossipSeeds []string
+
+	OriginURL string
+	OriginTTL time.Duration
+	Loaders   []Loader
+	Writers   []Writer
+
+	WriteBehindQueue      int
+	WriteBehindWorkers    int
+	WriteBehindRetries    int
+	WriteBehindDeadLetter string
+
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+
+	BreakerFailures int
+	BreakerCooldown time.Duration
+
+	ScriptTimeout time.Duration
+	ScriptsDir    string
+
+	ScriptMaxMemory int64
+
+	RebalanceMode string
+
+	GeoRegion  string
+	GeoRemotes []string
+
+	RaftAddr      string
+	RaftDir       string
+	RaftBootstrap bool
+	RaftJoin      string
+
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+	SnapshotKey      []byte
+
+	WarmupSource  string
+	WarmupTimeout time.Duration
+
+	ProxyUpstream     string
+	ProxyPort         int
+	ProxyDefaultTTL   time.Duration
+	ProxyMaxBodyBytes int64
+
+	SensitiveKeys []string
+	FieldKey      []byte
+}
+
+// loadConfig :: reads the server settings from the command line flags, the
+// environment and the config file at path, if any, in that order
+func loadConfig(path string) (*Config, error) {
+	if path != "" {
+		if err := loadConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	port := envInt("CACHE_PORT", 8080)
+	cfg := &Config{
+		Node: Node{
+			ID:   envString("CACHE_NODE_ID", hostname),
+			Addr: envString("CACHE_NODE_ADDR", fmt.Sprintf("http://localhost:%d", port)),
+		},
+		Port:                 port,
+		Capacity:             envInt("CACHE_CAPACITY", 100),
+		EvictionPolicy:       envString("CACHE_EVICTION_POLICY", lru.EvictLRU),
+		EvictionBatch:        envFloat("CACHE_EVICTION_BATCH", 0),
+		CompressMin:          int64(envInt("CACHE_COMPRESS_MIN_BYTES", 0)),
+		DefaultTTL:           envDuration("CACHE_DEFAULT_TTL", 0),
+		JanitorInterval:      envDuration("CACHE_JANITOR_INTERVAL", 5*time.Second),
+		ExpiryStrategy:       envString("CACHE_EXPIRY_STRATEGY", ExpiryScan),
+		MemoryLimit:          int64(envInt("CACHE_MEMORY_LIMIT", 0)),
+		StaleWhileRevalidate: envDuration("CACHE_STALE_WHILE_REVALIDATE", 0),
+		StaleIfError:         envDuration("CACHE_STALE_IF_ERROR", 0),
+		BreakerFailures:      envInt("CACHE_BREAKER_FAILURES", 5),
+		BreakerCooldown:      envDuration("CACHE_BREAKER_COOLDOWN", 30*time.Second),
+		ScriptTimeout:        envDuration("CACHE_SCRIPT_TIMEOUT", 100*time.Millisecond),
+		ScriptsDir:           envString("CACHE_SCRIPTS_DIR", ""),
+		ScriptMaxMemory:      int64(envInt("CACHE_SCRIPT_MAX_MEMORY", 64<<20)),
+		ReadOnly:             envBool("CACHE_READ_ONLY", false),
+		WSEnabled:            envBool("CACHE_WS_ENABLED", true),
+		MetricsEnabled:       envBool("CACHE_METRICS_ENABLED", true),
+		SnapshotEnabled:      envBool("CACHE_SNAPSHOT_ENABLED", true),
+		LogLevel:             envString("CACHE_LOG_LEVEL", "info"),
+		LogFormat:            envString("CACHE_LOG_FORMAT", "text"),
+		APIKeysFile:          envString("CACHE_API_KEYS_FILE", ""),
+		ClusterKey:           envString("CACHE_CLUSTER_KEY", ""),
+		InvalidationSecret:   envString("CACHE_INVALIDATION_SECRET", ""),
+		ACLFile:              envString("CACHE_ACL_FILE", ""),
+		MetricsNamespaces:    envBool("CACHE_METRICS_NAMESPACES", false),
+		MetricsMaxNamespaces: envInt("CACHE_METRICS_MAX_NAMESPACES", 50),
+		MetricsMaxTenants:    envInt("CACHE_METRICS_MAX_TENANTS", 50),
+		OTLPEndpoint:         envString("CACHE_OTLP_ENDPOINT", ""),
+		ServiceName:          envString("CACHE_SERVICE_NAME", "lru-cache-api"),
+		TraceSampleRatio:     envFloat("CACHE_TRACE_SAMPLE_RATIO", 1),
+		AuditFile:            envString("CACHE_AUDIT_FILE", ""),
+		AuditMaxBytes:        int64(envInt("CACHE_AUDIT_MAX_BYTES", 100<<20)),
+		AuditMaxFiles:        envInt("CACHE_AUDIT_MAX_FILES", 5),
+		AuditWebhook:         envString("CACHE_AUDIT_WEBHOOK", ""),
+		SlowlogThreshold:     envDuration("CACHE_SLOWLOG_THRESHOLD", 10*time.Millisecond),
+		SlowlogMaxLen:        envInt("CACHE_SLOWLOG_MAX_LEN", 128),
+		HotKeysWindow:        envDuration("CACHE_HOTKEYS_WINDOW", time.Minute),
+		HotKeysTop:           envInt("CACHE_HOTKEYS_TOP", 10),
+		EventHistory:         envInt("CACHE_EVENT_HISTORY", 1000),
+		WSPingInterval:       envDuration("CACHE_WS_PING_INTERVAL", 30*time.Second),
+		WSPongTimeout:        envDuration("CACHE_WS_PONG_TIMEOUT", time.Minute),
+		WSWriteTimeout:       envDuration("CACHE_WS_WRITE_TIMEOUT", 10*time.Second),
+		WSBufferSize:         envInt("CACHE_WS_BUFFER_SIZE", 256),
+		WSSlowClientPolicy:   envString("CACHE_WS_SLOW_CLIENT_POLICY", SlowClientDisconnect),
+		WSBatchWindow:        envDuration("CACHE_WS_BATCH_WINDOW", 0),
+		WSCompression:        envBool("CACHE_WS_COMPRESSION", true),
+		WSCompressionMinSize: envInt("CACHE_WS_COMPRESSION_MIN_SIZE", 1024),
+		BroadcastBuffer:      envInt("CACHE_BROADCAST_BUFFER", 1024),
+		BroadcastOverflow:    envString("CACHE_BROADCAST_OVERFLOW", BroadcastDrop),
+		AlertInterval:        envDuration("CACHE_ALERT_INTERVAL", 30*time.Second),
+		AlertCooldown:        envDuration("CACHE_ALERT_COOLDOWN", 15*time.Minute),
+		AlertWebhook:         envString("CACHE_ALERT_WEBHOOK", ""),
+		MaxBodyBytes:         int64(envInt("CACHE_MAX_BODY_BYTES", 1<<20)),
+		MaxKeyLength:         envInt("CACHE_MAX_KEY_LENGTH", 1024),
+		MaxItemBytes:         int64(envInt("CACHE_MAX_ITEM_BYTES", 0)),
+		MaxURLLength:         envInt("CACHE_MAX_URL_LENGTH", 8192),
+		MaxClusterBodyBytes:  int64(envInt("CACHE_MAX_CLUSTER_BODY_BYTES", 1<<30)),
+		TLSCert:              envString("CACHE_TLS_CERT", ""),
+		TLSKey:               envString("CACHE_TLS_KEY", ""),
+		TLSClientCA:          envString("CACHE_TLS_CLIENT_CA", ""),
+		TLSClientAuth:        envString("CACHE_TLS_CLIENT_AUTH", ClientAuthRequire),
+		JWTSecret:            envString("CACHE_JWT_SECRET", ""),
+		JWTJWKSURL:           envString("CACHE_JWT_JWKS_URL", ""),
+		JWTJWKSRefresh:       envDuration("CACHE_JWT_JWKS_REFRESH", time.Hour),
+		JWTIssuer:            envString("CACHE_JWT_ISSUER", ""),
+		JWTAudience:          envString("CACHE_JWT_AUDIENCE", ""),
+		JWTRolesClaim:        envString("CACHE_JWT_ROLES_CLAIM", "roles"),
+		JWTTenantClaim:       envString("CACHE_JWT_TENANT_CLAIM", "tenant"),
+		Role:                 envString("CACHE_ROLE", RoleStandalone),
+		PrimaryAddr:          strings.TrimRight(envString("CACHE_PRIMARY_ADDR", ""), "/"),
+		MaxStaleness:         envDuration("CACHE_MAX_STALENESS", 5*time.Second),
+		GossipAddr:           envString("CACHE_GOSSIP_ADDR", ""),
+		GossipSeeds:          envList("CACHE_GOSSIP_SEEDS"),
+		OriginURL:            envString("CACHE_ORIGIN_URL", ""),
+		OriginTTL:            envDuration("CACHE_ORIGIN_TTL", 5*time.Minute),
+		RebalanceMode:        envString("CACHE_REBALANCE", RebalanceOff),
+		GeoRegion:            envString("CACHE_GEO_REGION", ""),
+		GeoRemotes:           envList("CACHE_GEO_REMOTES"),
+		RaftAddr:             envString("CACHE_RAFT_ADDR", ""),
+		RaftDir:              envString("CACHE_RAFT_DIR", "raft-data"),
+		RaftBootstrap:        envBool("CACHE_RAFT_BOOTSTRAP", false),
+		RaftJoin:             strings.TrimRight(envString("CACHE_RAFT_JOIN", ""), "/"),
+		SnapshotPath:         envString("CACHE_SNAPSHOT_PATH", ""),
+		SnapshotInterval:     envDuration("CACHE_SNAPSHOT_INTERVAL", time.Minute),
+		WarmupSource:         envString("CACHE_WARMUP_SOURCE", ""),
+		WarmupTimeout:        envDuration("CACHE_WARMUP_TIMEOUT", 5*time.Minute),
+		ProxyUpstream:        strings.TrimRight(envString("CACHE_PROXY_UPSTREAM", ""), "/"),
+		ProxyPort:            envInt("CACHE_PROXY_PORT", 8081),
+		ProxyDefaultTTL:      envDuration("CACHE_PROXY_DEFAULT_TTL", 0),
+		ProxyMaxBodyBytes:    int64(envInt("CACHE_PROXY_MAX_BODY_BYTES", 1<<20)),
+	}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("CACHE_PORT %d is not a port", cfg.Port)
+	}
+	if cfg.Capacity < 1 {
+		return nil, errors.New("CACHE_CAPACITY must be at least 1")
+	}
+	if cfg.EvictionPolicy != lru.EvictLRU {
+		return nil, fmt.Errorf("unknown CACHE_EVICTION_POLICY %q, only lru is supported", cfg.EvictionPolicy)
+	}
+	if cfg.EvictionBatch < 0 || cfg.EvictionBatch >= 1 {
+		return nil, errors.New("CACHE_EVICTION_BATCH must be at least 0 and below 1")
+	}
+	if cfg.CompressMin < 0 {
+		return nil, errors.New("CACHE_COMPRESS_MIN_BYTES must not be negative")
+	}
+	if cfg.DefaultTTL < 0 {
+		return nil, errors.New("CACHE_DEFAULT_TTL must not be negative")
+	}
+	if cfg.MaxItemBytes < 0 {
+		return nil, errors.New("CACHE_MAX_ITEM_BYTES must not be negative")
+	}
+	if cfg.JanitorInterval < time.Millisecond {
+		return nil, errors.New("CACHE_JANITOR_INTERVAL must be at least 1ms")
+	}
+	if cfg.ExpiryStrategy != ExpiryScan && cfg.ExpiryStrategy != ExpirySampled {
+		return nil, fmt.Errorf("unknown CACHE_EXPIRY_STRATEGY %q, expected scan or sampled", cfg.ExpiryStrategy)
+	}
+	if cfg.MemoryLimit < 0 {
+		return nil, errors.New("CACHE_MEMORY_LIMIT must not be negative")
+	}
+	if cfg.StaleWhileRevalidate < 0 || cfg.StaleIfError < 0 {
+		return nil, errors.New("CACHE_STALE_WHILE_REVALIDATE and CACHE_STALE_IF_ERROR must not be negative")
+	}
+	if cfg.BreakerFailures < 0 || cfg.BreakerCooldown <= 0 {
+		return nil, errors.New("CACHE_BREAKER_FAILURES must not be negative and CACHE_BREAKER_COOLDOWN must be positive")
+	}
+	if cfg.ScriptTimeout <= 0 {
+		return nil, errors.New("CACHE_SCRIPT_TIMEOUT must be positive")
+	}
+	if cfg.ScriptMaxMemory <= 0 {
+		return nil, errors.New("CACHE_SCRIPT_MAX_MEMORY must be positive")
+	}
+	if cfg.MaxClusterBodyBytes < cfg.MaxBodyBytes {
+		return nil, errors.New("CACHE_MAX_CLUSTER_BODY_BYTES must be at least CACHE_MAX_BODY_BYTES")
+	}
+
+	switch cfg.Role {
+	case RoleStandalone, RolePrimary:
+	case RoleReplica:
+		if cfg.PrimaryAddr == "" {
+			return nil, errors.New("CACHE_PRIMARY_ADDR is required for replicas")
+		}
+		if u, err := url.Parse(cfg.PrimaryAddr); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("CACHE_PRIMARY_ADDR %q is not an http(s) URL", cfg.PrimaryAddr)
+		}
+	case RoleAuto:
+		if cfg.RaftAddr == "" {
+			return nil, errors.New("CACHE_RAFT_ADDR is required to elect a primary")
+		}
+	default:
+		return nil, fmt.Errorf("unknown CACHE_ROLE %q", cfg.Role)
+	}
+
+	if cfg.RaftAddr != "" && cfg.Role == RoleReplica {
+		return nil, errors.New("raft cluster mode cannot be combined with CACHE_ROLE=replica")
+	}
+	if cfg.WarmupSource != "" && (cfg.Role == RoleReplica || cfg.RaftAddr != "") {
+		return nil, errors.New("CACHE_WARMUP_SOURCE cannot be used by replicas or raft nodes, which get their items from the cluster")
+	}
+
+	if cfg.ProxyUpstream != "" {
+		if u, err := url.Parse(cfg.ProxyUpstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("CACHE_PROXY_UPSTREAM %q is not an http(s) URL", cfg.ProxyUpstream)
+		}
+		if cfg.ProxyPort < 1 || cfg.ProxyPort > 65535 || cfg.ProxyPort == cfg.Port {
+			return nil, fmt.Errorf("CACHE_PROXY_PORT %d is not a port other than CACHE_PORT", cfg.ProxyPort)
+		}
+		if cfg.ProxyDefaultTTL < 0 {
+			return nil, errors.New("CACHE_PROXY_DEFAULT_TTL must not be negative")
+		}
+		if cfg.ProxyMaxBodyBytes < 1 {
+			return nil, errors.New("CACHE_PROXY_MAX_BODY_BYTES must be at least 1")
+		}
+	}
+
+	if cfg.AllowedOrigins = envList("CACHE_ALLOWED_ORIGINS"); cfg.AllowedOrigins == nil {
+		cfg.AllowedOrigins = []string{"http://localhost:3000"}
+	}
+
+	if cfg.WSPingInterval <= 0 || cfg.WSPongTimeout <= cfg.WSPingInterval {
+		return nil, errors.New("CACHE_WS_PONG_TIMEOUT must be longer than CACHE_WS_PING_INTERVAL")
+	}
+	if cfg.WSBufferSize < 1 {
+		return nil, errors.New("CACHE_WS_BUFFER_SIZE must be at least 1")
+	}
+	switch cfg.WSSlowClientPolicy {
+	case SlowClientDisconnect, SlowClientDropOldest, SlowClientCoalesce:
+	default:
+		return nil, fmt.Errorf("unknown CACHE_WS_SLOW_CLIENT_POLICY %q", cfg.WSSlowClientPolicy)
+	}
+	if cfg.WSCompressionMinSize < 0 {
+		return nil, errors.New("CACHE_WS_COMPRESSION_MIN_SIZE must not be negative")
+	}
+	if cfg.BroadcastBuffer < 1 {
+		return nil, errors.New("CACHE_BROADCAST_BUFFER must be at least 1")
+	}
+	if cfg.BroadcastOverflow != BroadcastDrop && cfg.BroadcastOverflow != BroadcastBlock {
+		return nil, fmt.Errorf("unknown CACHE_BROADCAST_OVERFLOW %q, expected drop or block", cfg.BroadcastOverflow)
+	}
+
+	if err := validateTLSConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	switch cfg.RebalanceMode {
+	case RebalanceOff, RebalanceCopy, RebalanceMove:
+	default:
+		return nil, fmt.Errorf("unknown CACHE_REBALANCE %q", cfg.RebalanceMode)
+	}
+
+	if len(cfg.GeoRemotes) > 0 && cfg.GeoRegion == "" {
+		return nil, errors.New("CACHE_GEO_REGION is required to ship to CACHE_GEO_REMOTES")
+	}
+	for i, remote := range cfg.GeoRemotes {
+		cfg.GeoRemotes[i] = strings.TrimRight(remote, "/")
+	}
+
+	apiKeys, err := parseAPIKeys(envString("CACHE_API_KEYS", ""))
+	if err != nil {
+		return nil, err
+	}
+	cfg.APIKeys = apiKeys
+
+	if cfg.ReadRateLimit, err = parseRateLimit(envString("CACHE_RATE_LIMIT_READ", "")); err != nil {
+		return nil, err
+	}
+	if cfg.WriteRateLimit, err = parseRateLimit(envString("CACHE_RATE_LIMIT_WRITE", "")); err != nil {
+		return nil, err
+	}
+	if limit := envString("CACHE_RATE_LIMIT_AUTH_FAILURES", "10/m"); limit != "off" {
+		if cfg.AuthFailureLimit, err = parseRateLimit(limit); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Caches, err = parseNamedCaches(envList("CACHE_CACHES")); err != nil {
+		return nil, err
+	}
+
+	if cfg.Quotas, err = parseNamespaceQuotas(envList("CACHE_NAMESPACE_QUOTAS")); err != nil {
+		return nil, err
+	}
+
+	if cfg.Loaders, err = parseLoaders(envList("CACHE_LOADERS")); err != nil {
+		return nil, err
+	}
+	if cfg.Writers, err = parseWriters(envList("CACHE_WRITE_THROUGH")); err != nil {
+		return nil, err
+	}
+	cfg.WriteBehindQueue = envInt("CACHE_WRITE_BEHIND_QUEUE", 10000)
+	cfg.WriteBehindWorkers = envInt("CACHE_WRITE_BEHIND_WORKERS", 4)
+	cfg.WriteBehindRetries = envInt("CACHE_WRITE_BEHIND_RETRIES", 5)
+	cfg.WriteBehindDeadLetter = envString("CACHE_WRITE_BEHIND_DEAD_LETTER", "")
+	if cfg.WriteBehindQueue < 1 || cfg.WriteBehindWorkers < 1 || cfg.WriteBehindRetries < 0 {
+		return nil, errors.New("CACHE_WRITE_BEHIND_QUEUE and CACHE_WRITE_BEHIND_WORKERS must be positive, CACHE_WRITE_BEHIND_RETRIES not negative")
+	}
+
+	if cfg.InvalidationRules, err = parseInvalidationRules(envList("CACHE_INVALIDATION_RULES")); err != nil {
+		return nil, err
+	}
+
+	if cfg.AlertRules, err = parseAlertRules(envList("CACHE_ALERT_RULES")); err != nil {
+		return nil, err
+	}
+	if len(cfg.AlertRules) > 0 && cfg.AlertInterval <= 0 {
+		return nil, errors.New("CACHE_ALERT_INTERVAL must be positive")
+	}
+
+	roleScopes, err := parseRoleScopes(envString("CACHE_JWT_ROLES", ""))
+	if err != nil {
+		return nil, err
+	}
+	cfg.JWTRoleScopes = roleScopes
+
+	peers, err := parsePeers(envString("CACHE_PEERS", ""))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Peers = peers
+
+	key, err := loadSnapshotKey()
+	if err != nil {
+		return nil, err
+	}
+	cfg.SnapshotKey = key
+
+	cfg.SensitiveKeys = envList("CACHE_SENSITIVE_KEYS")
+	cfg.FieldKey = cfg.SnapshotKey
+	if encoded := envString("CACHE_FIELD_KEY", ""); encoded != "" {
+		if cfg.FieldKey, err = parseAESKey("CACHE_FIELD_KEY", encoded); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.SensitiveKeys) > 0 && cfg.FieldKey == nil {
+		return nil, errors.New("CACHE_SENSITIVE_KEYS needs CACHE_FIELD_KEY or CACHE_SNAPSHOT_KEY to seal values with")
+	}
+
+	if len(settingErrors) > 0 {
+		return nil, errors.Join(settingErrors...)
+	}
+	if err := unknownSettings(path); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func envString(name, def string) string {
+	if v, ok := setting(name); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envList(name string) []string {
+	var list []string
+	v, _ := setting(name)
+	for _, v := range strings.Split(v, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func envBool(name string, def bool) bool {
+	if v, ok := setting(name); ok && v != "" {
+		b, err := strconv.ParseBool(v)
+		if err == nil {
+			return b
+		}
+		badSetting(name, v, "true or false")
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v, ok := setting(name); ok && v != "" {
+		i, err := strconv.Atoi(v)
+		if err == nil {
+			return i
+		}
+		badSetting(name, v, "a whole number")
+	}
+	return def
+}
+
+func envFloat(name string, def float64) float64 {
+	if v, ok := setting(name); ok && v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err == nil {
+			return f
+		}
+		badSetting(name, v, "a number")
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if v, ok := setting(name); ok && v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			return d
+		}
+		badSetting(name, v, "a duration such as 30s")
+	}
+	return def
+}
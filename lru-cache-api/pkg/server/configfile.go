@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// flagSettings holds the settings given as command line flags, under the
+// names of the environment variables they stand for
+var flagSettings = map[string]string{}
+
+// fileSettings holds the settings read from the --config file under the
+// names of the environment variables they stand for
+var fileSettings = map[string]string{}
+
+// usedSettings records the settings loadConfig looked up, to find the
+// misspelled ones in the file and flags
+var usedSettings = map[string]bool{}
+
+// settingAliases are other names settings are known by, for environments
+// written for them
+var settingAliases = map[string]string{
+	"CACHE_ALLOWED_ORIGINS": "CACHE_CORS_ORIGINS",
+	"CACHE_EVICTION_POLICY": "CACHE_POLICY",
+}
+
+// settingErrors collects the settings that could not be parsed
+var settingErrors []error
+
+// setting returns the value of the named setting: the flag's, the
+// environment variable's when set, under its name or alias, and the config
+// file's otherwise
+func setting(name string) (string, bool) {
+	usedSettings[name] = true
+	if v, ok := flagSettings[name]; ok {
+		return v, true
+	}
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v, true
+	}
+	if alias := settingAliases[name]; alias != "" {
+		if v, ok := os.LookupEnv(alias); ok && v != "" {
+			return v, true
+		}
+	}
+	v, ok := fileSettings[name]
+	return v, ok
+}
+
+func badSetting(name, value, want string) {
+	settingErrors = append(settingErrors, fmt.Errorf("%s=%q: expected %s", name, value, want))
+}
+
+// loadConfigFile :: reads a YAML (or JSON) file of settings. Keys are the
+// environment variables without CACHE_, lower case, and may be nested:
+//
+//	port: 8080
+//	ws:
+//	  batch_window: 20ms
+//	allowed_origins: [https://app.example.com]
+//
+// sets CACHE_PORT, CACHE_WS_BATCH_WINDOW and CACHE_ALLOWED_ORIGINS
+func loadConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return flattenSettings("", doc)
+}
+
+func flattenSettings(prefix string, doc map[string]interface{}) error {
+	for key, value := range doc {
+		name := settingName(prefix + key)
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if err := flattenSettings(prefix+key+"_", v); err != nil {
+				return err
+			}
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			fileSettings[name] = strings.Join(items, ",")
+		case nil:
+		default:
+			fileSettings[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// settingName returns the environment variable a flag or config file key
+// such as ws-batch-window stands for
+func settingName(key string) string {
+	return "CACHE_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// unknownSettings reports the flags and config file settings nothing reads
+func unknownSettings(path string) error {
+	var flags, keys []string
+	for name := range flagSettings {
+		if !usedSettings[name] {
+			flags = append(flags, "--"+strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, "CACHE_"), "_", "-")))
+		}
+	}
+	for name := range fileSettings {
+		if !usedSettings[name] {
+			keys = append(keys, strings.ToLower(strings.TrimPrefix(name, "CACHE_")))
+		}
+	}
+	sort.Strings(flags)
+	sort.Strings(keys)
+	switch {
+	case len(flags) > 0:
+		return fmt.Errorf("unknown flags %s", strings.Join(flags, ", "))
+	case len(keys) > 0:
+		return fmt.Errorf("%s: unknown settings %s", path, strings.Join(keys, ", "))
+	}
+	return nil
+}
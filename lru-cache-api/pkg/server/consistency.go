@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Read consistency levels
+const (
+	ConsistencyStrong   = "strong"   // served by, or checked against, the leader
+	ConsistencyBounded  = "bounded"  // served locally unless we lag more than max_lag
+	ConsistencyEventual = "eventual" // served locally
+)
+
+// raftCluster reports whether the cache itself is replicated through raft,
+// as opposed to raft only electing the primary
+func raftCluster() bool {
+	return config.RaftAddr != "" && config.Role != RoleAuto
+}
+
+// readConsistency returns the level asked for with ?consistency= or the
+// X-Consistency header, and the staleness allowed for bounded reads
+func readConsistency(r *http.Request) (string, time.Duration, error) {
+	level := r.URL.Query().Get("consistency")
+	if level == "" {
+		level = r.Header.Get("X-Consistency")
+	}
+	if level == "" {
+		// Raft clusters have always served linearizable reads
+		level = ConsistencyEventual
+		if raftCluster() {
+			level = ConsistencyStrong
+		}
+	}
+
+	switch level {
+	case ConsistencyStrong, ConsistencyEventual:
+		return level, 0, nil
+	case ConsistencyBounded:
+	default:
+		return "", 0, fmt.Errorf("unknown consistency %q", level)
+	}
+
+	maxLag := config.MaxStaleness
+	if v := r.URL.Query().Get("max_lag"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid max_lag: %w", err)
+		}
+		maxLag = d
+	}
+	return level, maxLag, nil
+}
+
+// localLag estimates how stale this node's copy of the cache may be
+func localLag() time.Duration {
+	switch {
+	case raftCluster() || config.Role == RoleAuto:
+		if raftNode.State() == raft.Leader {
+			return 0
+		}
+		if config.Role == RoleAuto {
+			return replicationLag()
+		}
+		return time.Since(raftNode.LastContact())
+	case config.Role == RoleReplica:
+		return replicationLag()
+	}
+	return 0
+}
+
+// withConsistency serves reads at the consistency level the client asked for
+func withConsistency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		level, maxLag, err := readConsistency(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case level == ConsistencyEventual:
+			next(w, r)
+		case level == ConsistencyBounded && localLag() <= maxLag:
+			next(w, r)
+		default:
+			// Strong reads, and bounded ones we are too far behind for
+			strongRead(w, r, next)
+		}
+	}
+}
+
+func strongRead(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if raftCluster() {
+		if err := waitForReadIndex(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
+		return
+	}
+
+	primary := config.PrimaryAddr
+	if config.Role == RoleAuto {
+		if raftNode.State() == raft.Leader {
+			next(w, r)
+			return
+		}
+		primary = currentPrimary()
+	}
+	if primary == "" || r.Header.Get(forwardedHeader) != "" {
+		// We are the primary, or the one who forwarded this thinks we are
+		next(w, r)
+		return
+	}
+
+	target, err := url.Parse(primary)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.Header.Set(forwardedHeader, config.Node.ID)
+	newForwardingProxy(target).ServeHTTP(w, r)
+}
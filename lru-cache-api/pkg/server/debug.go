@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// RuntimeStats is the body of GET /debug/runtime
+type RuntimeStats struct {
+	GoVersion  string `json:"goVersion"`
+	Uptime     string `json:"uptime"`
+	Goroutines int    `json:"goroutines"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	Heap       struct {
+		AllocBytes      uint64 `json:"allocBytes"`
+		InuseBytes      uint64 `json:"inuseBytes"`
+		IdleBytes       uint64 `json:"idleBytes"`
+		SysBytes        uint64 `json:"sysBytes"`
+		Objects         uint64 `json:"objects"`
+		NextGCBytes     uint64 `json:"nextGcBytes"`
+		TotalAllocBytes uint64 `json:"totalAllocBytes"`
+	} `json:"heap"`
+	GC struct {
+		Cycles      uint32     `json:"cycles"`
+		Last        *time.Time `json:"last,omitempty"`
+		LastPause   string     `json:"lastPause,omitempty"`
+		TotalPause  string     `json:"totalPause"`
+		CPUFraction float64    `json:"cpuFraction"`
+	} `json:"gc"`
+	Cache struct {
+		Items            int   `json:"items"`
+		Capacity         int   `json:"capacity"`
+		MemoryBytes      int64 `json:"memoryBytes"`
+		AverageItemBytes int64 `json:"averageItemBytes"`
+	} `json:"cache"`
+	WebSocketClients int64 `json:"websocketClients"`
+	BroadcastQueue   int   `json:"broadcastQueue"`
+}
+
+// runtimeHandler serves GET /debug/runtime. Reading the memory statistics
+// stops the world briefly, so this is not meant to be scraped
+func runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var stats RuntimeStats
+	stats.GoVersion = runtime.Version()
+	stats.Uptime = clock.Now().Sub(startedAt).Round(time.Second).String()
+	stats.Goroutines = runtime.NumGoroutine()
+	stats.GOMAXPROCS = runtime.GOMAXPROCS(0)
+
+	stats.Heap.AllocBytes = mem.HeapAlloc
+	stats.Heap.InuseBytes = mem.HeapInuse
+	stats.Heap.IdleBytes = mem.HeapIdle
+	stats.Heap.SysBytes = mem.Sys
+	stats.Heap.Objects = mem.HeapObjects
+	stats.Heap.NextGCBytes = mem.NextGC
+	stats.Heap.TotalAllocBytes = mem.TotalAlloc
+
+	stats.GC.Cycles = mem.NumGC
+	if mem.NumGC > 0 {
+		last := time.Unix(0, int64(mem.LastGC))
+		stats.GC.Last = &last
+		stats.GC.LastPause = time.Duration(mem.PauseNs[(mem.NumGC+255)%256]).String()
+	}
+	stats.GC.TotalPause = time.Duration(mem.PauseTotalNs).String()
+	stats.GC.CPUFraction = mem.GCCPUFraction
+
+	cacheStats := cache.Stats()
+	stats.Cache.Items = cacheStats.Items
+	stats.Cache.Capacity = cacheStats.Capacity
+	stats.Cache.MemoryBytes = cacheStats.MemoryBytes
+	if cacheStats.Items > 0 {
+		stats.Cache.AverageItemBytes = cacheStats.MemoryBytes / int64(cacheStats.Items)
+	}
+	stats.WebSocketClients = wsConnections.Load()
+	stats.BroadcastQueue = len(broadcast)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// registerDebugRoutes :: mounts /debug/runtime, the expvar variables at
+// /debug/vars and the pprof profiles under /debug/pprof/; like /admin they
+// need the admin scope
+func registerDebugRoutes(r *mux.Router) {
+	r.HandleFunc("/debug/runtime", runtimeHandler).Methods("GET")
+	r.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// Options configures the handler made by NewHandler
+type Options struct {
+	// Args are server flags such as --api-keys=..., read as the command
+	// line is: over the environment and the CACHE_CONFIG file
+	Args []string
+	// CORS answers cross-origin requests as the server does, from
+	// CACHE_ALLOWED_ORIGINS. Leave it off behind CORS middleware of your own
+	CORS bool
+	// Clock is the time expiry, the janitor and uptime go by; nil takes
+	// the cache's
+	Clock lru.Clock
+	// Codec encodes and decodes the JSON of the data path; nil takes
+	// encoding/json. See Codec
+	Codec Codec
+	// Loaders load the keys GET /cache/{key} misses, before those of
+	// CACHE_LOADERS and CACHE_ORIGIN_URL; see Loader
+	Loaders []Loader
+	// Writers write keys through to stores such as SQLStore on sets and
+	// deletes, before those of CACHE_WRITE_THROUGH; see Writer
+	Writers []Writer
+}
+
+var handlerMade atomic.Bool
+
+// ErrHandlerMade is returned by NewHandler once it was called
+var ErrHandlerMade = errors.New("server: NewHandler was already called")
+
+// NewHandler :: the cache API, with its auth, limits and WebSocket, serving
+// c, for applications mounting it on their own mux instead of running the
+// server, e.g.
+//
+//	api, err := server.NewHandler(c, opts)
+//	mux.Handle("/cache-api/", http.StripPrefix("/cache-api", api))
+//
+// A nil c is made from the settings. The server's background work, such as
+// removing expired items, starts with it, and it sets up the default slog
+// logger and expvars as the server does. Its state is global, so a process
+// has one handler at most: calling NewHandler again returns ErrHandlerMade.
+// Invalid settings and the failures the server dies of, such as an
+// unreadable ACL file, are returned before any background work starts, and
+// NewHandler may be called again once they are fixed. Call Shutdown when
+// done
+func NewHandler(c *lru.LRUCache, opts Options) (http.Handler, error) {
+	if handlerMade.Swap(true) {
+		return nil, ErrHandlerMade
+	}
+	handler, err := newHandler(c, opts)
+	if err != nil {
+		handlerMade.Store(false)
+		return nil, fmt.Errorf("server: %w", err)
+	}
+	return handler, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewHandlerRetry(t *testing.T) {
+	t.Setenv("CACHE_SNAPSHOT_ENABLED", "false")
+	t.Setenv("CACHE_CACHES", "sessions:100")
+
+	// Gossip fails last of all, after the caches were made
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	failures := []struct {
+		name, env, value string
+	}{
+		{"missing ACL file", "CACHE_ACL_FILE", filepath.Join(t.TempDir(), "missing.json")},
+		{"gossip port taken", "CACHE_GOSSIP_ADDR", taken.Addr().String()},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			if _, err := NewHandler(nil, Options{}); err == nil || errors.Is(err, ErrHandlerMade) {
+				t.Fatalf("NewHandler = %v, want the setup error", err)
+			}
+			if len(namedCaches) != 0 || gossip != nil || traceProvider != nil || audit.file != nil {
+				t.Error("failed NewHandler left state behind")
+			}
+		})
+	}
+
+	handler, err := NewHandler(nil, Options{})
+	if err != nil || handler == nil {
+		t.Fatalf("NewHandler after fixing the settings = %v", err)
+	}
+	t.Cleanup(Shutdown)
+	if len(namedCaches) != 1 {
+		t.Errorf("named caches = %d, want 1", len(namedCaches))
+	}
+
+	if _, err := NewHandler(nil, Options{}); !errors.Is(err, ErrHandlerMade) {
+		t.Errorf("second NewHandler = %v, want ErrHandlerMade", err)
+	}
+}
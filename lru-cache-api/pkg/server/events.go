@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// What happened to a key, the type of a CacheUpdate
+const (
+	EventSet    = "set"
+	EventDelete = "delete"
+	EventExpire = "expire"
+	EventEvict  = "evict"
+	EventFlush  = "flush"
+)
+
+// Why it happened, the reason of a CacheUpdate
+const (
+	ReasonRequest      = "request"      // a client's set, delete or flush
+	ReasonFill         = "fill"         // loaded from the origin on a miss
+	ReasonProxy        = "proxy"        // an upstream response cached by the reverse proxy
+	ReasonImport       = "import"       // POST /admin/cache/import
+	ReasonWarmup       = "warmup"       // loaded from CACHE_WARMUP_SOURCE on start
+	ReasonGeo          = "geo"          // written in another region
+	ReasonInvalidation = "invalidation" // changed on another node
+	ReasonRebalance    = "rebalance"    // handed over between nodes
+	ReasonSchedule     = "schedule"     // removed by a CACHE_INVALIDATION_RULES rule
+	ReasonWebhook      = "webhook"      // removed through POST /invalidate
+	ReasonTTL          = "ttl"
+	ReasonCapacity     = "capacity" // least recently used, to make room
+)
+
+var eventTypes = map[string]bool{EventSet: true, EventDelete: true, EventExpire: true, EventEvict: true, EventFlush: true}
+
+// isEvent tells change events from the control messages sharing the stream.
+// Servers from before event types sent updates without one
+func isEvent(updateType string) bool {
+	return updateType == "" || eventTypes[updateType]
+}
+
+// removal returns the update telling clients key is gone
+func removal(key, eventType, reason, requestID string) CacheUpdate {
+	return CacheUpdate{Type: eventType, Reason: reason, Key: key, Value: nil, ExpiresAt: time.Time{}, RequestID: requestID}
+}
+
+// What publish does when the broadcast queue is full
+const (
+	BroadcastDrop  = "drop"  // discard the update; clients are closed with 1013 and reload
+	BroadcastBlock = "block" // wait for room, holding up the writer
+)
+
+var (
+	broadcastDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cache_broadcast_dropped_total",
+		Help: "Updates discarded because the broadcast queue was full.",
+	})
+
+	// broadcastLost tells the hub that updates were discarded
+	broadcastLost = make(chan struct{}, 1)
+)
+
+// publish :: hands update to the hub for the WebSocket clients. When the
+// CACHE_BROADCAST_BUFFER queue is full it waits under
+// CACHE_BROADCAST_OVERFLOW=block and drops the update otherwise. Without
+// the hub, under CACHE_WS_ENABLED=false, there is no one to tell
+func publish(update CacheUpdate) {
+	if !config.WSEnabled {
+		return
+	}
+	if config.BroadcastOverflow == BroadcastBlock {
+		broadcast <- update
+		return
+	}
+	offer(update)
+}
+
+// offer publishes update without ever waiting, as callers holding the
+// cache lock must
+func offer(update CacheUpdate) {
+	if !config.WSEnabled {
+		return
+	}
+	select {
+	case broadcast <- update:
+	default:
+		broadcastDropped.Inc()
+		select {
+		case broadcastLost <- struct{}{}:
+			slog.Warn("websocket: broadcast queue full, dropping updates", "size", cap(broadcast))
+		default: // the hub has yet to notice the last loss
+		}
+	}
+}
+
+// publishEviction :: tells WebSocket clients about keys evicted for room and
+// drops their tags
+func publishEviction(key string) {
+	keyTags.remove(key)
+	offer(removal(key, EventEvict, ReasonCapacity, ""))
+}
+
+// parseEventTypes reads a list such as "delete,expire", nil meaning all types
+func parseEventTypes(list []string) (map[string]bool, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+	types := make(map[string]bool, len(list))
+	for _, t := range list {
+		t = strings.TrimSpace(t)
+		if !eventTypes[t] {
+			return nil, fmt.Errorf("unknown event type %q, expected set, delete, expire, evict or flush", t)
+		}
+		types[t] = true
+	}
+	return types, nil
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"time"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// Expiry strategies, for CACHE_EXPIRY_STRATEGY
+const (
+	// ExpiryScan looks at every item every CACHE_JANITOR_INTERVAL, locking
+	// each shard for as long as it takes
+	ExpiryScan = "scan"
+	// ExpirySampled looks at a sample of the items, as Redis does, so the
+	// janitor's pauses do not grow with the cache
+	ExpirySampled = "sampled"
+)
+
+const (
+	expirySample  = 20                    // items a round looks at per shard
+	expiryRepeat  = 0.25                  // share of a sample expired that calls for another round
+	expiryBudget  = 25 * time.Millisecond // how long a cycle goes on sampling
+	expirySpeedup = 10                    // how much sooner the next cycle starts after one out of time
+)
+
+// expireSampled :: removes expired items from every cache in rounds of
+// samples, publishing them, for as long as more than a quarter of a round
+// was expired and time is left. It reports false when time ran out with
+// expired items still common, for the next cycle to come sooner
+func expireSampled() bool {
+	deadline := time.Now().Add(expiryBudget)
+	clean := expireRounds(cache, removal, deadline)
+	for _, nc := range namedCaches {
+		clean = expireRounds(nc.LRUCache, nc.removal, deadline) && clean
+	}
+	return clean
+}
+
+// expireRounds samples c until few expired items are found, reporting
+// false when the deadline passed first
+func expireRounds(c *lru.LRUCache, removal func(key, event, reason, requestID string) CacheUpdate, deadline time.Time) bool {
+	for {
+		keys, sampled := c.RemoveExpiredSample(expirySample)
+		for _, key := range keys {
+			if c == cache {
+				keyTags.remove(key)
+			}
+			publish(removal(key, EventExpire, ReasonTTL, ""))
+		}
+		if float64(len(keys)) <= expiryRepeat*float64(sampled) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+}
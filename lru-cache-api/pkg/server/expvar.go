@@ -0,0 +1,66 @@
+package server
+
+import (
+	"expvar"
+)
+
+// setupExpvar :: publishes the cache counters and the settings under
+// /debug/vars, next to the cmdline and memstats expvar always has
+func setupExpvar(cfg *Config) {
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		return statsOf(cache)
+	}))
+	expvar.Publish("websocket", expvar.Func(func() interface{} {
+		return map[string]int64{"clients": wsConnections.Load(), "broadcastQueue": int64(len(broadcast)), "lastSeq": int64(history.latestSeq())}
+	}))
+	expvar.Publish("uptimeSeconds", expvar.Func(func() interface{} {
+		return int64(clock.Now().Sub(startedAt).Seconds())
+	}))
+	expvar.Publish("config", expvar.Func(func() interface{} {
+		return publicConfig(cfg)
+	}))
+}
+
+// publicConfig is the part of cfg that is safe to show: no keys, secrets,
+// or URLs that might embed credentials
+func publicConfig(cfg *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"node":             cfg.Node,
+		"peers":            len(cfg.Peers),
+		"role":             cfg.Role,
+		"readOnly":         cfg.ReadOnly,
+		"websocket":        cfg.WSEnabled,
+		"metrics":          cfg.MetricsEnabled,
+		"capacity":         cache.Capacity(),
+		"namedCaches":      len(cfg.Caches),
+		"logLevel":         logLevel.Level().String(),
+		"authentication":   apiKeys.enabled() || jwtAuth != nil,
+		"acls":             cfg.ACLFile != "",
+		"tls":              cfg.TLSCert != "",
+		"tlsClientAuth":    cfg.TLSClientCA != "",
+		"maxBodyBytes":     cfg.MaxBodyBytes,
+		"maxKeyLength":     cfg.MaxKeyLength,
+		"maxItemBytes":     cfg.MaxItemBytes,
+		"readRateLimit":    tuned().ReadRateLimit.String(),
+		"writeRateLimit":   tuned().WriteRateLimit.String(),
+		"snapshots":        cfg.SnapshotPath != "",
+		"snapshotInterval": cfg.SnapshotInterval.String(),
+		"warmup":           cfg.WarmupSource != "",
+		"slowlogThreshold": cfg.SlowlogThreshold.String(),
+		"hotKeysWindow":    cfg.HotKeysWindow.String(),
+		"eventHistory":     cfg.EventHistory,
+		"wsBufferSize":     cfg.WSBufferSize,
+		"wsSlowClients":    cfg.WSSlowClientPolicy,
+		"wsBatchWindow":    tuned().WSBatchWindow.String(),
+		"wsCompression":    cfg.WSCompression,
+		"broadcastBuffer":  cfg.BroadcastBuffer,
+		"broadcastPolicy":  cfg.BroadcastOverflow,
+		"tracing":          cfg.OTLPEndpoint != "",
+		"gossip":           cfg.GossipAddr != "",
+		"raft":             cfg.RaftAddr != "",
+		"distributedFill":  len(loaders) > 0,
+		"reverseProxy":     cfg.ProxyUpstream != "",
+		"rebalance":        cfg.RebalanceMode,
+		"geoRegion":        cfg.GeoRegion,
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"lru-cache-api/client"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// peerHeader marks a fill request sent by another node, which the owner must
+// answer itself instead of passing it on
+const peerHeader = "X-Cache-Peer"
+
+var (
+	fills      flightGroup
+	ring       *client.HashRing
+	ringNodes  string
+	ringMutex  sync.Mutex
+	fillClient = &http.Client{Timeout: 10 * time.Second, Transport: tracedTransport(http.DefaultTransport)} // talks to the origin, never gets the cluster key
+)
+
+// flightGroup makes concurrent callers for the same key share one call
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// Do :: runs fn once per key at a time, everyone else waits for its result
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.value, call.err = fn()
+	call.wg.Done()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	return call.value, call.err
+}
+
+// ownerOf returns the node responsible for loading key from the origin
+func ownerOf(key string) Node {
+	var nodes []Node
+	for _, node := range clusterNodes() {
+		// A draining node hands its keys over, so it must not own any
+		if node.ID != config.Node.ID || !draining.Load() {
+			nodes = append(nodes, node)
+		}
+	}
+	byID := make(map[string]Node, len(nodes))
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		byID[node.ID] = node
+		ids[i] = node.ID
+	}
+
+	ringMutex.Lock()
+	if signature := strings.Join(ids, ","); ring == nil || signature != ringNodes {
+		// By ID, as client.RingFromNodes keys its ring, so smart clients
+		// send keys to the owner
+		ring = client.NewHashRing(client.DefaultReplicas)
+		ring.Add(ids...)
+		ringNodes = signature
+	}
+	owner := ring.Get(key)
+	ringMutex.Unlock()
+
+	return byID[owner]
+}
+
+// fill loads a missing key: the owning node fetches it from the origin and
+// caches it, every other node asks the owner, so the origin sees one request
+// per key across the whole fleet
+func fill(ctx context.Context, key string, fromPeer bool) (interface{}, error) {
+	return fills.Do(key, func() (interface{}, error) {
+		ctx, span := startSpan(ctx, "cache.fill", key)
+		owner := ownerOf(key)
+		span.SetAttributes(attribute.String("cache.owner", owner.ID))
+		if fromPeer || owner.ID == config.Node.ID {
+			value, err := fillFromOrigin(ctx, key)
+			endSpan(span, err)
+			return value, err
+		}
+
+		value, err := fetchFromPeer(ctx, owner, key)
+		if err == nil || errors.Is(err, ErrOriginNotFound) {
+			span.End()
+			return value, err
+		}
+		loggerFrom(ctx).Warn("fill: asking the owner failed, loading it ourselves", "owner", owner.ID, "key", key, "err", err)
+		value, err = fillFromOrigin(ctx, key)
+		endSpan(span, err)
+		return value, err
+	})
+}
+
+// fillFromOrigin :: loads key through its loader and caches it
+func fillFromOrigin(ctx context.Context, key string) (interface{}, error) {
+	loader, ok := loaderFor(key)
+	if !ok {
+		return nil, ErrOriginNotFound
+	}
+	value, err := loader.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateValue(value); err != nil {
+		return nil, err
+	}
+
+	if err := cache.Set(key, value, loader.TTL); err != nil {
+		// Served all the same, just not cached
+		slog.Debug("fill: not caching", "key", key, "err", err)
+		return value, nil
+	}
+	keyTags.remove(key)
+	publish(CacheUpdate{
+		Type:      EventSet,
+		Reason:    ReasonFill,
+		Key:       key,
+		Value:     value,
+		ExpiresAt: clock.Now().Add(loader.TTL),
+		RequestID: requestID(ctx),
+	})
+	return value, nil
+}
+
+func fetchFromPeer(ctx context.Context, owner Node, key string) (interface{}, error) {
+	defer func(start time.Time) { observeLatency("peer_fetch", time.Since(start)) }(time.Now())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, owner.Addr+"/cache/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerHeader, config.Node.ID)
+
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrOriginNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("peer returned %s", resp.Status)
+	}
+
+	var body struct {
+		Value interface{} `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Value, nil
+}
+
+// fillHandler serves GET /cache/{key}, loading misses of keys with a loader
+// through fill
+func fillHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	value, err := cache.Get(key)
+	if _, ok := loaderFor(key); err != nil && !ok {
+		cacheError(w, err)
+		return
+	}
+	if err != nil && serveStale(w, r, key) {
+		return
+	}
+	if err != nil {
+		value, err = fill(r.Context(), key, r.Header.Get(peerHeader) != "")
+		if errors.Is(err, ErrOriginNotFound) {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			if value, ok := staleValue(r, key, config.StaleIfError); ok {
+				// Better the last value than none while the origin is down
+				loggerFrom(r.Context()).Warn("fill: loading failed, serving stale", "key", key, "err", err)
+				w.Header().Set("Warning", `111 - "Revalidation Failed"`)
+				writeStale(w, key, value)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{"key": key, "value": value})
+}
+
+// revalidating holds the keys serveStale is refreshing
+var revalidating sync.Map
+
+// serveStale :: serves the expired value of key within
+// CACHE_STALE_WHILE_REVALIDATE of its expiry, marked stale, and refreshes it
+// from the origin in the background, so hot keys never wait on a miss.
+// Returns false when there is no such value
+func serveStale(w http.ResponseWriter, r *http.Request, key string) bool {
+	value, ok := staleValue(r, key, config.StaleWhileRevalidate)
+	if !ok {
+		return false
+	}
+
+	if _, busy := revalidating.LoadOrStore(key, struct{}{}); !busy {
+		ctx := context.WithoutCancel(r.Context())
+		go func() {
+			defer revalidating.Delete(key)
+			if _, err := fill(ctx, key, false); err != nil {
+				loggerFrom(ctx).Warn("fill: revalidating a stale key failed", "key", key, "err", err)
+			}
+		}()
+	}
+	writeStale(w, key, value)
+	return true
+}
+
+// staleValue returns the value key held until it expired, if that was
+// within window. Peers are never served stale, as they would cache it afresh
+func staleValue(r *http.Request, key string, window time.Duration) (interface{}, bool) {
+	if window == 0 || r.Header.Get(peerHeader) != "" {
+		return nil, false
+	}
+	value, expiresAt, err := cache.GetStale(key)
+	if err != nil || clock.Now().After(expiresAt.Add(window)) {
+		return nil, false
+	}
+	return value, true
+}
+
+// writeStale :: answers with a stale value, marked as such
+func writeStale(w http.ResponseWriter, key string, value interface{}) {
+	w.Header().Set("X-Cache", "STALE")
+	writeJSON(w, map[string]interface{}{"key": key, "value": value, "stale": true})
+}
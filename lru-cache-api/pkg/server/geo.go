@@ -0,0 +1,336 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	geoQueueSize    = 10000
+	geoBatchSize    = 100
+	geoBatchWindow  = 100 * time.Millisecond
+	geoTombstoneTTL = 10 * time.Minute
+)
+
+// HLC is a hybrid logical clock timestamp: wall clock milliseconds, a counter
+// for events within the same millisecond, and the region as tie breaker
+type HLC struct {
+	Wall    int64  `json:"wall"`
+	Logical uint32 `json:"logical"`
+	Region  string `json:"region"`
+}
+
+// After reports whether t happened after o
+func (t HLC) After(o HLC) bool {
+	if t.Wall != o.Wall {
+		return t.Wall > o.Wall
+	}
+	if t.Logical != o.Logical {
+		return t.Logical > o.Logical
+	}
+	return t.Region > o.Region
+}
+
+// hlcClock hands out HLC timestamps that never go backwards, even when the
+// wall clock does or a remote region's clock runs ahead of ours
+type hlcClock struct {
+	mutex sync.Mutex
+	last  HLC
+}
+
+// Now :: timestamps a local event
+func (c *hlcClock) Now() HLC {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if wall := time.Now().UnixMilli(); wall > c.last.Wall {
+		c.last = HLC{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	c.last.Region = config.GeoRegion
+	return c.last
+}
+
+// Update :: merges a timestamp received from another region
+func (c *hlcClock) Update(remote HLC) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	wall := max(c.last.Wall, remote.Wall, time.Now().UnixMilli())
+	switch {
+	case wall == c.last.Wall && wall == remote.Wall:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	case wall == c.last.Wall:
+		c.last.Logical++
+	case wall == remote.Wall:
+		c.last.Logical = remote.Logical + 1
+	default:
+		c.last.Logical = 0
+	}
+	c.last.Wall = wall
+}
+
+// geoMutation is a change shipped between regions
+type geoMutation struct {
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value,omitempty"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	Deleted   bool        `json:"deleted,omitempty"`
+	Version   HLC         `json:"version"`
+	RequestID string      `json:"requestId,omitempty"`
+}
+
+// geoVersion is the last write we know of for a key; deletes are kept as
+// tombstones for a while so an older remote set cannot resurrect the key
+type geoVersion struct {
+	version   HLC
+	expiresAt time.Time
+}
+
+// geoLink ships our mutations to one remote cluster
+type geoLink struct {
+	remote string
+	queue  chan geoMutation
+
+	mutex     sync.Mutex
+	shipped   uint64
+	dropped   uint64
+	lastError string
+	lastShip  time.Time
+}
+
+var (
+	geoClock    hlcClock
+	geoLinks    []*geoLink
+	geoVersions = make(map[string]geoVersion)
+	geoMutex    sync.Mutex
+)
+
+// startGeoReplication :: starts a shipper for every remote cluster
+func startGeoReplication(cfg *Config) {
+	for _, remote := range cfg.GeoRemotes {
+		link := &geoLink{remote: remote, queue: make(chan geoMutation, geoQueueSize)}
+		geoLinks = append(geoLinks, link)
+		go link.run()
+	}
+	go pruneGeoVersions()
+}
+
+// shipToRegions :: records the version of a local write and queues it for
+// the remote clusters, no-op without geo replication
+func shipToRegions(update CacheUpdate) {
+	if config.GeoRegion == "" {
+		return
+	}
+
+	m := geoMutation{
+		Key:       update.Key,
+		Value:     update.Value,
+		ExpiresAt: update.ExpiresAt,
+		Deleted:   update.Value == nil,
+		Version:   geoClock.Now(),
+		RequestID: update.RequestID,
+	}
+	recordGeoVersion(m)
+
+	for _, link := range geoLinks {
+		select {
+		case link.queue <- m:
+		default:
+			link.mutex.Lock()
+			link.dropped++
+			link.mutex.Unlock()
+		}
+	}
+}
+
+func recordGeoVersion(m geoMutation) {
+	expiresAt := m.ExpiresAt
+	if m.Deleted {
+		expiresAt = clock.Now().Add(geoTombstoneTTL)
+	}
+	geoMutex.Lock()
+	geoVersions[m.Key] = geoVersion{version: m.Version, expiresAt: expiresAt}
+	geoMutex.Unlock()
+}
+
+// run :: sends queued mutations in batches, retrying a batch until it goes through
+func (l *geoLink) run() {
+	backoff := time.Second
+	for {
+		batch := []geoMutation{<-l.queue}
+		timeout := time.After(geoBatchWindow)
+	collect:
+		for len(batch) < geoBatchSize {
+			select {
+			case m := <-l.queue:
+				batch = append(batch, m)
+			case <-timeout:
+				break collect
+			}
+		}
+
+		for {
+			err := l.send(batch)
+			l.mutex.Lock()
+			if err == nil {
+				l.shipped += uint64(len(batch))
+				l.lastShip = clock.Now()
+				l.lastError = ""
+			} else {
+				l.lastError = err.Error()
+			}
+			l.mutex.Unlock()
+
+			if err == nil {
+				backoff = time.Second
+				break
+			}
+			slog.Error("geo: shipping mutations", "mutations", len(batch), "remote", l.remote, "err", err)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+func (l *geoLink) send(batch []geoMutation) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"region":    config.GeoRegion,
+		"mutations": batch,
+	})
+	if err != nil {
+		return err
+	}
+	return breakerFor("geo " + l.remote).do(func() error {
+		resp, err := peerClient.Post(l.remote+"/geo/replicate", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("remote returned %s", resp.Status)
+		}
+		return nil
+	})
+}
+
+// applyGeoMutation applies a remote write unless we have seen a later one for
+// the same key (last writer wins); it is not shipped again
+func applyGeoMutation(m geoMutation) (bool, error) {
+	geoClock.Update(m.Version)
+
+	geoMutex.Lock()
+	current, known := geoVersions[m.Key]
+	geoMutex.Unlock()
+	if known && !m.Version.After(current.version) {
+		return false, nil
+	}
+
+	if raftCluster() {
+		cmd := raftCommand{Op: opSet, Key: m.Key, Value: m.Value, ExpiresAt: m.ExpiresAt, RequestID: m.RequestID, Reason: ReasonGeo}
+		if m.Deleted {
+			cmd = raftCommand{Op: opDelete, Key: m.Key, RequestID: m.RequestID, Reason: ReasonGeo}
+		}
+		if err := applyCommand(cmd); err != nil {
+			return false, err
+		}
+	} else if m.Deleted {
+		cache.Delete(m.Key)
+		keyTags.remove(m.Key)
+		publish(removal(m.Key, EventDelete, ReasonGeo, m.RequestID))
+	} else {
+		keyTags.remove(m.Key)
+		if err := cache.Set(m.Key, m.Value, m.ExpiresAt.Sub(clock.Now())); err != nil {
+			// A miss is better than the value the other region replaced
+			cache.Delete(m.Key)
+			slog.Warn("geo: cannot apply set", "key", m.Key, "err", err)
+			publish(removal(m.Key, EventDelete, ReasonGeo, m.RequestID))
+		} else {
+			publish(CacheUpdate{Type: EventSet, Reason: ReasonGeo, Key: m.Key, Value: m.Value, ExpiresAt: m.ExpiresAt, RequestID: m.RequestID})
+		}
+	}
+	publishInvalidation(m.Key)
+	recordGeoVersion(m)
+	return true, nil
+}
+
+// geoReplicateHandler receives a batch of mutations from another region
+func geoReplicateHandler(w http.ResponseWriter, r *http.Request) {
+	if raftCluster() && raftNode.State() != raft.Leader {
+		forwardToLeader(w, r)
+		return
+	}
+
+	var data struct {
+		Region    string        `json:"region"`
+		Mutations []geoMutation `json:"mutations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	applied := 0
+	for _, m := range data.Mutations {
+		ok, err := applyGeoMutation(m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if ok {
+			applied++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"received": len(data.Mutations), "applied": applied})
+}
+
+func geoStatusHandler(w http.ResponseWriter, r *http.Request) {
+	links := make([]map[string]interface{}, 0, len(geoLinks))
+	for _, link := range geoLinks {
+		link.mutex.Lock()
+		links = append(links, map[string]interface{}{
+			"remote":        link.remote,
+			"queued":        len(link.queue),
+			"shipped":       link.shipped,
+			"dropped":       link.dropped,
+			"lastError":     link.lastError,
+			"lastShippedAt": link.lastShip,
+		})
+		link.mutex.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"region": config.GeoRegion,
+		"links":  links,
+	})
+}
+
+// pruneGeoVersions forgets versions of keys that expired and old tombstones
+func pruneGeoVersions() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := clock.Now()
+		geoMutex.Lock()
+		for key, v := range geoVersions {
+			if now.After(v.expiresAt) {
+				delete(geoVersions, key)
+			}
+		}
+		geoMutex.Unlock()
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Geo sets are sorted sets whose scores are the 52 bit geohashes of the
+// members' places, as in Redis, so the places near a point are found by
+// looking up the score ranges of the geohash cells around it instead of
+// measuring the distance to every member. The sorted set endpoints work on
+// them too
+
+const (
+	geoMaxLat    = 85.05112878 // the bounds of Web Mercator, as in Redis
+	geoMaxSteps  = 26          // bits of latitude and of longitude in a geohash
+	earthRadius  = 6372797.560856
+	mercatorSpan = 20037726.37 // metres from the equator to the edge
+)
+
+// geoUnits are the units distances can be given in, in metres
+var geoUnits = map[string]float64{"m": 1, "km": 1000, "mi": 1609.34, "ft": 0.3048}
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"geosearch": {fn: geoSetSearch, read: true},
+	})
+}
+
+// geoPoint is a place as requests give it
+type geoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// geoMatch is a member found near a point
+type geoMatch struct {
+	Member   string  `json:"member"`
+	Distance float64 `json:"distance"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+}
+
+// valid reports whether p can be geohashed
+func (p geoPoint) valid() bool {
+	return p.Lat >= -geoMaxLat && p.Lat <= geoMaxLat && p.Lon >= -180 && p.Lon <= 180
+}
+
+// geoCell returns the indexes of the cell holding p at steps bits
+func geoCell(p geoPoint, steps int) (lat, lon uint64) {
+	cells := float64(uint64(1) << steps)
+	lat = uint64(math.Min((p.Lat+geoMaxLat)/(2*geoMaxLat)*cells, cells-1))
+	lon = uint64(math.Min((p.Lon+180)/360*cells, cells-1))
+	return lat, lon
+}
+
+// interleave returns the bits of lon and lat, steps of each, alternating
+// from the highest, longitude first
+func interleave(lat, lon uint64, steps int) uint64 {
+	var hash uint64
+	for i := steps - 1; i >= 0; i-- {
+		hash = hash<<1 | lon>>i&1
+		hash = hash<<1 | lat>>i&1
+	}
+	return hash
+}
+
+// geohash returns the 52 bit geohash of p
+func geohash(p geoPoint) uint64 {
+	lat, lon := geoCell(p, geoMaxSteps)
+	return interleave(lat, lon, geoMaxSteps)
+}
+
+// geohashPoint returns the centre of the cell of a 52 bit geohash
+func geohashPoint(hash uint64) geoPoint {
+	var lat, lon uint64
+	for i := 0; i < geoMaxSteps; i++ {
+		lon = lon<<1 | hash>>(2*(geoMaxSteps-i)-1)&1
+		lat = lat<<1 | hash>>(2*(geoMaxSteps-i)-2)&1
+	}
+	cells := float64(uint64(1) << geoMaxSteps)
+	return geoPoint{
+		Lat: (float64(lat)+0.5)/cells*2*geoMaxLat - geoMaxLat,
+		Lon: (float64(lon)+0.5)/cells*360 - 180,
+	}
+}
+
+// geoDistance returns the distance between a and b in metres
+func geoDistance(a, b geoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat, dLon := lat2-lat1, (b.Lon-a.Lon)*math.Pi/180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// geoSearchSteps returns the bits of geohash cells at least radius across
+// around lat, so those around the point cover the circle
+func geoSearchSteps(radius, lat float64) int {
+	steps := geoMaxSteps
+	if radius > 0 {
+		steps = 1
+		for r := radius; r < mercatorSpan; r *= 2 {
+			steps++
+		}
+		// Cells are half as tall as they are wide, and narrow towards the poles
+		steps -= 3
+		if lat > 66 || lat < -66 {
+			steps--
+			if lat > 80 || lat < -80 {
+				steps--
+			}
+		}
+	}
+	return min(max(steps, 1), geoMaxSteps)
+}
+
+// geoSearchRanges returns the score ranges, [from, to), of the cells
+// around p that may hold places within radius
+func geoSearchRanges(p geoPoint, radius float64) [][2]float64 {
+	steps := geoSearchSteps(radius, p.Lat)
+	lat, lon := geoCell(p, steps)
+	cells := int64(1) << steps
+	shift := 2 * (geoMaxSteps - steps)
+	var ranges [][2]float64
+	for dLat := int64(-1); dLat <= 1; dLat++ {
+		cellLat := int64(lat) + dLat
+		if cellLat < 0 || cellLat >= cells {
+			continue
+		}
+		for dLon := int64(-1); dLon <= 1; dLon++ {
+			cellLon := (int64(lon) + dLon + cells) % cells // around the antimeridian
+			hash := interleave(uint64(cellLat), uint64(cellLon), steps)
+			ranges = append(ranges, [2]float64{float64(hash << shift), float64((hash + 1) << shift)})
+		}
+	}
+	return ranges
+}
+
+// geoSetSearch :: GeoSearch: the members within args[2] metres of the point
+// at latitude args[0] and longitude args[1], nearest first, up to args[3] of
+// them or all when it is 0
+func geoSetSearch(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	zset, err := asZSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	nums := make([]float64, 4)
+	for i := range nums {
+		if nums[i], err = argFloat(args, i); err != nil {
+			return nil, nil, err
+		}
+	}
+	center, radius, count := geoPoint{Lat: nums[0], Lon: nums[1]}, nums[2], int(nums[3])
+	entries := sortZSet(zset, false)
+	seen := make(map[string]bool)
+	results := []geoMatch{}
+	for _, r := range geoSearchRanges(center, radius) {
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].Score >= r[0] })
+		for ; i < len(entries) && entries[i].Score < r[1]; i++ {
+			entry := entries[i]
+			if seen[entry.Member] {
+				continue // the cells overlap near the poles
+			}
+			seen[entry.Member] = true
+			p := geohashPoint(uint64(entry.Score))
+			if d := geoDistance(center, p); d <= radius {
+				results = append(results, geoMatch{Member: entry.Member, Distance: d, Lat: p.Lat, Lon: p.Lon})
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance != results[j].Distance {
+			return results[i].Distance < results[j].Distance
+		}
+		return results[i].Member < results[j].Member
+	})
+	if count > 0 && len(results) > count {
+		results = results[:count]
+	}
+	return results, value, nil
+}
+
+// registerGeoSetRoutes :: mounts /cache/{key}/geo
+func registerGeoSetRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/geo/search", withConsistency(geoSetSearchHandler)).Methods("GET")
+	r.Handle("/cache/{key}/geo/add", typeWrite(geoSetAddHandler)).Methods("POST")
+}
+
+// geoSetAddHandler serves POST /cache/{key}/geo/add:
+// {"locations": {"driver:7": {"lat": 51.5, "lon": -0.12}}}, adding the
+// members or moving them
+func geoSetAddHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	scores := make(map[string]interface{}, len(data.Locations))
+	for member, p := range data.Locations {
+		if !p.valid() {
+			http.Error(w, "lat must be within ±85.05112878 and lon within ±180", http.StatusBadRequest)
+			return
+		}
+		scores[member] = float64(geohash(p))
+	}
+	added, err := runTypeOp(r, key, typeOp{Name: "zadd", Args: []interface{}{scores}}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"added": added})
+}
+
+// geoSetSearchHandler serves GET
+// /cache/{key}/geo/search?lat=51.5&lon=-0.12&radius=2&unit=km&count=10,
+// answering distances in the unit, metres by default
+func geoSetSearchHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	q := r.URL.Query()
+	var p geoPoint
+	var radius float64
+	for name, v := range map[string]*float64{"lat": &p.Lat, "lon": &p.Lon, "radius": &radius} {
+		var err error
+		if *v, err = strconv.ParseFloat(q.Get(name), 64); err != nil {
+			http.Error(w, name+" must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	unit := q.Get("unit")
+	if unit == "" {
+		unit = "m"
+	}
+	metres, ok := geoUnits[unit]
+	if !ok {
+		http.Error(w, "unit must be m, km, mi or ft", http.StatusBadRequest)
+		return
+	}
+	if !p.valid() || radius < 0 {
+		http.Error(w, "lat must be within ±85.05112878, lon within ±180 and radius not negative", http.StatusBadRequest)
+		return
+	}
+	count := 0
+	if s := q.Get("count"); s != "" {
+		var err error
+		if count, err = strconv.Atoi(s); err != nil || count < 0 {
+			http.Error(w, "count must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	args := []interface{}{p.Lat, p.Lon, radius * metres, count}
+	members, err := runTypeOp(r, key, typeOp{Name: "geosearch", Args: args}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	matches := members.([]geoMatch)
+	for i := range matches {
+		matches[i].Distance /= metres
+	}
+	writeTypeReply(w, key, map[string]interface{}{"members": matches, "unit": unit})
+}
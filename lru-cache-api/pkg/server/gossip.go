@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/hashicorp/memberlist"
+)
+
+var (
+	gossip      *memberlist.Memberlist
+	gossipQueue *memberlist.TransmitLimitedQueue
+)
+
+// invalidation tells peers to drop their copy of a key
+type invalidation struct {
+	Key    string `json:"key"`
+	Origin string `json:"origin"`
+}
+
+// invalidationBroadcast is queued for gossip; a newer one for the same key replaces it
+type invalidationBroadcast struct {
+	key string
+	msg []byte
+}
+
+func (b *invalidationBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*invalidationBroadcast)
+	return ok && o.key == b.key
+}
+
+func (b *invalidationBroadcast) Message() []byte { return b.msg }
+
+func (b *invalidationBroadcast) Finished() {}
+
+// gossipDelegate hooks the cache into memberlist
+type gossipDelegate struct{}
+
+// NodeMeta advertises our HTTP address so discovered peers show up in /cluster/nodes
+func (gossipDelegate) NodeMeta(limit int) []byte {
+	return []byte(config.Node.Addr)
+}
+
+// NotifyMsg :: drops keys a peer reported as changed
+func (gossipDelegate) NotifyMsg(msg []byte) {
+	var inv invalidation
+	if err := json.Unmarshal(msg, &inv); err != nil {
+		slog.Warn("gossip: bad invalidation", "err", err)
+		return
+	}
+	if inv.Origin == config.Node.ID {
+		return
+	}
+	cache.Delete(inv.Key)
+	keyTags.remove(inv.Key)
+	publish(removal(inv.Key, EventDelete, ReasonInvalidation, ""))
+}
+
+func (gossipDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return gossipQueue.GetBroadcasts(overhead, limit)
+}
+
+func (gossipDelegate) LocalState(join bool) []byte { return nil }
+
+func (gossipDelegate) MergeRemoteState(buf []byte, join bool) {}
+
+// gossipEvents logs membership changes
+type gossipEvents struct{}
+
+func (gossipEvents) NotifyJoin(n *memberlist.Node) {
+	slog.Info("gossip: member joined", "node", n.Name, "addr", string(n.Meta))
+}
+
+func (gossipEvents) NotifyLeave(n *memberlist.Node) {
+	slog.Info("gossip: member left", "node", n.Name)
+}
+
+func (gossipEvents) NotifyUpdate(n *memberlist.Node) {}
+
+// startGossip :: joins the gossip pool so peers are discovered automatically
+func startGossip(cfg *Config) error {
+	host, port, err := net.SplitHostPort(cfg.GossipAddr)
+	if err != nil {
+		return err
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+
+	mc := memberlist.DefaultLANConfig()
+	mc.Name = cfg.Node.ID
+	mc.BindAddr = host
+	mc.BindPort = portNum
+	mc.AdvertisePort = portNum
+	mc.Delegate = gossipDelegate{}
+	mc.Events = gossipEvents{}
+
+	gossip, err = memberlist.Create(mc)
+	if err != nil {
+		return err
+	}
+	gossipQueue = &memberlist.TransmitLimitedQueue{
+		NumNodes:       gossip.NumMembers,
+		RetransmitMult: mc.RetransmitMult,
+	}
+
+	if len(cfg.GossipSeeds) > 0 {
+		if _, err := gossip.Join(cfg.GossipSeeds); err != nil {
+			slog.Error("gossip: joining", "seeds", cfg.GossipSeeds, "err", err)
+		}
+	}
+	return nil
+}
+
+// stopGossip leaves the gossip pool without telling the others, when setting
+// up the server fails
+func stopGossip() {
+	if gossip != nil {
+		gossip.Shutdown()
+		gossip = nil
+	}
+}
+
+// publishInvalidation :: tells peers key changed here, no-op without gossip
+func publishInvalidation(key string) {
+	if gossip == nil {
+		return
+	}
+	msg, err := json.Marshal(invalidation{Key: key, Origin: config.Node.ID})
+	if err != nil {
+		return
+	}
+	gossipQueue.QueueBroadcast(&invalidationBroadcast{key: key, msg: msg})
+}
+
+// gossipMembers returns the peers currently alive in the gossip pool
+func gossipMembers() []Node {
+	if gossip == nil {
+		return nil
+	}
+	var nodes []Node
+	for _, member := range gossip.Members() {
+		if member.Name == config.Node.ID {
+			continue
+		}
+		nodes = append(nodes, Node{ID: member.Name, Addr: string(member.Meta)})
+	}
+	return nodes
+}
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+)
+
+// Hashes are JSON objects, so a field of a large object can be read or
+// changed without sending the whole value back and forth.
+//
+// Fields can expire before the key, such as a session's one-time token:
+// their times, in Unix milliseconds, are kept in the hash under hashExpires,
+// {"user": "ann", "token": "...", "$expires": {"token": 1700000000000}}.
+// Expired fields are left out of replies, dropped by the next write and
+// removed by the janitor. The ops take the time as args[0], so in raft
+// cluster mode every node drops the fields the leader did
+
+// hashExpires is the member holding the field expiries, which is not a field
+const hashExpires = "$expires"
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"hset":    {fn: hashSet},
+		"hdel":    {fn: hashDelete},
+		"hincrby": {fn: hashIncrBy},
+		"hexpire": {fn: hashExpire},
+		"hprune":  {fn: hashPrune},
+		"hget":    {fn: hashGet, read: true},
+		"hgetall": {fn: hashGetAll, read: true},
+	})
+}
+
+// asHash returns the hash held by a key, nil when it is not cached
+func asHash(value interface{}) (map[string]interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	hash, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errWrongType
+	}
+	return hash, nil
+}
+
+// hashAt returns the hash held by a key without the fields expired at
+// args[0], and the rest of args
+func hashAt(value interface{}, args []interface{}) (map[string]interface{}, []interface{}, error) {
+	hash, err := asHash(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	now, err := argInt(args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return liveHash(hash, int64(now)), args[1:], nil
+}
+
+// liveHash returns hash without the fields expired at now, a copy when
+// there are any
+func liveHash(hash map[string]interface{}, now int64) map[string]interface{} {
+	expires, _ := hash[hashExpires].(map[string]interface{})
+	var live, liveExpires map[string]interface{}
+	for field, at := range expires {
+		if at, _ := at.(float64); int64(at) > now {
+			continue
+		}
+		if live == nil {
+			live, liveExpires = copyHash(hash, 0), copyHash(expires, 0)
+			live[hashExpires] = liveExpires
+		}
+		delete(live, field)
+		delete(liveExpires, field)
+	}
+	if live == nil {
+		return hash
+	}
+	if len(liveExpires) == 0 {
+		delete(live, hashExpires)
+	}
+	return live
+}
+
+// hashExpiry returns when field expires, in Unix milliseconds, 0 for never
+func hashExpiry(hash map[string]interface{}, field string) int64 {
+	expires, _ := hash[hashExpires].(map[string]interface{})
+	at, _ := expires[field].(float64)
+	return int64(at)
+}
+
+// setHashExpiry sets when field of hash, a copy, expires, 0 for never
+func setHashExpiry(hash map[string]interface{}, field string, at int64) {
+	expires, _ := hash[hashExpires].(map[string]interface{})
+	if _, ok := expires[field]; !ok && at == 0 {
+		return
+	}
+	expires = copyHash(expires, 1)
+	if at == 0 {
+		delete(expires, field)
+	} else {
+		expires[field] = float64(at) // as JSON numbers are decoded
+	}
+	if len(expires) == 0 {
+		delete(hash, hashExpires)
+	} else {
+		hash[hashExpires] = expires
+	}
+}
+
+// hashFields returns the fields of hash, without the expiries
+func hashFields(hash map[string]interface{}) map[string]interface{} {
+	if _, ok := hash[hashExpires]; !ok {
+		return hash
+	}
+	fields := copyHash(hash, 0)
+	delete(fields, hashExpires)
+	return fields
+}
+
+// copyHash returns a copy of hash with room for n more fields
+func copyHash(hash map[string]interface{}, n int) map[string]interface{} {
+	c := make(map[string]interface{}, len(hash)+n)
+	for field, v := range hash {
+		c[field] = v
+	}
+	return c
+}
+
+// argField returns args[0] as a field name
+func argField(args []interface{}) (string, error) {
+	fields, err := argStrings(args[:min(len(args), 1)], "fields")
+	if err != nil {
+		return "", err
+	}
+	if fields[0] == hashExpires {
+		return "", argError("%s is not a field", hashExpires)
+	}
+	return fields[0], nil
+}
+
+// hashSet :: HSet: sets the fields of the object in args[1], which expire at
+// args[2] or never when it is 0, replying with how many were new
+func hashSet(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	hash, args, err := hashAt(value, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	var fields map[string]interface{}
+	if len(args) > 0 {
+		fields, _ = args[0].(map[string]interface{})
+	}
+	if len(fields) == 0 {
+		return nil, nil, argError("no fields to set")
+	}
+	if _, ok := fields[hashExpires]; ok {
+		return nil, nil, argError("%s is not a field", hashExpires)
+	}
+	at, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	set := copyHash(hash, len(fields))
+	added := 0
+	for field, v := range fields {
+		if _, ok := hash[field]; !ok {
+			added++
+		}
+		set[field] = v
+		setHashExpiry(set, field, int64(at))
+	}
+	return added, set, nil
+}
+
+// hashDelete :: HDel: removes the fields, replying with how many were
+// there. Removing the last field deletes the key
+func hashDelete(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	hash, args, err := hashAt(value, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, err := argStrings(args, "fields")
+	if err != nil {
+		return nil, nil, err
+	}
+	var rest map[string]interface{}
+	deleted := 0
+	for _, field := range fields {
+		if _, ok := hash[field]; !ok || field == hashExpires {
+			continue
+		}
+		if rest == nil {
+			rest = copyHash(hash, 0)
+		}
+		delete(rest, field)
+		setHashExpiry(rest, field, 0)
+		deleted++
+	}
+	switch {
+	case rest == nil:
+		return 0, noChange, nil
+	case len(hashFields(rest)) == 0:
+		return deleted, nil, nil
+	}
+	return deleted, rest, nil
+}
+
+// hashIncrBy :: HIncrBy: adds args[2] to the integer in field args[1],
+// which starts at 0, replying with the result. The field keeps its expiry
+func hashIncrBy(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	hash, args, err := hashAt(value, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	field, err := argField(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	by, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, argError("by must be an integer")
+	}
+	var n int
+	if current, ok := hash[field]; ok {
+		if n, err = argInt([]interface{}{current}, 0); err != nil {
+			return nil, nil, &conflictError{fmt.Sprintf("Field %q does not hold an integer", field)}
+		}
+	}
+	n += by
+	incremented := copyHash(hash, 1)
+	incremented[field] = float64(n) // as JSON numbers are decoded
+	return n, incremented, nil
+}
+
+// hashExpire :: HExpire: sets field args[1] to expire at args[2], never
+// when it is 0, replying whether the field is there
+func hashExpire(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	hash, args, err := hashAt(value, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	field, err := argField(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	at, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := hash[field]; !ok {
+		return false, noChange, nil
+	}
+	expiring := copyHash(hash, 0)
+	setHashExpiry(expiring, field, int64(at))
+	return true, expiring, nil
+}
+
+// hashPrune :: drops the fields expired at args[0], replying with how many
+// there were, for the janitor. Dropping the last field deletes the key
+func hashPrune(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	hash, _, err := hashAt(value, args)
+	if err != nil || value == nil {
+		return 0, noChange, err
+	}
+	pruned := len(hashFields(value.(map[string]interface{}))) - len(hashFields(hash))
+	switch {
+	case pruned == 0:
+		return 0, noChange, nil
+	case len(hashFields(hash)) == 0:
+		return pruned, nil, nil
+	}
+	return pruned, hash, nil
+}
+
+// hashGet :: HGet: the value of field args[1] and when it expires, or
+// errFieldNotFound
+func hashGet(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	hash, args, err := hashAt(value, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	field, err := argField(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, ok := hash[field]
+	if !ok {
+		return nil, nil, errFieldNotFound
+	}
+	reply := map[string]interface{}{"value": v}
+	if at := hashExpiry(hash, field); at != 0 {
+		reply["expiresAt"] = time.UnixMilli(at).UTC()
+	}
+	return reply, value, nil
+}
+
+// hashGetAll :: HGetAll: every field
+func hashGetAll(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	hash, _, err := hashAt(value, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hash == nil {
+		return map[string]interface{}{}, value, nil
+	}
+	return hashFields(hash), value, nil
+}
+
+// pruneHashFields :: removes the expired fields of the hashes in the
+// default cache, for the janitor
+func pruneHashFields() {
+	now := clock.Now().UnixMilli()
+	var keys []string
+	cache.Walk(itemBatch, func(item lru.CacheItem) bool {
+		if hash, ok := item.Value.(map[string]interface{}); ok {
+			if _, ok := hash[hashExpires]; ok && len(liveHash(hash, now)) != len(hash) {
+				keys = append(keys, item.Key)
+			}
+		}
+		return true
+	})
+	op := typeOp{Name: "hprune", Args: []interface{}{now}}
+	for _, key := range keys {
+		if _, err := applyTypeOp(key, op, 0, "", ReasonTTL); err != nil {
+			slog.Warn("janitor: pruning hash fields", "key", key, "err", err)
+		}
+	}
+}
+
+// registerHashRoutes :: mounts /cache/{key}/hash
+func registerHashRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/hash", withConsistency(hashGetAllHandler)).Methods("GET")
+	r.Handle("/cache/{key}/hash", typeWrite(hashSetHandler)).Methods("POST")
+	r.Handle("/cache/{key}/hash/{field}", withConsistency(hashGetHandler)).Methods("GET")
+	r.Handle("/cache/{key}/hash/{field}", typeWrite(hashSetFieldHandler)).Methods("POST")
+	r.Handle("/cache/{key}/hash/{field}", typeWrite(hashDeleteHandler)).Methods("DELETE")
+	r.Handle("/cache/{key}/hash/{field}/incr", typeWrite(hashIncrHandler)).Methods("POST")
+	r.Handle("/cache/{key}/hash/{field}/expire", typeWrite(hashExpireHandler)).Methods("POST")
+}
+
+// fieldExpiry returns when the fields a request sets expire, in Unix
+// milliseconds after now, 0 for never
+func (r typeRequest) fieldExpiry(now int64) int64 {
+	if r.FieldExpiration <= 0 {
+		return 0
+	}
+	return now + int64(r.FieldExpiration)*1000
+}
+
+// hashGetAllHandler serves GET /cache/{key}/hash; a key not cached is an
+// empty hash
+func hashGetAllHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	args := []interface{}{clock.Now().UnixMilli()}
+	fields, err := runTypeOp(r, key, typeOp{Name: "hgetall", Args: args}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"fields": fields})
+}
+
+// hashSetHandler serves POST /cache/{key}/hash: sets {"fields": {...}},
+// which expire after "fieldExpiration" seconds when it is given
+func hashSetHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	now := clock.Now().UnixMilli()
+	args := []interface{}{now, data.Fields, data.fieldExpiry(now)}
+	added, err := runTypeOp(r, key, typeOp{Name: "hset", Args: args}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"added": added})
+}
+
+// hashGetHandler serves GET /cache/{key}/hash/{field}, with the field's
+// expiresAt when it has one
+func hashGetHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	args := []interface{}{clock.Now().UnixMilli(), field}
+	reply, err := runTypeOp(r, key, typeOp{Name: "hget", Args: args}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	fieldReply := reply.(map[string]interface{})
+	fieldReply["field"] = field
+	writeTypeReply(w, key, fieldReply)
+}
+
+// hashSetFieldHandler serves POST /cache/{key}/hash/{field}: sets the field
+// to {"value": ...}, expiring after "fieldExpiration" seconds when it is
+// given
+func hashSetFieldHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	if data.Value == nil {
+		http.Error(w, "value is required", http.StatusBadRequest)
+		return
+	}
+	now := clock.Now().UnixMilli()
+	args := []interface{}{now, map[string]interface{}{field: data.Value}, data.fieldExpiry(now)}
+	added, err := runTypeOp(r, key, typeOp{Name: "hset", Args: args}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"field": field, "created": added == 1})
+}
+
+func hashDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	args := []interface{}{clock.Now().UnixMilli(), field}
+	deleted, err := runTypeOp(r, key, typeOp{Name: "hdel", Args: args}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"field": field, "deleted": deleted == 1})
+}
+
+// hashIncrHandler serves POST /cache/{key}/hash/{field}/incr: adds "by", 1
+// by default, to the integer in the field
+func hashIncrHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	by := 1.0
+	if data.By != nil {
+		by = *data.By
+	}
+	args := []interface{}{clock.Now().UnixMilli(), field, by}
+	value, err := runTypeOp(r, key, typeOp{Name: "hincrby", Args: args}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"field": field, "value": value})
+}
+
+// hashExpireHandler serves POST /cache/{key}/hash/{field}/expire: the field
+// expires after {"fieldExpiration": seconds}, or never with 0
+func hashExpireHandler(w http.ResponseWriter, r *http.Request) {
+	key, field := mux.Vars(r)["key"], mux.Vars(r)["field"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	now := clock.Now().UnixMilli()
+	args := []interface{}{now, field, data.fieldExpiry(now)}
+	found, err := runTypeOp(r, key, typeOp{Name: "hexpire", Args: args}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	if found != true {
+		http.Error(w, errFieldNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"field": field, "fieldExpiration": data.FieldExpiration})
+}
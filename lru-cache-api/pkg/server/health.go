@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readinessChecks are what /readyz runs; each returns why the node is not
+// ready yet, nil once it is
+var (
+	readinessMutex  sync.RWMutex
+	readinessChecks = map[string]func() error{}
+
+	snapshotLoaded atomic.Bool
+	// replicaConnected is set while a replica streams from its primary
+	replicaConnected atomic.Bool
+)
+
+// addReadinessCheck :: makes /readyz fail while check returns an error
+func addReadinessCheck(name string, check func() error) {
+	readinessMutex.Lock()
+	defer readinessMutex.Unlock()
+	readinessChecks[name] = check
+}
+
+// probePath reports whether path is a health probe, which load balancers
+// and the kubelet call without credentials
+func probePath(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+// signedPath reports whether path is the invalidation webhook, which
+// checks its own signature in place of credentials
+func signedPath(path string) bool {
+	return path == "/invalidate" && config.InvalidationSecret != ""
+}
+
+// setupReadiness :: registers the checks that apply to cfg
+func setupReadiness(cfg *Config) {
+	addReadinessCheck("draining", func() error {
+		if draining.Load() {
+			return errors.New("node is draining")
+		}
+		return nil
+	})
+
+	if cfg.SnapshotPath != "" {
+		addReadinessCheck("snapshot", func() error {
+			if !snapshotLoaded.Load() {
+				return errors.New("snapshot not loaded yet")
+			}
+			return nil
+		})
+		addReadinessCheck("persistence", func() error {
+			return checkWritable(filepath.Dir(cfg.SnapshotPath))
+		})
+	}
+
+	switch {
+	case cfg.Role == RoleReplica:
+		addReadinessCheck("replication", func() error {
+			if !replicaConnected.Load() {
+				return fmt.Errorf("not connected to primary %s", cfg.PrimaryAddr)
+			}
+			return nil
+		})
+	case cfg.RaftAddr != "":
+		addReadinessCheck("raft", func() error {
+			if raftNode == nil {
+				return errors.New("raft not started")
+			}
+			if addr, _ := raftNode.LeaderWithID(); addr == "" {
+				return errors.New("no raft leader known")
+			}
+			return nil
+		})
+	}
+	if cfg.GossipAddr != "" && len(cfg.GossipSeeds) > 0 {
+		addReadinessCheck("gossip", func() error {
+			if gossip == nil || gossip.NumMembers() < 2 {
+				return errors.New("not joined to any gossip member")
+			}
+			return nil
+		})
+	}
+}
+
+// checkWritable creates and removes a file in dir
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// healthzHandler serves GET /healthz: the process is up and serving
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+		"node":   config.Node.ID,
+		"uptime": clock.Now().Sub(startedAt).Round(time.Second).String(),
+	})
+}
+
+// CheckResult is one check's entry in GET /readyz
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// readyzHandler serves GET /readyz: 200 when every readiness check passes,
+// 503 otherwise, with the result of each check
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	readinessMutex.RLock()
+	ready := true
+	results := make(map[string]CheckResult, len(readinessChecks))
+	for name, check := range readinessChecks {
+		if err := check(); err != nil {
+			results[name] = CheckResult{Error: err.Error()}
+			ready = false
+		} else {
+			results[name] = CheckResult{OK: true}
+		}
+	}
+	readinessMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	body := map[string]interface{}{"ready": ready, "checks": results}
+	if m := maintenance.Load(); m != nil {
+		// Reads go on, so the node stays ready
+		body["maintenance"] = m
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// eventHistory numbers every change sent to WebSocket clients and keeps the
+// last CACHE_EVENT_HISTORY of them, so consumers that missed some can catch up
+type eventHistory struct {
+	mutex  sync.RWMutex
+	events []CacheUpdate
+	next   int
+	size   int
+	seq    uint64
+}
+
+var history = &eventHistory{}
+
+// add :: numbers update and keeps it, returning it with its Seq set
+func (h *eventHistory) add(update CacheUpdate) CacheUpdate {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.seq++
+	update.Seq = h.seq
+	if h.size == 0 {
+		return update
+	}
+	if len(h.events) < h.size {
+		h.events = append(h.events, update)
+	} else {
+		h.events[h.next] = update
+	}
+	h.next = (h.next + 1) % h.size
+	return update
+}
+
+// since returns the kept events after seq, oldest first, the latest
+// sequence number, and whether some events after seq are no longer kept
+func (h *eventHistory) since(seq uint64) ([]CacheUpdate, uint64, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	events := []CacheUpdate{}
+	if seq >= h.seq {
+		return events, h.seq, false
+	}
+	for i := range h.events {
+		// Until the ring is full next is len(h.events), so this starts at 0
+		if event := h.events[(h.next+i)%len(h.events)]; event.Seq > seq {
+			events = append(events, event)
+		}
+	}
+	oldest := h.seq + 1 - uint64(len(h.events))
+	return events, h.seq, seq+1 < oldest
+}
+
+// skip uses up a sequence number for updates that were never kept and
+// forgets the rest, so that since reports any seq before it as truncated
+func (h *eventHistory) skip() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.seq++
+	h.events, h.next = nil, 0
+}
+
+func (h *eventHistory) latestSeq() uint64 {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.seq
+}
+
+// historyHandler serves GET /events/history?since=<seq>&types=: the changes
+// after seq that the caller may see, oldest first. When the oldest ones are gone
+// "truncated" is set and the consumer should reload GET /cache instead
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "since must be a sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	types, err := parseEventTypes(queryPatterns(r.URL.Query().Get("types")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.URL.Query().Get("cache")
+	events, latest, truncated := history.since(since)
+	principal := principalFrom(r.Context())
+	visible := make([]CacheUpdate, 0, len(events))
+	for _, event := range events {
+		if event.Cache == name && (types == nil || types[event.Type]) && canAccess(r.Context(), event.Key, ScopeRead) {
+			event.Value = redact(principal, event.Key, event.Value)
+			visible = append(visible, event)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events":    visible,
+		"latestSeq": latest,
+		"epoch":     historyEpoch,
+		"truncated": truncated,
+	})
+}
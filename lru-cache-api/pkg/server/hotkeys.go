@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+
+	// hotKeySlots is how many pieces the window is split into; the oldest
+	// piece is dropped as the window slides
+	hotKeySlots = 6
+)
+
+// countMinSketch estimates how often keys were seen in constant memory. It
+// may overcount, when keys collide in every row, but never undercounts
+type countMinSketch struct {
+	counts [sketchDepth][sketchWidth]uint32
+}
+
+var sketchSeeds = func() (seeds [sketchDepth]maphash.Seed) {
+	for i := range seeds {
+		seeds[i] = maphash.MakeSeed()
+	}
+	return seeds
+}()
+
+func sketchIndex(row int, key string) int {
+	return int(maphash.String(sketchSeeds[row], key) % sketchWidth)
+}
+
+func (s *countMinSketch) add(key string) {
+	for row := range s.counts {
+		s.counts[row][sketchIndex(row, key)]++
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint32 {
+	least := ^uint32(0)
+	for row := range s.counts {
+		least = min(least, s.counts[row][sketchIndex(row, key)])
+	}
+	return least
+}
+
+// HotKey is one entry of GET /stats/hotkeys
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint32 `json:"count"`
+}
+
+// hotKeyTracker counts lookups per key over a sliding window, with one
+// sketch per slot, and keeps the keys with the highest estimates as
+// candidates for the top list
+type hotKeyTracker struct {
+	mutex      sync.Mutex
+	slots      [hotKeySlots]countMinSketch
+	current    int
+	candidates map[string]uint32
+	size       int
+}
+
+var hotKeys *hotKeyTracker
+
+// setupHotKeys :: starts counting lookups when CACHE_HOTKEYS_WINDOW is set
+func setupHotKeys(cfg *Config) {
+	if cfg.HotKeysWindow <= 0 || cfg.HotKeysTop <= 0 {
+		return
+	}
+	// Twice as many candidates as reported, so keys near the cut are not lost
+	hotKeys = &hotKeyTracker{candidates: make(map[string]uint32), size: 2 * cfg.HotKeysTop}
+	cache.OnLookup = append(cache.OnLookup, func(key string, _ bool) { hotKeys.record(key) })
+	go hotKeys.slide(cfg.HotKeysWindow / hotKeySlots)
+}
+
+func (t *hotKeyTracker) estimate(key string) uint32 {
+	var total uint32
+	for i := range t.slots {
+		total += t.slots[i].estimate(key)
+	}
+	return total
+}
+
+func (t *hotKeyTracker) record(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.slots[t.current].add(key)
+	count := t.estimate(key)
+	if _, ok := t.candidates[key]; ok || len(t.candidates) < t.size {
+		t.candidates[key] = count
+		return
+	}
+
+	coldest, least := "", count
+	for candidate, c := range t.candidates {
+		if c < least {
+			coldest, least = candidate, c
+		}
+	}
+	if coldest != "" {
+		delete(t.candidates, coldest)
+		t.candidates[key] = count
+	}
+}
+
+// slide drops the oldest slot every interval and re-estimates the
+// candidates, forgetting those no longer seen in the window
+func (t *hotKeyTracker) slide(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mutex.Lock()
+		t.current = (t.current + 1) % hotKeySlots
+		t.slots[t.current] = countMinSketch{}
+		for key := range t.candidates {
+			if count := t.estimate(key); count > 0 {
+				t.candidates[key] = count
+			} else {
+				delete(t.candidates, key)
+			}
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// top returns the hottest candidates, most looked up first
+func (t *hotKeyTracker) top() []HotKey {
+	t.mutex.Lock()
+	keys := make([]HotKey, 0, len(t.candidates))
+	for key, count := range t.candidates {
+		keys = append(keys, HotKey{Key: key, Count: count})
+	}
+	t.mutex.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// hotKeysHandler serves GET /stats/hotkeys: the keys looked up most over
+// the last CACHE_HOTKEYS_WINDOW, with approximate counts, at most ?limit=
+// of them (default CACHE_HOTKEYS_TOP)
+func hotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if hotKeys == nil {
+		http.Error(w, "Hot key tracking is disabled", http.StatusNotFound)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > config.HotKeysTop {
+		limit = config.HotKeysTop
+	}
+
+	keys := []HotKey{}
+	for _, hot := range hotKeys.top() {
+		if len(keys) == limit {
+			break
+		}
+		if canAccess(r.Context(), hot.Key, ScopeRead) {
+			keys = append(keys, hot)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window": config.HotKeysWindow.String(),
+		"keys":   keys,
+	})
+}
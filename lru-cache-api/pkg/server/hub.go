@@ -0,0 +1,483 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// wsProtocol is the subprotocol /ws selects when a client offers it, as
+// browsers require when they offer credentials as subprotocols
+const wsProtocol = "cache.v1"
+
+// What happens to a client whose send buffer is full
+const (
+	SlowClientDisconnect = "disconnect"  // close it with 1013, it reconnects and reloads
+	SlowClientDropOldest = "drop-oldest" // discard the oldest pending update
+	SlowClientCoalesce   = "coalesce"    // keep only the latest pending update per key
+)
+
+var (
+	wsBackpressure = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_websocket_backpressure_total",
+		Help: "Updates dropped or coalesced, and clients disconnected, because a WebSocket client fell behind.",
+	}, []string{"action"})
+
+	broadcastCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cache_broadcast_coalesced_total",
+		Help: "Updates not sent because a later one for the same key came within CACHE_WS_BATCH_WINDOW.",
+	})
+)
+
+// sendBuffer holds the updates waiting for one client, at most limit of them
+type sendBuffer struct {
+	mutex   sync.Mutex
+	updates []CacheUpdate
+	limit   int
+	policy  string
+	closed  bool
+	wake    chan struct{} // signalled when updates arrive or the buffer closes
+}
+
+func newSendBuffer(limit int, policy string) *sendBuffer {
+	return &sendBuffer{limit: limit, policy: policy, wake: make(chan struct{}, 1)}
+}
+
+// push adds update, applying the policy when the buffer is full. It reports
+// false when the client has to be disconnected instead
+func (b *sendBuffer) push(update CacheUpdate) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return true
+	}
+
+	if b.policy == SlowClientCoalesce && update.Type != EventMessage {
+		// Only the latest value of a key matters to a client that is behind
+		for i, pending := range b.updates {
+			if pending.target() == update.target() && pending.Type != EventMessage {
+				b.updates = append(b.updates[:i], b.updates[i+1:]...)
+				wsBackpressure.WithLabelValues("coalesced").Inc()
+				break
+			}
+		}
+	}
+	if len(b.updates) >= b.limit {
+		if b.policy == SlowClientDisconnect {
+			wsBackpressure.WithLabelValues("disconnected").Inc()
+			return false
+		}
+		b.updates = b.updates[1:]
+		wsBackpressure.WithLabelValues("dropped").Inc()
+	}
+	b.updates = append(b.updates, update)
+	b.signal()
+	return true
+}
+
+// take returns the pending updates, oldest first, and whether the buffer
+// was closed; a closed buffer takes no more updates
+func (b *sendBuffer) take() ([]CacheUpdate, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	updates := b.updates
+	b.updates = nil
+	return updates, b.closed
+}
+
+func (b *sendBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.signal()
+}
+
+func (b *sendBuffer) signal() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wsClient is one WebSocket connection and the keys it subscribed to
+type wsClient struct {
+	conn      *websocket.Conn
+	principal *Principal
+	binary    bool // MessagePack frames, see wsProtocolMsgpack
+
+	// credentials are the upgrade request's, for the client's ops
+	credentials http.Header
+
+	// store is the cache the client follows, named cacheName, "" for the
+	// default one
+	store     lru.Cache
+	cacheName string
+
+	// queue holds the updates the hub sends this client, written once ready
+	// is closed. The hub closes it when dropping the client, after setting
+	// closeCode and closeText
+	queue     *sendBuffer
+	ready     chan struct{}
+	syncedSeq uint64 // queued updates up to this seq were covered by the initial state
+	closeCode int
+	closeText string
+
+	// pings carries the payloads of the client's pings to the write pump,
+	// which answers them after the updates queued before
+	pings chan string
+
+	writeMutex sync.Mutex
+
+	subMutex sync.RWMutex
+	patterns []string        // nil until the client subscribes: every key
+	types    map[string]bool // event types the client wants, nil for all
+	channels []string        // patterns of the channels the client follows
+}
+
+func newWSClient(conn *websocket.Conn, principal *Principal) *wsClient {
+	return &wsClient{
+		conn:      conn,
+		principal: principal,
+		store:     cache,
+		binary:    conn.Subprotocol() == wsProtocolMsgpack,
+		queue:     newSendBuffer(config.WSBufferSize, config.WSSlowClientPolicy),
+		ready:     make(chan struct{}),
+		pings:     make(chan string, 1),
+		closeCode: websocket.CloseNormalClosure,
+	}
+}
+
+// send writes one message as a JSON text frame, or a binary frame holding
+// just it; gorilla allows one writer at a time
+func (c *wsClient) send(v interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(config.WSWriteTimeout))
+	if c.binary {
+		return c.writeFrame([]interface{}{v})
+	}
+	data, err := jsonCodec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(websocket.TextMessage, data)
+}
+
+// keepAlive makes reads fail once the client has been silent for
+// CACHE_WS_PONG_TIMEOUT; the write pump pings it often enough to hear back
+func (c *wsClient) keepAlive() {
+	c.extendDeadline()
+	c.conn.SetPongHandler(func(string) error {
+		c.extendDeadline()
+		return nil
+	})
+	c.conn.SetPingHandler(func(payload string) error {
+		c.extendDeadline()
+		select {
+		case c.pings <- payload:
+		default: // the previous ping is not answered yet, skip this one
+		}
+		return nil
+	})
+}
+
+// extendDeadline is called whenever the client is heard from
+func (c *wsClient) extendDeadline() {
+	c.conn.SetReadDeadline(time.Now().Add(config.WSPongTimeout))
+}
+
+// writePump sends queued updates and pings until the hub closes the queue,
+// then says goodbye with the close code the hub chose
+func (c *wsClient) writePump(done func()) {
+	defer done()
+	<-c.ready
+
+	ticker := time.NewTicker(config.WSPingInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		closed := false
+		select {
+		case <-c.queue.wake:
+			closed, err = c.flush()
+		case payload := <-c.pings:
+			if closed, err = c.flush(); err == nil {
+				// Answered after the updates queued so far, so a replica
+				// measuring its lag knows it has everything sent before its ping
+				err = c.conn.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(config.WSWriteTimeout))
+			}
+		case <-ticker.C:
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(config.WSWriteTimeout))
+		}
+		if err != nil {
+			slog.Debug("websocket: writing", "err", err)
+			// Closing makes the read loop fail, which unregisters the client
+			c.conn.Close()
+			return
+		}
+		if closed {
+			message := websocket.FormatCloseMessage(c.closeCode, c.closeText)
+			c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// flush writes the pending updates, reporting whether the hub closed the
+// queue. Channel messages have no seq, and are never covered
+func (c *wsClient) flush() (bool, error) {
+	updates, closed := c.queue.take()
+	pending := updates[:0]
+	for _, update := range updates {
+		if update.Seq == 0 || update.Seq > c.syncedSeq {
+			pending = append(pending, update)
+		}
+	}
+	return closed, c.sendUpdates(pending)
+}
+
+// hub owns the set of WebSocket clients and channel listeners. Only its run
+// goroutine touches the sets; connections join and leave through register
+// and unregister, listeners through follow and unfollow, and updates arrive
+// on broadcast
+type hub struct {
+	clients    map[*wsClient]bool
+	register   chan *wsClient
+	unregister chan *wsClient
+	stop       chan struct{}
+	done       chan struct{} // closed once run returns
+	writers    sync.WaitGroup
+
+	listeners map[*channelListener]bool
+	follow    chan *channelListener
+	unfollow  chan *channelListener
+}
+
+var wsHub = newHub()
+
+func newHub() *hub {
+	return &hub{
+		clients:    make(map[*wsClient]bool),
+		register:   make(chan *wsClient),
+		unregister: make(chan *wsClient),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		listeners:  make(map[*channelListener]bool),
+		follow:     make(chan *channelListener),
+		unfollow:   make(chan *channelListener),
+	}
+}
+
+// join adds client, reporting false once the hub has shut down
+func (h *hub) join(client *wsClient) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// leave removes client; it is safe to call more than once
+func (h *hub) leave(client *wsClient) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+// listen adds listener, reporting false once the hub has shut down
+func (h *hub) listen(listener *channelListener) bool {
+	select {
+	case h.follow <- listener:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// unlisten removes listener; it is safe to call more than once
+func (h *hub) unlisten(listener *channelListener) {
+	select {
+	case h.unfollow <- listener:
+	case <-h.done:
+	}
+}
+
+// drop removes client and closes its queue, which ends its write pump
+func (h *hub) drop(client *wsClient, code int, text string) {
+	delete(h.clients, client)
+	client.closeCode, client.closeText = code, text
+	client.queue.close()
+}
+
+// run :: fans updates from broadcast out to the subscribed clients
+func (h *hub) run() {
+	defer close(h.done)
+
+	// With CACHE_WS_BATCH_WINDOW set, updates wait in batch until flush fires
+	var batch updateBatch
+	var flush <-chan time.Time
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+			h.writers.Add(1)
+			go client.writePump(h.writers.Done)
+		case client := <-h.unregister:
+			if h.clients[client] {
+				h.drop(client, websocket.CloseNormalClosure, "")
+			}
+		case listener := <-h.follow:
+			h.listeners[listener] = true
+		case listener := <-h.unfollow:
+			delete(h.listeners, listener)
+		case update := <-broadcast:
+			window := tuned().WSBatchWindow
+			if update.Type == EventMessage {
+				h.deliver(update)
+				continue
+			}
+			if window <= 0 {
+				h.fanOut(update)
+				continue
+			}
+			if batch.add(update) {
+				broadcastCoalesced.Inc()
+			}
+			if flush == nil {
+				flush = time.After(window)
+			}
+		case <-flush:
+			for _, update := range batch.take() {
+				h.fanOut(update)
+			}
+			flush = nil
+		case <-broadcastLost:
+			h.resync(&batch)
+		case <-h.stop:
+			for _, update := range batch.take() {
+				h.fanOut(update)
+			}
+			for client := range h.clients {
+				h.drop(client, websocket.CloseGoingAway, "server shutting down")
+			}
+			for listener := range h.listeners {
+				listener.queue.close()
+			}
+			return
+		}
+	}
+}
+
+// fanOut numbers update and queues it for the clients that want it
+func (h *hub) fanOut(update CacheUpdate) {
+	update = history.add(update)
+	for client := range h.clients {
+		if !client.wants(update) {
+			continue
+		}
+		visible := update
+		visible.Value = redact(client.principal, update.Key, update.Value)
+		if !client.queue.push(visible) {
+			slog.Warn("websocket: client too slow, disconnecting", "remote_addr", client.conn.RemoteAddr().String())
+			h.drop(client, websocket.CloseTryAgainLater, "too slow")
+		}
+	}
+}
+
+// deliver queues a channel message for the clients and listeners following
+// its channel
+func (h *hub) deliver(message CacheUpdate) {
+	for client := range h.clients {
+		if !client.follows(message.Channel) || !allowed(client.principal, channelKey(message.Channel), ScopeRead) {
+			continue
+		}
+		if !client.queue.push(message) {
+			slog.Warn("websocket: client too slow, disconnecting", "remote_addr", client.conn.RemoteAddr().String())
+			h.drop(client, websocket.CloseTryAgainLater, "too slow")
+		}
+	}
+	for listener := range h.listeners {
+		if listener.wants(message) && !listener.queue.push(message) {
+			slog.Warn("channels: listener too slow, disconnecting", "channel", listener.pattern)
+			delete(h.listeners, listener)
+			listener.queue.close()
+		}
+	}
+}
+
+// resync closes every connection after updates were discarded, so clients
+// reconnect and reload. The gap left in the history makes resuming from
+// before it reload too
+func (h *hub) resync(batch *updateBatch) {
+	for _, update := range batch.take() {
+		h.fanOut(update)
+	}
+	history.skip()
+	for client := range h.clients {
+		h.drop(client, websocket.CloseTryAgainLater, "missed updates")
+	}
+}
+
+// updateTarget is the key an update is about, in the cache it names: the
+// same key in two named caches is two keys
+type updateTarget struct {
+	cache, key string
+}
+
+func (u CacheUpdate) target() updateTarget {
+	return updateTarget{cache: u.Cache, key: u.Key}
+}
+
+// updateBatch holds the updates of one batch window, the latest per key,
+// in the order the keys first changed
+type updateBatch struct {
+	updates []CacheUpdate
+	index   map[updateTarget]int
+}
+
+// add keeps update, reporting whether it replaced one for the same key
+func (b *updateBatch) add(update CacheUpdate) bool {
+	if i, ok := b.index[update.target()]; ok {
+		b.updates[i] = update
+		return true
+	}
+	if b.index == nil {
+		b.index = make(map[updateTarget]int)
+	}
+	b.index[update.target()] = len(b.updates)
+	b.updates = append(b.updates, update)
+	return false
+}
+
+func (b *updateBatch) take() []CacheUpdate {
+	updates := b.updates
+	b.updates, b.index = nil, nil
+	return updates
+}
+
+// shutdown closes every connection with a going away frame, waiting at most
+// timeout for the queued updates to be written
+func (h *hub) shutdown(timeout time.Duration) {
+	close(h.stop)
+	<-h.done
+
+	flushed := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(timeout):
+		slog.Warn("websocket: timed out closing connections")
+	}
+}
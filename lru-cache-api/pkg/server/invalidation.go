@@ -0,0 +1,276 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// InvalidationRule removes the keys matching Pattern every Every, or daily
+// at the time of day At, in the server's time zone
+type InvalidationRule struct {
+	Action  string // delete or flush, the type of the events sent
+	Pattern string
+	At      time.Duration // since midnight, when Every is zero
+	Every   time.Duration
+}
+
+func (r InvalidationRule) String() string {
+	if r.Every > 0 {
+		return fmt.Sprintf("%s %s every %s", r.Action, r.Pattern, r.Every)
+	}
+	return fmt.Sprintf("%s %s at %02d:%02d", r.Action, r.Pattern, int(r.At.Hours()), int(r.At.Minutes())%60)
+}
+
+// next returns when the rule runs after last, its previous run or the time
+// the server started
+func (r InvalidationRule) next(last time.Time) time.Time {
+	if r.Every > 0 {
+		return last.Add(r.Every)
+	}
+	year, month, day := last.Date()
+	at := time.Date(year, month, day, 0, 0, 0, 0, last.Location()).Add(r.At)
+	if !at.After(last) {
+		at = time.Date(year, month, day+1, 0, 0, 0, 0, last.Location()).Add(r.At)
+	}
+	return at
+}
+
+// parseInvalidationRules :: parses rules such as "delete daily:* every 24h"
+// or "flush namespace reports at 02:00". The pattern may be given as a
+// namespace, which matches its keys, or a prefix
+func parseInvalidationRules(specs []string) ([]InvalidationRule, error) {
+	var rules []InvalidationRule
+	for _, spec := range specs {
+		rule, err := parseInvalidationRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseInvalidationRule(spec string) (InvalidationRule, error) {
+	fields := strings.Fields(spec)
+	invalid := func(why string) (InvalidationRule, error) {
+		return InvalidationRule{}, fmt.Errorf("invalid invalidation rule %q, %s", spec, why)
+	}
+	if len(fields) == 5 {
+		switch fields[1] {
+		case "namespace":
+			fields[2] = strings.TrimSuffix(strings.TrimSuffix(fields[2], "*"), ":") + ":*"
+		case "prefix":
+			fields[2] = strings.TrimSuffix(fields[2], "*") + "*"
+		default:
+			return invalid("expected namespace or prefix before the pattern")
+		}
+		fields = append(fields[:1], fields[2:]...)
+	}
+	if len(fields) != 4 {
+		return invalid("expected e.g. delete daily:* every 24h")
+	}
+
+	rule := InvalidationRule{Action: fields[0], Pattern: fields[1]}
+	if rule.Action != EventDelete && rule.Action != EventFlush {
+		return invalid("the action must be delete or flush")
+	}
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return invalid("bad pattern")
+	}
+	switch fields[2] {
+	case "every":
+		every, err := time.ParseDuration(fields[3])
+		if err != nil || every < time.Second {
+			return invalid("the interval must be a duration of at least 1s")
+		}
+		rule.Every = every
+	case "at":
+		hours, minutes, ok := strings.Cut(fields[3], ":")
+		h, errH := strconv.Atoi(hours)
+		m, errM := strconv.Atoi(minutes)
+		if !ok || errH != nil || errM != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+			return invalid("the time must be HH:MM")
+		}
+		rule.At = time.Duration(h)*time.Hour + time.Duration(m)*time.Minute
+	default:
+		return invalid("expected at HH:MM or every <duration>")
+	}
+	return rule, nil
+}
+
+// InvalidationState is what GET /admin/invalidations reports about a rule
+type InvalidationState struct {
+	Rule        string     `json:"rule"`
+	Next        time.Time  `json:"next"`
+	LastRun     *time.Time `json:"lastRun,omitempty"`
+	LastRemoved int        `json:"lastRemoved"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+type invalidationState struct {
+	rule        InvalidationRule
+	next        time.Time
+	lastRun     time.Time
+	lastRemoved int
+	lastError   string
+}
+
+var (
+	invalidationMutex  sync.Mutex
+	invalidationStates []*invalidationState
+)
+
+// startInvalidation :: runs every CACHE_INVALIDATION_RULES rule on its
+// schedule
+func startInvalidation(cfg *Config) {
+	now := time.Now()
+	for _, rule := range cfg.InvalidationRules {
+		state := &invalidationState{rule: rule, next: rule.next(now)}
+		invalidationStates = append(invalidationStates, state)
+		go state.run()
+	}
+}
+
+func (s *invalidationState) run() {
+	for {
+		invalidationMutex.Lock()
+		next := s.next
+		invalidationMutex.Unlock()
+		time.Sleep(time.Until(next))
+
+		// Only the node taking writes runs the rules, the others get the
+		// deletes from it
+		if config.Role == RoleReplica || (config.RaftAddr != "" && raftNode.State() != raft.Leader) {
+			invalidationMutex.Lock()
+			s.next = s.rule.next(next)
+			invalidationMutex.Unlock()
+			continue
+		}
+
+		start := time.Now()
+		removed, err := invalidate(s.rule)
+		if err != nil {
+			slog.Error("invalidation: rule failed", "rule", s.rule.String(), "removed", removed, "err", err)
+		} else {
+			slog.Info("invalidation: rule ran", "rule", s.rule.String(), "removed", removed, "took", time.Since(start))
+		}
+
+		invalidationMutex.Lock()
+		s.lastRun, s.lastRemoved, s.lastError = start, removed, ""
+		if err != nil {
+			s.lastError = err.Error()
+		}
+		s.next = s.rule.next(next)
+		invalidationMutex.Unlock()
+	}
+}
+
+// invalidate removes the keys rule matches, returning how many
+func invalidate(rule InvalidationRule) (int, error) {
+	return removeKeys(cache.Keys(rule.Pattern), rule.Action, ReasonSchedule, "")
+}
+
+// removeKeys deletes keys everywhere, through raft or from this node, its
+// peers and the other regions, sending eventType events for them. Returns
+// how many were removed before any error
+func removeKeys(keys []string, eventType, reason, requestID string) (int, error) {
+	removed := 0
+	for _, key := range keys {
+		update := removal(key, eventType, reason, requestID)
+		if raftCluster() {
+			if err := applyCommand(raftCommand{Op: opDelete, Key: key, RequestID: requestID, Reason: reason}); err != nil {
+				return removed, err
+			}
+		} else {
+			cache.Delete(key)
+			keyTags.remove(key)
+			publishInvalidation(key)
+			publish(update)
+		}
+		shipToRegions(update)
+		removed++
+	}
+	return removed, nil
+}
+
+// invalidationsHandler serves GET /admin/invalidations, the rules with
+// their next and last runs
+func invalidationsHandler(w http.ResponseWriter, r *http.Request) {
+	invalidationMutex.Lock()
+	states := make([]InvalidationState, 0, len(invalidationStates))
+	for _, state := range invalidationStates {
+		s := InvalidationState{Rule: state.rule.String(), Next: state.next, LastRemoved: state.lastRemoved, LastError: state.lastError}
+		if !state.lastRun.IsZero() {
+			lastRun := state.lastRun
+			s.LastRun = &lastRun
+		}
+		states = append(states, s)
+	}
+	invalidationMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": states})
+}
+
+// invalidationPreviewHandler serves GET /admin/invalidations/preview, what
+// ?rule= would remove if it ran now, without removing anything. The rule
+// is the index of a configured one or a rule to try out; at most ?limit=
+// keys are listed (default 100)
+func invalidationPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 100
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "limit must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rule, err := previewRule(query.Get("rule"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys := cache.Keys(rule.Pattern)
+	sort.Strings(keys)
+	matches := len(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rule":    rule.String(),
+		"next":    rule.next(time.Now()),
+		"matches": matches,
+		"keys":    keys,
+	})
+}
+
+func previewRule(spec string) (InvalidationRule, error) {
+	if spec == "" {
+		return InvalidationRule{}, errors.New("give the rule to preview with ?rule=")
+	}
+	if i, err := strconv.Atoi(spec); err == nil {
+		if i < 0 || i >= len(invalidationStates) {
+			return InvalidationRule{}, fmt.Errorf("there is no rule %d", i)
+		}
+		return invalidationStates[i].rule, nil
+	}
+	return parseInvalidationRule(spec)
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+)
+
+// Any value is a JSON document whose parts can be read, set and deleted at
+// a path such as $.user.emails[0], so clients changing different parts of
+// a document at once do not overwrite each other. The events of a change
+// carry the path, with the whole document as the value
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"jsonset": {fn: jsonSet},
+		"jsondel": {fn: jsonDelete},
+		"jsonget": {fn: jsonGet, read: true},
+	})
+}
+
+// parseJSONPath splits a path such as $.users[0]['first name'] into object
+// members, strings, and array indexes, ints; $ alone is the whole document.
+// Wildcards and filters are not supported
+func parseJSONPath(path string) ([]interface{}, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, argError("path must start with $")
+	}
+	var segs []interface{}
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, argError("bad path %q", path)
+			}
+			segs = append(segs, rest[1:1+end])
+			rest = rest[1+end:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, argError("bad path %q", path)
+			}
+			inner := rest[1:end]
+			if n := len(inner); n >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[n-1] == inner[0] {
+				segs = append(segs, inner[1:n-1])
+			} else if i, err := strconv.Atoi(inner); err == nil {
+				segs = append(segs, i)
+			} else {
+				return nil, argError("bad path %q", path)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, argError("bad path %q", path)
+		}
+	}
+	return segs, nil
+}
+
+// argPath returns args[0] parsed as a path
+func argPath(args []interface{}) ([]interface{}, error) {
+	path, ok := "", len(args) > 0
+	if ok {
+		path, ok = args[0].(string)
+	}
+	if !ok {
+		return nil, argError("no path given")
+	}
+	return parseJSONPath(path)
+}
+
+// jsonIndex returns the array index of seg, negative ones counting from
+// the end, or false when it is out of range
+func jsonIndex(array []interface{}, seg int) (int, bool) {
+	if seg < 0 {
+		seg += len(array)
+	}
+	return seg, seg >= 0 && seg < len(array)
+}
+
+// jsonGetAt returns the part of node at segs
+func jsonGetAt(node interface{}, segs []interface{}) (interface{}, error) {
+	for _, seg := range segs {
+		switch seg := seg.(type) {
+		case string:
+			object, _ := node.(map[string]interface{})
+			child, ok := object[seg]
+			if !ok {
+				return nil, errPathNotFound
+			}
+			node = child
+		case int:
+			array, _ := node.([]interface{})
+			i, ok := jsonIndex(array, seg)
+			if !ok {
+				return nil, errPathNotFound
+			}
+			node = array[i]
+		}
+	}
+	return node, nil
+}
+
+// jsonSetAt returns a copy of node with value at segs and whether that
+// added an object member; only the last member may be missing. The parts of
+// node along segs are copied, the rest shared
+func jsonSetAt(node interface{}, segs []interface{}, value interface{}) (interface{}, bool, error) {
+	if len(segs) == 0 {
+		return value, false, nil
+	}
+	switch seg := segs[0].(type) {
+	case string:
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false, errPathNotFound
+		}
+		child, exists := object[seg]
+		if !exists && len(segs) > 1 {
+			return nil, false, errPathNotFound
+		}
+		child, created, err := jsonSetAt(child, segs[1:], value)
+		if err != nil {
+			return nil, false, err
+		}
+		set := copyHash(object, 1)
+		set[seg] = child
+		return set, created || !exists, nil
+	default:
+		array, _ := node.([]interface{})
+		i, ok := jsonIndex(array, seg.(int))
+		if !ok {
+			return nil, false, errPathNotFound
+		}
+		child, created, err := jsonSetAt(array[i], segs[1:], value)
+		if err != nil {
+			return nil, false, err
+		}
+		set := append([]interface{}(nil), array...)
+		set[i] = child
+		return set, created, nil
+	}
+}
+
+// jsonDeleteAt returns a copy of node without the part at segs, which are
+// not empty, copied as jsonSetAt does
+func jsonDeleteAt(node interface{}, segs []interface{}) (interface{}, error) {
+	switch seg := segs[0].(type) {
+	case string:
+		object, ok := node.(map[string]interface{})
+		child, exists := object[seg]
+		if !ok || !exists {
+			return nil, errPathNotFound
+		}
+		rest := copyHash(object, 0)
+		if len(segs) == 1 {
+			delete(rest, seg)
+			return rest, nil
+		}
+		child, err := jsonDeleteAt(child, segs[1:])
+		if err != nil {
+			return nil, err
+		}
+		rest[seg] = child
+		return rest, nil
+	default:
+		array, _ := node.([]interface{})
+		i, ok := jsonIndex(array, seg.(int))
+		if !ok {
+			return nil, errPathNotFound
+		}
+		if len(segs) == 1 {
+			rest := make([]interface{}, 0, len(array)-1)
+			return append(append(rest, array[:i]...), array[i+1:]...), nil
+		}
+		child, err := jsonDeleteAt(array[i], segs[1:])
+		if err != nil {
+			return nil, err
+		}
+		rest := append([]interface{}(nil), array...)
+		rest[i] = child
+		return rest, nil
+	}
+}
+
+// jsonSet :: JSON.SET: sets path args[0] to args[1], replying whether that
+// added an object member. A key not cached can only be set whole, at $
+func jsonSet(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	segs, err := argPath(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) < 2 || args[1] == nil {
+		return nil, nil, argError("no value given")
+	}
+	if value == nil && len(segs) > 0 {
+		return nil, nil, lru.ErrNotFound
+	}
+	set, created, err := jsonSetAt(value, segs, args[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return created, set, nil
+}
+
+// jsonDelete :: JSON.DEL: deletes path args[0], replying with how many
+// parts were deleted, 0 or 1. Deleting $ deletes the key
+func jsonDelete(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	segs, err := argPath(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case value == nil:
+		return 0, noChange, nil
+	case len(segs) == 0:
+		return 1, nil, nil
+	}
+	rest, err := jsonDeleteAt(value, segs)
+	if errors.Is(err, errPathNotFound) {
+		return 0, noChange, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return 1, rest, nil
+}
+
+// jsonGet :: JSON.GET: the part at path args[0]
+func jsonGet(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	segs, err := argPath(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if value == nil {
+		return nil, nil, lru.ErrNotFound
+	}
+	part, err := jsonGetAt(value, segs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return part, value, nil
+}
+
+// registerJSONRoutes :: mounts /cache/{key}/json
+func registerJSONRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/json", withConsistency(jsonGetHandler)).Methods("GET")
+	r.Handle("/cache/{key}/json", typeWrite(jsonSetHandler)).Methods("POST")
+	r.Handle("/cache/{key}/json", typeWrite(jsonDeleteHandler)).Methods("DELETE")
+}
+
+// jsonPathParam returns the path query parameter, $ when it is left out
+func jsonPathParam(r *http.Request) string {
+	if path := r.URL.Query().Get("path"); path != "" {
+		return path
+	}
+	return "$"
+}
+
+// jsonGetHandler serves GET /cache/{key}/json?path=$.a.b
+func jsonGetHandler(w http.ResponseWriter, r *http.Request) {
+	key, path := mux.Vars(r)["key"], jsonPathParam(r)
+	part, err := runTypeOp(r, key, typeOp{Name: "jsonget", Args: []interface{}{path}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"path": path, "value": part})
+}
+
+// jsonSetHandler serves POST /cache/{key}/json: sets {"path": "$.a.b",
+// "value": ...}, the whole document by default
+func jsonSetHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	if data.Path == "" {
+		data.Path = "$"
+	}
+	op := typeOp{Name: "jsonset", Args: []interface{}{data.Path, data.Value}, Path: data.Path}
+	created, err := runTypeOp(r, key, op, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"path": data.Path, "created": created})
+}
+
+// jsonDeleteHandler serves DELETE /cache/{key}/json?path=$.a.b
+func jsonDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, path := mux.Vars(r)["key"], jsonPathParam(r)
+	op := typeOp{Name: "jsondel", Args: []interface{}{path}, Path: path}
+	deleted, err := runTypeOp(r, key, op, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"path": path, "deleted": deleted})
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksMinRefresh stops tokens with unknown key ids from hammering the JWKS endpoint
+const jwksMinRefresh = time.Minute
+
+// jwtVerifier validates bearer tokens and turns their claims into a Principal
+type jwtVerifier struct {
+	secret      []byte
+	jwks        *jwksCache
+	parser      *jwt.Parser
+	rolesClaim  string
+	tenantClaim string
+	roleScopes  map[string][]string
+}
+
+// jwtAuth is nil unless CACHE_JWT_SECRET or CACHE_JWT_JWKS_URL is set
+var jwtAuth *jwtVerifier
+
+// newJWTVerifier :: builds the verifier from the config, nil when JWT is not configured
+func newJWTVerifier(cfg *Config) *jwtVerifier {
+	if cfg.JWTSecret == "" && cfg.JWTJWKSURL == "" {
+		return nil
+	}
+
+	var methods []string
+	if cfg.JWTSecret != "" {
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if cfg.JWTJWKSURL != "" {
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512")
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithLeeway(30 * time.Second)}
+	if cfg.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.JWTIssuer))
+	}
+	if cfg.JWTAudience != "" {
+		options = append(options, jwt.WithAudience(cfg.JWTAudience))
+	}
+
+	v := &jwtVerifier{
+		secret:      []byte(cfg.JWTSecret),
+		parser:      jwt.NewParser(options...),
+		rolesClaim:  cfg.JWTRolesClaim,
+		tenantClaim: cfg.JWTTenantClaim,
+		roleScopes:  cfg.JWTRoleScopes,
+	}
+	if cfg.JWTJWKSURL != "" {
+		v.jwks = &jwksCache{url: cfg.JWTJWKSURL, refresh: cfg.JWTJWKSRefresh}
+	}
+	return v
+}
+
+// verify :: checks the signature and registered claims of a token
+func (v *jwtVerifier) verify(raw string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(raw, claims, v.key); err != nil {
+		return nil, fmt.Errorf("Invalid bearer token: %v", err)
+	}
+
+	subject, _ := claims.GetSubject()
+	p := &Principal{Name: subject}
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		p.ExpiresAt = exp.Time
+	}
+	for _, role := range claimStrings(lookupClaim(claims, v.rolesClaim)) {
+		if scopes, ok := v.roleScopes[role]; ok {
+			p.Scopes = append(p.Scopes, scopes...)
+		} else if len(v.roleScopes) == 0 {
+			p.Scopes = append(p.Scopes, role)
+		}
+	}
+	if v.tenantClaim != "" {
+		p.Tenant, _ = lookupClaim(claims, v.tenantClaim).(string)
+	}
+	return p, nil
+}
+
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return v.secret, nil
+	}
+	if v.jwks == nil {
+		return nil, errors.New("no JWKS configured")
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.jwks.key(kid)
+}
+
+// lookupClaim finds a claim by dotted path, so nested claims such as
+// realm_access.roles can carry the roles
+func lookupClaim(claims jwt.MapClaims, path string) interface{} {
+	var value interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+// claimStrings accepts both JSON arrays and space separated strings (the
+// OAuth "scope" claim)
+func claimStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var list []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// parseRoleScopes :: parses CACHE_JWT_ROLES, comma separated role=scope|scope entries
+func parseRoleScopes(s string) (map[string][]string, error) {
+	roles := make(map[string][]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		role, scopes, ok := strings.Cut(entry, "=")
+		if !ok || role == "" || scopes == "" {
+			return nil, fmt.Errorf("invalid JWT role entry %q, expected role=scopes", entry)
+		}
+		roles[role] = strings.Split(scopes, "|")
+	}
+	return roles, nil
+}
+
+// jwksCache keeps the public keys published at a JWKS URL
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	fetches flightGroup
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// key :: returns the key with the given id, refetching the set when it is
+// stale or does not know the id (the issuer rotated its keys). The lock is
+// not held across the fetch, and concurrent callers share one
+func (c *jwksCache) key(kid string) (crypto.PublicKey, error) {
+	c.mutex.Lock()
+	key, ok := c.keys[kid]
+	fetched := c.fetched
+	c.mutex.Unlock()
+
+	age := time.Since(fetched)
+	if (ok && age < c.refresh) || (!ok && age < jwksMinRefresh) {
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	}
+
+	keys, err := c.fetch(fetched)
+	if err != nil {
+		slog.Error("jwt: fetching JWKS", "url", c.url, "err", err)
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// fetch refetches the set unless it was fetched again since seen, by a
+// caller that got there first
+func (c *jwksCache) fetch(seen time.Time) (map[string]crypto.PublicKey, error) {
+	keys, err := c.fetches.Do(c.url, func() (interface{}, error) {
+		c.mutex.Lock()
+		keys, fetched := c.keys, c.fetched
+		c.mutex.Unlock()
+		if fetched.After(seen) {
+			return keys, nil
+		}
+
+		keys, err := fetchJWKS(c.url)
+		if err != nil {
+			return nil, err
+		}
+		c.mutex.Lock()
+		c.keys = keys
+		c.fetched = time.Now()
+		c.mutex.Unlock()
+		return keys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys.(map[string]crypto.PublicKey), nil
+}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS returned %s", resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("key %q: malformed RSA parameters", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("key %q: malformed EC parameters", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
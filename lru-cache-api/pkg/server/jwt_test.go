@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWKSCacheKey(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := fmt.Sprintf(`{"keys":[{"kid":"a","kty":"RSA","n":%q,"e":%q}]}`,
+		base64.RawURLEncoding.EncodeToString(private.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(private.E)).Bytes()))
+
+	var fetches atomic.Int32
+	gate := make(chan struct{})
+	close(gate)
+	var gateMutex sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		gateMutex.Lock()
+		g := gate
+		gateMutex.Unlock()
+		<-g
+		fmt.Fprint(w, set)
+	}))
+	defer srv.Close()
+
+	c := &jwksCache{url: srv.URL, refresh: time.Hour}
+	lookups := []struct {
+		kid     string
+		ok      bool
+		fetches int32
+	}{
+		{"a", true, 1},  // first use fetches
+		{"a", true, 1},  // cached
+		{"b", false, 1}, // unknown, but fetched less than jwksMinRefresh ago
+	}
+	for _, tt := range lookups {
+		key, err := c.key(tt.kid)
+		if (err == nil) != tt.ok || (tt.ok && !private.PublicKey.Equal(key)) {
+			t.Errorf("key(%q) = %v, %v, want ok %v", tt.kid, key, err, tt.ok)
+		}
+		if n := fetches.Load(); n != tt.fetches {
+			t.Errorf("after key(%q) fetches = %d, want %d", tt.kid, n, tt.fetches)
+		}
+	}
+
+	// Stale: concurrent callers share one fetch, which holds no lock
+	gateMutex.Lock()
+	gate = make(chan struct{})
+	release := gate
+	gateMutex.Unlock()
+	c.mutex.Lock()
+	c.fetched = time.Now().Add(-2 * time.Hour)
+	c.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.key("a"); err != nil {
+				t.Errorf("key(a) while refreshing = %v", err)
+			}
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if !c.mutex.TryLock() {
+		t.Error("the lock is held across the JWKS fetch")
+	} else {
+		c.mutex.Unlock()
+	}
+	close(release)
+	wg.Wait()
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("concurrent refresh fetched %d times, want once", n-1)
+	}
+}
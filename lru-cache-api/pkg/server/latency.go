@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// latencyBuckets cover 1µs to about 16s, four buckets per doubling, so a
+	// percentile is off by at most 19%
+	latencyBuckets  = 4*24 + 1
+	bucketsPerPower = 4
+)
+
+// latencyHistogram counts durations in log scale buckets, lock free
+type latencyHistogram struct {
+	counts [latencyBuckets]atomic.Uint64
+	total  atomic.Uint64
+	max    atomic.Int64
+}
+
+func latencyBucket(d time.Duration) int {
+	micros := float64(d) / float64(time.Microsecond)
+	if micros <= 1 {
+		return 0
+	}
+	return min(int(math.Ceil(bucketsPerPower*math.Log2(micros))), latencyBuckets-1)
+}
+
+// bucketBound is the largest duration in bucket i, in microseconds
+func bucketBound(i int) float64 {
+	return math.Pow(2, float64(i)/bucketsPerPower)
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	h.counts[latencyBucket(d)].Add(1)
+	h.total.Add(1)
+	for {
+		max := h.max.Load()
+		if int64(d) <= max || h.max.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+// percentile returns the upper bound of the bucket holding the p-th
+// fraction of the observations, in microseconds
+func (h *latencyHistogram) percentile(p float64) float64 {
+	total := h.total.Load()
+	if total == 0 {
+		return 0
+	}
+	max := toMicros(h.max.Load())
+	rank := uint64(math.Ceil(p * float64(total)))
+	var seen uint64
+	for i := range h.counts {
+		if seen += h.counts[i].Load(); seen >= rank {
+			return math.Min(math.Round(bucketBound(i)*10)/10, max)
+		}
+	}
+	return max
+}
+
+// toMicros converts nanoseconds to microseconds, to a tenth
+func toMicros(ns int64) float64 {
+	return math.Round(float64(ns)/100) / 10
+}
+
+// LatencySummary is one operation's entry in GET /stats/latency
+type LatencySummary struct {
+	Count     uint64  `json:"count"`
+	P50Micros float64 `json:"p50Micros"`
+	P95Micros float64 `json:"p95Micros"`
+	P99Micros float64 `json:"p99Micros"`
+	MaxMicros float64 `json:"maxMicros"`
+}
+
+var (
+	latencies sync.Map // operation name -> *latencyHistogram
+
+	opDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cache_operation_duration_seconds",
+		Help:    "Latency of cache operations, origin and peer fetches, and snapshot writes.",
+		Buckets: prometheus.ExponentialBuckets(.000001, 4, 12),
+	}, []string{"op"})
+)
+
+// observeLatency :: records how long one op took, for /stats/latency and /metrics
+func observeLatency(op string, took time.Duration) {
+	h, ok := latencies.Load(op)
+	if !ok {
+		h, _ = latencies.LoadOrStore(op, &latencyHistogram{})
+	}
+	h.(*latencyHistogram).observe(took)
+	opDuration.WithLabelValues(op).Observe(took.Seconds())
+}
+
+// setupLatency :: times every cache operation
+func setupLatency() {
+	cache.OnOp = append(cache.OnOp, func(op, _ string, took time.Duration) { observeLatency(op, took) })
+}
+
+// latencyHandler serves GET /stats/latency: percentiles per operation since
+// the server started. They are read from buckets, so they are approximate
+func latencyHandler(w http.ResponseWriter, r *http.Request) {
+	summaries := make(map[string]LatencySummary)
+	latencies.Range(func(op, value interface{}) bool {
+		h := value.(*latencyHistogram)
+		summaries[op.(string)] = LatencySummary{
+			Count:     h.total.Load(),
+			P50Micros: h.percentile(.50),
+			P95Micros: h.percentile(.95),
+			P99Micros: h.percentile(.99),
+			MaxMicros: toMicros(h.max.Load()),
+		}
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
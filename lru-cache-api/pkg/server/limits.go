@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+)
+
+// limitMiddleware rejects oversized requests before anything reads them:
+// long URLs, and keys or names in the path of the route they match, get
+// 414, bodies are cut off at CACHE_MAX_BODY_BYTES. Batches between servers
+// are cut off at CACHE_MAX_CLUSTER_BODY_BYTES instead; this runs before
+// authentication, so the route decides, not the caller
+func limitMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.RequestURI) > config.MaxURLLength {
+			http.Error(w, fmt.Sprintf("URL exceeds %d bytes", config.MaxURLLength), http.StatusRequestURITooLong)
+			return
+		}
+		var match mux.RouteMatch
+		if router.Match(r, &match) {
+			for _, name := range pathVars {
+				if len(match.Vars[name]) > config.MaxKeyLength {
+					http.Error(w, fmt.Sprintf("%s exceeds %d bytes", strings.ToUpper(name[:1])+name[1:], config.MaxKeyLength), http.StatusRequestURITooLong)
+					return
+				}
+			}
+		}
+		limit := config.MaxBodyBytes
+		if requiredScope(r) == ScopeCluster {
+			limit = config.MaxClusterBodyBytes
+		}
+		if r.ContentLength > limit {
+			http.Error(w, fmt.Sprintf("Body exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// pathVars are the route variables naming keys, or what is stored under
+// one, such as /locks/{name}
+var pathVars = []string{"key", "name", "bucket", "channel", "field"}
+
+// validateKey :: checks a key taken from a request body
+func validateKey(key string) error {
+	if len(key) > config.MaxKeyLength {
+		return fmt.Errorf("Key exceeds %d bytes", config.MaxKeyLength)
+	}
+	return nil
+}
+
+// validateWriteKey :: checks a key a client writes, which must also be
+// outside the keys the server writes itself: a client setting proxy:<path>
+// would have the proxy serve its value to everyone asking for the path
+func validateWriteKey(key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if strings.HasPrefix(key, proxyKeyPrefix) {
+		return fmt.Errorf("Keys starting with %q are written by the proxy only", proxyKeyPrefix)
+	}
+	return nil
+}
+
+// bodyError answers a request whose body could not be decoded, with 413 when
+// it was too large
+func bodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// errorReader replays a read error to whoever reads the body next
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+// cacheError answers a request the cache failed: 404 for missing and expired
+// keys, 413 for items over CACHE_MAX_ITEM_BYTES and 507 when there is no
+// room. It is counted in cache_errors_total
+func cacheError(w http.ResponseWriter, err error) {
+	status, label, message := http.StatusInternalServerError, "other", err.Error()
+	switch {
+	case errors.Is(err, lru.ErrNotFound):
+		status, label, message = http.StatusNotFound, "not_found", "Key not found"
+	case errors.Is(err, lru.ErrExpired):
+		status, label, message = http.StatusNotFound, "expired", "Key expired"
+	case errors.Is(err, lru.ErrTooLarge):
+		status, label, message = http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Item exceeds %d bytes", config.MaxItemBytes)
+	case errors.Is(err, lru.ErrCapacityZero):
+		status, label, message = http.StatusInsufficientStorage, "capacity_zero", "The cache has no room"
+	}
+	cacheErrors.WithLabelValues(label).Inc()
+	http.Error(w, message, status)
+}
+
+// refused reports whether err is the cache declining to hold an item, as
+// opposed to the write failing
+func refused(err error) bool {
+	return errors.Is(err, lru.ErrTooLarge) || errors.Is(err, lru.ErrCapacityZero)
+}
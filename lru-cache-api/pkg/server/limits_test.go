@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func withMaxKeyLength(t *testing.T, n int) {
+	t.Helper()
+	saved := config
+	config = &Config{MaxKeyLength: n}
+	t.Cleanup(func() { config = saved })
+}
+
+func TestValidateWriteKey(t *testing.T) {
+	withMaxKeyLength(t, 16)
+
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"user:1", true},
+		{"", true},
+		{"proxy", true},
+		{"my-proxy:/login", true},
+		{"proxy:/login", false},
+		{"proxy:", false},
+		{strings.Repeat("k", 17), false},
+	}
+	for _, tt := range tests {
+		if err := validateWriteKey(tt.key); (err == nil) != tt.ok {
+			t.Errorf("validateWriteKey(%q) = %v, want ok %v", tt.key, err, tt.ok)
+		}
+	}
+}
+
+func TestWritableKey(t *testing.T) {
+	withMaxKeyLength(t, 64)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/cache/{key}/hash", writableKey(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/cache/user:1/hash", http.StatusNoContent},
+		{"/cache/proxy:login/hash", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("POST %s = %d, want %d", tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestProxyCacheKey(t *testing.T) {
+	withMaxKeyLength(t, 64)
+
+	tests := []struct {
+		name   string
+		method string
+		header string
+		want   string
+		ok     bool
+	}{
+		{"get", http.MethodGet, "", "proxy:/login?next=%2F", true},
+		{"post", http.MethodPost, "", "", false},
+		{"credentials", http.MethodGet, "Authorization", "", false},
+		{"upgrade", http.MethodGet, "Upgrade", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/login?next=%2F", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, "x")
+			}
+			key, ok := proxyCacheKey(r)
+			if key != tt.want || ok != tt.ok {
+				t.Errorf("proxyCacheKey = %q, %v, want %q, %v", key, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
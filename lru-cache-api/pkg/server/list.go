@@ -0,0 +1,215 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Lists are JSON arrays, so GET /cache/{key} returns them whole and they are
+// exported, snapshotted and replicated as any other value. The whole list is
+// one LRU entry
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"lpush":  {fn: listPush(true)},
+		"rpush":  {fn: listPush(false)},
+		"lpop":   {fn: listPop(true)},
+		"rpop":   {fn: listPop(false)},
+		"lrange": {fn: listRange, read: true},
+	})
+}
+
+// asList returns the list held by a key, nil when it is not cached
+func asList(value interface{}) ([]interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errWrongType
+	}
+	return list, nil
+}
+
+// listPush :: LPush or RPush: adds the args to the head, one after the
+// other so the last ends up first, or to the tail, replying with the length
+func listPush(head bool) typeOpFunc {
+	return func(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+		list, err := asList(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(args) == 0 {
+			return nil, nil, argError("no values to push")
+		}
+		pushed := make([]interface{}, 0, len(list)+len(args))
+		if head {
+			for i := len(args) - 1; i >= 0; i-- {
+				pushed = append(pushed, args[i])
+			}
+			pushed = append(pushed, list...)
+		} else {
+			pushed = append(append(pushed, list...), args...)
+		}
+		return len(pushed), pushed, nil
+	}
+}
+
+// listPop :: LPop or RPop: removes up to args[0] values from the head or
+// the tail, replying with them in the order they were taken. Popping the
+// last value deletes the key
+func listPop(head bool) typeOpFunc {
+	return func(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+		list, err := asList(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		count, err := argInt(args, 0)
+		if err != nil || count < 1 {
+			return nil, nil, argError("count must be at least 1")
+		}
+		count = min(count, len(list))
+		popped := make([]interface{}, count)
+		var rest []interface{}
+		if head {
+			copy(popped, list[:count])
+			rest = list[count:]
+		} else {
+			for i := range popped {
+				popped[i] = list[len(list)-1-i]
+			}
+			rest = list[:len(list)-count]
+		}
+		if len(rest) == 0 {
+			return popped, nil, nil
+		}
+		// A copy, so the popped values are not kept alive by the rest
+		return popped, append([]interface{}(nil), rest...), nil
+	}
+}
+
+// listRange :: LRange: the values from index args[0] to args[1], both
+// included; negative indexes count from the tail, -1 being the last
+func listRange(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	list, err := asList(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	start, err := argInt(args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if start < 0 {
+		start = max(len(list)+start, 0)
+	}
+	if stop < 0 {
+		stop = len(list) + stop
+	}
+	stop = min(stop, len(list)-1)
+	if start > stop {
+		return []interface{}{}, value, nil
+	}
+	return list[start : stop+1], value, nil
+}
+
+// registerListRoutes :: mounts /cache/{key}/list
+func registerListRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/list", withConsistency(listRangeHandler)).Methods("GET")
+	r.Handle("/cache/{key}/list/push", typeWrite(listPushHandler)).Methods("POST")
+	r.Handle("/cache/{key}/list/pop", typeWrite(listPopHandler)).Methods("POST")
+}
+
+// listSide returns whether side names the head of a list, which is "left"
+func listSide(w http.ResponseWriter, side, def string) (head bool, ok bool) {
+	if side == "" {
+		side = def
+	}
+	if side != "left" && side != "right" {
+		http.Error(w, "side must be left or right", http.StatusBadRequest)
+		return false, false
+	}
+	return side == "left", true
+}
+
+// listPushHandler serves POST /cache/{key}/list/push: {"values": [...]}
+// appended to the tail, or to the head with "side": "left"
+func listPushHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	head, ok := listSide(w, data.Side, "right")
+	if !ok {
+		return
+	}
+	name := "rpush"
+	if head {
+		name = "lpush"
+	}
+	length, err := runTypeOp(r, key, typeOp{Name: name, Args: data.Values}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"length": length})
+}
+
+// listPopHandler serves POST /cache/{key}/list/pop: takes "count" values,
+// 1 by default, from the head, or the tail with "side": "right"
+func listPopHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	head, ok := listSide(w, data.Side, "left")
+	if !ok {
+		return
+	}
+	name := "rpop"
+	if head {
+		name = "lpop"
+	}
+	if data.Count == 0 {
+		data.Count = 1
+	}
+	values, err := runTypeOp(r, key, typeOp{Name: name, Args: []interface{}{data.Count}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"values": values})
+}
+
+// listRangeHandler serves GET /cache/{key}/list?start=0&stop=-1, the whole
+// list by default; a key not cached is an empty list
+func listRangeHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	start, stop := 0, -1
+	var err error
+	if s := r.URL.Query().Get("start"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "start must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.URL.Query().Get("stop"); s != "" {
+		if stop, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "stop must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	values, err := runTypeOp(r, key, typeOp{Name: "lrange", Args: []interface{}{start, stop}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"values": values})
+}
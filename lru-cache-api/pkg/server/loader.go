@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrOriginNotFound is what a LoaderFunc returns for keys its origin does
+// not have, which GET /cache/{key} answers with 404
+var ErrOriginNotFound = errors.New("key not found at origin")
+
+// LoaderFunc loads the value of key from an origin, for applications
+// embedding the API. The value is cached as given, so it must encode as
+// JSON
+type LoaderFunc func(ctx context.Context, key string) (interface{}, error)
+
+// Loader loads the keys matching Pattern, a shell pattern such as users:*,
+// on a miss: from URL, with {key} replaced by the key and {id} by the part
+// after its namespace, or through Func. What it loads is cached for TTL,
+// CACHE_ORIGIN_TTL when 0
+type Loader struct {
+	Pattern string
+	URL     string
+	Func    LoaderFunc
+	TTL     time.Duration
+}
+
+// loaders are checked in order on a miss, the first matching loading the
+// key; set up before serving and never changed after
+var loaders []Loader
+
+// parseLoaders :: parses loaders such as "users:* http://users/v1/{id} 10m",
+// pattern url [ttl]
+func parseLoaders(specs []string) ([]Loader, error) {
+	var parsed []Loader
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid loader %q, expected pattern url [ttl]", spec)
+		}
+		l := Loader{Pattern: fields[0], URL: fields[1]}
+		if len(fields) == 3 {
+			ttl, err := time.ParseDuration(fields[2])
+			if err != nil || ttl <= 0 {
+				return nil, fmt.Errorf("invalid loader %q, bad TTL", spec)
+			}
+			l.TTL = ttl
+		}
+		if err := l.check(); err != nil {
+			return nil, fmt.Errorf("invalid loader %q: %w", spec, err)
+		}
+		parsed = append(parsed, l)
+	}
+	return parsed, nil
+}
+
+// check returns an error for loaders that cannot load anything
+func (l Loader) check() error {
+	if _, err := path.Match(l.Pattern, ""); err != nil {
+		return fmt.Errorf("bad pattern %q", l.Pattern)
+	}
+	if (l.URL == "") == (l.Func == nil) {
+		return errors.New("a loader needs either a URL or a function")
+	}
+	if l.URL != "" {
+		if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("bad URL %q", l.URL)
+		}
+	}
+	return nil
+}
+
+// setupLoaders :: registers the loaders of the embedding application, then
+// those of CACHE_LOADERS, then CACHE_ORIGIN_URL for every other key
+func setupLoaders(cfg *Config, opts Options) error {
+	loaders = nil
+	for _, l := range opts.Loaders {
+		if err := l.check(); err != nil {
+			return fmt.Errorf("loader %s: %w", l.Pattern, err)
+		}
+		loaders = append(loaders, l)
+	}
+	loaders = append(loaders, cfg.Loaders...)
+	if cfg.OriginURL != "" {
+		loaders = append(loaders, Loader{Pattern: "*", URL: cfg.OriginURL})
+	}
+	for i := range loaders {
+		if loaders[i].TTL == 0 {
+			loaders[i].TTL = cfg.OriginTTL
+		}
+	}
+	return nil
+}
+
+// loaderFor returns the loader of key, false when none matches
+func loaderFor(key string) (Loader, bool) {
+	for _, l := range loaders {
+		if ok, _ := path.Match(l.Pattern, key); ok {
+			return l, true
+		}
+	}
+	return Loader{}, false
+}
+
+// load :: loads key from the loader's origin, through its breaker
+func (l Loader) load(ctx context.Context, key string) (interface{}, error) {
+	defer func(start time.Time) { observeLatency("origin_fetch", time.Since(start)) }(time.Now())
+	var value interface{}
+	err := breakerFor("loader " + l.Pattern).do(func() (err error) {
+		if l.Func != nil {
+			value, err = l.Func(ctx, key)
+		} else {
+			value, err = fetchOrigin(ctx, originURL(l.URL, key))
+		}
+		return err
+	})
+	return value, err
+}
+
+// originURL returns template with {key} replaced by key and {id} by the
+// part of key after its namespace
+func originURL(template, key string) string {
+	_, id, ok := strings.Cut(key, ":")
+	if !ok {
+		id = key
+	}
+	return strings.NewReplacer("{key}", url.PathEscape(key), "{id}", url.PathEscape(id)).Replace(template)
+}
+
+// fetchOrigin :: GETs target; JSON bodies are decoded, anything else is
+// cached as a string
+func fetchOrigin(ctx context.Context, target string) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fillClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrOriginNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("origin returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return string(body), nil
+	}
+	return value, nil
+}
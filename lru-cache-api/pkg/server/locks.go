@@ -0,0 +1,261 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Locks are leases on a name that services already using the cache can
+// coordinate with, such as one worker running a job at a time. The lock on
+// a name is the key lock:{name}, holding {"owner": ..., "token": ...} and
+// expiring when the lease does, so acquiring is setting the key if it is
+// not there, atomically, and ACLs on lock:* cover the locks. Whoever
+// acquires a lock gets its fencing token, which it renews and releases it
+// with and should pass to what it guards: tokens are the microseconds of
+// the clock of the node taking writes when the lock was acquired, or one
+// more than the last token given out when that is larger, so a later
+// holder's is larger, even after the key was evicted or another node took
+// over writes with a clock behind, and a store refusing tokens smaller than
+// the last it saw refuses a holder whose lease ran out while it stalled.
+// Locks go through raft in cluster mode like any other write, the last
+// token being kept in the raft snapshots, and replicas learn it from the
+// locks they are sent
+
+// defaultLockTTL is how long a lock is held without a ttl
+const defaultLockTTL = 30 // seconds
+
+// lastLockToken is the largest fencing token given out or seen
+var lastLockToken atomic.Int64
+
+// nextLockToken returns the token of a lock acquired now, proposed being
+// the clock's
+func nextLockToken(proposed int) int {
+	for {
+		last := lastLockToken.Load()
+		next := max(int64(proposed), last+1)
+		if lastLockToken.CompareAndSwap(last, next) {
+			return int(next)
+		}
+	}
+}
+
+// observeLockToken raises lastLockToken to the token of a lock set on key
+// elsewhere, such as on the primary a replica follows
+func observeLockToken(key string, value interface{}) {
+	if !strings.HasPrefix(key, lockKey("")) {
+		return
+	}
+	if _, token, err := asLock(value); err == nil {
+		raiseLockToken(int64(token))
+	}
+}
+
+// raiseLockToken makes token the last given out unless a larger one was
+func raiseLockToken(token int64) {
+	for {
+		last := lastLockToken.Load()
+		if token <= last || lastLockToken.CompareAndSwap(last, token) {
+			return
+		}
+	}
+}
+
+var (
+	// errLockHeld refuses to acquire a lock someone holds
+	errLockHeld error = &conflictError{"Lock is held"}
+	// errLockLost refuses to renew or release a lock with another token,
+	// which the caller's lease ran out for
+	errLockLost error = &conflictError{"Lock is not held with this token"}
+)
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"lockacquire": {fn: lockAcquire, renew: true},
+		"lockrenew":   {fn: lockRenew, renew: true},
+		"lockrelease": {fn: lockRelease, renew: true},
+	})
+}
+
+// lockKey returns the key holding the lock on name
+func lockKey(name string) string {
+	return "lock:" + name
+}
+
+// asLock returns the holder and token of the lock held by a key
+func asLock(value interface{}) (string, int, error) {
+	lock, ok := value.(map[string]interface{})
+	owner, isString := lock["owner"].(string)
+	token, err := argInt([]interface{}{lock["token"]}, 0)
+	if !ok || !isString || err != nil || len(lock) != 2 {
+		return "", 0, errWrongType
+	}
+	return owner, token, nil
+}
+
+// lockAcquire :: takes the lock for args[0], the owner, unless it is held,
+// with the token args[1] or, when that is not larger, the next after the
+// last. Run by every raft node in log order, it gives the same token on each
+func lockAcquire(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	if value != nil {
+		if _, _, err := asLock(value); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errLockHeld
+	}
+	owner, _ := args[0].(string)
+	proposed, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	token := nextLockToken(proposed)
+	return token, map[string]interface{}{"owner": owner, "token": token}, nil
+}
+
+// lockRenew :: extends the lease of the lock held with the token args[0]
+func lockRenew(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	owner, err := checkLockToken(value, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	token, _ := argInt(args, 0)
+	return owner, map[string]interface{}{"owner": owner, "token": token}, nil
+}
+
+// lockRelease :: frees the lock held with the token args[0]
+func lockRelease(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	if _, err := checkLockToken(value, args); err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, nil
+}
+
+// checkLockToken returns the owner of the lock held by value when it is held
+// with the token args[0]
+func checkLockToken(value interface{}, args []interface{}) (string, error) {
+	token, err := argInt(args, 0)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", errLockLost
+	}
+	owner, held, err := asLock(value)
+	if err != nil {
+		return "", err
+	}
+	if held != token {
+		return "", errLockLost
+	}
+	return owner, nil
+}
+
+// lockRequest is the body accepted by POST and PUT /locks/{name}
+type lockRequest struct {
+	Owner string `json:"owner"`
+	Token int    `json:"token"`
+	TTL   int    `json:"ttl"` // in seconds
+}
+
+// lease returns how long the lock is held for
+func (r lockRequest) lease() time.Duration {
+	if r.TTL == 0 {
+		return defaultLockTTL * time.Second
+	}
+	return time.Duration(r.TTL) * time.Second
+}
+
+// readLockRequest decodes the body, answering the request when it cannot
+func readLockRequest(w http.ResponseWriter, r *http.Request) (lockRequest, bool) {
+	var data lockRequest
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return data, false
+	}
+	if data.TTL < 0 {
+		http.Error(w, "ttl must not be negative", http.StatusBadRequest)
+		return data, false
+	}
+	return data, true
+}
+
+// registerLockRoutes :: mounts /locks/{name}
+func registerLockRoutes(r *mux.Router) {
+	r.Handle("/locks/{name}", withConsistency(lockGetHandler)).Methods("GET")
+	r.Handle("/locks/{name}", typeWrite(lockAcquireHandler)).Methods("POST")
+	r.Handle("/locks/{name}", typeWrite(lockRenewHandler)).Methods("PUT")
+	r.Handle("/locks/{name}", typeWrite(lockReleaseHandler)).Methods("DELETE")
+}
+
+// lockGetHandler serves GET /locks/{name}: the owner and token of the lock
+// and when its lease ends, 404 when it is free
+func lockGetHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	value, expiresAt, err := cache.GetStale(lockKey(name))
+	if err != nil || !clock.Now().Before(expiresAt) {
+		http.Error(w, "Lock is free", http.StatusNotFound)
+		return
+	}
+	owner, token, err := asLock(value)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"name": name, "owner": owner, "token": token, "expiresAt": expiresAt})
+}
+
+// lockAcquireHandler serves POST /locks/{name}: {"owner": ..., "ttl": 30}
+// takes the lock for ttl seconds, answering with its fencing token, or 409
+// when it is held
+func lockAcquireHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	data, ok := readLockRequest(w, r)
+	if !ok {
+		return
+	}
+	now := clock.Now()
+	args := []interface{}{data.Owner, int(now.UnixMicro())}
+	token, err := runTypeOp(r, lockKey(name), typeOp{Name: "lockacquire", Args: args}, data.lease())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"name": name, "owner": data.Owner, "token": token, "expiresAt": now.Add(data.lease())})
+}
+
+// lockRenewHandler serves PUT /locks/{name}: {"token": ..., "ttl": 30}
+// holds the lock for ttl seconds from now, or answers 409 when it is not
+// held with the token
+func lockRenewHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	data, ok := readLockRequest(w, r)
+	if !ok {
+		return
+	}
+	owner, err := runTypeOp(r, lockKey(name), typeOp{Name: "lockrenew", Args: []interface{}{data.Token}}, data.lease())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"name": name, "owner": owner, "token": data.Token, "expiresAt": clock.Now().Add(data.lease())})
+}
+
+// lockReleaseHandler serves DELETE /locks/{name}?token=..., freeing the lock
+// or answering 409 when it is not held with the token
+func lockReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	token, err := strconv.Atoi(r.URL.Query().Get("token"))
+	if err != nil {
+		http.Error(w, "token must be an integer", http.StatusBadRequest)
+		return
+	}
+	if _, err := runTypeOp(r, lockKey(name), typeOp{Name: "lockrelease", Args: []interface{}{token}}, 0); err != nil {
+		typeOpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,63 @@
+package server
+
+import "testing"
+
+func withLockToken(t *testing.T, token int64) {
+	t.Helper()
+	saved := lastLockToken.Load()
+	lastLockToken.Store(token)
+	t.Cleanup(func() { lastLockToken.Store(saved) })
+}
+
+func TestLockTokens(t *testing.T) {
+	withLockToken(t, 100)
+
+	// Each step acquires a lock at the proposed clock reading, or raises the
+	// last token to one seen elsewhere
+	steps := []struct {
+		name     string
+		proposed int
+		raise    int64
+		want     int64
+	}{
+		{"clock ahead", 500, 0, 500},
+		{"clock behind", 200, 0, 501},
+		{"same clock", 501, 0, 502},
+		{"seen larger", 0, 900, 900},
+		{"seen smaller", 0, 300, 900},
+		{"after raise", 600, 0, 901},
+	}
+	for _, tt := range steps {
+		var got int64
+		if tt.raise != 0 {
+			raiseLockToken(tt.raise)
+			got = lastLockToken.Load()
+		} else {
+			got = int64(nextLockToken(tt.proposed))
+		}
+		if got != tt.want {
+			t.Errorf("%s: token = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestObserveLockToken(t *testing.T) {
+	withLockToken(t, 10)
+
+	tests := []struct {
+		key   string
+		value interface{}
+		want  int64
+	}{
+		{"user:1", map[string]interface{}{"owner": "a", "token": 50.0}, 10},
+		{lockKey("job"), "not a lock", 10},
+		{lockKey("job"), map[string]interface{}{"owner": "a", "token": 50.0}, 50},
+		{lockKey("job"), map[string]interface{}{"owner": "b", "token": 20.0}, 50},
+	}
+	for _, tt := range tests {
+		observeLockToken(tt.key, tt.value)
+		if got := lastLockToken.Load(); got != tt.want {
+			t.Errorf("observeLockToken(%q, %v): last token = %d, want %d", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logLevel can be changed at runtime through PUT /admin/log-level
+var logLevel = new(slog.LevelVar)
+
+type loggerKey struct{}
+
+// setupLogging :: installs the slog handler configured by CACHE_LOG_FORMAT
+// and CACHE_LOG_LEVEL as the default logger. The standard library logger,
+// which memberlist writes to, goes through it as well
+func setupLogging(cfg *Config) error {
+	if err := logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("invalid CACHE_LOG_LEVEL %q", cfg.LogLevel)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch cfg.LogFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid CACHE_LOG_FORMAT %q, expected text or json", cfg.LogFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// loggerFrom returns the logger of the request ctx belongs to, carrying its
+// fields, or the default logger outside of requests
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// logMiddleware gives every request a logger carrying its method, path and
+// request id, and logs the request once it has been served
+func logMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := slog.Default().With("method", r.Method, "path", r.URL.Path, "request_id", requestID(r.Context()))
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		logger.Info("request", "status", recorder.status, "duration", time.Since(start))
+	})
+}
+
+// logLevelHandler serves GET and PUT /admin/log-level
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var data struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			bodyError(w, err)
+			return
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(data.Level)); err != nil {
+			http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+		slog.Info("log level changed", "level", level)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+}
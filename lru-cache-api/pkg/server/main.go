@@ -0,0 +1,675 @@
+// Package server is the HTTP and WebSocket API in front of the cache: its
+// handlers, WebSocket hub, clustering and settings
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/rs/cors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	config   *Config
+	cache    *lru.LRUCache
+	clock    = lru.SystemClock // expiry, the janitor and uptime go by it
+	upgrader = websocket.Upgrader{
+		CheckOrigin: checkWebSocketOrigin,
+	}
+	broadcast chan CacheUpdate // see publish
+
+	wsConnections atomic.Int64
+)
+
+// CacheUpdate represents a cache update to be sent via WebSocket
+type CacheUpdate struct {
+	Type      string      `json:"type"`             // set, delete, expire, evict or flush
+	Reason    string      `json:"reason,omitempty"` // why, see the Reason constants
+	Cache     string      `json:"cache,omitempty"`  // the named cache changed, "" for the default one
+	Channel   string      `json:"-"`                // the channel of a message, whose Value it is
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	Path      string      `json:"path,omitempty"` // the part of a JSON document changed, Value being all of it
+	Tags      []string    `json:"tags,omitempty"` // of a key set with tags, for replicas to keep
+	ExpiresAt time.Time   `json:"expiresAt"`
+	RequestID string      `json:"requestId,omitempty"` // of the request that made the change
+	Seq       uint64      `json:"seq,omitempty"`       // numbers the changes this node sent
+}
+
+// Main runs the server with the settings of the command line, environment
+// and config file, until it is told to stop
+func Main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); errors.Is(err, flag.ErrHelp) {
+		usage()
+	} else if err != nil {
+		fatal(name, "err", err)
+	}
+}
+
+// serve :: runs the server
+func serve(args []string) error {
+	handler, err := newHandler(nil, Options{Args: args, CORS: true})
+	if err != nil {
+		return err
+	}
+	go awaitShutdown()
+	if config.ProxyUpstream != "" {
+		startProxy(config)
+	}
+	return listenAndServe(fmt.Sprintf(":%d", config.Port), handler)
+}
+
+// newHandler :: sets the server up around c, or a cache made from the
+// settings when it is nil, and starts its background work. Failures are
+// returned for the server to die of and embedders to handle. Everything that
+// can fail is checked and built before any background work starts, and
+// undone again when a later step fails, so a failed call can be retried
+func newHandler(c *lru.LRUCache, opts Options) (_ http.Handler, err error) {
+	var undo []func()
+	defer func() {
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+		}
+	}()
+
+	if config, _, err = parseCommandLine(opts.Args, nil); err != nil {
+		return nil, err
+	}
+	setupTunables(config)
+	if !config.SnapshotEnabled {
+		// Everything else goes by the path
+		config.SnapshotPath = ""
+	}
+	if err := setupLogging(config); err != nil {
+		return nil, fmt.Errorf("setting up logging: %w", err)
+	}
+
+	if err := loadAPIKeys(config); err != nil {
+		return nil, fmt.Errorf("loading API keys: %w", err)
+	}
+	jwtAuth = newJWTVerifier(config)
+	if err := openAudit(config); err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	undo = append(undo, closeAudit)
+	if config.ACLFile != "" {
+		if err := loadACLs(config.ACLFile); err != nil {
+			return nil, fmt.Errorf("loading ACLs: %w", err)
+		}
+	}
+	if err := setupTracing(config); err != nil {
+		return nil, fmt.Errorf("setting up tracing: %w", err)
+	}
+	undo = append(undo, stopTracing)
+	if err := setupTLS(config); err != nil {
+		return nil, fmt.Errorf("loading TLS certificates: %w", err)
+	}
+
+	broadcast = make(chan CacheUpdate, config.BroadcastBuffer)
+	upgrader.EnableCompression = config.WSCompression
+	switch {
+	case opts.Clock != nil:
+		clock = opts.Clock
+	case c != nil:
+		clock = c.Clock()
+	}
+	if opts.Codec != nil {
+		jsonCodec = opts.Codec
+	}
+	startedAt = clock.Now()
+	if cache = c; cache == nil {
+		if cache, err = lru.NewCache(
+			lru.WithCapacity(config.Capacity),
+			lru.WithPolicy(config.EvictionPolicy),
+			lru.WithEvictionBatch(config.EvictionBatch),
+			lru.WithCompression(config.CompressMin),
+			lru.WithQuotas(config.Quotas),
+			lru.WithStaleWindow(max(config.StaleWhileRevalidate, config.StaleIfError)),
+			lru.WithMaxItemSize(config.MaxItemBytes),
+			lru.WithOnEvict(publishEviction),
+			lru.WithClock(clock),
+		); err != nil {
+			return nil, fmt.Errorf("creating the cache: %w", err)
+		}
+		made := cache
+		undo = append(undo, func() { made.Close() })
+	}
+	undo = append(undo, closeNamedCaches)
+	if err := setupNamedCaches(config); err != nil {
+		return nil, fmt.Errorf("creating the named caches: %w", err)
+	}
+	if err := setupLoaders(config, opts); err != nil {
+		return nil, err
+	}
+	if err := setupWriters(config, opts); err != nil {
+		return nil, err
+	}
+	if err := setupScripts(config); err != nil {
+		return nil, err
+	}
+	history.size = config.EventHistory
+
+	if config.SnapshotPath != "" {
+		err := loadSnapshot(cache, config.SnapshotPath, config.SnapshotKey)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("loading snapshot: %w", err)
+		}
+	}
+
+	var setRoute, deleteRoute http.Handler = http.HandlerFunc(setHandler), http.HandlerFunc(deleteHandler)
+	var getRoute, listRoute http.Handler = http.HandlerFunc(getHandler), http.HandlerFunc(getAllCacheItems)
+	fsm.electionOnly = false
+	switch {
+	case config.Role == RoleReplica:
+		// Replicas serve reads locally and hand writes to the primary
+		proxy := forwardToPrimary(config.PrimaryAddr)
+		setRoute, deleteRoute = proxy, proxy
+		getRoute, listRoute = withConsistency(getHandler), withConsistency(getAllCacheItems)
+	case config.Role == RoleAuto:
+		// Raft elects the primary, which takes the writes and streams them to the rest
+		setRoute, deleteRoute = primaryOnly(setHandler), primaryOnly(deleteHandler)
+		getRoute, listRoute = withConsistency(getHandler), withConsistency(getAllCacheItems)
+		fsm.electionOnly = true
+	case config.RaftAddr != "":
+		// In cluster mode every mutation goes through the raft log
+		setRoute, deleteRoute = http.HandlerFunc(raftSetHandler), http.HandlerFunc(raftDeleteHandler)
+		getRoute, listRoute = withConsistency(getHandler), withConsistency(getAllCacheItems)
+	case len(loaders) > 0:
+		// Misses are loaded from the origin by the node owning the key
+		getRoute = http.HandlerFunc(fillHandler)
+	}
+
+	setRoute, deleteRoute = rejectWhileDraining(setRoute), rejectWhileDraining(deleteRoute)
+
+	r := mux.NewRouter()
+	r.Handle("/cache/{key}", getRoute).Methods("GET", "OPTIONS")
+	r.Handle("/cache/{key}", deleteRoute).Methods("DELETE", "OPTIONS")
+	r.Handle("/cache", listRoute).Methods("GET")
+	r.Handle("/cache", setRoute).Methods("POST", "OPTIONS")
+	r.HandleFunc("/healthz", healthzHandler).Methods("GET")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	r.HandleFunc("/stats", statsHandler).Methods("GET")
+	r.HandleFunc("/stats/hotkeys", hotKeysHandler).Methods("GET")
+	r.HandleFunc("/stats/latency", latencyHandler).Methods("GET")
+	if config.WSEnabled {
+		r.HandleFunc("/ws", handleWebSocket)
+		r.HandleFunc("/events/history", historyHandler).Methods("GET")
+		registerChannelRoutes(r)
+	}
+	r.HandleFunc("/admin/log-level", logLevelHandler).Methods("GET", "PUT")
+	r.HandleFunc("/admin/config", configHandler).Methods("GET", "PUT")
+	r.HandleFunc("/admin/maintenance", maintenanceHandler).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/admin/slowlog", slowlogHandler).Methods("GET", "DELETE")
+	r.HandleFunc("/admin/alerts", alertsHandler).Methods("GET")
+	r.HandleFunc("/admin/invalidations", invalidationsHandler).Methods("GET")
+	r.HandleFunc("/admin/invalidations/preview", invalidationPreviewHandler).Methods("GET")
+	if config.InvalidationSecret != "" {
+		r.Handle("/invalidate", typeWrite(webhookHandler)).Methods("POST")
+	}
+	r.HandleFunc("/cluster/nodes", clusterNodesHandler).Methods("GET")
+	r.HandleFunc("/cluster/stats", clusterStatsHandler).Methods("GET")
+	r.HandleFunc("/cluster/keys", receiveKeysHandler).Methods("POST")
+	registerClusterAdminRoutes(r)
+	registerCacheAdminRoutes(r)
+	registerTypeRoutes(r)
+	registerRawRoutes(r)
+	registerLockRoutes(r)
+	registerRateLimitRoutes(r)
+	registerScriptRoutes(r)
+	registerNamedCacheRoutes(r)
+	registerDebugRoutes(r)
+	r.HandleFunc("/geo/replicate", geoReplicateHandler).Methods("POST")
+	r.HandleFunc("/geo/status", geoStatusHandler).Methods("GET")
+	if config.RaftAddr != "" {
+		registerRaftRoutes(r)
+	}
+
+	// Gossip and raft listen on their ports, so they come last of what
+	// can fail
+	if config.GossipAddr != "" {
+		if err := startGossip(config); err != nil {
+			return nil, fmt.Errorf("starting gossip: %w", err)
+		}
+		undo = append(undo, stopGossip)
+	}
+	if config.RaftAddr != "" {
+		if err := startRaft(config); err != nil {
+			return nil, fmt.Errorf("starting raft: %w", err)
+		}
+	}
+
+	// Nothing fails from here on: hook into the cache and start the
+	// background work
+	peers = append(peers, config.Peers...)
+	if c != nil {
+		cache.OnEvict = append(cache.OnEvict, publishEviction)
+	}
+	if config.MetricsEnabled {
+		r.Handle("/metrics", setupMetrics(config)).Methods("GET")
+	}
+	setupSlowlog(config)
+	setupLatency()
+	setupExpvar(config)
+	setupReadiness(config)
+	setupHotKeys(config)
+	if config.APIKeysFile != "" {
+		go watchAPIKeysFile(config)
+	}
+	if config.ACLFile != "" {
+		go watchACLs(config.ACLFile)
+	}
+	startAudit(config)
+	if tlsCerts != nil {
+		go tlsCerts.watch()
+	}
+	startWriters()
+	if config.SnapshotPath != "" {
+		snapshotLoaded.Store(true)
+		go snapshotLoop(cache, config)
+	}
+	if config.WarmupSource != "" {
+		startWarmup(config)
+	}
+	if config.Role == RoleReplica {
+		go replicate(context.Background(), config.PrimaryAddr)
+	}
+	if config.WSEnabled {
+		go wsHub.run()
+	}
+	go limiter.sweep() // the limits can be set at runtime
+	go cleanupExpiredItems()
+	if config.MemoryLimit > 0 {
+		go watchMemory()
+	}
+	if len(config.AlertRules) > 0 {
+		startAlerts(config)
+	}
+	startInvalidation(config)
+	if config.RebalanceMode != RebalanceOff {
+		go watchTopology()
+	}
+	if config.GeoRegion != "" {
+		startGeoReplication(config)
+	}
+	if config.RaftAddr != "" {
+		startRaftWork(config)
+	}
+
+	// Wrap router with CORS and logging middleware
+	handler := limitMiddleware(r, authMiddleware(labelMiddleware(rateLimitMiddleware(auditMiddleware(slowlogMiddleware(r, aclMiddleware(readOnlyMiddleware(r))))))))
+	if opts.CORS {
+		handler = cors.New(cors.Options{
+			AllowedOrigins:   config.AllowedOrigins,
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization", "X-API-Key", "X-Consistency", requestIDHeader},
+			ExposedHeaders:   []string{requestIDHeader},
+			AllowCredentials: true,
+		}).Handler(handler)
+	}
+	if config.MetricsEnabled {
+		handler = metricsMiddleware(r, handler)
+	}
+	handler = tracingMiddleware(r, handler)
+	handler = logMiddleware(handler)
+	handler = requestIDMiddleware(handler)
+	apiHandler = handler
+	return handler, nil
+}
+
+func getHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	_, span := startSpan(r.Context(), "cache.get", key)
+	value, err := cache.Get(key)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	span.End()
+	if err != nil {
+		cacheError(w, err)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{"key": key, "value": value})
+}
+
+// setRequest is the body accepted by POST /cache
+type setRequest struct {
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+	Expiration int         `json:"expiration"` // in seconds
+	Tags       []string    `json:"tags,omitempty"`
+}
+
+// ttl is how long the item lives, CACHE_DEFAULT_TTL when no expiration is given
+func (r setRequest) ttl() time.Duration {
+	if ttl := tuned().DefaultTTL; r.Expiration == 0 && ttl > 0 {
+		return ttl
+	}
+	return time.Duration(r.Expiration) * time.Second
+}
+
+func setHandler(w http.ResponseWriter, r *http.Request) {
+	var data setRequest
+
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := validateWriteKey(data.Key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(data.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateValue(data.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !writeThrough(w, r, data.Key, data.Value, false) {
+		return
+	}
+
+	expiration := data.ttl()
+	_, span := startSpan(r.Context(), "cache.set", data.Key)
+	err := cache.Set(data.Key, data.Value, expiration)
+	endSpan(span, err)
+	if err != nil {
+		cacheError(w, err)
+		return
+	}
+	keyTags.set(data.Key, data.Tags)
+	publishInvalidation(data.Key)
+
+	update := CacheUpdate{
+		Type:      EventSet,
+		Reason:    ReasonRequest,
+		Key:       data.Key,
+		Value:     data.Value,
+		ExpiresAt: clock.Now().Add(expiration),
+		RequestID: requestID(r.Context()),
+		Tags:      data.Tags,
+	}
+	shipToRegions(update)
+	publish(update)
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]string{"message": "Key set successfully"})
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	if !writeThrough(w, r, key, nil, true) {
+		return
+	}
+
+	_, span := startSpan(r.Context(), "cache.delete", key)
+	cache.Delete(key)
+	span.End()
+	keyTags.remove(key)
+	publishInvalidation(key)
+
+	update := removal(key, EventDelete, ReasonRequest, requestID(r.Context()))
+	shipToRegions(update)
+	publish(update)
+
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, map[string]string{"message": "Key deleted successfully"})
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	store, name := cacheFor(r)
+	if store == nil {
+		http.Error(w, "Cache not found", http.StatusNotFound)
+		return
+	}
+	resume, err := parseResumePoint(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	types, err := parseEventTypes(queryPatterns(r.URL.Query().Get("types")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	channels := queryPatterns(r.URL.Query().Get("channels"))
+	if err := validatePatterns(channels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, subprotocolHeader(r))
+	if err != nil {
+		loggerFrom(r.Context()).Warn("websocket: upgrade failed", "err", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(config.MaxBodyBytes)
+	wsConnections.Add(1)
+	defer wsConnections.Add(-1)
+	if p := principalFrom(r.Context()); p != nil && !p.ExpiresAt.IsZero() {
+		// The connection only lives as long as the token it was opened with
+		timer := time.AfterFunc(time.Until(p.ExpiresAt), func() {
+			message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired")
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			conn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	client := newWSClient(conn, principalFrom(r.Context()))
+	client.credentials = credentialHeader(r)
+	client.store, client.cacheName = store, name
+	if patterns := queryPatterns(r.URL.Query().Get("subscribe")); patterns != nil {
+		client.subscribe(patterns)
+	}
+	client.followChannels(channels)
+	client.filterTypes(types)
+	// Join before reading the current state, so no change made meanwhile is
+	// missed; the hub queues them until the state has been sent
+	if !wsHub.join(client) {
+		return
+	}
+	defer wsHub.leave(client)
+
+	// Send the new client the current state, or what it missed since it
+	// last connected, and tell it which seq that brings it up to
+	updates, synced := syncState(client, resume)
+	if err = client.sendUpdates(updates); err == nil {
+		err = client.send(synced)
+	}
+	client.syncedSeq = synced.Seq
+	close(client.ready)
+	if err != nil {
+		loggerFrom(r.Context()).Debug("websocket: sending initial state", "err", err)
+		return
+	}
+
+	client.keepAlive()
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				loggerFrom(r.Context()).Info("websocket: client stopped answering pings, closing", "remote_addr", conn.RemoteAddr().String())
+			} else {
+				loggerFrom(r.Context()).Debug("websocket: connection closed", "err", err)
+			}
+			return
+		}
+		client.extendDeadline()
+		handleClientMessage(client, messageType, data)
+	}
+}
+
+// awaitShutdown :: on SIGINT or SIGTERM closes the WebSocket connections,
+// saves a last snapshot when snapshots are on, closes the caches and exits
+func awaitShutdown() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+
+	slog.Info("shutting down")
+	Shutdown()
+	os.Exit(0)
+}
+
+// Shutdown :: closes the WebSocket connections, writes the write-behind
+// queue, saves the snapshot, if any, closes the caches and exports the
+// spans still buffered. The handler must not be used after
+func Shutdown() {
+	if config.WSEnabled {
+		wsHub.shutdown(5 * time.Second)
+	}
+	if writeBehind != nil {
+		writeBehind.shutdown(10 * time.Second)
+	}
+	if config.SnapshotPath != "" {
+		if err := saveSnapshot(cache, config.SnapshotPath, config.SnapshotKey); err != nil {
+			slog.Error("snapshot: saving", "err", err)
+		}
+	}
+	closeCaches()
+	stopTracing()
+}
+
+// closeCaches closes the default cache and the named ones, once nothing
+// uses them any more
+func closeCaches() {
+	stores := []lru.Cache{cache}
+	for _, nc := range namedCaches {
+		stores = append(stores, nc)
+	}
+	for _, store := range stores {
+		if err := store.Close(); err != nil {
+			slog.Error("closing cache", "err", err)
+		}
+	}
+}
+
+// cleanupExpiredItems :: removes the expired items of every cache every
+// CACHE_JANITOR_INTERVAL, which can change at runtime, or sooner while
+// CACHE_EXPIRY_STRATEGY=sampled finds many
+func cleanupExpiredItems() {
+	wait := tuned().JanitorInterval
+	for {
+		<-clock.After(wait)
+		wait = tuned().JanitorInterval
+		if config.ExpiryStrategy == ExpirySampled {
+			if !expireSampled() {
+				wait /= expirySpeedup
+			}
+		} else {
+			// Published after unlocking: a stalled hub must not hold up the cache
+			for _, key := range cache.RemoveExpired() {
+				keyTags.remove(key)
+				publish(removal(key, EventExpire, ReasonTTL, ""))
+			}
+			for _, nc := range namedCaches {
+				for _, key := range nc.RemoveExpired() {
+					publish(nc.removal(key, EventExpire, ReasonTTL, ""))
+				}
+			}
+		}
+		pruneHashFields()
+	}
+}
+
+func getAllCacheItems(w http.ResponseWriter, r *http.Request) {
+	writeItems(w, r, cache)
+}
+
+// itemBatch is how many items GET /cache copies from the cache at a time
+const itemBatch = 256
+
+// writeItems streams the live items of c the caller may read, as a JSON
+// object by key or, with ?format=ndjson, one {"key", "value", "expiresAt"}
+// object per line. The items are read a batch at a time rather than all at
+// once, so the cache is not locked while the response is written, and the
+// memory used does not grow with the cache
+func writeItems(w http.ResponseWriter, r *http.Request, c *lru.LRUCache) {
+	ndjson := r.URL.Query().Get("format") == "ndjson"
+	principal := principalFrom(r.Context())
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	first := true
+	c.Walk(itemBatch, func(item lru.CacheItem) bool {
+		if !canAccess(r.Context(), item.Key, ScopeRead) {
+			return true
+		}
+		value := redact(principal, item.Key, item.Value)
+		var data []byte
+		var err error
+		if ndjson {
+			data, err = jsonCodec.Marshal(map[string]interface{}{"key": item.Key, "value": value, "expiresAt": item.ExpiresAt})
+		} else {
+			data, err = jsonCodec.Marshal(map[string]interface{}{"value": value, "expiresAt": item.ExpiresAt})
+		}
+		if err != nil {
+			return true // values come from JSON, so this cannot happen
+		}
+		buf.Reset()
+		if !ndjson {
+			// "key":{"expiresAt": ..., "value": ...} after a { or a comma
+			if first {
+				buf.WriteByte('{')
+			} else {
+				buf.WriteByte(',')
+			}
+			key, _ := jsonCodec.Marshal(item.Key)
+			buf.Write(key)
+			buf.WriteByte(':')
+		}
+		buf.Write(data)
+		if ndjson {
+			buf.WriteByte('\n')
+		}
+		first = false
+		_, err = w.Write(buf.Bytes())
+		return err == nil // stop once the client is gone
+	})
+	if !ndjson {
+		if first {
+			io.WriteString(w, "{")
+		}
+		io.WriteString(w, "}\n")
+	}
+}
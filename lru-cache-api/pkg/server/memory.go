@@ -0,0 +1,106 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// With CACHE_MEMORY_LIMIT set, the heap the last garbage collection found
+// live is checked against it every memoryCheck. Above memoryHigh of the
+// limit, every cache evicts its least recently used items in proportion to
+// how far over memoryTarget the heap is, taking the items to make up most of
+// it; the collector only gives the memory back at its next cycle, so no more
+// is evicted until one has run. Above memoryCritical, sets and imports are
+// refused with 503 until the heap is back under memoryHigh, while reads,
+// deletes and flushes, which free memory, still go through. The limit is
+// also the runtime's soft memory limit, unless GOMEMLIMIT sets one, so the
+// collector works harder as the heap nears it instead of letting it double
+const (
+	memoryCheck    = time.Second
+	memoryTarget   = 0.75
+	memoryHigh     = 0.85
+	memoryCritical = 0.95
+)
+
+// MemoryPressure is how close the heap is to CACHE_MEMORY_LIMIT
+type MemoryPressure struct {
+	LimitBytes uint64 `json:"limitBytes"`
+	LiveBytes  uint64 `json:"liveBytes"` // the heap the last collection found live
+	Critical   bool   `json:"critical"`  // set while writes are refused
+	Evictions  uint64 `json:"evictions"` // items evicted to free memory
+}
+
+var (
+	memoryLive      atomic.Uint64
+	memoryFull      atomic.Bool // writes are refused
+	memoryEvictions atomic.Uint64
+)
+
+// memoryPressure returns what /stats serves of it, nil with no limit set
+func memoryPressure() *MemoryPressure {
+	if config.MemoryLimit == 0 {
+		return nil
+	}
+	return &MemoryPressure{
+		LimitBytes: uint64(config.MemoryLimit),
+		LiveBytes:  memoryLive.Load(),
+		Critical:   memoryFull.Load(),
+		Evictions:  memoryEvictions.Load(),
+	}
+}
+
+// watchMemory :: keeps the heap under CACHE_MEMORY_LIMIT, evicting items
+// and refusing writes as the limit nears
+func watchMemory() {
+	limit := float64(config.MemoryLimit)
+	if os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(config.MemoryLimit)
+	}
+	samples := []metrics.Sample{{Name: "/gc/heap/live:bytes"}, {Name: "/gc/cycles/total:gc-cycles"}}
+	var evictedAt uint64 // the collection the last eviction waits for
+	for range time.Tick(memoryCheck) {
+		metrics.Read(samples)
+		live, cycle := samples[0].Value.Uint64(), samples[1].Value.Uint64()
+		memoryLive.Store(live)
+
+		switch {
+		case float64(live) >= memoryCritical*limit && !memoryFull.Load():
+			memoryFull.Store(true)
+			slog.Warn("memory: refusing writes", "live", live, "limit", config.MemoryLimit)
+		case float64(live) < memoryHigh*limit && memoryFull.Load():
+			memoryFull.Store(false)
+			slog.Info("memory: accepting writes again", "live", live, "limit", config.MemoryLimit)
+		}
+		if float64(live) < memoryHigh*limit || cycle <= evictedAt {
+			continue
+		}
+		fraction := (float64(live) - memoryTarget*limit) / float64(live)
+		evicted := cache.EvictFraction(fraction)
+		for _, nc := range namedCaches {
+			evicted += nc.EvictFraction(fraction)
+		}
+		memoryEvictions.Add(uint64(evicted))
+		slog.Warn("memory: evicting", "live", live, "limit", config.MemoryLimit, "fraction", fraction, "evicted", evicted)
+		metrics.Read(samples[1:])
+		evictedAt = samples[1].Value.Uint64()
+		if memoryFull.Load() {
+			runtime.GC() // with writes refused, nothing may allocate enough to start one
+		}
+	}
+}
+
+// memoryWrite reports whether r is a write refused while memory is short:
+// any data write but deletes and flushes
+func memoryWrite(r *http.Request) bool {
+	if !memoryFull.Load() || !dataWrite(r) || r.Method == http.MethodDelete {
+		return false
+	}
+	_, path := namedCachePath(r.URL.Path)
+	return path != "/admin/cache/flush"
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_http_requests_total",
+		Help: "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cache_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and method.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"route", "method"})
+
+	namespaceLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_namespace_lookups_total",
+		Help: "Cache lookups by key namespace and result, with CACHE_METRICS_NAMESPACES=true.",
+	}, []string{"namespace", "result"})
+
+	namespaceRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_namespace_requests_total",
+		Help: "HTTP requests for a key by namespace, tenant, method and status, with CACHE_METRICS_NAMESPACES=true.",
+	}, []string{"namespace", "tenant", "method", "status"})
+
+	namespaceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cache_namespace_request_duration_seconds",
+		Help:    "Latency of HTTP requests for a key by namespace, tenant and method, with CACHE_METRICS_NAMESPACES=true.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"namespace", "tenant", "method"})
+
+	cacheErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cache_errors_total",
+		Help: "Cache calls answered with an error, by error: not_found, expired, too_large or capacity_zero.",
+	}, []string{"error"})
+
+	// namespaceLabel and tenantLabel keep the per-team series bounded
+	namespaceLabel, tenantLabel *boundedLabel
+
+	metricsRegistry = prometheus.NewRegistry()
+)
+
+// cacheCollector reports the cache counters at scrape time, from one Stats call
+type cacheCollector struct{}
+
+var (
+	hitsDesc        = prometheus.NewDesc("cache_hits_total", "Lookups that found a live key.", nil, nil)
+	missesDesc      = prometheus.NewDesc("cache_misses_total", "Lookups that found nothing or an expired key.", nil, nil)
+	evictionsDesc   = prometheus.NewDesc("cache_evictions_total", "Keys evicted to make room.", nil, nil)
+	expirationsDesc = prometheus.NewDesc("cache_expirations_total", "Keys removed because their TTL ran out.", nil, nil)
+	itemsDesc       = prometheus.NewDesc("cache_items", "Keys currently held.", nil, nil)
+	capacityDesc    = prometheus.NewDesc("cache_capacity", "Keys the cache can hold.", nil, nil)
+	bytesDesc       = prometheus.NewDesc("cache_memory_bytes", "Estimated size of the keys and values held.", nil, nil)
+	compressedDesc  = prometheus.NewDesc("cache_compressed_bytes", "Size of the values kept compressed, as kept.", nil, nil)
+	rawDesc         = prometheus.NewDesc("cache_uncompressed_bytes", "Size of the values kept compressed, before compressing.", nil, nil)
+	wsClientsDesc   = prometheus.NewDesc("cache_websocket_clients", "Connected WebSocket clients.", nil, nil)
+	broadcastDesc   = prometheus.NewDesc("cache_broadcast_queue_depth", "Updates waiting to be sent to WebSocket clients.", nil, nil)
+)
+
+func (cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{hitsDesc, missesDesc, evictionsDesc, expirationsDesc, itemsDesc, capacityDesc, bytesDesc, compressedDesc, rawDesc, wsClientsDesc, broadcastDesc} {
+		ch <- desc
+	}
+}
+
+func (cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := cache.Stats()
+	ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(missesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(evictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(expirationsDesc, prometheus.CounterValue, float64(stats.Expirations))
+	ch <- prometheus.MustNewConstMetric(itemsDesc, prometheus.GaugeValue, float64(stats.Items))
+	ch <- prometheus.MustNewConstMetric(capacityDesc, prometheus.GaugeValue, float64(stats.Capacity))
+	ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.GaugeValue, float64(stats.MemoryBytes))
+	ch <- prometheus.MustNewConstMetric(compressedDesc, prometheus.GaugeValue, float64(stats.CompressedBytes))
+	ch <- prometheus.MustNewConstMetric(rawDesc, prometheus.GaugeValue, float64(stats.UncompressedBytes))
+	ch <- prometheus.MustNewConstMetric(wsClientsDesc, prometheus.GaugeValue, float64(wsConnections.Load()))
+	ch <- prometheus.MustNewConstMetric(broadcastDesc, prometheus.GaugeValue, float64(len(broadcast)))
+}
+
+// setupMetrics :: registers the collectors and returns the /metrics handler
+func setupMetrics(cfg *Config) http.Handler {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		cacheCollector{},
+		httpRequests,
+		httpDuration,
+		cacheErrors,
+		opDuration,
+		wsBackpressure,
+		broadcastCoalesced,
+		broadcastDropped,
+	)
+	if cfg.MetricsNamespaces {
+		namespaceLabel = &boundedLabel{max: cfg.MetricsMaxNamespaces, seen: make(map[string]bool)}
+		tenantLabel = &boundedLabel{max: cfg.MetricsMaxTenants, seen: make(map[string]bool)}
+		metricsRegistry.MustRegister(namespaceLookups, namespaceRequests, namespaceDuration)
+		cache.OnLookup = append(cache.OnLookup, countNamespaceLookup)
+	}
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// keyNamespace returns the part of key before the first colon, the
+// convention namespaced keys such as users:42 follow
+func keyNamespace(key string) string {
+	if namespace, _, ok := strings.Cut(key, ":"); ok {
+		return namespace
+	}
+	return ""
+}
+
+func countNamespaceLookup(key string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	namespaceLookups.WithLabelValues(namespaceLabel.value(keyNamespace(key)), result).Inc()
+}
+
+// boundedLabel caps how many values a label takes: the first max values
+// seen are reported as they are, any later one as "other"
+type boundedLabel struct {
+	mutex sync.Mutex
+	seen  map[string]bool
+	max   int
+}
+
+func (b *boundedLabel) value(v string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.seen[v] {
+		return v
+	}
+	if len(b.seen) >= b.max {
+		return "other"
+	}
+	b.seen[v] = true
+	return v
+}
+
+// requestLabels is filled in by labelMiddleware, once the key and tenant of
+// a request are known, for metricsMiddleware to read
+type requestLabels struct {
+	key    string
+	keyed  bool
+	tenant string
+}
+
+type requestLabelsKey struct{}
+
+// labelMiddleware notes which key and tenant a request is for. It runs after
+// authentication, where the tenant is known
+func labelMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if labels, ok := r.Context().Value(requestLabelsKey{}).(*requestLabels); ok {
+			labels.key, labels.keyed = requestKey(r)
+			if p := principalFrom(r.Context()); p != nil {
+				labels.tenant = p.Tenant
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeTemplate returns the template of the route r matches, such as
+// /cache/{key}, or "unmatched"
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+	if router.Match(r, &match) && match.Route != nil {
+		if template, err := match.Route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// metricsMiddleware counts and times every request by the route it matches,
+// so /cache/{key} is one series however many keys there are
+func metricsMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(router, r)
+		var labels *requestLabels
+		if config.MetricsNamespaces {
+			labels = &requestLabels{}
+			r = r.WithContext(context.WithValue(r.Context(), requestLabelsKey{}, labels))
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if labels != nil && labels.keyed {
+			namespace, tenant := namespaceLabel.value(keyNamespace(labels.key)), tenantLabel.value(labels.tenant)
+			namespaceRequests.WithLabelValues(namespace, tenant, r.Method, strconv.Itoa(recorder.status)).Inc()
+			namespaceDuration.WithLabelValues(namespace, tenant, r.Method).Observe(time.Since(start).Seconds())
+		}
+
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Inc()
+		if recorder.status != http.StatusSwitchingProtocols {
+			// WebSocket connections would only measure how long clients stayed
+			httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		}
+	})
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+)
+
+// NamedCacheConfig is one of the caches of CACHE_CACHES
+type NamedCacheConfig struct {
+	Name           string
+	Capacity       int
+	DefaultTTL     time.Duration // CACHE_DEFAULT_TTL when zero
+	EvictionPolicy string
+}
+
+// namedCache is a cache of its own, served under /caches/{name}/ next to
+// the default one. Its items are kept on this node only: they are not
+// replicated, gossiped, shipped to other regions or saved in snapshots
+type namedCache struct {
+	*lru.LRUCache
+	name       string
+	defaultTTL time.Duration
+}
+
+// namedCaches are set up before serving and never change after
+var namedCaches = map[string]*namedCache{}
+
+var cacheNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// parseNamedCaches :: parses caches such as "sessions:10000:30m" or
+// "responses:5000", name:capacity[:default_ttl[:policy]]
+func parseNamedCaches(specs []string) ([]NamedCacheConfig, error) {
+	var caches []NamedCacheConfig
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		parts := strings.Split(spec, ":")
+		if len(parts) < 2 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid cache %q, expected name:capacity[:default_ttl[:policy]]", spec)
+		}
+		c := NamedCacheConfig{Name: parts[0], EvictionPolicy: lru.EvictLRU}
+		if !cacheNamePattern.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid cache %q, names are letters, digits, - and _", spec)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("cache %q is configured twice", c.Name)
+		}
+		seen[c.Name] = true
+		var err error
+		if c.Capacity, err = strconv.Atoi(parts[1]); err != nil || c.Capacity < 1 {
+			return nil, fmt.Errorf("invalid cache %q, the capacity must be at least 1", spec)
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			if c.DefaultTTL, err = time.ParseDuration(parts[2]); err != nil || c.DefaultTTL < 0 {
+				return nil, fmt.Errorf("invalid cache %q, bad default TTL", spec)
+			}
+		}
+		if len(parts) > 3 && parts[3] != "" {
+			c.EvictionPolicy = parts[3]
+		}
+		if c.EvictionPolicy != lru.EvictLRU {
+			return nil, fmt.Errorf("invalid cache %q, only the lru policy is supported", spec)
+		}
+		caches = append(caches, c)
+	}
+	return caches, nil
+}
+
+// closeNamedCaches closes and forgets the named caches, when setting up the
+// server fails
+func closeNamedCaches() {
+	for name, nc := range namedCaches {
+		nc.Close()
+		delete(namedCaches, name)
+	}
+}
+
+// setupNamedCaches creates the caches of CACHE_CACHES
+func setupNamedCaches(cfg *Config) error {
+	for _, c := range cfg.Caches {
+		nc := &namedCache{name: c.Name, defaultTTL: c.DefaultTTL}
+		store, err := lru.NewCache(
+			lru.WithCapacity(c.Capacity),
+			lru.WithPolicy(c.EvictionPolicy),
+			lru.WithEvictionBatch(config.EvictionBatch),
+			lru.WithCompression(config.CompressMin),
+			lru.WithMaxItemSize(config.MaxItemBytes),
+			lru.WithClock(clock),
+			lru.WithOnEvict(func(key string) {
+				offer(nc.removal(key, EventEvict, ReasonCapacity, ""))
+			}),
+		)
+		if err != nil {
+			return fmt.Errorf("cache %s: %w", c.Name, err)
+		}
+		nc.LRUCache = store
+		namedCaches[c.Name] = nc
+	}
+	return nil
+}
+
+// removal returns the update telling the cache's clients key is gone
+func (nc *namedCache) removal(key, eventType, reason, requestID string) CacheUpdate {
+	update := removal(key, eventType, reason, requestID)
+	update.Cache = nc.name
+	return update
+}
+
+// namedCachePath splits /caches/{name}/rest into the cache name and /rest,
+// returning "" and path itself for the paths of the default cache
+func namedCachePath(path string) (string, string) {
+	if rest, ok := strings.CutPrefix(path, "/caches/"); ok {
+		if name, rest, ok := strings.Cut(rest, "/"); ok {
+			return name, "/" + rest
+		}
+	}
+	return "", path
+}
+
+// cacheFor returns the cache r is about with its name: the named one for
+// /caches/{name}/..., nil when there is no such cache, and the default one
+// for every other path
+func cacheFor(r *http.Request) (lru.Cache, string) {
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		return cache, ""
+	}
+	if nc := namedCaches[name]; nc != nil {
+		return nc.LRUCache, name
+	}
+	return nil, name
+}
+
+func registerNamedCacheRoutes(r *mux.Router) {
+	r.HandleFunc("/caches", namedCachesHandler).Methods("GET")
+	r.HandleFunc("/caches/{name}/cache", withNamedCache(namedListHandler)).Methods("GET")
+	r.HandleFunc("/caches/{name}/cache", withNamedCache(namedSetHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/caches/{name}/cache/{key}", withNamedCache(namedGetHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/caches/{name}/cache/{key}", withNamedCache(namedDeleteHandler)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/caches/{name}/stats", withNamedCache(namedStatsHandler)).Methods("GET")
+	if config.WSEnabled {
+		r.HandleFunc("/caches/{name}/ws", handleWebSocket)
+	}
+}
+
+// withNamedCache looks up the cache of the path, answering 404 when there
+// is none by that name
+func withNamedCache(next func(w http.ResponseWriter, r *http.Request, nc *namedCache)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nc := namedCaches[mux.Vars(r)["name"]]
+		if nc == nil {
+			http.Error(w, "Cache not found", http.StatusNotFound)
+			return
+		}
+		next(w, r, nc)
+	}
+}
+
+// namedCachesHandler :: GET /caches, the stats of every named cache
+func namedCachesHandler(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(namedCaches))
+	for name := range namedCaches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	caches := make([]map[string]interface{}, len(names))
+	for i, name := range names {
+		nc := namedCaches[name]
+		defaultTTL := nc.defaultTTL
+		if defaultTTL == 0 {
+			defaultTTL = tuned().DefaultTTL
+		}
+		caches[i] = map[string]interface{}{"name": name, "defaultTtl": defaultTTL.String(), "stats": statsOf(nc.LRUCache)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(caches)
+}
+
+func namedListHandler(w http.ResponseWriter, r *http.Request, nc *namedCache) {
+	writeItems(w, r, nc.LRUCache)
+}
+
+func namedGetHandler(w http.ResponseWriter, r *http.Request, nc *namedCache) {
+	key := mux.Vars(r)["key"]
+	value, err := nc.Get(key)
+	if err != nil {
+		cacheError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"key": key, "value": value})
+}
+
+func namedSetHandler(w http.ResponseWriter, r *http.Request, nc *namedCache) {
+	var data setRequest
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := validateKey(data.Key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateValue(data.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expiration := data.ttl()
+	if data.Expiration == 0 && nc.defaultTTL > 0 {
+		expiration = nc.defaultTTL
+	}
+	if err := nc.Set(data.Key, data.Value, expiration); err != nil {
+		cacheError(w, err)
+		return
+	}
+	publish(CacheUpdate{
+		Type:      EventSet,
+		Reason:    ReasonRequest,
+		Cache:     nc.name,
+		Key:       data.Key,
+		Value:     data.Value,
+		ExpiresAt: clock.Now().Add(expiration),
+		RequestID: requestID(r.Context()),
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]string{"message": "Key set successfully"})
+}
+
+func namedDeleteHandler(w http.ResponseWriter, r *http.Request, nc *namedCache) {
+	key := mux.Vars(r)["key"]
+	nc.Delete(key)
+	publish(nc.removal(key, EventDelete, ReasonRequest, requestID(r.Context())))
+
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, map[string]string{"message": "Key deleted successfully"})
+}
+
+func namedStatsHandler(w http.ResponseWriter, r *http.Request, nc *namedCache) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statsOf(nc.LRUCache))
+}
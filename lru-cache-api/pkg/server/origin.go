@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// originAllowed :: reports whether pages from origin may use the API. Entries
+// of CACHE_ALLOWED_ORIGINS may hold one * wildcard, e.g. https://*.example.com,
+// the same as the CORS middleware accepts
+func originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range config.AllowedOrigins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) >= len(prefix)+len(suffix) &&
+			strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebSocketOrigin stops other websites from opening the event stream in
+// their visitors' browsers. Requests without an Origin do not come from a
+// browser, e.g. replicas following their primary
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || originAllowed(origin)
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyKeyPrefix starts the keys of the responses cached by the reverse proxy
+const proxyKeyPrefix = "proxy:"
+
+// cacheableStatus are the statuses the proxy stores when the upstream says
+// they are fresh, those RFC 9111 lets caches reuse by default
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// proxyKeyContext carries the cache key of a request whose response may be
+// stored
+type proxyKeyContext struct{}
+
+// startProxy :: serves CACHE_PROXY_UPSTREAM on CACHE_PROXY_PORT, answering
+// GETs from the cache while the upstream's Cache-Control says they are fresh
+func startProxy(cfg *Config) {
+	handler := requestIDMiddleware(logMiddleware(newProxyHandler(cfg)))
+	go func() {
+		if err := listenAndServe(fmt.Sprintf(":%d", cfg.ProxyPort), handler); err != nil {
+			fatal("serving the reverse proxy", "err", err)
+		}
+	}()
+}
+
+func newProxyHandler(cfg *Config) http.Handler {
+	upstream, _ := url.Parse(cfg.ProxyUpstream) // checked by loadConfig
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(upstream)
+			pr.SetXForwarded()
+			if _, ok := pr.In.Context().Value(proxyKeyContext{}).(string); ok {
+				// Stored bodies are served to every client, so they are
+				// fetched without a content encoding
+				pr.Out.Header.Del("Accept-Encoding")
+			}
+		},
+		ModifyResponse: storeProxyResponse,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("proxy: upstream request failed", "url", r.URL.String(), "err", err)
+			http.Error(w, "Upstream unavailable", http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := proxyCacheKey(r)
+		if !ok {
+			w.Header().Set("X-Cache", "BYPASS")
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		directives := cacheControl(r.Header.Get("Cache-Control"))
+		if _, noCache := directives["no-cache"]; !noCache && serveProxyHit(w, key) {
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+		if _, noStore := directives["no-store"]; noStore {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), proxyKeyContext{}, key))
+		coalesceProxy(w, r, key, proxy)
+	})
+}
+
+// proxyCacheKey returns the key a request's response is cached under, and
+// false for requests that are always passed on: anything but GET, requests
+// carrying credentials and protocol upgrades
+func proxyCacheKey(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		return "", false
+	}
+	key := proxyKeyPrefix + r.URL.RequestURI()
+	if validateKey(key) != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// serveProxyHit answers the request from the cache, reporting whether key
+// held a response
+func serveProxyHit(w http.ResponseWriter, key string) bool {
+	value, err := cache.Get(key)
+	if err != nil {
+		return false
+	}
+	resp, ok := decodeProxyResponse(value)
+	if !ok {
+		return false
+	}
+	writeProxyResponse(w, resp, "HIT")
+	return true
+}
+
+// writeProxyResponse answers with a response the proxy kept, marked with
+// X-Cache: xCache
+func writeProxyResponse(w http.ResponseWriter, resp proxyResponse, xCache string) {
+	for name, values := range resp.header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	if !resp.storedAt.IsZero() {
+		w.Header().Set("Age", strconv.Itoa(int(clock.Now().Sub(resp.storedAt).Seconds())))
+	}
+	w.Header().Set("X-Cache", xCache)
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// storeProxyResponse caches a fresh upstream response, leaving resp as it
+// was for the client
+func storeProxyResponse(resp *http.Response) error {
+	key, ok := resp.Request.Context().Value(proxyKeyContext{}).(string)
+	if !ok || !cacheableStatus[resp.StatusCode] || !shareable(resp.Header) {
+		return nil
+	}
+	ttl := freshness(resp.Header)
+	if ttl <= 0 || resp.ContentLength > config.ProxyMaxBodyBytes {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, config.ProxyMaxBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	// The client still gets the whole body, however much of it was read
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	if int64(len(body)) > config.ProxyMaxBodyBytes {
+		return nil
+	}
+
+	value := encodeProxyResponse(proxyResponse{resp.StatusCode, resp.Header.Clone(), body, clock.Now()})
+	if err := cache.Set(key, value, ttl); err != nil {
+		return nil
+	}
+	keyTags.remove(key)
+	publish(CacheUpdate{
+		Type:      EventSet,
+		Reason:    ReasonProxy,
+		Key:       key,
+		Value:     value,
+		ExpiresAt: clock.Now().Add(ttl),
+		RequestID: requestID(resp.Request.Context()),
+	})
+	return nil
+}
+
+// shareable reports whether a response may be served to other clients: not
+// private, not setting cookies and not varying on more than its encoding,
+// which the proxy takes out of the requests it caches
+func shareable(header http.Header) bool {
+	directives := cacheControl(header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return false
+		}
+	}
+	if len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			if name = strings.TrimSpace(name); name != "" && !strings.EqualFold(name, "Accept-Encoding") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// freshness is how long a response stays fresh: its s-maxage, max-age or
+// Expires, less the Age it already has, or CACHE_PROXY_DEFAULT_TTL when it
+// says nothing
+func freshness(header http.Header) time.Duration {
+	directives := cacheControl(header.Get("Cache-Control"))
+	var ttl time.Duration
+	if v, ok := directives["s-maxage"]; ok {
+		ttl = seconds(v)
+	} else if v, ok := directives["max-age"]; ok {
+		ttl = seconds(v)
+	} else if expires := header.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			return 0 // an invalid Expires means already expired
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		ttl = at.Sub(date)
+	} else {
+		return config.ProxyDefaultTTL
+	}
+	if age := header.Get("Age"); age != "" {
+		ttl -= seconds(age)
+	}
+	return ttl
+}
+
+// cacheControl parses a Cache-Control header into its directives, names
+// lower cased
+func cacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+func seconds(s string) time.Duration {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// proxyResponse is an upstream response as the proxy caches it
+type proxyResponse struct {
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+}
+
+// encodeProxyResponse turns a response into a value shaped like decoded
+// JSON, so it can be listed, exported and replicated as any other item
+func encodeProxyResponse(resp proxyResponse) interface{} {
+	header := make(map[string]interface{}, len(resp.header))
+	for name, values := range resp.header {
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		header[name] = list
+	}
+	return map[string]interface{}{
+		"status":   float64(resp.status),
+		"headers":  header,
+		"body":     base64.StdEncoding.EncodeToString(resp.body),
+		"storedAt": resp.storedAt.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+func decodeProxyResponse(value interface{}) (proxyResponse, bool) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return proxyResponse{}, false
+	}
+	status, _ := m["status"].(float64)
+	encoded, _ := m["body"].(string)
+	body, err := base64.StdEncoding.DecodeString(encoded)
+	if status < 100 || err != nil {
+		return proxyResponse{}, false
+	}
+	resp := proxyResponse{status: int(status), header: http.Header{}, body: body}
+	resp.storedAt, _ = time.Parse(time.RFC3339Nano, fmt.Sprint(m["storedAt"]))
+	headers, _ := m["headers"].(map[string]interface{})
+	for name, values := range headers {
+		list, _ := values.([]interface{})
+		for _, v := range list {
+			if s, ok := v.(string); ok {
+				resp.header.Add(name, s)
+			}
+		}
+	}
+	return resp, true
+}
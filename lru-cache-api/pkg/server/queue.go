@@ -0,0 +1,294 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Delay queues hold values that become visible at a given time, for jobs
+// scheduled for later. Popping a visible item leases it rather than taking
+// it: the item stays in the queue, hidden until the lease ends, and is only
+// removed when acked with the receipt the pop returned. An item whose
+// consumer dies is so delivered again, at least once in all.
+//
+// A queue is a JSON object of the items, sorted by when they are visible,
+// and the id the next one gets, so receipts stay unique:
+// {"nextId": 3, "queue": [{"id": 2, "value": ..., "visibleAt": 1700000000000, "attempts": 0}]}.
+// Times are in Unix milliseconds, passed to the ops as args[0] as for hashes
+
+// defaultLease is how long a popped item stays hidden by default
+const defaultLease = 30 // seconds
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"qpush":  {fn: queuePush},
+		"qpop":   {fn: queuePop},
+		"qack":   {fn: queueAck},
+		"qstats": {fn: queueStats, read: true},
+	})
+}
+
+// queueItem is an item of a delay queue
+type queueItem struct {
+	ID        int
+	Value     interface{}
+	VisibleAt int // Unix milliseconds
+	Attempts  int // how many times it was popped
+}
+
+// receipt is what acks the item popped for the attempts'th time, so a
+// consumer whose lease ran out cannot ack the next one's
+func (item queueItem) receipt() string {
+	return fmt.Sprintf("%d:%d", item.ID, item.Attempts)
+}
+
+// asQueue returns the items of the queue held by a key and the next id
+func asQueue(value interface{}) ([]queueItem, int, error) {
+	if value == nil {
+		return nil, 1, nil
+	}
+	queue, ok := value.(map[string]interface{})
+	raw, isList := queue["queue"].([]interface{})
+	next, err := argInt([]interface{}{queue["nextId"]}, 0)
+	if !ok || !isList || err != nil || len(queue) != 2 {
+		return nil, 0, errWrongType
+	}
+	items := make([]queueItem, len(raw))
+	for i, r := range raw {
+		fields, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, 0, errWrongType
+		}
+		nums := make([]int, 3)
+		for j, name := range []string{"id", "visibleAt", "attempts"} {
+			if nums[j], err = argInt([]interface{}{fields[name]}, 0); err != nil {
+				return nil, 0, errWrongType
+			}
+		}
+		items[i] = queueItem{ID: nums[0], Value: fields["value"], VisibleAt: nums[1], Attempts: nums[2]}
+	}
+	return items, next, nil
+}
+
+// queueValue returns the value holding items, sorting them
+func queueValue(items []queueItem, next int) map[string]interface{} {
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].VisibleAt != items[j].VisibleAt {
+			return items[i].VisibleAt < items[j].VisibleAt
+		}
+		return items[i].ID < items[j].ID
+	})
+	raw := make([]interface{}, len(items))
+	for i, item := range items {
+		// Numbers as JSON decodes them, so replicas hold the same value
+		raw[i] = map[string]interface{}{
+			"id":        float64(item.ID),
+			"value":     item.Value,
+			"visibleAt": float64(item.VisibleAt),
+			"attempts":  float64(item.Attempts),
+		}
+	}
+	return map[string]interface{}{"nextId": float64(next), "queue": raw}
+}
+
+// queuePush :: adds args[2:], visible at args[1], replying with their ids
+func queuePush(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	items, next, err := asQueue(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	visibleAt, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(args) < 3 {
+		return nil, nil, argError("no values to push")
+	}
+	pushed := append(make([]queueItem, 0, len(items)+len(args)-2), items...)
+	ids := make([]int, 0, len(args)-2)
+	for _, v := range args[2:] {
+		pushed = append(pushed, queueItem{ID: next, Value: v, VisibleAt: visibleAt})
+		ids = append(ids, next)
+		next++
+	}
+	return ids, queueValue(pushed, next), nil
+}
+
+// queuePop :: leases up to args[1] items visible at args[0] until args[2],
+// replying with them and their receipts
+func queuePop(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	items, next, err := asQueue(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	now, err := argInt(args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	count, err := argInt(args, 1)
+	if err != nil || count < 1 {
+		return nil, nil, argError("count must be at least 1")
+	}
+	leaseUntil, err := argInt(args, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	popped := []map[string]interface{}{}
+	leased := append([]queueItem(nil), items...)
+	for i := range leased {
+		if len(popped) == count || leased[i].VisibleAt > now {
+			break
+		}
+		leased[i].VisibleAt = leaseUntil
+		leased[i].Attempts++
+		popped = append(popped, map[string]interface{}{
+			"id":       leased[i].ID,
+			"value":    leased[i].Value,
+			"attempts": leased[i].Attempts,
+			"receipt":  leased[i].receipt(),
+		})
+	}
+	if len(popped) == 0 {
+		return popped, noChange, nil
+	}
+	return popped, queueValue(leased, next), nil
+}
+
+// queueAck :: removes the items whose receipts are in args, replying with
+// how many there were. The queue is kept when it empties, with its next id
+func queueAck(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	items, next, err := asQueue(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	receipts, err := argStrings(args, "receipts")
+	if err != nil {
+		return nil, nil, err
+	}
+	acking := make(map[string]bool, len(receipts))
+	for _, receipt := range receipts {
+		acking[receipt] = true
+	}
+	rest := make([]queueItem, 0, len(items))
+	for _, item := range items {
+		if item.Attempts == 0 || !acking[item.receipt()] {
+			rest = append(rest, item)
+		}
+	}
+	if len(rest) == len(items) {
+		return 0, noChange, nil
+	}
+	return len(items) - len(rest), queueValue(rest, next), nil
+}
+
+// queueStats :: how many items are visible at args[0], delayed, or leased
+func queueStats(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	items, _, err := asQueue(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	now, err := argInt(args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ready, delayed, leased int
+	for _, item := range items {
+		switch {
+		case item.VisibleAt <= now:
+			ready++
+		case item.Attempts > 0:
+			leased++
+		default:
+			delayed++
+		}
+	}
+	return map[string]interface{}{"size": len(items), "ready": ready, "delayed": delayed, "leased": leased}, value, nil
+}
+
+// registerQueueRoutes :: mounts /cache/{key}/queue
+func registerQueueRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/queue", withConsistency(queueStatsHandler)).Methods("GET")
+	r.Handle("/cache/{key}/queue/push", typeWrite(queuePushHandler)).Methods("POST")
+	r.Handle("/cache/{key}/queue/pop", typeWrite(queuePopHandler)).Methods("POST")
+	r.Handle("/cache/{key}/queue/ack", typeWrite(queueAckHandler)).Methods("POST")
+}
+
+// queuePushHandler serves POST /cache/{key}/queue/push: {"values": [...]},
+// visible after "delay" seconds, at once by default
+func queuePushHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	if data.Delay < 0 {
+		http.Error(w, "delay must not be negative", http.StatusBadRequest)
+		return
+	}
+	now := int(clock.Now().UnixMilli())
+	args := append([]interface{}{now, now + data.Delay*1000}, data.Values...)
+	ids, err := runTypeOp(r, key, typeOp{Name: "qpush", Args: args}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"ids": ids})
+}
+
+// queuePopHandler serves POST /cache/{key}/queue/pop: leases "count" visible
+// items, 1 by default, for "lease" seconds, 30 by default
+func queuePopHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	if data.Count == 0 {
+		data.Count = 1
+	}
+	if data.Lease == 0 {
+		data.Lease = defaultLease
+	}
+	if data.Lease < 0 {
+		http.Error(w, "lease must be positive", http.StatusBadRequest)
+		return
+	}
+	now := int(clock.Now().UnixMilli())
+	args := []interface{}{now, data.Count, now + data.Lease*1000}
+	items, err := runTypeOp(r, key, typeOp{Name: "qpop", Args: args}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"items": items})
+}
+
+// queueAckHandler serves POST /cache/{key}/queue/ack: {"receipts": [...]}
+func queueAckHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	acked, err := runTypeOp(r, key, typeOp{Name: "qack", Args: data.Receipts}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"acked": acked})
+}
+
+// queueStatsHandler serves GET /cache/{key}/queue: how many items there are
+// and how many are ready, delayed and leased; a key not cached is empty
+func queueStatsHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	stats, err := runTypeOp(r, key, typeOp{Name: "qstats", Args: []interface{}{int(clock.Now().UnixMilli())}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, stats.(map[string]interface{}))
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// parseNamespaceQuotas :: parses quotas such as "reports=20%" or
+// "batch=5000", namespace=items or namespace=percent%
+func parseNamespaceQuotas(specs []string) (map[string]lru.Quota, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	quotas := make(map[string]lru.Quota, len(specs))
+	for _, spec := range specs {
+		namespace, amount, ok := strings.Cut(spec, "=")
+		namespace = strings.TrimSpace(namespace)
+		if !ok || namespace == "" || strings.Contains(namespace, ":") {
+			return nil, fmt.Errorf("invalid namespace quota %q, expected namespace=items or namespace=percent%%", spec)
+		}
+		if _, seen := quotas[namespace]; seen {
+			return nil, fmt.Errorf("namespace %q has two quotas", namespace)
+		}
+		var quota lru.Quota
+		if percent, ok := strings.CutSuffix(amount, "%"); ok {
+			share, err := strconv.ParseFloat(percent, 64)
+			if err != nil || share <= 0 || share > 100 {
+				return nil, fmt.Errorf("invalid namespace quota %q, the percentage must be above 0 and at most 100", spec)
+			}
+			quota.Share = share / 100
+		} else {
+			items, err := strconv.Atoi(amount)
+			if err != nil || items < 1 {
+				return nil, fmt.Errorf("invalid namespace quota %q, the items must be at least 1", spec)
+			}
+			quota.Items = items
+		}
+		quotas[namespace] = quota
+	}
+	return quotas, nil
+}
@@ -0,0 +1,572 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+)
+
+// Raft command operations
+const (
+	opSet    = "set"
+	opDelete = "delete"
+	opNode   = "node"
+	opForget = "forget"
+	opFlush  = "flush"
+	opType   = "type"   // an op on a structured value, see typeOp
+	opScript = "script" // a script over several keys, see scriptCall
+)
+
+const (
+	raftApplyTimeout = 5 * time.Second
+	readIndexTimeout = 2 * time.Second
+
+	// forwardedHeader marks requests already passed on to the leader or primary
+	forwardedHeader = "X-Cache-Forwarded"
+)
+
+var (
+	raftNode *raft.Raft
+	fsm      = &cacheFSM{nodes: make(map[string]string)}
+)
+
+// raftCommand is a cache mutation as stored in the raft log
+type raftCommand struct {
+	Op        string      `json:"op"`
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value,omitempty"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	RequestID string      `json:"requestId,omitempty"`
+	Reason    string      `json:"reason,omitempty"` // for the event, when not a client request
+	Type      *typeOp     `json:"type,omitempty"`   // for opType
+	Script    *scriptCall `json:"script,omitempty"` // for opScript
+	Tags      []string    `json:"tags,omitempty"`   // for opSet
+}
+
+// cacheFSM applies committed raft commands to the cache. It also tracks the
+// HTTP address of every member so followers know where the leader listens
+type cacheFSM struct {
+	mutex sync.RWMutex
+	nodes map[string]string
+
+	// electionOnly is set when raft just elects the primary, the cache itself
+	// being replicated over WebSocket, so snapshots leave it alone
+	electionOnly bool
+}
+
+// Apply :: applies a committed log entry on this node
+func (f *cacheFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return err
+	}
+
+	reason := cmd.Reason
+	if reason == "" {
+		reason = ReasonRequest
+	}
+	switch cmd.Op {
+	case opSet:
+		// ExpiresAt was fixed by the leader, so every node expires the key at the same time
+		if err := cache.Set(cmd.Key, cmd.Value, cmd.ExpiresAt.Sub(clock.Now())); err != nil {
+			// Every node refuses it alike, as they share the settings, and
+			// the leader answers the request with the error
+			cache.Delete(cmd.Key)
+			publish(removal(cmd.Key, EventDelete, reason, cmd.RequestID))
+			return err
+		}
+		keyTags.set(cmd.Key, cmd.Tags)
+		publish(CacheUpdate{Type: EventSet, Reason: reason, Key: cmd.Key, Value: cmd.Value, ExpiresAt: cmd.ExpiresAt, RequestID: cmd.RequestID, Tags: cmd.Tags})
+	case opType:
+		result, err := applyTypeOp(cmd.Key, *cmd.Type, cmd.ExpiresAt.Sub(clock.Now()), cmd.RequestID, reason)
+		if err != nil {
+			return err
+		}
+		return result
+	case opScript:
+		result, err := applyScriptChanges(*cmd.Script, cmd.RequestID, reason)
+		if err != nil {
+			return err
+		}
+		return result
+	case opDelete:
+		cache.Delete(cmd.Key)
+		keyTags.remove(cmd.Key)
+		publish(removal(cmd.Key, EventDelete, reason, cmd.RequestID))
+	case opFlush:
+		flushCache(cmd.RequestID)
+	case opNode:
+		addr, _ := cmd.Value.(string)
+		f.mutex.Lock()
+		f.nodes[cmd.Key] = addr
+		f.mutex.Unlock()
+	case opForget:
+		f.mutex.Lock()
+		delete(f.nodes, cmd.Key)
+		f.mutex.Unlock()
+	default:
+		return fmt.Errorf("unknown raft command %q", cmd.Op)
+	}
+	return nil
+}
+
+// fsmSnapshot is the state written to raft snapshots
+type fsmSnapshot struct {
+	Items []lru.CacheItem   `json:"items"`
+	Nodes map[string]string `json:"nodes"`
+
+	LockToken int64 `json:"lockToken,omitempty"` // the last fencing token given out
+}
+
+// Snapshot :: captures the cache so the raft log can be compacted
+func (f *cacheFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	nodes := make(map[string]string, len(f.nodes))
+	for id, addr := range f.nodes {
+		nodes[id] = addr
+	}
+	snapshot := &fsmSnapshot{Nodes: nodes, LockToken: lastLockToken.Load()}
+	if !f.electionOnly {
+		items, err := sealItems(cache.Snapshot())
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Items = items
+	}
+	return snapshot, nil
+}
+
+// Restore :: replaces the cache with the contents of a raft snapshot
+func (f *cacheFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var snapshot fsmSnapshot
+	if err := json.NewDecoder(rc).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	if err := openItems(snapshot.Items); err != nil {
+		return err
+	}
+	if !f.electionOnly {
+		cache.Clear()
+		keyTags.reset()
+		cache.Restore(snapshot.Items)
+	}
+
+	raiseLockToken(snapshot.LockToken)
+
+	f.mutex.Lock()
+	f.nodes = snapshot.Nodes
+	if f.nodes == nil {
+		f.nodes = make(map[string]string)
+	}
+	f.mutex.Unlock()
+	return nil
+}
+
+// httpAddr returns the HTTP address registered for a raft server id
+func (f *cacheFSM) httpAddr(id string) string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.nodes[id]
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
+
+// startRaft :: joins this node to the raft cluster described by cfg,
+// closing what it opened again when it fails
+func startRaft(cfg *Config) (err error) {
+	if err := os.MkdirAll(cfg.RaftDir, 0700); err != nil {
+		return err
+	}
+
+	store, err := newBoltStore(filepath.Join(cfg.RaftDir, "raft.db"))
+	if err != nil {
+		return err
+	}
+	var transport *raft.NetworkTransport
+	defer func() {
+		if err == nil {
+			return
+		}
+		if raftNode != nil {
+			raftNode.Shutdown().Error() // closes the transport too
+			raftNode = nil
+		} else if transport != nil {
+			transport.Close()
+		}
+		store.Close()
+	}()
+	snapshots, err := raft.NewFileSnapshotStore(cfg.RaftDir, 2, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", cfg.RaftAddr)
+	if err != nil {
+		return err
+	}
+	transport, err = raft.NewTCPTransport(cfg.RaftAddr, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cfg.Node.ID)
+
+	raftNode, err = raft.NewRaft(rc, fsm, store, store, snapshots, transport)
+	if err != nil {
+		return err
+	}
+
+	if cfg.RaftBootstrap {
+		existing, err := raft.HasExistingState(store, store, snapshots)
+		if err != nil {
+			return err
+		}
+		if !existing {
+			raftNode.BootstrapCluster(raft.Configuration{
+				Servers: []raft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}},
+			})
+		}
+	}
+	return nil
+}
+
+// startRaftWork starts registering this node with the leader and, with
+// CACHE_RAFT_JOIN, joining the cluster
+func startRaftWork(cfg *Config) {
+	go registerWhenLeader(cfg.Node)
+	if cfg.RaftJoin != "" {
+		go joinCluster(cfg)
+	}
+	if cfg.Role == RoleAuto {
+		go followLeader()
+	}
+}
+
+// registerWhenLeader makes sure the leader's own HTTP address is known to the
+// cluster, since nobody else registers it
+func registerWhenLeader(self Node) {
+	for isLeader := range raftNode.LeaderCh() {
+		if !isLeader || fsm.httpAddr(self.ID) == self.Addr {
+			continue
+		}
+		if err := applyCommand(raftCommand{Op: opNode, Key: self.ID, Value: self.Addr}); err != nil {
+			slog.Error("raft: registering", "node", self.ID, "err", err)
+		}
+	}
+}
+
+// joinCluster asks an existing member to add this node, retrying until it succeeds
+func joinCluster(cfg *Config) {
+	body, _ := json.Marshal(joinRequest{ID: cfg.Node.ID, RaftAddr: cfg.RaftAddr, HTTPAddr: cfg.Node.Addr})
+
+	for {
+		resp, err := peerClient.Post(cfg.RaftJoin+"/admin/raft/nodes", "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				slog.Info("raft: joined cluster", "via", cfg.RaftJoin)
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		slog.Warn("raft: joining cluster", "via", cfg.RaftJoin, "err", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// applyCommand :: commits cmd through the raft log, must be called on the leader
+func applyCommand(cmd raftCommand) error {
+	_, err := applyCommandResponse(cmd)
+	return err
+}
+
+// applyCommandResponse :: applyCommand, also returning what the FSM
+// answered on this node
+func applyCommandResponse(cmd raftCommand) (interface{}, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	future := raftNode.Apply(data, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	if err, ok := future.Response().(error); ok {
+		return nil, err
+	}
+	return future.Response(), nil
+}
+
+// forwardToLeader proxies the request to the leader's HTTP address
+func forwardToLeader(w http.ResponseWriter, r *http.Request) {
+	_, id := raftNode.LeaderWithID()
+	addr := fsm.httpAddr(string(id))
+	if addr == "" || r.Header.Get(forwardedHeader) != "" {
+		http.Error(w, "No raft leader available", http.StatusServiceUnavailable)
+		return
+	}
+	target, err := url.Parse(addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.Header.Set(forwardedHeader, config.Node.ID)
+	newForwardingProxy(target).ServeHTTP(w, r)
+}
+
+func raftSetHandler(w http.ResponseWriter, r *http.Request) {
+	if raftNode.State() != raft.Leader {
+		forwardToLeader(w, r)
+		return
+	}
+
+	var data setRequest
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := validateWriteKey(data.Key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(data.Tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateValue(data.Value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !writeThrough(w, r, data.Key, data.Value, false) {
+		return
+	}
+
+	cmd := raftCommand{
+		Op:        opSet,
+		Key:       data.Key,
+		Value:     data.Value,
+		ExpiresAt: clock.Now().Add(data.ttl()),
+		RequestID: requestID(r.Context()),
+		Tags:      data.Tags,
+	}
+	if err := applyCommand(cmd); refused(err) {
+		cacheError(w, err)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	shipToRegions(CacheUpdate{Key: cmd.Key, Value: cmd.Value, ExpiresAt: cmd.ExpiresAt, RequestID: cmd.RequestID})
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]string{"message": "Key set successfully"})
+}
+
+func raftDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if raftNode.State() != raft.Leader {
+		forwardToLeader(w, r)
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if !writeThrough(w, r, key, nil, true) {
+		return
+	}
+	if err := applyCommand(raftCommand{Op: opDelete, Key: key, RequestID: requestID(r.Context())}); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	shipToRegions(CacheUpdate{Key: key, Value: nil, ExpiresAt: time.Time{}, RequestID: requestID(r.Context())})
+
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, map[string]string{"message": "Key deleted successfully"})
+}
+
+// waitForReadIndex returns once this node has applied everything the leader
+// had committed when the read arrived (the raft read index), so a follower
+// never serves a value older than the last acknowledged write
+func waitForReadIndex() error {
+	index, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(readIndexTimeout)
+	for raftNode.AppliedIndex() < index {
+		if time.Now().After(deadline) {
+			return errors.New("timed out catching up with the leader")
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	return nil
+}
+
+// readIndex returns the leader's commit index, confirmed by a quorum
+func readIndex() (uint64, error) {
+	if raftNode.State() == raft.Leader {
+		index := raftNode.CommitIndex()
+		if err := raftNode.VerifyLeader().Error(); err != nil {
+			return 0, err
+		}
+		return index, nil
+	}
+
+	_, id := raftNode.LeaderWithID()
+	addr := fsm.httpAddr(string(id))
+	if addr == "" {
+		return 0, errors.New("no raft leader available")
+	}
+	resp, err := peerClient.Get(addr + "/raft/readindex")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("read index: %s", resp.Status)
+	}
+
+	var body struct {
+		Index uint64 `json:"index"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	return body.Index, nil
+}
+
+func readIndexHandler(w http.ResponseWriter, r *http.Request) {
+	if raftNode.State() != raft.Leader {
+		http.Error(w, "Not the raft leader", http.StatusServiceUnavailable)
+		return
+	}
+	index, err := readIndex()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]uint64{"index": index})
+}
+
+// joinRequest is the body accepted by POST /admin/raft/nodes
+type joinRequest struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raftAddr"`
+	HTTPAddr string `json:"httpAddr"`
+}
+
+func raftStatusHandler(w http.ResponseWriter, r *http.Request) {
+	future := raftNode.GetConfiguration()
+	if err := future.Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	leaderAddr, leaderID := raftNode.LeaderWithID()
+	servers := make([]map[string]interface{}, 0)
+	for _, server := range future.Configuration().Servers {
+		servers = append(servers, map[string]interface{}{
+			"id":       server.ID,
+			"raftAddr": server.Address,
+			"httpAddr": fsm.httpAddr(string(server.ID)),
+			"voter":    server.Suffrage == raft.Voter,
+			"leader":   server.Address == leaderAddr,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":           config.Node.ID,
+		"state":        raftNode.State().String(),
+		"leader":       leaderID,
+		"appliedIndex": raftNode.AppliedIndex(),
+		"servers":      servers,
+	})
+}
+
+func raftJoinHandler(w http.ResponseWriter, r *http.Request) {
+	if raftNode.State() != raft.Leader {
+		forwardToLeader(w, r)
+		return
+	}
+
+	var data joinRequest
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if data.ID == "" || data.RaftAddr == "" || data.HTTPAddr == "" {
+		http.Error(w, "id, raftAddr and httpAddr are required", http.StatusBadRequest)
+		return
+	}
+
+	future := raftNode.AddVoter(raft.ServerID(data.ID), raft.ServerAddress(data.RaftAddr), 0, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := applyCommand(raftCommand{Op: opNode, Key: data.ID, Value: data.HTTPAddr}); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Node added successfully"})
+}
+
+func raftRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if raftNode.State() != raft.Leader {
+		forwardToLeader(w, r)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	future := raftNode.RemoveServer(raft.ServerID(id), 0, raftApplyTimeout)
+	if err := future.Error(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err := applyCommand(raftCommand{Op: opForget, Key: id}); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"message": "Node removed successfully"})
+}
+
+// registerRaftRoutes :: mounts the raft admin API
+func registerRaftRoutes(r *mux.Router) {
+	r.HandleFunc("/raft/readindex", readIndexHandler).Methods("GET")
+	r.HandleFunc("/admin/raft", raftStatusHandler).Methods("GET")
+	r.HandleFunc("/admin/raft/nodes", raftJoinHandler).Methods("POST")
+	r.HandleFunc("/admin/raft/nodes/{id}", raftRemoveHandler).Methods("DELETE")
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/hashicorp/raft"
+)
+
+// withFSM gives the test an empty cache and a fresh FSM. The clock stays
+// the global one, which a janitor left by an earlier test may be reading
+func withFSM(t *testing.T) {
+	t.Helper()
+	c, err := lru.NewCache(lru.WithCapacity(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedConfig, savedCache, savedFSM := config, cache, fsm
+	config = &Config{SensitiveKeys: []string{"secret:*"}, FieldKey: bytes.Repeat([]byte{7}, 32)}
+	cache, fsm = c, &cacheFSM{nodes: make(map[string]string)}
+	withLockToken(t, 0)
+	t.Cleanup(func() { config, cache, fsm = savedConfig, savedCache, savedFSM })
+}
+
+func applyLog(t *testing.T, cmd raftCommand) interface{} {
+	t.Helper()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsm.Apply(&raft.Log{Data: data})
+}
+
+func TestFSMApply(t *testing.T) {
+	withFSM(t)
+	later := clock.Now().Add(time.Minute)
+
+	tests := []struct {
+		name  string
+		cmd   raftCommand
+		err   bool
+		key   string
+		value interface{} // nil for a missing key
+	}{
+		{"set", raftCommand{Op: opSet, Key: "a", Value: "1", ExpiresAt: later}, false, "a", "1"},
+		{"overwrite", raftCommand{Op: opSet, Key: "a", Value: 2.0, ExpiresAt: later}, false, "a", 2.0},
+		{"set expired", raftCommand{Op: opSet, Key: "b", Value: "x", ExpiresAt: clock.Now().Add(-time.Second)}, false, "b", nil},
+		{"delete", raftCommand{Op: opDelete, Key: "a"}, false, "a", nil},
+		{"delete missing", raftCommand{Op: opDelete, Key: "zzz"}, false, "zzz", nil},
+		{"unknown op", raftCommand{Op: "drop", Key: "a"}, true, "a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := applyLog(t, tt.cmd)
+			if _, failed := result.(error); failed != tt.err {
+				t.Errorf("Apply = %v, want error %v", result, tt.err)
+			}
+			got, err := cache.Get(tt.key)
+			if tt.value == nil && err == nil || tt.value != nil && got != tt.value {
+				t.Errorf("%s = %v, %v, want %v", tt.key, got, err, tt.value)
+			}
+		})
+	}
+
+	if result := fsm.Apply(&raft.Log{Data: []byte("{not json")}); result == nil {
+		t.Error("Apply of a malformed entry = nil, want an error")
+	}
+
+	applyLog(t, raftCommand{Op: opNode, Key: "n1", Value: "10.0.0.1:8080"})
+	applyLog(t, raftCommand{Op: opNode, Key: "n2", Value: "10.0.0.2:8080"})
+	applyLog(t, raftCommand{Op: opForget, Key: "n2"})
+	if fsm.httpAddr("n1") != "10.0.0.1:8080" || fsm.httpAddr("n2") != "" {
+		t.Errorf("nodes = %v, want n1 only", fsm.nodes)
+	}
+}
+
+// memorySink is a raft.SnapshotSink keeping the snapshot in memory
+type memorySink struct{ bytes.Buffer }
+
+func (s *memorySink) ID() string    { return "test" }
+func (s *memorySink) Cancel() error { return nil }
+func (s *memorySink) Close() error  { return nil }
+
+func TestFSMSnapshotRestore(t *testing.T) {
+	tests := []struct {
+		name         string
+		electionOnly bool
+	}{
+		{"cache", false},
+		{"election only", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFSM(t)
+			later := clock.Now().Add(time.Minute)
+			applyLog(t, raftCommand{Op: opSet, Key: "plain", Value: "visible", ExpiresAt: later})
+			applyLog(t, raftCommand{Op: opSet, Key: "secret:1", Value: "hunter2", ExpiresAt: later})
+			applyLog(t, raftCommand{Op: opNode, Key: "n1", Value: "10.0.0.1:8080"})
+			nextLockToken(42)
+
+			fsm.electionOnly = tt.electionOnly
+			snapshot, err := fsm.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sink memorySink
+			if err := snapshot.Persist(&sink); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(sink.Bytes(), []byte("hunter2")) {
+				t.Error("snapshot holds a sensitive value in the clear")
+			}
+			if held := bytes.Contains(sink.Bytes(), []byte("visible")); held == tt.electionOnly {
+				t.Errorf("snapshot holds the cache = %v, want %v", held, !tt.electionOnly)
+			}
+
+			// Restore on a node that has a different state
+			cache.Clear()
+			cache.Set("stale", "x", time.Minute)
+			fsm.nodes = map[string]string{"old": "10.0.0.9:8080"}
+			lastLockToken.Store(7)
+			if err := fsm.Restore(io.NopCloser(bytes.NewReader(sink.Bytes()))); err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[string]interface{}{"plain": "visible", "secret:1": "hunter2", "stale": nil}
+			if tt.electionOnly {
+				want = map[string]interface{}{"plain": nil, "secret:1": nil, "stale": "x"}
+			}
+			for key, value := range want {
+				got, err := cache.Get(key)
+				if value == nil && err == nil || value != nil && got != value {
+					t.Errorf("after Restore %s = %v, %v, want %v", key, got, err, value)
+				}
+			}
+			if fsm.httpAddr("n1") != "10.0.0.1:8080" || fsm.httpAddr("old") != "" {
+				t.Errorf("nodes after Restore = %v, want n1 only", fsm.nodes)
+			}
+			if got := lastLockToken.Load(); got != 42 {
+				t.Errorf("last lock token after Restore = %d, want 42", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Requests per Window, in bursts of up to Requests
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+}
+
+// parseRateLimit :: parses limits such as 100/s, 6000/m or 50000/h; empty means unlimited
+func parseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected e.g. 100/s", s)
+	}
+	windows := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	window, ok := windows[unit]
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, the unit must be s, m or h", s)
+	}
+	return RateLimit{Requests: n, Window: window}, nil
+}
+
+// String formats l the way parseRateLimit reads it, "" when unlimited
+func (l RateLimit) String() string {
+	if l.Requests == 0 {
+		return ""
+	}
+	unit := map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h"}[l.Window]
+	return fmt.Sprintf("%d/%s", l.Requests, unit)
+}
+
+// tokenBucket refills continuously at Requests per Window
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take :: spends a token if there is one, returning the tokens left and how
+// long until the next one
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, int, time.Duration) {
+	b.tokens, b.last = b.available(limit, now), now
+	if b.tokens < 1 {
+		return false, 0, b.wait(limit)
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// available returns the tokens there are at now, refilled since the last take
+func (b *tokenBucket) available(limit RateLimit, now time.Time) float64 {
+	perToken := limit.Window / time.Duration(limit.Requests)
+	return math.Min(float64(limit.Requests), b.tokens+float64(now.Sub(b.last))/float64(perToken))
+}
+
+// wait returns how long until the bucket has a token again
+func (b *tokenBucket) wait(limit RateLimit) time.Duration {
+	perToken := limit.Window / time.Duration(limit.Requests)
+	return time.Duration((1 - b.tokens) * float64(perToken))
+}
+
+// rateLimiter keeps a bucket per caller and operation class
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+func (l *rateLimiter) take(id string, limit RateLimit) (bool, int, time.Duration) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.Requests), last: now}
+		l.buckets[id] = b
+	}
+	return b.take(limit, now)
+}
+
+// empty returns how long until id's bucket has a token, 0 when it has one,
+// without spending it
+func (l *rateLimiter) empty(id string, limit RateLimit) time.Duration {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[id]
+	if !ok {
+		return 0
+	}
+	refilled := tokenBucket{tokens: b.available(limit, now), last: now}
+	if refilled.tokens >= 1 {
+		return 0
+	}
+	return refilled.wait(limit)
+}
+
+// sweep forgets buckets that have refilled, they are no different from new ones
+func (l *rateLimiter) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mutex.Lock()
+		for id, b := range l.buckets {
+			if time.Since(b.last) > time.Hour {
+				delete(l.buckets, id)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// clientID identifies the caller: its API key or token subject, the address
+// it connects from otherwise
+func clientID(r *http.Request) string {
+	if p := principalFrom(r.Context()); p != nil {
+		return "principal:" + p.Name
+	}
+	return "ip:" + clientIP(r)
+}
+
+// authThrottled answers 429 to a client IP past CACHE_RATE_LIMIT_AUTH_FAILURES,
+// whatever credentials it sends, so keys and tokens cannot be guessed at speed.
+// Runs before authentication, which rateLimitMiddleware comes after
+func authThrottled(w http.ResponseWriter, r *http.Request) bool {
+	limit := config.AuthFailureLimit
+	if limit.Requests == 0 {
+		return false
+	}
+	wait := limiter.empty("auth|ip:"+clientIP(r), limit)
+	if wait == 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many failed authentications", http.StatusTooManyRequests)
+	return true
+}
+
+// authFailed counts a failed authentication against the client IP
+func authFailed(r *http.Request) {
+	if limit := config.AuthFailureLimit; limit.Requests > 0 {
+		limiter.take("auth|ip:"+clientIP(r), limit)
+	}
+}
+
+// rateLimitMiddleware limits reads and writes separately per caller. Other
+// servers are never limited
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || probePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p := principalFrom(r.Context()); p != nil && p.HasScope(ScopeCluster) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		class, limit := "write", tuned().WriteRateLimit
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			class, limit = "read", tuned().ReadRateLimit
+		}
+		if limit.Requests == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, remaining, retryAfter := limiter.take(class+"|"+clientID(r), limit)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, int(limit.Window.Seconds())))
+		if !ok {
+			seconds := strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+			w.Header().Set("RateLimit-Reset", seconds)
+			w.Header().Set("Retry-After", seconds)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
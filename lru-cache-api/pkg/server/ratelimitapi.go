@@ -0,0 +1,111 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// POST /ratelimit/{bucket} lends the cache to API gateways as their shared
+// limiter store: each call takes a token from a bucket holding limit tokens
+// and refilling continuously at limit per window, as the server limits its
+// own callers, and answers whether it was allowed. The bucket is the key
+// ratelimit:{bucket}, holding {"tokens": ..., "last": ...} with the time in
+// Unix milliseconds, taken from atomically, and expiring a window after its
+// last call, when it would be full again anyway
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"rltake": {fn: rateLimitTake, renew: true},
+	})
+}
+
+// rateLimitKey returns the key holding bucket
+func rateLimitKey(bucket string) string {
+	return "ratelimit:" + bucket
+}
+
+// asTokenBucket returns the bucket held by a key, full as of now when it
+// is not cached
+func asTokenBucket(value interface{}, limit RateLimit, now time.Time) (tokenBucket, error) {
+	if value == nil {
+		return tokenBucket{tokens: float64(limit.Requests), last: now}, nil
+	}
+	held, ok := value.(map[string]interface{})
+	tokens, isNumber := held["tokens"].(float64)
+	last, err := argInt([]interface{}{held["last"]}, 0)
+	if !ok || !isNumber || err != nil || len(held) != 2 {
+		return tokenBucket{}, errWrongType
+	}
+	return tokenBucket{tokens: tokens, last: time.UnixMilli(int64(last))}, nil
+}
+
+// rateLimitTake :: takes a token from the bucket at args[0], the time in
+// Unix milliseconds, holding args[1] tokens refilled per args[2] seconds
+func rateLimitTake(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	var nums [3]int
+	for i := range nums {
+		n, err := argInt(args, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		nums[i] = n
+	}
+	now := time.UnixMilli(int64(nums[0]))
+	limit := RateLimit{Requests: nums[1], Window: time.Duration(nums[2]) * time.Second}
+	bucket, err := asTokenBucket(value, limit, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allowed, remaining, retryAfter := bucket.take(limit, now)
+	perToken := limit.Window / time.Duration(limit.Requests)
+	reply := map[string]interface{}{
+		"allowed":   allowed,
+		"remaining": remaining,
+		"reset":     math.Ceil((float64(limit.Requests) - bucket.tokens) * perToken.Seconds()),
+	}
+	if !allowed {
+		reply["retryAfter"] = math.Ceil(retryAfter.Seconds())
+	}
+	return reply, map[string]interface{}{"tokens": bucket.tokens, "last": int(bucket.last.UnixMilli())}, nil
+}
+
+// registerRateLimitRoutes :: mounts /ratelimit/{bucket}
+func registerRateLimitRoutes(r *mux.Router) {
+	r.Handle("/ratelimit/{bucket}", typeWrite(rateLimitHandler)).Methods("POST")
+}
+
+// rateLimitHandler serves POST /ratelimit/{bucket}: {"limit": 100,
+// "window": 60} takes a token from a bucket of limit tokens refilled per
+// window seconds, answering whether it was allowed, the tokens remaining,
+// in how many seconds the bucket is full again and, when not allowed, when
+// to retry
+func rateLimitHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := mux.Vars(r)["bucket"]
+	var data struct {
+		Limit  int `json:"limit"`
+		Window int `json:"window"` // in seconds
+	}
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if data.Limit < 1 || data.Window < 1 {
+		http.Error(w, "limit and window must be positive", http.StatusBadRequest)
+		return
+	}
+
+	args := []interface{}{int(clock.Now().UnixMilli()), data.Limit, data.Window}
+	window := time.Duration(data.Window) * time.Second
+	reply, err := runTypeOp(r, rateLimitKey(bucket), typeOp{Name: "rltake", Args: args}, window)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	result := reply.(map[string]interface{})
+	result["bucket"] = bucket
+	writeJSON(w, result)
+}
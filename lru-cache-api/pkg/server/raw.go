@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+)
+
+// Raw values are kept as the bytes the client sent, with their content type,
+// and written back as they are, for payloads the cache only passes through:
+// neither the set nor the get decodes or encodes them as JSON. Elsewhere,
+// such as in GET /cache/{key}, snapshots and events, they are JSON objects
+// as lru.RawValue describes, and a node that got one so, a replica or a
+// raft follower, serves it decoded from that
+
+// defaultRawType is the content type of raw values set without one
+const defaultRawType = "application/octet-stream"
+
+// asRaw returns value as a raw value, also when it came through JSON
+func asRaw(value interface{}) (lru.RawValue, bool) {
+	switch v := value.(type) {
+	case lru.RawValue:
+		return v, true
+	case map[string]interface{}:
+		contentType, isType := v["contentType"].(string)
+		encoded, isRaw := v["raw"].(string)
+		if !isType || !isRaw || len(v) != 2 {
+			return lru.RawValue{}, false
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		return lru.RawValue{ContentType: contentType, Data: data}, err == nil
+	}
+	return lru.RawValue{}, false
+}
+
+// registerRawRoutes :: mounts /cache/{key}/raw
+func registerRawRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/raw", withConsistency(rawGetHandler)).Methods("GET")
+	r.Handle("/cache/{key}/raw", typeWrite(rawSetHandler)).Methods("PUT")
+}
+
+// rawGetHandler serves GET /cache/{key}/raw: the bytes of a raw value with
+// its content type, 409 for keys holding JSON values
+func rawGetHandler(w http.ResponseWriter, r *http.Request) {
+	value, err := cache.Get(mux.Vars(r)["key"])
+	if err != nil {
+		cacheError(w, err)
+		return
+	}
+	raw, ok := asRaw(value)
+	if !ok {
+		typeOpError(w, errWrongType)
+		return
+	}
+	w.Header().Set("Content-Type", raw.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw.Data)))
+	w.Write(raw.Data)
+}
+
+// rawSetHandler serves PUT /cache/{key}/raw?expiration=60, setting the key
+// to the body, kept with its Content-Type
+func rawSetHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if err := validateWriteKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var data setRequest
+	if s := r.URL.Query().Get("expiration"); s != "" {
+		var err error
+		if data.Expiration, err = strconv.Atoi(s); err != nil || data.Expiration < 0 {
+			http.Error(w, "expiration must be a whole number of seconds", http.StatusBadRequest)
+			return
+		}
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	raw := lru.RawValue{ContentType: r.Header.Get("Content-Type"), Data: body}
+	if raw.ContentType == "" {
+		raw.ContentType = defaultRawType
+	}
+	if !writeThrough(w, r, key, raw, false) {
+		return
+	}
+
+	update := CacheUpdate{
+		Type:      EventSet,
+		Reason:    ReasonRequest,
+		Key:       key,
+		Value:     raw,
+		ExpiresAt: clock.Now().Add(data.ttl()),
+		RequestID: requestID(r.Context()),
+	}
+	if raftCluster() {
+		cmd := raftCommand{Op: opSet, Key: key, Value: raw, ExpiresAt: update.ExpiresAt, RequestID: update.RequestID}
+		if err := applyCommand(cmd); refused(err) {
+			cacheError(w, err)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	} else {
+		if err := cache.Set(key, raw, data.ttl()); err != nil {
+			cacheError(w, err)
+			return
+		}
+		keyTags.remove(key)
+		publishInvalidation(key)
+		publish(update)
+	}
+	shipToRegions(update)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]interface{}{"message": "Key set successfully", "key": key, "bytes": len(body)})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Maintenance describes the read-only mode POST /admin/maintenance turns on
+type Maintenance struct {
+	Reason     string    `json:"reason,omitempty"`
+	Since      time.Time `json:"since"`
+	RetryAfter int       `json:"retryAfter"` // seconds, sent with the refused writes
+	Principal  string    `json:"principal,omitempty"`
+}
+
+// maintenance is nil unless the node is in maintenance mode
+var maintenance atomic.Pointer[Maintenance]
+
+// dataWrite reports whether r changes the items of a cache: a set, delete,
+// lock, rate limit, script, flush or import, in the default cache or a
+// named one
+func dataWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	_, path := namedCachePath(r.URL.Path)
+	return path == "/cache" || strings.HasPrefix(path, "/cache/") || strings.HasPrefix(path, "/locks/") || strings.HasPrefix(path, "/ratelimit/") ||
+		path == "/eval" || path == "/invalidate" || strings.HasPrefix(path, "/scripts/") || path == "/admin/cache/flush" || path == "/admin/cache/import"
+}
+
+// readOnlyMiddleware answers writes with 405 under CACHE_READ_ONLY, and with
+// 503 while in maintenance mode or, all but deletes and flushes, while the
+// heap is near CACHE_MEMORY_LIMIT. Changes from the primary, the raft leader
+// or other regions still come in
+func readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !dataWrite(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if config.ReadOnly {
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			http.Error(w, "Server is read-only", http.StatusMethodNotAllowed)
+			return
+		}
+		if m := maintenance.Load(); m != nil {
+			message := "Server is in maintenance mode"
+			if m.Reason != "" {
+				message += ": " + m.Reason
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+			http.Error(w, message, http.StatusServiceUnavailable)
+			return
+		}
+		if memoryWrite(r) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Server is low on memory", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceHandler serves /admin/maintenance: POST puts this node in
+// read-only mode, optionally with a reason and the Retry-After to send, e.g.
+// {"reason": "backup", "retryAfter": 300}, DELETE ends it and GET shows it
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	who := "anonymous"
+	if p := principalFrom(r.Context()); p != nil {
+		who = p.Name
+	}
+	switch r.Method {
+	case http.MethodPost:
+		m := Maintenance{RetryAfter: 60}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+				bodyError(w, err)
+				return
+			}
+		}
+		if m.RetryAfter < 1 {
+			http.Error(w, "retryAfter must be at least 1 second", http.StatusBadRequest)
+			return
+		}
+		m.Since, m.Principal = time.Now(), who
+		maintenance.Store(&m)
+		loggerFrom(r.Context()).Warn("maintenance: started, refusing writes", "reason", m.Reason, "principal", who)
+	case http.MethodDelete:
+		if maintenance.Swap(nil) != nil {
+			loggerFrom(r.Context()).Warn("maintenance: ended, accepting writes", "principal", who)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"maintenance": maintenance.Load()})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// Rebalance modes
+const (
+	RebalanceOff  = "off"
+	RebalanceCopy = "copy" // warm the new owner, keep our copy until it is evicted
+	RebalanceMove = "move" // hand the key over and drop it here
+)
+
+const rebalanceBatchSize = 100
+
+// RebalanceStatus reports the progress of the latest rebalance
+type RebalanceStatus struct {
+	State      string    `json:"state"` // idle or running
+	Mode       string    `json:"mode"`
+	Nodes      []string  `json:"nodes"` // membership the run is for
+	StartedAt  time.Time `json:"startedAt,omitempty"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	Total      int       `json:"total"`  // keys owned by another node
+	Copied     int       `json:"copied"` // keys handed to their owner
+	Failed     int       `json:"failed"`
+}
+
+var (
+	rebalance      = RebalanceStatus{State: "idle"}
+	rebalanceMutex sync.Mutex
+)
+
+// watchTopology starts a rebalance whenever the cluster membership changes
+func watchTopology() {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	last := nodeIDs(clusterNodes())
+	for range ticker.C {
+		nodes := clusterNodes()
+		if ids := nodeIDs(nodes); ids != last {
+			slog.Info("rebalance: membership changed", "from", last, "to", ids)
+			last = ids
+			rebalanceKeys(nodes, config.RebalanceMode)
+		}
+	}
+}
+
+func nodeIDs(nodes []Node) string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+// rebalanceKeys :: sends every key we hold but no longer own to its owner
+func rebalanceKeys(nodes []Node, mode string) {
+	byOwner := make(map[string][]lru.CacheItem)
+	owners := make(map[string]Node)
+	for _, item := range cache.Snapshot() {
+		owner := ownerOf(item.Key)
+		if owner.ID == "" || owner.ID == config.Node.ID {
+			continue
+		}
+		byOwner[owner.ID] = append(byOwner[owner.ID], item)
+		owners[owner.ID] = owner
+	}
+
+	rebalanceMutex.Lock()
+	rebalance = RebalanceStatus{
+		State:     "running",
+		Mode:      mode,
+		Nodes:     strings.Split(nodeIDs(nodes), ","),
+		StartedAt: time.Now(),
+	}
+	for _, items := range byOwner {
+		rebalance.Total += len(items)
+	}
+	rebalanceMutex.Unlock()
+
+	for id, items := range byOwner {
+		for start := 0; start < len(items); start += rebalanceBatchSize {
+			batch := items[start:min(start+rebalanceBatchSize, len(items))]
+			err := sendKeys(owners[id], batch)
+
+			rebalanceMutex.Lock()
+			if err != nil {
+				slog.Error("rebalance: sending keys", "keys", len(batch), "node", id, "err", err)
+				rebalance.Failed += len(batch)
+			} else {
+				rebalance.Copied += len(batch)
+			}
+			rebalanceMutex.Unlock()
+
+			if err == nil && mode == RebalanceMove {
+				for _, item := range batch {
+					cache.Delete(item.Key)
+					keyTags.remove(item.Key)
+					publish(removal(item.Key, EventDelete, ReasonRebalance, ""))
+				}
+			}
+		}
+	}
+
+	rebalanceMutex.Lock()
+	rebalance.State = "idle"
+	rebalance.FinishedAt = time.Now()
+	slog.Info("rebalance: done", "copied", rebalance.Copied, "total", rebalance.Total, "failed", rebalance.Failed)
+	rebalanceMutex.Unlock()
+}
+
+func sendKeys(owner Node, items []lru.CacheItem) error {
+	body, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	resp, err := peerClient.Post(owner.Addr+"/cluster/keys", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("owner returned %s", resp.Status)
+	}
+	return nil
+}
+
+// receiveKeysHandler accepts keys handed over by a peer; keys we already hold
+// are newer than the peer's copy and are kept
+func receiveKeysHandler(w http.ResponseWriter, r *http.Request) {
+	var items []lru.CacheItem
+	if err := readJSON(r, &items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	added := 0
+	for _, item := range items {
+		ttl := item.ExpiresAt.Sub(clock.Now())
+		if ttl <= 0 || cache.Add(item.Key, item.Value, ttl) != nil {
+			continue
+		}
+		added++
+		keyTags.remove(item.Key)
+		publish(CacheUpdate{Type: EventSet, Reason: ReasonRebalance, Key: item.Key, Value: item.Value, ExpiresAt: item.ExpiresAt})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"received": len(items), "added": added})
+}
+
+func rebalanceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	rebalanceMutex.Lock()
+	status := rebalance
+	rebalanceMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/raft"
+)
+
+// Replication roles
+const (
+	RoleStandalone = "standalone"
+	RolePrimary    = "primary"
+	RoleReplica    = "replica"
+	RoleAuto       = "auto"
+)
+
+// applyUpdate :: applies a mutation received from the primary and passes it
+// on to our own WebSocket clients
+func applyUpdate(update CacheUpdate) {
+	if update.Value == nil {
+		cache.Delete(update.Key)
+		keyTags.remove(update.Key)
+	} else {
+		ttl := update.ExpiresAt.Sub(clock.Now())
+		if ttl <= 0 {
+			return
+		}
+		if err := cache.Set(update.Key, update.Value, ttl); err != nil {
+			// A miss is better than the value the primary replaced
+			cache.Delete(update.Key)
+			keyTags.remove(update.Key)
+			slog.Warn("replication: cannot apply set", "key", update.Key, "err", err)
+			return
+		}
+		keyTags.set(update.Key, update.Tags)
+		observeLockToken(update.Key, update.Value)
+	}
+	publish(update)
+}
+
+// replicate keeps the local cache in sync with the primary until ctx is
+// cancelled: every connection starts with the full state the primary sends to
+// new clients, followed by the stream of mutations
+func replicate(ctx context.Context, primary string) {
+	wsURL := "ws" + strings.TrimPrefix(primary, "http") + "/ws"
+	backoff := time.Second
+
+	for ctx.Err() == nil {
+		var conn *websocket.Conn
+		err := breakerFor("primary " + primary).do(func() (err error) {
+			conn, _, err = clusterDialer().DialContext(ctx, wsURL, clusterHeader())
+			return err
+		})
+		if err != nil {
+			slog.Warn("replication: connecting", "url", wsURL, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+			continue
+		}
+		slog.Info("replication: connected", "url", wsURL)
+		backoff = time.Second
+
+		// Unblocks ReadJSON when we are told to stop following this primary
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}()
+		go measureLag(conn, done)
+
+		// Anything we hold may have changed while we were disconnected
+		cache.Clear()
+		replicaConnected.Store(true)
+
+		// The primary pings every CACHE_WS_PING_INTERVAL; when it goes quiet
+		// for longer the connection is dead and we reconnect
+		conn.SetReadDeadline(time.Now().Add(config.WSPongTimeout))
+		conn.SetPingHandler(func(payload string) error {
+			conn.SetReadDeadline(time.Now().Add(config.WSPongTimeout))
+			// A failed write shows up as a failed read soon enough
+			conn.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(config.WSWriteTimeout))
+			return nil
+		})
+
+		for {
+			var update CacheUpdate
+			if err := conn.ReadJSON(&update); err != nil {
+				if ctx.Err() == nil {
+					slog.Warn("replication: stream ended", "err", err)
+				}
+				break
+			}
+			conn.SetReadDeadline(time.Now().Add(config.WSPongTimeout))
+			if isEvent(update.Type) {
+				applyUpdate(update)
+			}
+		}
+		replicaConnected.Store(false)
+		close(done)
+		conn.Close()
+	}
+}
+
+// lastSync is when the last acknowledged ping was sent to the primary, in
+// unix nanoseconds. The primary answers pings in order with the updates it
+// streams, so everything it had written by then has reached us
+var lastSync atomic.Int64
+
+// measureLag pings the primary every second until done is closed
+func measureLag(conn *websocket.Conn, done <-chan struct{}) {
+	conn.SetPongHandler(func(payload string) error {
+		if sent, err := strconv.ParseInt(payload, 10, 64); err == nil {
+			lastSync.Store(sent)
+		}
+		return nil
+	})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+		if err := conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(time.Second)); err != nil {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// replicationLag returns how far behind the primary this replica may be
+func replicationLag() time.Duration {
+	return time.Since(time.Unix(0, lastSync.Load()))
+}
+
+// forwardToPrimary proxies write requests to the primary so replicas can be
+// used as the only entry point for clients
+func forwardToPrimary(primary string) http.Handler {
+	target, _ := url.Parse(primary) // checked by loadConfig
+	return newForwardingProxy(target)
+}
+
+// newForwardingProxy returns a reverse proxy to another node of the cluster
+func newForwardingProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = nodeTransport{}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Our own CORS middleware already answered for the browser
+		for name := range resp.Header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				resp.Header.Del(name)
+			}
+		}
+		// and already echoed the request id, which the target shares
+		resp.Header.Del(requestIDHeader)
+		return nil
+	}
+	return proxy
+}
+
+// followLeader implements CACHE_ROLE=auto: raft only elects the primary, and
+// every other node replicates from whichever node currently holds leadership
+func followLeader() {
+	var following string
+	var stop context.CancelFunc
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		<-ticker.C
+		leader := raftNode.State() == raft.Leader
+		primary := currentPrimary()
+		if leader {
+			primary = ""
+		}
+		if primary == following {
+			continue
+		}
+
+		if stop != nil {
+			stop()
+			stop = nil
+		}
+		following = primary
+		switch {
+		case leader:
+			slog.Info("replication: promoted to primary")
+		case primary != "":
+			slog.Info("replication: following primary", "primary", primary)
+			var ctx context.Context
+			ctx, stop = context.WithCancel(context.Background())
+			go replicate(ctx, primary)
+		}
+	}
+}
+
+// currentPrimary returns the HTTP address of the elected primary, "" while
+// an election is in progress
+func currentPrimary() string {
+	_, id := raftNode.LeaderWithID()
+	return fsm.httpAddr(string(id))
+}
+
+// primaryOnly lets writes through on the elected primary and redirects them
+// to it everywhere else; 307 makes clients repeat the method and body
+func primaryOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if raftNode.State() == raft.Leader {
+			next(w, r)
+			return
+		}
+		primary := currentPrimary()
+		if primary == "" {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "No primary elected", http.StatusServiceUnavailable)
+			return
+		}
+		http.Redirect(w, r, primary+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}
+}
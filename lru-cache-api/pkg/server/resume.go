@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+// historyEpoch tells one run of the server from the next. Sequence numbers
+// start over on restart, so a since from another epoch means nothing here
+var historyEpoch = newRequestID()
+
+// syncMessage follows the state a client is sent on connecting: the updates
+// before it bring the client up to Seq, and every update after it has a
+// larger seq
+type syncMessage struct {
+	Type  string `json:"type"` // synced
+	Seq   uint64 `json:"seq"`
+	Epoch string `json:"epoch"`
+	Full  bool   `json:"full"` // the updates were the whole state, not what changed since ?since=
+}
+
+// resumePoint is where a reconnecting client left off, from ?since=&epoch=
+type resumePoint struct {
+	since uint64
+	epoch string
+	ok    bool
+}
+
+func parseResumePoint(query url.Values) (resumePoint, error) {
+	s := query.Get("since")
+	if s == "" {
+		return resumePoint{}, nil
+	}
+	since, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return resumePoint{}, errors.New("since must be a sequence number")
+	}
+	return resumePoint{since: since, epoch: query.Get("epoch"), ok: true}, nil
+}
+
+// syncState returns what client needs to catch up: the events since its
+// resume point when they are all still kept, the current items otherwise.
+// The client must have joined the hub already, so that everything after the
+// returned seq reaches its queue
+func syncState(client *wsClient, from resumePoint) ([]CacheUpdate, syncMessage) {
+	if from.ok && (from.epoch == "" || from.epoch == historyEpoch) {
+		events, latest, truncated := history.since(from.since)
+		if !truncated && from.since <= latest {
+			updates := make([]CacheUpdate, 0, len(events))
+			for _, event := range events {
+				if client.wants(event) {
+					event.Value = redact(client.principal, event.Key, event.Value)
+					updates = append(updates, event)
+				}
+			}
+			return updates, syncMessage{Type: "synced", Seq: latest, Epoch: historyEpoch}
+		}
+	}
+
+	// Read the seq first: every change numbered up to it is already in the
+	// cache, and the later ones reach the queue, even if also in the items
+	seq := history.latestSeq()
+	return currentItems(client, nil), syncMessage{Type: "synced", Seq: seq, Epoch: historyEpoch, Full: true}
+}
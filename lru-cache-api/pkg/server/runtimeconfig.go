@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunables are the settings that can change while the server runs, through
+// PUT /admin/config. They are read from tuned(), not config
+type Tunables struct {
+	JanitorInterval time.Duration
+	DefaultTTL      time.Duration
+	WSBatchWindow   time.Duration
+	ReadRateLimit   RateLimit
+	WriteRateLimit  RateLimit
+}
+
+var (
+	tunables      atomic.Pointer[Tunables]
+	tunablesMutex sync.Mutex // held while changing them
+)
+
+// setupTunables starts the tunables off at the configured values
+func setupTunables(cfg *Config) {
+	tunables.Store(&Tunables{
+		JanitorInterval: cfg.JanitorInterval,
+		DefaultTTL:      cfg.DefaultTTL,
+		WSBatchWindow:   cfg.WSBatchWindow,
+		ReadRateLimit:   cfg.ReadRateLimit,
+		WriteRateLimit:  cfg.WriteRateLimit,
+	})
+}
+
+// tuned returns the current tunables, which must not be modified
+func tuned() *Tunables {
+	return tunables.Load()
+}
+
+// tunable is how /admin/config shows and parses one of the tunables
+type tunable struct {
+	get func(t *Tunables) string
+	set func(t *Tunables, value string) error
+}
+
+var tunableSettings = map[string]tunable{
+	"janitorInterval": durationTunable(func(t *Tunables) *time.Duration { return &t.JanitorInterval }, time.Millisecond),
+	"defaultTtl":      durationTunable(func(t *Tunables) *time.Duration { return &t.DefaultTTL }, 0),
+	"wsBatchWindow":   durationTunable(func(t *Tunables) *time.Duration { return &t.WSBatchWindow }, 0),
+	"readRateLimit":   rateLimitTunable(func(t *Tunables) *RateLimit { return &t.ReadRateLimit }),
+	"writeRateLimit":  rateLimitTunable(func(t *Tunables) *RateLimit { return &t.WriteRateLimit }),
+}
+
+func durationTunable(field func(t *Tunables) *time.Duration, min time.Duration) tunable {
+	return tunable{
+		get: func(t *Tunables) string { return field(t).String() },
+		set: func(t *Tunables, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return errors.New("expected a duration such as 30s")
+			}
+			if d < min {
+				return fmt.Errorf("must be at least %s", min)
+			}
+			*field(t) = d
+			return nil
+		},
+	}
+}
+
+func rateLimitTunable(field func(t *Tunables) *RateLimit) tunable {
+	return tunable{
+		get: func(t *Tunables) string { return field(t).String() },
+		set: func(t *Tunables, value string) (err error) {
+			*field(t), err = parseRateLimit(value)
+			return err
+		},
+	}
+}
+
+// configHandler serves GET /admin/config, the tunables of this node, and
+// PUT, which changes the ones in the body, all of them or none. Changes are
+// logged and noted on the audit entry of the request
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	tunablesMutex.Lock()
+	defer tunablesMutex.Unlock()
+
+	if r.Method == http.MethodPut {
+		var values map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+			bodyError(w, err)
+			return
+		}
+
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		next := *tuned()
+		var changes []string
+		for _, name := range names {
+			setting, ok := tunableSettings[name]
+			if !ok {
+				http.Error(w, fmt.Sprintf("%q cannot be changed at runtime", name), http.StatusBadRequest)
+				return
+			}
+			old := setting.get(&next)
+			if err := setting.set(&next, values[name]); err != nil {
+				http.Error(w, fmt.Sprintf("%s: %v", name, err), http.StatusBadRequest)
+				return
+			}
+			if value := setting.get(&next); value != old {
+				changes = append(changes, fmt.Sprintf("%s=%s (was %s)", name, value, old))
+			}
+		}
+		tunables.Store(&next)
+
+		who := "anonymous"
+		if p := principalFrom(r.Context()); p != nil {
+			who = p.Name
+		}
+		for _, change := range changes {
+			loggerFrom(r.Context()).Info("config: changed", "change", change, "principal", who)
+		}
+		noteAudit(r.Context(), changes...)
+	}
+
+	current := map[string]string{}
+	for name, setting := range tunableSettings {
+		current[name] = setting.get(tuned())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(current)
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+// A library function runs to its end once called, however long its result,
+// and the context stopping a script is only checked between instructions.
+// So the functions building strings a script chose the length of, string.rep,
+// string.format, string.gsub and table.concat, check it against what the
+// script may still allocate before building it. What scripts allocate
+// instruction by instruction, such as .. in a loop, is caught by watching the
+// heap instead
+
+// errScriptMemory stops a script whose heap growth passed CACHE_SCRIPT_MAX_MEMORY
+var errScriptMemory = errors.New("script memory exceeded")
+
+const (
+	// scriptMemoryCheck is how often the heap is looked at while a script runs
+	scriptMemoryCheck = time.Millisecond
+
+	// formatSlack bounds what string.format adds to an argument: its
+	// width, precision and the digits of a number
+	formatSlack = 512
+)
+
+// scriptMemory :: what a script may still allocate through the library
+type scriptMemory struct{ left int64 }
+
+// take charges n bytes, failing the script when they are not left
+func (m *scriptMemory) take(L *lua.LState, fn string, n int64) {
+	if n > m.left {
+		m.exceeded(L, fn)
+	}
+	m.left -= n
+}
+
+func (m *scriptMemory) exceeded(L *lua.LState, fn string) {
+	L.RaiseError("%s: result exceeds CACHE_SCRIPT_MAX_MEMORY (%d bytes)", fn, config.ScriptMaxMemory)
+}
+
+// limitScriptLibs replaces the library functions building long strings with
+// ones charging m, method calls such as s:rep(n) included
+func limitScriptLibs(L *lua.LState, m *scriptMemory) {
+	if str, ok := L.GetGlobal("string").(*lua.LTable); ok {
+		format := str.RawGetString("format").(*lua.LFunction).GFunction
+		str.RawSetString("rep", L.NewFunction(m.rep))
+		str.RawSetString("format", L.NewFunction(m.format(format)))
+		str.RawSetString("gsub", L.NewFunction(m.gsub))
+	}
+	if table, ok := L.GetGlobal("table").(*lua.LTable); ok {
+		concat := table.RawGetString("concat").(*lua.LFunction).GFunction
+		table.RawSetString("concat", L.NewFunction(m.concat(concat)))
+	}
+}
+
+// rep is string.rep(s, n)
+func (m *scriptMemory) rep(L *lua.LState) int {
+	s := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n <= 0 || s == "" {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	if int64(n) > m.left/int64(len(s)) {
+		m.exceeded(L, "string.rep")
+	}
+	m.take(L, "string.rep", int64(len(s))*int64(n))
+	L.Push(lua.LString(strings.Repeat(s, n)))
+	return 1
+}
+
+// format is string.format with widths and precisions of two digits at most,
+// as in Lua, and without the argument indexes and * widths of Go's fmt
+func (m *scriptMemory) format(format lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		f := L.CheckString(1)
+		if err := checkFormat(f); err != nil {
+			L.RaiseError("string.format: %v", err)
+		}
+		bound := int64(len(f))
+		for i := 2; i <= L.GetTop(); i++ {
+			bound += 4*int64(len(L.Get(i).String())) + formatSlack // %q and % x at most quadruple
+		}
+		if bound > m.left {
+			m.exceeded(L, "string.format")
+		}
+		n := format(L)
+		m.take(L, "string.format", int64(len(lua.LVAsString(L.Get(-1)))))
+		return n
+	}
+}
+
+// checkFormat refuses the specs of f string.format cannot bound the output of
+func checkFormat(f string) error {
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			continue
+		}
+		i++
+		if i < len(f) && f[i] == '%' {
+			continue
+		}
+		for i < len(f) && strings.IndexByte("-+ #0", f[i]) >= 0 {
+			i++
+		}
+		width := digits(f, &i)
+		precision := 0
+		if i < len(f) && f[i] == '.' {
+			i++
+			precision = digits(f, &i)
+		}
+		if width > 2 || precision > 2 {
+			return errors.New("invalid format (width or precision too long)")
+		}
+		if i < len(f) && (f[i] == '*' || f[i] == '[') {
+			return errors.New("invalid format")
+		}
+	}
+	return nil
+}
+
+// digits skips the digits of f at *i, returning how many there were
+func digits(f string, i *int) int {
+	start := *i
+	for *i < len(f) && f[*i] >= '0' && f[*i] <= '9' {
+		*i++
+	}
+	return *i - start
+}
+
+// gsub is string.gsub, building the result in one pass within m
+func (m *scriptMemory) gsub(L *lua.LState) int {
+	str := L.CheckString(1)
+	pattern := L.CheckString(2)
+	L.CheckTypes(3, lua.LTString, lua.LTTable, lua.LTFunction)
+	repl := L.CheckAny(3)
+	limit := L.OptInt(4, -1)
+
+	matches, err := pm.Find(pattern, []byte(str), 0, limit)
+	if err != nil {
+		L.RaiseError(err.Error())
+	}
+	if len(matches) == 0 {
+		L.SetTop(1)
+		L.Push(lua.LNumber(0))
+		return 2
+	}
+
+	var out strings.Builder
+	add := func(s string) {
+		if int64(out.Len()+len(s)) > m.left {
+			m.exceeded(L, "string.gsub")
+		}
+		out.WriteString(s)
+	}
+	last := 0
+	for _, match := range matches {
+		start, end := match.Capture(0), match.Capture(1)
+		add(str[last:start])
+		last = end
+		switch repl := repl.(type) {
+		case lua.LString:
+			for i := 0; i < len(repl); i++ {
+				if repl[i] != '%' || i == len(repl)-1 {
+					add(string(repl[i : i+1]))
+					continue
+				}
+				i++
+				switch c := repl[i]; {
+				case c == '%':
+					add("%")
+				case c >= '0' && c <= '9':
+					add(gsubCapture(L, str, match, 2*int(c-'0')))
+				default:
+					add(string(repl[i-1 : i+1]))
+				}
+			}
+		case *lua.LTable:
+			idx := 0
+			if match.CaptureLength() > 2 {
+				idx = 2
+			}
+			var value lua.LValue
+			if match.IsPosCapture(idx) {
+				value = L.GetTable(repl, lua.LNumber(match.Capture(idx)))
+			} else {
+				value = L.GetField(repl, str[match.Capture(idx):match.Capture(idx+1)])
+			}
+			if lua.LVIsFalse(value) {
+				add(str[start:end])
+			} else {
+				add(lua.LVAsString(value))
+			}
+		case *lua.LFunction:
+			L.Push(repl)
+			nargs := 0
+			if match.CaptureLength() > 2 {
+				for i := 2; i < match.CaptureLength(); i += 2 {
+					if match.IsPosCapture(i) {
+						L.Push(lua.LNumber(match.Capture(i)))
+					} else {
+						L.Push(lua.LString(gsubCapture(L, str, match, i)))
+					}
+					nargs++
+				}
+			} else {
+				L.Push(lua.LString(str[start:end]))
+				nargs++
+			}
+			L.Call(nargs, 1)
+			value := L.Get(-1)
+			L.Pop(1)
+			if lua.LVIsFalse(value) {
+				add(str[start:end])
+			} else {
+				add(lua.LVAsString(value))
+			}
+		}
+	}
+	add(str[last:])
+	m.take(L, "string.gsub", int64(out.Len()))
+	L.Push(lua.LString(out.String()))
+	L.Push(lua.LNumber(len(matches)))
+	return 2
+}
+
+// gsubCapture returns capture idx/2 of match, the whole match for %1 of a
+// pattern without captures
+func gsubCapture(L *lua.LState, str string, match *pm.MatchData, idx int) string {
+	if idx > 2 && idx >= match.CaptureLength() {
+		L.RaiseError("invalid capture index")
+	}
+	if idx == 2 && idx >= match.CaptureLength() {
+		idx = 0
+	}
+	if match.IsPosCapture(idx) {
+		return strconv.Itoa(match.Capture(idx))
+	}
+	return str[match.Capture(idx):match.Capture(idx+1)]
+}
+
+// concat is table.concat, checking the length of the result first
+func (m *scriptMemory) concat(concat lua.LGFunction) lua.LGFunction {
+	return func(L *lua.LState) int {
+		t := L.CheckTable(1)
+		sep := int64(len(L.OptString(2, "")))
+		var bound int64
+		for i := max(L.OptInt(3, 1), 1); i <= min(L.OptInt(4, t.Len()), t.Len()); i++ {
+			if bound += int64(len(lua.LVAsString(t.RawGetInt(i)))) + sep; bound > m.left {
+				m.exceeded(L, "table.concat")
+			}
+		}
+		n := concat(L)
+		m.take(L, "table.concat", int64(len(lua.LVAsString(L.Get(-1)))))
+		return n
+	}
+}
+
+// watchScriptMemory cancels a script once the heap has grown by more than
+// CACHE_SCRIPT_MAX_MEMORY since it started, until ctx is done. Go does not
+// tell which goroutine allocated what, so this counts whatever the process
+// allocates meanwhile
+func watchScriptMemory(ctx context.Context, cancel context.CancelCauseFunc) {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	start := sample[0].Value.Uint64()
+
+	ticker := time.NewTicker(scriptMemoryCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			metrics.Read(sample)
+			if heap := sample[0].Value.Uint64(); heap > start && heap-start > uint64(config.ScriptMaxMemory) {
+				cancel(errScriptMemory)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func withScriptLimits(t *testing.T, memory int64) {
+	t.Helper()
+	saved := config
+	config = &Config{ScriptTimeout: 2 * time.Second, ScriptMaxMemory: memory}
+	t.Cleanup(func() { config = saved })
+}
+
+func TestScriptLimits(t *testing.T) {
+	withScriptLimits(t, 1<<20)
+
+	tests := []struct {
+		name   string
+		source string
+		want   interface{}
+		err    string
+	}{
+		{"rep", `return string.rep("ab", 3)`, "ababab", ""},
+		{"rep too long", `return string.rep("x", 2^31)`, nil, "string.rep"},
+		{"rep method", `return ("x"):rep(2^31)`, nil, "string.rep"},
+		{"rep under limit", `return #string.rep("x", 1000)`, 1000.0, ""},
+		{"format", `return string.format("%5.2f|%-3d|%s", 1.5, 7, "a")`, " 1.50|7  |a", ""},
+		{"format wide", `return string.format("%100d", 1)`, nil, "string.format"},
+		{"format precision", `return string.format("%.100f", 1)`, nil, "string.format"},
+		{"gsub capture", `return (string.gsub("hello world", "(o)", "[%1]"))`, "hell[o] w[o]rld", ""},
+		{"gsub whole match", `return (string.gsub("abc", "b", "<%1%%>"))`, "a<b%>c", ""},
+		{"gsub table", `return (string.gsub("$a $b", "%$(%w)", {a = "1"}))`, "1 $b", ""},
+		{"gsub function", `return (string.gsub("a b", "%w", function(s) return s:upper() end))`, "A B", ""},
+		{"gsub count", `local s, n = string.gsub("aaa", "a", "b", 2) return s .. n`, "bba2", ""},
+		{"gsub no match", `local s, n = string.gsub("abc", "z", "y") return s .. n`, "abc0", ""},
+		// Building toward the limit, the heap watcher may stop it first
+		{"gsub too long", `local s = string.rep("x", 2000) return string.gsub(s, "x", s)`, nil, "CACHE_SCRIPT_MAX_MEMORY"},
+		{"concat", `return table.concat({"a", "b", "c"}, ",", 2)`, "b,c", ""},
+		{"concat too long", `local x, t = string.rep("x", 1000), {} for i = 1, 2000 do t[i] = x end return table.concat(t)`, nil, "table.concat"},
+		{"doubling", `local s = "x" while true do s = s .. s end`, nil, "CACHE_SCRIPT_MAX_MEMORY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := evalScript(scriptCall{Source: tt.source}, map[string]interface{}{})
+			if tt.want != nil {
+				if err != nil || got != tt.want {
+					t.Errorf("evalScript = %v, %v, want %v", got, err, tt.want)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("evalScript = %v, %v, want an error mentioning %q", got, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,651 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Scripts are Lua run on the server over several keys at once, atomically,
+// as Redis runs EVAL: the keys are declared up front, their shards stay
+// locked while the script runs, and what it sets and deletes is made all at
+// once when it returns, or not at all when it fails. Scripts see KEYS and
+// ARGV, and cache.get, cache.set and cache.delete, on the declared keys
+// only; their return value is the reply. They run in a sandbox of the base,
+// table, string and math libraries, without loading code, files or random
+// numbers, and are stopped after CACHE_SCRIPT_TIMEOUT, which also bounds
+// how long they hold up the keys sharing their shards. In cluster mode the
+// leader runs a script once and the raft log carries the changes it made,
+// with the values it read: every node makes them only while its keys hold
+// those values, and the leader runs the script again when they do not. So
+// a slower node never times out a script the others ran
+
+const (
+	maxScriptDepth = 32 // how deeply tables converted to and from JSON nest
+
+	// The Lua stacks of a script, bounding what it holds: calls nest at
+	// most scriptCallStackSize deep and scriptRegistryMaxSize values are
+	// on the stack at once
+	scriptCallStackSize   = 200
+	scriptRegistryMaxSize = 64 * 1024
+
+	// maxScriptRetries is how often the leader runs a script again when
+	// its keys changed before its changes were applied
+	maxScriptRetries = 5
+)
+
+// errScriptStale is applying a script's changes after another write to its
+// keys came first
+var errScriptStale error = &conflictError{"The script's keys kept changing while it ran"}
+
+// scriptCall is a script to run
+type scriptCall struct {
+	Source string        `json:"source,omitempty"`
+	Keys   []string      `json:"keys"`
+	Args   []interface{} `json:"args,omitempty"`
+
+	// In the raft log, in place of the source: the JSON of the values the
+	// leader ran the script on and the changes it made
+	Read    map[string]json.RawMessage `json:"read,omitempty"`
+	Changes []scriptChange             `json:"changes,omitempty"`
+
+	proto *lua.FunctionProto // compiled, when it already is
+}
+
+// scriptChange is a change a script made as stored in the raft log: a nil
+// Value deletes the key, a zero ExpiresAt keeps the expiry of a cached one
+type scriptChange struct {
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+}
+
+// scriptResult is what applying a script gives
+type scriptResult struct {
+	Reply   interface{}
+	Updates []CacheUpdate
+}
+
+// scriptError fails a script, answered with 400
+func scriptError(format string, args ...interface{}) error {
+	return &typeArgError{fmt.Sprintf(format, args...)}
+}
+
+var (
+	scripts      = make(map[string]scriptCall) // registered by name, without keys
+	scriptsMutex sync.RWMutex
+)
+
+// compileScript parses and compiles a script's source
+func compileScript(name, source string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, scriptError("script %s: %v", name, err)
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, scriptError("script %s: %v", name, err)
+	}
+	return proto, nil
+}
+
+// registerScript :: compiles source and keeps it as the script called name
+func registerScript(name, source string) error {
+	proto, err := compileScript(name, source)
+	if err != nil {
+		return err
+	}
+	scriptsMutex.Lock()
+	defer scriptsMutex.Unlock()
+	scripts[name] = scriptCall{Source: source, proto: proto}
+	return nil
+}
+
+// setupScripts :: registers the scripts in CACHE_SCRIPTS_DIR, each file
+// name.lua as name
+func setupScripts(cfg *Config) error {
+	scriptsMutex.Lock()
+	scripts = make(map[string]scriptCall)
+	scriptsMutex.Unlock()
+	if cfg.ScriptsDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(cfg.ScriptsDir, "*.lua"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := registerScript(strings.TrimSuffix(filepath.Base(file), ".lua"), string(source)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runScript :: runs call over its keys: through the raft log in cluster mode
+// and locally otherwise, publishing the changes
+func runScript(r *http.Request, call scriptCall) (interface{}, error) {
+	for _, key := range call.Keys {
+		if _, ok := writerFor(key); ok {
+			return nil, errWrittenThrough
+		}
+	}
+
+	requestID := requestID(r.Context())
+	var result scriptResult
+	if raftCluster() {
+		var err error
+		if result, err = raftScript(call, requestID); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if result, err = applyScript(call, requestID, ReasonRequest); err != nil {
+			return nil, err
+		}
+		for _, update := range result.Updates {
+			publishInvalidation(update.Key)
+		}
+	}
+	for _, update := range result.Updates {
+		shipToRegions(update)
+	}
+	return result.Reply, nil
+}
+
+// raftScript runs call on the leader and replicates its changes, running it
+// again when another write to its keys got in before them
+func raftScript(call scriptCall, requestID string) (scriptResult, error) {
+	for attempt := 0; ; attempt++ {
+		var reply interface{}
+		logged := scriptCall{Keys: call.Keys, Read: make(map[string]json.RawMessage, len(call.Keys))}
+		// Only reads: the changes are made when the log entry is applied
+		_, err := cache.UpdateMany(call.Keys, func(values map[string]interface{}) ([]lru.Change, error) {
+			for key, value := range values {
+				data, err := json.Marshal(value)
+				if err != nil {
+					return nil, err
+				}
+				logged.Read[key] = data
+			}
+			var changes []lru.Change
+			var err error
+			if reply, changes, err = evalScript(call, values); err != nil {
+				return nil, err
+			}
+			now := clock.Now()
+			for _, c := range changes {
+				change := scriptChange{Key: c.Key, Value: c.Value}
+				if c.TTL > 0 {
+					change.ExpiresAt = now.Add(c.TTL)
+				}
+				logged.Changes = append(logged.Changes, change)
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return scriptResult{}, err
+		}
+		if len(logged.Changes) == 0 {
+			return scriptResult{Reply: reply}, nil
+		}
+
+		response, err := applyCommandResponse(raftCommand{Op: opScript, Script: &logged, RequestID: requestID})
+		if errors.Is(err, errScriptStale) && attempt < maxScriptRetries {
+			continue
+		}
+		if err != nil {
+			return scriptResult{}, err
+		}
+		result, _ := response.(scriptResult)
+		result.Reply = reply
+		return result, nil
+	}
+}
+
+// applyScriptChanges :: makes the changes of a script the leader ran, as
+// the raft log has them, when its keys still hold the values it read
+func applyScriptChanges(call scriptCall, requestID, reason string) (scriptResult, error) {
+	return updateScriptKeys(call.Keys, requestID, reason, func(values map[string]interface{}) ([]lru.Change, error) {
+		if len(values) != len(call.Read) {
+			return nil, errScriptStale
+		}
+		for key, value := range values {
+			data, err := json.Marshal(value)
+			if err != nil || !bytes.Equal(data, call.Read[key]) {
+				return nil, errScriptStale
+			}
+		}
+		now := clock.Now()
+		changes := make([]lru.Change, len(call.Changes))
+		for i, c := range call.Changes {
+			changes[i] = lru.Change{Key: c.Key, Value: c.Value}
+			if !c.ExpiresAt.IsZero() {
+				// Past already when applied late: expire it at once
+				changes[i].TTL = max(c.ExpiresAt.Sub(now), time.Nanosecond)
+			}
+		}
+		return changes, nil
+	})
+}
+
+// applyScript :: runs a script on the cache and publishes its changes
+func applyScript(call scriptCall, requestID, reason string) (scriptResult, error) {
+	var reply interface{}
+	result, err := updateScriptKeys(call.Keys, requestID, reason, func(values map[string]interface{}) ([]lru.Change, error) {
+		var changes []lru.Change
+		var err error
+		reply, changes, err = evalScript(call, values)
+		return changes, err
+	})
+	result.Reply = reply
+	return result, err
+}
+
+// updateScriptKeys changes keys with fn as UpdateMany does, publishing the
+// changes
+func updateScriptKeys(keys []string, requestID, reason string, fn func(values map[string]interface{}) ([]lru.Change, error)) (scriptResult, error) {
+	var result scriptResult
+	items, err := cache.UpdateMany(keys, fn)
+	if err != nil {
+		return result, err
+	}
+	for _, item := range items {
+		keyTags.remove(item.Key)
+		update := removal(item.Key, EventDelete, reason, requestID)
+		if item.Value != nil {
+			update = CacheUpdate{Type: EventSet, Reason: reason, Key: item.Key, Value: item.Value, ExpiresAt: item.ExpiresAt, RequestID: requestID}
+		}
+		publish(update)
+		result.Updates = append(result.Updates, update)
+	}
+	return result, nil
+}
+
+// evalScript runs call on values, the cached ones of its keys, returning
+// its reply and the changes it made
+func evalScript(call scriptCall, values map[string]interface{}) (interface{}, []lru.Change, error) {
+	proto := call.proto
+	if proto == nil {
+		var err error
+		if proto, err = compileScript("script", call.Source); err != nil {
+			return nil, nil, err
+		}
+	}
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   scriptCallStackSize,
+		RegistrySize:    lua.RegistrySize,
+		RegistryMaxSize: scriptRegistryMaxSize,
+	})
+	defer L.Close()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	ctx, stop := context.WithTimeout(ctx, config.ScriptTimeout)
+	defer stop()
+	go watchScriptMemory(ctx, cancel)
+	L.SetContext(ctx)
+	openScriptLibs(L)
+	limitScriptLibs(L, &scriptMemory{left: config.ScriptMaxMemory})
+
+	keys := L.NewTable()
+	declared := make(map[string]bool, len(call.Keys))
+	for _, key := range call.Keys {
+		keys.Append(lua.LString(key))
+		declared[key] = true
+	}
+	args := L.NewTable()
+	for _, arg := range call.Args {
+		args.Append(toLua(L, arg))
+	}
+	L.SetGlobal("KEYS", keys)
+	L.SetGlobal("ARGV", args)
+
+	// The script sees its own changes; the last change of a key is made
+	var changes []lru.Change
+	changed := make(map[string]int)
+	change := func(L *lua.LState, c lru.Change) {
+		if !declared[c.Key] {
+			L.RaiseError("key %q is not in KEYS", c.Key)
+		}
+		if i, ok := changed[c.Key]; ok {
+			changes[i] = c
+		} else {
+			changed[c.Key] = len(changes)
+			changes = append(changes, c)
+		}
+		if c.Value == nil {
+			delete(values, c.Key)
+		} else {
+			values[c.Key] = c.Value
+		}
+	}
+	api := L.NewTable()
+	L.SetFuncs(api, map[string]lua.LGFunction{
+		"get": func(L *lua.LState) int {
+			key := L.CheckString(1)
+			if !declared[key] {
+				L.RaiseError("key %q is not in KEYS", key)
+			}
+			L.Push(toLua(L, values[key]))
+			return 1
+		},
+		"set": func(L *lua.LState) int {
+			key := L.CheckString(1)
+			value, err := fromLua(L.CheckAny(2), 0)
+			if err != nil {
+				L.RaiseError("%v", err)
+			}
+			if value == nil {
+				L.RaiseError("cache.set needs a value, use cache.delete to remove a key")
+			}
+			if err := validateValue(value); err != nil {
+				L.RaiseError("%v", err)
+			}
+			ttl := L.OptNumber(3, 0) // in seconds
+			if ttl < 0 {
+				L.RaiseError("ttl must not be negative")
+			}
+			change(L, lru.Change{Key: key, Value: value, TTL: time.Duration(float64(ttl) * float64(time.Second))})
+			return 0
+		},
+		"delete": func(L *lua.LState) int {
+			change(L, lru.Change{Key: L.CheckString(1)})
+			return 0
+		},
+	})
+	L.SetGlobal("cache", api)
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 1, nil); err != nil {
+		if errors.Is(context.Cause(ctx), errScriptMemory) {
+			return nil, nil, scriptError("script used more than CACHE_SCRIPT_MAX_MEMORY (%d bytes)", config.ScriptMaxMemory)
+		}
+		if ctx.Err() != nil {
+			return nil, nil, scriptError("script ran longer than CACHE_SCRIPT_TIMEOUT (%s)", config.ScriptTimeout)
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return nil, nil, scriptError("script failed: %s", apiErr.Object.String())
+		}
+		return nil, nil, scriptError("script failed: %v", err)
+	}
+	reply, err := fromLua(L.Get(-1), 0)
+	if err != nil {
+		return nil, nil, scriptError("script reply: %v", err)
+	}
+	return reply, changes, nil
+}
+
+// openScriptLibs opens the libraries scripts may use, leaving out what
+// loads code or is not deterministic
+func openScriptLibs(L *lua.LState) {
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage", "print", "_printregs"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if math, ok := L.GetGlobal("math").(*lua.LTable); ok {
+		math.RawSetString("random", lua.LNil)
+		math.RawSetString("randomseed", lua.LNil)
+	}
+}
+
+// toLua converts a JSON value to Lua: objects and arrays become tables
+func toLua(L *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case []interface{}:
+		table := L.NewTable()
+		for _, item := range v {
+			table.Append(toLua(L, item))
+		}
+		return table
+	case map[string]interface{}:
+		table := L.NewTable()
+		for key, item := range v {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	}
+	// Other Go values, such as those of the data types, as their JSON has them
+	data, err := json.Marshal(value)
+	if err != nil {
+		return lua.LNil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return lua.LNil
+	}
+	return toLua(L, decoded)
+}
+
+// fromLua converts a Lua value to JSON: tables holding 1 to n become
+// arrays, other tables objects
+func fromLua(value lua.LValue, depth int) (interface{}, error) {
+	if depth > maxScriptDepth {
+		return nil, fmt.Errorf("tables nested deeper than %d", maxScriptDepth)
+	}
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 && n == countTable(v) {
+			array := make([]interface{}, n)
+			for i := range array {
+				item, err := fromLua(v.RawGetInt(i+1), depth+1)
+				if err != nil {
+					return nil, err
+				}
+				array[i] = item
+			}
+			return array, nil
+		}
+		object := make(map[string]interface{})
+		var err error
+		v.ForEach(func(key, item lua.LValue) {
+			if err != nil {
+				return
+			}
+			var converted interface{}
+			if converted, err = fromLua(item, depth+1); err == nil {
+				object[key.String()] = converted
+			}
+		})
+		return object, err
+	}
+	return nil, fmt.Errorf("cannot convert a Lua %s to JSON", value.Type())
+}
+
+// countTable returns how many entries a table has
+func countTable(table *lua.LTable) int {
+	n := 0
+	table.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	return n
+}
+
+// scriptRequest is the body of POST /eval and POST /scripts/{name}
+type scriptRequest struct {
+	Script string        `json:"script"` // for /eval
+	Keys   []string      `json:"keys"`
+	Args   []interface{} `json:"args"`
+}
+
+// readScriptRequest decodes the body and checks the caller may write every
+// key, answering the request when it cannot
+func readScriptRequest(w http.ResponseWriter, r *http.Request) (scriptRequest, bool) {
+	var data scriptRequest
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return data, false
+	}
+	for _, key := range data.Keys {
+		if err := validateWriteKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return data, false
+		}
+		if !canAccess(r.Context(), key, ScopeWrite) {
+			loggerFrom(r.Context()).Warn("acl: denied", "op", ScopeWrite, "key", key, "principal", principalFrom(r.Context()).Name, "client_ip", clientIP(r))
+			http.Error(w, fmt.Sprintf("Not allowed to %s %q", ScopeWrite, key), http.StatusForbidden)
+			return data, false
+		}
+	}
+	return data, true
+}
+
+// registerScriptRoutes :: mounts /eval, /scripts/{name} and /admin/scripts
+func registerScriptRoutes(r *mux.Router) {
+	r.Handle("/eval", typeWrite(evalHandler)).Methods("POST")
+	r.Handle("/scripts/{name}", typeWrite(runScriptHandler)).Methods("POST")
+	r.HandleFunc("/admin/scripts", listScriptsHandler).Methods("GET")
+	r.HandleFunc("/admin/scripts/{name}", getScriptHandler).Methods("GET")
+	r.HandleFunc("/admin/scripts/{name}", putScriptHandler).Methods("PUT")
+	r.HandleFunc("/admin/scripts/{name}", deleteScriptHandler).Methods("DELETE")
+}
+
+// evalHandler serves POST /eval: {"script": "...", "keys": [...], "args":
+// [...]} runs the script, answering {"result": ...}
+func evalHandler(w http.ResponseWriter, r *http.Request) {
+	data, ok := readScriptRequest(w, r)
+	if !ok {
+		return
+	}
+	proto, err := compileScript("eval", data.Script)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	reply, err := runScript(r, scriptCall{Source: data.Script, Keys: data.Keys, Args: data.Args, proto: proto})
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"result": reply})
+}
+
+// runScriptHandler serves POST /scripts/{name}: {"keys": [...], "args":
+// [...]} runs the script registered as name
+func runScriptHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	scriptsMutex.RLock()
+	call, ok := scripts[name]
+	scriptsMutex.RUnlock()
+	if !ok {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+	data, ok := readScriptRequest(w, r)
+	if !ok {
+		return
+	}
+	call.Keys, call.Args = data.Keys, data.Args
+	reply, err := runScript(r, call)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"result": reply})
+}
+
+// listScriptsHandler serves GET /admin/scripts, the names of the scripts
+func listScriptsHandler(w http.ResponseWriter, r *http.Request) {
+	scriptsMutex.RLock()
+	names := make([]string, 0, len(scripts))
+	for name := range scripts {
+		names = append(names, name)
+	}
+	scriptsMutex.RUnlock()
+	sort.Strings(names)
+	writeJSON(w, map[string]interface{}{"scripts": names})
+}
+
+// getScriptHandler serves GET /admin/scripts/{name}, the script's source
+func getScriptHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	scriptsMutex.RLock()
+	call, ok := scripts[name]
+	scriptsMutex.RUnlock()
+	if !ok {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"name": name, "script": call.Source})
+}
+
+// putScriptHandler serves PUT /admin/scripts/{name}: {"script": "..."}
+// registers the script on this node, replacing any of that name
+func putScriptHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	var data struct {
+		Script string `json:"script"`
+	}
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := registerScript(name, data.Script); err != nil {
+		typeOpError(w, err)
+		return
+	}
+	loggerFrom(r.Context()).Info("scripts: registered", "name", name, "bytes", len(data.Script))
+	writeJSON(w, map[string]interface{}{"name": name})
+}
+
+// deleteScriptHandler serves DELETE /admin/scripts/{name}
+func deleteScriptHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	scriptsMutex.Lock()
+	_, ok := scripts[name]
+	delete(scripts, name)
+	scriptsMutex.Unlock()
+	if !ok {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
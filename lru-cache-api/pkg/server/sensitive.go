@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+
+	"lru-cache-api/pkg/lru"
+)
+
+const (
+	// redactedValue replaces sensitive values for callers without the reveal scope
+	redactedValue = "[REDACTED]"
+
+	// sealedField holds a sensitive value encrypted in snapshots and exports
+	sealedField = "$sealed"
+)
+
+// sensitive reports whether key matches one of CACHE_SENSITIVE_KEYS
+func sensitive(key string) bool {
+	for _, pattern := range config.SensitiveKeys {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// canReveal reports whether p may see sensitive values. Everyone may when
+// authentication is off, since they can read the keys anyway
+func canReveal(p *Principal) bool {
+	return p == nil || p.HasScope(ScopeReveal)
+}
+
+// redact :: returns the value of key as p may see it
+func redact(p *Principal, key string, value interface{}) interface{} {
+	if value == nil || canReveal(p) || !sensitive(key) {
+		return value
+	}
+	return redactedValue
+}
+
+// validateValue refuses values shaped as sealed ones, an object holding
+// only "$sealed", which snapshots and exports reserve
+func validateValue(value interface{}) error {
+	if object, ok := value.(map[string]interface{}); ok && len(object) == 1 {
+		if _, ok := object[sealedField]; ok {
+			return fmt.Errorf("values must not be an object holding only %q", sealedField)
+		}
+	}
+	return nil
+}
+
+// sealItems returns a copy of items with the sensitive values encrypted
+func sealItems(items []lru.CacheItem) ([]lru.CacheItem, error) {
+	if len(config.SensitiveKeys) == 0 {
+		return items, nil
+	}
+	sealed := make([]lru.CacheItem, len(items))
+	for i, item := range items {
+		sealed[i] = item
+		if !sensitive(item.Key) {
+			continue
+		}
+		data, err := json.Marshal(item.Value)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = encryptSnapshot(config.FieldKey, data, []byte(item.Key)); err != nil {
+			return nil, err
+		}
+		sealed[i].Value = map[string]interface{}{sealedField: base64.StdEncoding.EncodeToString(data)}
+	}
+	return sealed, nil
+}
+
+// openItems decrypts the values sealItems encrypted, in place. Only keys
+// matching CACHE_SENSITIVE_KEYS are sealed; other values are left alone,
+// whatever their shape
+func openItems(items []lru.CacheItem) error {
+	for i, item := range items {
+		if !sensitive(item.Key) {
+			continue
+		}
+		object, ok := item.Value.(map[string]interface{})
+		if !ok || len(object) != 1 {
+			continue
+		}
+		encoded, ok := object[sealedField].(string)
+		if !ok {
+			continue
+		}
+		if config.FieldKey == nil {
+			return errors.New("found sealed values but CACHE_FIELD_KEY is not configured")
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", item.Key, err)
+		}
+		if data, err = decryptSnapshot(config.FieldKey, data, []byte(item.Key)); err != nil {
+			return fmt.Errorf("key %q: %w", item.Key, err)
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return fmt.Errorf("key %q: %w", item.Key, err)
+		}
+		items[i].Value = value
+	}
+	return nil
+}
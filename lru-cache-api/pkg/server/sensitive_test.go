@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"lru-cache-api/pkg/lru"
+)
+
+func withSensitiveKeys(t *testing.T, patterns ...string) {
+	t.Helper()
+	saved := config
+	config = &Config{SensitiveKeys: patterns, FieldKey: bytes.Repeat([]byte{7}, 32)}
+	t.Cleanup(func() { config = saved })
+}
+
+func sealedShape(value interface{}) bool {
+	object, ok := value.(map[string]interface{})
+	_, sealed := object[sealedField]
+	return ok && len(object) == 1 && sealed
+}
+
+func TestValidateValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		ok    bool
+	}{
+		{"string", "$sealed", true},
+		{"empty object", map[string]interface{}{}, true},
+		{"other field", map[string]interface{}{"sealed": "x"}, true},
+		{"sealed beside others", map[string]interface{}{sealedField: "x", "b": 1}, true},
+		{"nested", map[string]interface{}{"a": map[string]interface{}{sealedField: "x"}}, true},
+		{"sealed string", map[string]interface{}{sealedField: "x"}, false},
+		{"sealed number", map[string]interface{}{sealedField: 1.0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateValue(tt.value); (err == nil) != tt.ok {
+				t.Errorf("validateValue(%v) = %v, want ok %v", tt.value, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSealItemsRoundTrip(t *testing.T) {
+	withSensitiveKeys(t, "secret:*")
+
+	items := []lru.CacheItem{
+		{Key: "secret:a", Value: map[string]interface{}{"token": "abc"}},
+		{Key: "plain", Value: "visible"},
+	}
+	sealed, err := sealItems(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sealedShape(sealed[0].Value) {
+		t.Errorf("sensitive value not sealed: %v", sealed[0].Value)
+	}
+	if sealed[1].Value != "visible" {
+		t.Errorf("plain value changed: %v", sealed[1].Value)
+	}
+
+	if err := openItems(sealed); err != nil {
+		t.Fatal(err)
+	}
+	if got := sealed[0].Value.(map[string]interface{})["token"]; got != "abc" {
+		t.Errorf("opened value = %v, want abc", got)
+	}
+}
+
+func TestOpenItems(t *testing.T) {
+	withSensitiveKeys(t, "secret:*")
+
+	sealed, err := sealItems([]lru.CacheItem{{Key: "secret:a", Value: "abc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope := sealed[0].Value
+
+	tests := []struct {
+		name string
+		item lru.CacheItem
+		ok   bool
+	}{
+		{"sealed under its key", lru.CacheItem{Key: "secret:a", Value: envelope}, true},
+		{"moved to another key", lru.CacheItem{Key: "secret:b", Value: envelope}, false},
+		{"forged on a sensitive key", lru.CacheItem{Key: "secret:a", Value: map[string]interface{}{sealedField: "AAAA"}}, false},
+		{"shape on a plain key", lru.CacheItem{Key: "plain", Value: map[string]interface{}{sealedField: "AAAA"}}, true},
+		{"envelope on a plain key", lru.CacheItem{Key: "plain", Value: envelope}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items := []lru.CacheItem{tt.item}
+			if err := openItems(items); (err == nil) != tt.ok {
+				t.Fatalf("openItems = %v, want ok %v", err, tt.ok)
+			}
+			if tt.ok && tt.item.Key == "plain" && !sealedShape(items[0].Value) {
+				t.Errorf("plain value was opened: %v", items[0].Value)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// Sets are JSON objects with true for each member, {"alice": true}, so
+// membership is a lookup and adding a member does not grow an array. Members
+// are strings
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"sadd":      {fn: setAdd},
+		"srem":      {fn: setRemove},
+		"smembers":  {fn: setMembers, read: true},
+		"sismember": {fn: setIsMember, read: true},
+		"scard":     {fn: setCard, read: true},
+	})
+}
+
+// asSet returns the set held by a key, nil when it is not cached
+func asSet(value interface{}) (map[string]interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	set, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errWrongType
+	}
+	for _, v := range set {
+		if v != true {
+			return nil, errWrongType
+		}
+	}
+	return set, nil
+}
+
+// argStrings returns args as strings, naming what they are in the error
+func argStrings(args []interface{}, what string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, argError("no %s given", what)
+	}
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, argError("%s must be strings", what)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// setAdd :: SAdd: adds the members, replying with how many were new
+func setAdd(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	set, err := asSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := argStrings(args, "members")
+	if err != nil {
+		return nil, nil, err
+	}
+	var added map[string]interface{}
+	for _, member := range members {
+		if set[member] == true || added[member] == true {
+			continue
+		}
+		if added == nil {
+			added = make(map[string]interface{}, len(set)+len(members))
+			for m := range set {
+				added[m] = true
+			}
+		}
+		added[member] = true
+	}
+	if added == nil {
+		return 0, noChange, nil
+	}
+	return len(added) - len(set), added, nil
+}
+
+// setRemove :: SRem: removes the members, replying with how many were
+// there. Removing the last member deletes the key
+func setRemove(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	set, err := asSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := argStrings(args, "members")
+	if err != nil {
+		return nil, nil, err
+	}
+	removing := make(map[string]bool, len(members))
+	for _, member := range members {
+		if set[member] == true {
+			removing[member] = true
+		}
+	}
+	if len(removing) == 0 {
+		return 0, noChange, nil
+	}
+	if len(removing) == len(set) {
+		return len(removing), nil, nil
+	}
+	rest := make(map[string]interface{}, len(set)-len(removing))
+	for member := range set {
+		if !removing[member] {
+			rest[member] = true
+		}
+	}
+	return len(removing), rest, nil
+}
+
+// setMembers :: SMembers: every member, sorted
+func setMembers(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	set, err := asSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members, value, nil
+}
+
+// setIsMember :: SIsMember: whether args[0] is a member
+func setIsMember(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	set, err := asSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := argStrings(args, "members")
+	if err != nil {
+		return nil, nil, err
+	}
+	return set[members[0]] == true, value, nil
+}
+
+// setCard :: SCard: how many members there are
+func setCard(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	set, err := asSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return len(set), value, nil
+}
+
+// registerSetRoutes :: mounts /cache/{key}/set
+func registerSetRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/set", withConsistency(setReadHandler("smembers", "members"))).Methods("GET")
+	r.Handle("/cache/{key}/set/size", withConsistency(setReadHandler("scard", "size"))).Methods("GET")
+	r.Handle("/cache/{key}/set/contains", withConsistency(setContainsHandler)).Methods("GET")
+	r.Handle("/cache/{key}/set/add", typeWrite(setWriteHandler("sadd", "added"))).Methods("POST")
+	r.Handle("/cache/{key}/set/remove", typeWrite(setWriteHandler("srem", "removed"))).Methods("POST")
+}
+
+// setWriteHandler serves POST /cache/{key}/set/add and /remove, taking
+// {"members": [...]} and answering with the count the op replies under field
+func setWriteHandler(name, field string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		data, ok := readTypeRequest(w, r)
+		if !ok {
+			return
+		}
+		n, err := runTypeOp(r, key, typeOp{Name: name, Args: data.Members}, data.ttl())
+		if err != nil {
+			typeOpError(w, err)
+			return
+		}
+		writeTypeReply(w, key, map[string]interface{}{field: n})
+	}
+}
+
+// setReadHandler serves GET /cache/{key}/set and /size; a key not cached is
+// an empty set
+func setReadHandler(name, field string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		reply, err := runTypeOp(r, key, typeOp{Name: name}, 0)
+		if err != nil {
+			typeOpError(w, err)
+			return
+		}
+		writeTypeReply(w, key, map[string]interface{}{field: reply})
+	}
+}
+
+// setContainsHandler serves GET /cache/{key}/set/contains?member=alice
+func setContainsHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	member := r.URL.Query().Get("member")
+	isMember, err := runTypeOp(r, key, typeOp{Name: "sismember", Args: []interface{}{member}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"member": member, "isMember": isMember})
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SlowlogEntry is a request or cache operation that took longer than
+// CACHE_SLOWLOG_THRESHOLD
+type SlowlogEntry struct {
+	ID             uint64    `json:"id"`
+	Time           time.Time `json:"time"`
+	DurationMicros int64     `json:"durationMicros"`
+	Kind           string    `json:"kind"` // request or cache
+	Op             string    `json:"op"`
+	Key            string    `json:"key,omitempty"`
+	Status         int       `json:"status,omitempty"`
+	Principal      string    `json:"principal,omitempty"`
+	ClientIP       string    `json:"clientIp,omitempty"`
+	RequestID      string    `json:"requestId,omitempty"`
+}
+
+// slowLog keeps the latest CACHE_SLOWLOG_MAX_LEN slow entries, like Redis SLOWLOG
+type slowLog struct {
+	mutex   sync.Mutex
+	entries []SlowlogEntry
+	next    int
+	lastID  uint64
+}
+
+var slowlog = &slowLog{}
+
+// setupSlowlog :: starts timing cache operations when the slow log is enabled
+func setupSlowlog(cfg *Config) {
+	if cfg.SlowlogThreshold <= 0 || cfg.SlowlogMaxLen <= 0 {
+		return
+	}
+	cache.OnOp = append(cache.OnOp, func(op, key string, took time.Duration) {
+		if took >= cfg.SlowlogThreshold {
+			slowlog.record(SlowlogEntry{Time: time.Now().Add(-took), DurationMicros: took.Microseconds(), Kind: "cache", Op: op, Key: key})
+		}
+	})
+}
+
+func (l *slowLog) record(entry SlowlogEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.lastID++
+	entry.ID = l.lastID
+	if len(l.entries) < config.SlowlogMaxLen {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.next] = entry
+	}
+	l.next = (l.next + 1) % config.SlowlogMaxLen
+}
+
+// latest returns up to limit entries, newest first
+func (l *slowLog) latest(limit int) []SlowlogEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entries := make([]SlowlogEntry, 0, min(limit, len(l.entries)))
+	for i := 1; i <= len(l.entries) && len(entries) < limit; i++ {
+		entries = append(entries, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return entries
+}
+
+func (l *slowLog) reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries = nil
+	l.next = 0
+}
+
+// slowlogMiddleware records requests that took longer than the threshold.
+// WebSocket connections and event streams are left out, they last as long
+// as the client stays
+func slowlogMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	if config.SlowlogThreshold <= 0 || config.SlowlogMaxLen <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		took := time.Since(start)
+		streamed := recorder.status == http.StatusSwitchingProtocols || recorder.Header().Get("Content-Type") == "text/event-stream"
+		if took < config.SlowlogThreshold || streamed {
+			return
+		}
+		entry := SlowlogEntry{
+			Time:           start,
+			DurationMicros: took.Microseconds(),
+			Kind:           "request",
+			Op:             r.Method + " " + routeTemplate(router, r),
+			Status:         recorder.status,
+			ClientIP:       clientIP(r),
+			RequestID:      requestID(r.Context()),
+		}
+		var match mux.RouteMatch
+		if router.Match(r, &match) {
+			entry.Key = match.Vars["key"]
+		}
+		if p := principalFrom(r.Context()); p != nil {
+			entry.Principal = p.Name
+		}
+		slowlog.record(entry)
+	})
+}
+
+// slowlogHandler serves GET /admin/slowlog, newest first, at most ?limit=
+// entries (default 10), and DELETE /admin/slowlog, which empties it
+func slowlogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		slowlog.reset()
+		json.NewEncoder(w).Encode(map[string]string{"message": "Slow log reset"})
+		return
+	}
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 10
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"threshold": config.SlowlogThreshold.String(),
+		"entries":   slowlog.latest(limit),
+	})
+}
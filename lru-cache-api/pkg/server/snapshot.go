@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// snapshotMagic prefixes encrypted snapshot files so plaintext ones can still be read
+var snapshotMagic = []byte("LRUENC1\n")
+
+// saveSnapshot writes the cache to path, sealed with AES-GCM when a key is given
+func saveSnapshot(c *lru.LRUCache, path string, key []byte) (err error) {
+	_, span := tracer.Start(context.Background(), "snapshot.save")
+	defer func() { endSpan(span, err) }()
+	defer func(start time.Time) { observeLatency("snapshot_save", time.Since(start)) }(time.Now())
+
+	items, err := sealItems(c.Snapshot())
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return writeSnapshotFile(path, data, key)
+}
+
+// writeSnapshotFile replaces path with data, the JSON of the sealed items,
+// encrypting it when a key is given
+func writeSnapshotFile(path string, data, key []byte) (err error) {
+	if key != nil {
+		if data, err = encryptSnapshot(key, data, snapshotMagic); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadSnapshot reads a snapshot written by saveSnapshot into the cache
+func loadSnapshot(c *lru.LRUCache, path string, key []byte) error {
+	data, err := readSnapshotFile(path, key)
+	if err != nil {
+		return err
+	}
+
+	var items []lru.CacheItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	if err := openItems(items); err != nil {
+		return err
+	}
+	c.Restore(items)
+	return nil
+}
+
+// readSnapshotFile returns the JSON of the sealed items in the snapshot at
+// path, decrypted with key
+func readSnapshotFile(path string, key []byte) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, snapshotMagic) {
+		if key == nil {
+			return nil, errors.New("snapshot is encrypted but no key is configured")
+		}
+		return decryptSnapshot(key, data, snapshotMagic)
+	} else if key != nil {
+		return nil, errors.New("refusing to load plaintext snapshot while encryption is enabled")
+	}
+	return data, nil
+}
+
+// snapshotLoop :: periodically persists the cache; awaitShutdown saves it
+// once more on the way out
+func snapshotLoop(c *lru.LRUCache, cfg *Config) {
+	ticker := time.NewTicker(cfg.SnapshotInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := saveSnapshot(c, cfg.SnapshotPath, cfg.SnapshotKey); err != nil {
+			slog.Error("snapshot: saving", "err", err)
+		}
+	}
+}
+
+// encryptSnapshot encrypts data as magic || nonce || ciphertext, binding it
+// to ad: the magic for snapshot files, the item key for sealed values
+func encryptSnapshot(key, data, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, snapshotMagic...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, data, ad), nil
+}
+
+// decryptSnapshot reverses encryptSnapshot, failing if the data was tampered with or the key is wrong
+func decryptSnapshot(key, data, ad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		return nil, errors.New("snapshot is not encrypted")
+	}
+	data = data[len(snapshotMagic):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("snapshot is truncated")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plain, err := gcm.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting snapshot: %w", err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadSnapshotKey reads the base64 encoded AES key from CACHE_SNAPSHOT_KEY or,
+// for keys provisioned by a KMS or secrets agent, from CACHE_SNAPSHOT_KEY_FILE
+func loadSnapshotKey() ([]byte, error) {
+	encoded := envString("CACHE_SNAPSHOT_KEY", "")
+	if path := envString("CACHE_SNAPSHOT_KEY_FILE", ""); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	return parseAESKey("snapshot key", encoded)
+}
+
+// parseAESKey decodes a base64 encoded AES-128, 192 or 256 key
+func parseAESKey(name, encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s must be 16, 24 or 32 bytes, got %d", name, len(key))
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// CacheStats is the cache counters as GET /stats serves them
+type CacheStats struct {
+	lru.Stats
+	HeapBytes uint64 `json:"heapBytes"` // heap in use by the whole process
+
+	Maintenance *Maintenance      `json:"maintenance,omitempty"` // /stats only: set while writes are refused
+	Memory      *MemoryPressure   `json:"memory,omitempty"`      // /stats only: set under CACHE_MEMORY_LIMIT
+	WriteBehind *WriteBehindStats `json:"writeBehind,omitempty"` // /stats only: set when a writer writes behind
+
+	Breakers map[string]BreakerStats `json:"breakers,omitempty"` // /stats only: the remotes called so far
+}
+
+// statsOf :: returns the counters of c with the process heap in use
+func statsOf(c lru.Cache) CacheStats {
+	stats := CacheStats{Stats: c.Stats()}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.HeapBytes = mem.HeapInuse
+	return stats
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	stats := statsOf(cache)
+	stats.Maintenance = maintenance.Load()
+	stats.Memory = memoryPressure()
+	if writeBehind != nil {
+		stats.WriteBehind = writeBehind.stats()
+	}
+	stats.Breakers = breakerStats()
+	json.NewEncoder(w).Encode(stats)
+}
+
+// nodeStats is one node's entry in GET /cluster/stats
+type nodeStats struct {
+	Stats *CacheStats `json:"stats,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// clusterStatsHandler collects GET /stats from every node and adds them up
+func clusterStatsHandler(w http.ResponseWriter, r *http.Request) {
+	nodes := clusterNodes()
+	results := make(map[string]nodeStats, len(nodes))
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node Node) {
+			defer wg.Done()
+			var result nodeStats
+			if node.ID == config.Node.ID {
+				stats := statsOf(cache)
+				result.Stats = &stats
+			} else if stats, err := fetchNodeStats(node); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Stats = stats
+			}
+			mutex.Lock()
+			results[node.ID] = result
+			mutex.Unlock()
+		}(node)
+	}
+	wg.Wait()
+
+	var totals CacheStats
+	for _, result := range results {
+		if result.Stats == nil {
+			continue
+		}
+		totals.Items += result.Stats.Items
+		totals.Capacity += result.Stats.Capacity
+		totals.Hits += result.Stats.Hits
+		totals.Misses += result.Stats.Misses
+		totals.Evictions += result.Stats.Evictions
+		totals.Expirations += result.Stats.Expirations
+		totals.MemoryBytes += result.Stats.MemoryBytes
+		totals.CompressedItems += result.Stats.CompressedItems
+		totals.CompressedBytes += result.Stats.CompressedBytes
+		totals.UncompressedBytes += result.Stats.UncompressedBytes
+		totals.HeapBytes += result.Stats.HeapBytes
+	}
+	if total := totals.Hits + totals.Misses; total > 0 {
+		totals.HitRatio = float64(totals.Hits) / float64(total)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nodes":  results,
+		"totals": totals,
+	})
+}
+
+var statsClient = &http.Client{Timeout: 2 * time.Second, Transport: clusterTransport{}}
+
+func fetchNodeStats(node Node) (*CacheStats, error) {
+	resp, err := statsClient.Get(node.Addr + "/stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("stats returned %s", resp.Status)
+	}
+	var stats CacheStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// subscribed reports whether the client wants events for key
+func (c *wsClient) subscribed(key string) bool {
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+
+	return c.patterns == nil || matchAny(c.patterns, key)
+}
+
+// canSee reports whether the ACLs let the client read key
+func (c *wsClient) canSee(key string) bool {
+	return allowed(c.principal, key, ScopeRead)
+}
+
+// wants reports whether the client may see update and wants it, by key and
+// event type
+func (c *wsClient) wants(update CacheUpdate) bool {
+	if update.Cache != c.cacheName || !c.subscribed(update.Key) || !c.canSee(update.Key) {
+		return false
+	}
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+	return c.types == nil || c.types[update.Type]
+}
+
+// filterTypes limits the events the client gets to types, all when nil
+func (c *wsClient) filterTypes(types map[string]bool) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+	c.types = types
+}
+
+func (c *wsClient) eventTypes() []string {
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+	var types []string
+	for t := range c.types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// matchAny reports whether key matches one of patterns
+func matchAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribe adds patterns, returning the ones that are new
+func (c *wsClient) subscribe(patterns []string) []string {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	var added []string
+	for _, pattern := range patterns {
+		if !containsString(c.patterns, pattern) {
+			c.patterns = append(c.patterns, pattern)
+			added = append(added, pattern)
+		}
+	}
+	if c.patterns == nil {
+		c.patterns = []string{}
+	}
+	return added
+}
+
+// unsubscribe removes patterns; a client left with none receives nothing
+// until it subscribes again
+func (c *wsClient) unsubscribe(patterns []string) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+
+	kept := []string{}
+	for _, pattern := range c.patterns {
+		if !containsString(patterns, pattern) {
+			kept = append(kept, pattern)
+		}
+	}
+	c.patterns = kept
+}
+
+func (c *wsClient) subscriptions() []string {
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+	return append([]string{}, c.patterns...)
+}
+
+// follows reports whether the client follows channel
+func (c *wsClient) follows(channel string) bool {
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+	return matchAny(c.channels, channel)
+}
+
+// followChannels adds channel patterns
+func (c *wsClient) followChannels(patterns []string) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+	for _, pattern := range patterns {
+		if !containsString(c.channels, pattern) {
+			c.channels = append(c.channels, pattern)
+		}
+	}
+}
+
+// unfollowChannels removes channel patterns
+func (c *wsClient) unfollowChannels(patterns []string) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+	var kept []string
+	for _, pattern := range c.channels {
+		if !containsString(patterns, pattern) {
+			kept = append(kept, pattern)
+		}
+	}
+	c.channels = kept
+}
+
+func (c *wsClient) followedChannels() []string {
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+	return append([]string{}, c.channels...)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribeMessage is what clients send to choose the keys they get events
+// for: shell style key patterns, and namespaces, short for "namespace:*".
+// Types, when given, replaces the event types the client gets. Channels are
+// patterns of the channels whose messages the client gets
+type subscribeMessage struct {
+	Type       string   `json:"type"` // subscribe or unsubscribe
+	Keys       []string `json:"keys"`
+	Namespaces []string `json:"namespaces"`
+	Types      []string `json:"types"`
+	Channels   []string `json:"channels"`
+}
+
+// patterns returns the key patterns m asks for, or an error naming a bad one
+func (m subscribeMessage) patterns() ([]string, error) {
+	patterns := append([]string{}, m.Keys...)
+	for _, namespace := range m.Namespaces {
+		patterns = append(patterns, namespace+":*")
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return patterns, nil
+}
+
+// subscriptionReply confirms a subscribe or unsubscribe message
+type subscriptionReply struct {
+	Type     string   `json:"type"` // subscribed, unsubscribed or error
+	Patterns []string `json:"patterns,omitempty"`
+	Types    []string `json:"types,omitempty"` // all when empty
+	Channels []string `json:"channels,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// queryPatterns reads ?subscribe=users:*,orders:* from a /ws URL, so clients
+// can subscribe before the initial state is sent
+func queryPatterns(query string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(query, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// currentItems returns the live items the client may see and subscribed
+// to, matching patterns only when they are given
+func currentItems(client *wsClient, patterns []string) []CacheUpdate {
+	var updates []CacheUpdate
+	client.store.Range(func(item lru.CacheItem) bool {
+		if !client.subscribed(item.Key) || !client.canSee(item.Key) || (patterns != nil && !matchAny(patterns, item.Key)) {
+			return true
+		}
+		updates = append(updates, CacheUpdate{
+			Type:      EventSet,
+			Cache:     client.cacheName,
+			Key:       item.Key,
+			Value:     redact(client.principal, item.Key, item.Value),
+			ExpiresAt: item.ExpiresAt,
+		})
+		return true
+	})
+	return updates
+}
+
+// handleClientMessage acts on a message from a WebSocket client
+func handleClientMessage(client *wsClient, messageType int, data []byte) {
+	var msg subscribeMessage
+	if err := decodeClientMessage(messageType, data, &msg); err != nil {
+		client.send(subscriptionReply{Type: "error", Error: "invalid message: " + err.Error()})
+		return
+	}
+	if msg.Type == "set" || msg.Type == "delete" || msg.Type == "publish" {
+		var op opMessage
+		if err := decodeClientMessage(messageType, data, &op); err != nil {
+			client.send(opReply{Type: "error", ID: op.ID, Status: http.StatusBadRequest, Error: "invalid message: " + err.Error()})
+			return
+		}
+		handleOp(client, op)
+		return
+	}
+	patterns, err := msg.patterns()
+	if err != nil {
+		client.send(subscriptionReply{Type: "error", Error: "invalid pattern: " + err.Error()})
+		return
+	}
+	types, err := parseEventTypes(msg.Types)
+	if err != nil {
+		client.send(subscriptionReply{Type: "error", Error: err.Error()})
+		return
+	}
+	if err := validatePatterns(msg.Channels); err != nil {
+		client.send(subscriptionReply{Type: "error", Error: err.Error()})
+		return
+	}
+
+	switch msg.Type {
+	case "subscribe":
+		var added []string
+		if len(patterns) > 0 {
+			added = client.subscribe(patterns)
+		}
+		if types != nil {
+			client.filterTypes(types)
+		}
+		client.followChannels(msg.Channels)
+		client.send(subscriptionReply{Type: "subscribed", Patterns: client.subscriptions(), Types: client.eventTypes(), Channels: client.followedChannels()})
+		if len(added) > 0 {
+			// Catch the client up on the keys it just started following
+			client.sendUpdates(currentItems(client, added))
+		}
+	case "unsubscribe":
+		if len(patterns) > 0 || len(msg.Channels) == 0 {
+			client.unsubscribe(patterns)
+		}
+		client.unfollowChannels(msg.Channels)
+		client.send(subscriptionReply{Type: "unsubscribed", Patterns: client.subscriptions(), Types: client.eventTypes(), Channels: client.followedChannels()})
+	default:
+		client.send(subscriptionReply{Type: "error", Error: "unknown message type " + msg.Type})
+	}
+}
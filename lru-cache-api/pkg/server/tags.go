@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Keys set with "tags", such as the pages or products they were built from,
+// can be removed together by tag through POST /invalidate. The index lives
+// beside the default cache on every node applying writes, replicas getting
+// the tags with set events. A set replaces a key's tags; every other write
+// that rewrites its value, such as a raw set, a data type op, a script or a
+// fill, drops them, as does its removal
+
+// maxTags is how many tags one key may carry
+const maxTags = 32
+
+// tagIndex :: the keys carrying each tag and the tags of each key
+type tagIndex struct {
+	mutex sync.Mutex
+	keys  map[string]map[string]struct{} // by tag
+	tags  map[string][]string            // by key
+}
+
+var keyTags = &tagIndex{keys: make(map[string]map[string]struct{}), tags: make(map[string][]string)}
+
+// validateTags checks the tags given with a set
+func validateTags(tags []string) error {
+	if len(tags) > maxTags {
+		return errors.New("too many tags, at most 32")
+	}
+	for _, tag := range tags {
+		if tag == "" {
+			return errors.New("tags must not be empty")
+		}
+	}
+	return nil
+}
+
+// set gives key tags in place of those it had
+func (t *tagIndex) set(key string, tags []string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.untag(key)
+	if len(tags) == 0 {
+		return
+	}
+	for _, tag := range tags {
+		keys, ok := t.keys[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			t.keys[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	t.tags[key] = tags
+}
+
+// remove drops the tags of a key no longer cached
+func (t *tagIndex) remove(key string) {
+	t.mutex.Lock()
+	t.untag(key)
+	t.mutex.Unlock()
+}
+
+func (t *tagIndex) untag(key string) {
+	for _, tag := range t.tags[key] {
+		delete(t.keys[tag], key)
+		if len(t.keys[tag]) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+	delete(t.tags, key)
+}
+
+// reset drops every tag, after a flush
+func (t *tagIndex) reset() {
+	t.mutex.Lock()
+	t.keys = make(map[string]map[string]struct{})
+	t.tags = make(map[string][]string)
+	t.mutex.Unlock()
+}
+
+// tagged returns the keys carrying tag, sorted
+func (t *tagIndex) tagged(tag string) []string {
+	t.mutex.Lock()
+	keys := make([]string, 0, len(t.keys[tag]))
+	for key := range t.keys[tag] {
+		keys = append(keys, key)
+	}
+	t.mutex.Unlock()
+	sort.Strings(keys)
+	return keys
+}
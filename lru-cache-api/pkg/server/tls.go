@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client certificate policies for mutual TLS
+const (
+	ClientAuthRequire = "require" // every client must present a certificate signed by the CA
+	ClientAuthVerify  = "verify"  // certificates are verified when presented, but optional
+)
+
+// certReloader serves the configured certificate and client CA, picking up
+// new files (e.g. renewed by cert-manager) without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mutex     sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+}
+
+var (
+	tlsCerts *certReloader // nil when TLS is off
+
+	// peerTransport is rebuilt whenever the certificates change, so calls to
+	// other nodes present the current client certificate and trust the current CA
+	peerTransport atomic.Pointer[http.Transport]
+)
+
+// setupTLS :: loads the certificates when TLS is configured; newHandler
+// starts watching them for changes once nothing else can fail
+func setupTLS(cfg *Config) error {
+	peerTransport.Store(http.DefaultTransport.(*http.Transport))
+	tlsCerts = nil
+	if cfg.TLSCert == "" {
+		return nil
+	}
+
+	certs := &certReloader{certFile: cfg.TLSCert, keyFile: cfg.TLSKey, caFile: cfg.TLSClientCA}
+	if err := certs.load(); err != nil {
+		return err
+	}
+	tlsCerts = certs
+	return nil
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no certificates found", c.caFile)
+		}
+	}
+
+	c.mutex.Lock()
+	c.cert = &cert
+	c.clientCAs = pool
+	c.modTime = c.latestModTime()
+	c.mutex.Unlock()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = c.clientConfig()
+	if old := peerTransport.Swap(transport); old != nil && old != http.DefaultTransport {
+		old.CloseIdleConnections()
+	}
+	return nil
+}
+
+func (c *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile, c.caFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// watch reloads the files whenever one of them changes
+func (c *certReloader) watch() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mutex.RLock()
+		changed := c.latestModTime().After(c.modTime)
+		c.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.load(); err != nil {
+			slog.Error("tls: reloading certificates, keeping the previous ones", "err", err)
+			continue
+		}
+		slog.Info("tls: reloaded certificates", "path", c.certFile)
+	}
+}
+
+// serverConfig :: the TLS settings for a listener; HTTP, WebSocket and any
+// other listener share it so they all follow certificate reloads
+func (c *certReloader) serverConfig(clientAuth string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if c.clientCAs != nil {
+				config.ClientCAs = c.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				if clientAuth == ClientAuthVerify {
+					config.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// clientConfig :: the TLS settings for calls to other nodes: our certificate
+// as the client certificate, and the client CA to verify them, since the
+// nodes of a cluster share one
+func (c *certReloader) clientConfig() *tls.Config {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	cert := c.cert
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    c.clientCAs,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return cert, nil
+		},
+	}
+}
+
+// nodeTransport sends requests to other nodes with the current TLS settings,
+// the trace context and the id of the request being served
+type nodeTransport struct{}
+
+func (nodeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if id := requestID(r.Context()); id != "" && r.Header.Get(requestIDHeader) == "" {
+		r = r.Clone(r.Context())
+		r.Header.Set(requestIDHeader, id)
+	}
+	return tracedTransport(peerTransport.Load()).RoundTrip(r)
+}
+
+// clusterDialer returns the dialer for other nodes' WebSockets
+func clusterDialer() *websocket.Dialer {
+	if tlsCerts == nil {
+		return websocket.DefaultDialer
+	}
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  tlsCerts.clientConfig(),
+	}
+}
+
+// listenAndServe :: serves handler over TLS when it is configured, plain HTTP otherwise
+func listenAndServe(addr string, handler http.Handler) error {
+	server := &http.Server{Addr: addr, Handler: handler}
+	if tlsCerts == nil {
+		slog.Info("server starting", "url", "http://localhost"+addr)
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = tlsCerts.serverConfig(config.TLSClientAuth)
+	slog.Info("server starting", "url", "https://localhost"+addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+func validateTLSConfig(cfg *Config) error {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("CACHE_TLS_CERT and CACHE_TLS_KEY must be set together")
+	}
+	if cfg.TLSClientCA != "" && cfg.TLSCert == "" {
+		return errors.New("CACHE_TLS_CLIENT_CA requires CACHE_TLS_CERT")
+	}
+	switch cfg.TLSClientAuth {
+	case ClientAuthRequire, ClientAuthVerify:
+	default:
+		return fmt.Errorf("unknown CACHE_TLS_CLIENT_AUTH %q", cfg.TLSClientAuth)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+)
+
+// POST /cache/{key}/touch reads a key and resets its expiry in one step,
+// for sliding expiry such as sessions kept alive while they are used.
+// Reading and setting again would race with writers, undoing their changes
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"touch": {fn: touch, renew: true, same: true},
+	})
+}
+
+// touch :: answers the value, keeping it
+func touch(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	if value == nil {
+		return nil, nil, lru.ErrNotFound
+	}
+	return value, value, nil
+}
+
+// registerTouchRoutes :: mounts /cache/{key}/touch
+func registerTouchRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/touch", typeWrite(touchHandler)).Methods("POST")
+}
+
+// touchHandler serves POST /cache/{key}/touch: {"expiration": 1800} makes
+// the key expire that many seconds from now, or CACHE_DEFAULT_TTL, and
+// answers its value as GET /cache/{key} does
+func touchHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	if data.ttl() <= 0 {
+		http.Error(w, "expiration must be positive", http.StatusBadRequest)
+		return
+	}
+	value, err := runTypeOp(r, key, typeOp{Name: "touch"}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"key": key, "value": value})
+}
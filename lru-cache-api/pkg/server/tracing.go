@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates our spans; until setupTracing installs a provider it is a no-op
+var tracer = otel.Tracer("lru-cache-api")
+
+// traceProvider is the provider setupTracing installed, nil without
+// CACHE_OTLP_ENDPOINT
+var traceProvider *sdktrace.TracerProvider
+
+// setupTracing :: exports spans over OTLP/HTTP when CACHE_OTLP_ENDPOINT is
+// set. Incoming W3C trace context is honoured either way, so our spans join
+// the caller's trace
+func setupTracing(cfg *Config) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.OTLPEndpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(cfg.ServiceName),
+			semconv.ServiceInstanceID(cfg.Node.ID),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	traceProvider = provider
+	return nil
+}
+
+// stopTracing exports the spans still buffered and stops the exporter
+func stopTracing() {
+	if traceProvider != nil {
+		traceProvider.Shutdown(context.Background())
+		traceProvider = nil
+	}
+}
+
+// tracingMiddleware starts a server span per request, named after the route
+// it matches
+func tracingMiddleware(router *mux.Router, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + routeTemplate(router, r)
+		}),
+	)
+}
+
+// startSpan :: starts a span for a cache operation on key
+func startSpan(ctx context.Context, name, key string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attribute.String("cache.key", key)))
+}
+
+// endSpan records err, if any, and ends span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedTransport passes the trace context on to other servers and the origin
+func tracedTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+)
+
+var (
+	// errWrongType is returned by ops on a key holding another kind of value
+	errWrongType error = &conflictError{"Key holds a value of another type"}
+	// errFieldNotFound is returned by ops reading a field the value lacks
+	errFieldNotFound = errors.New("Field not found")
+	// errMemberNotFound is returned by ops reading a member the value lacks
+	errMemberNotFound = errors.New("Member not found")
+	// errPathNotFound is returned by ops on a JSON path the value lacks
+	errPathNotFound = errors.New("Path not found")
+)
+
+// noChange is the new value of ops leaving the key as it was, which are not
+// published
+var noChange interface{} = struct{ noChange bool }{}
+
+var errNoChange = errors.New("no change")
+
+// typeOp is an operation on a structured value, such as pushing onto a list.
+// Ops run under the key's lock, and in raft cluster mode on every node from
+// the log, so they depend on nothing but the value and their args
+type typeOp struct {
+	Name string        `json:"name"`
+	Args []interface{} `json:"args,omitempty"`
+	Path string        `json:"path,omitempty"` // what the op changes, for the event
+}
+
+// typeOpFunc :: applies an op to the value of a key, nil when it is not
+// cached, returning the reply for the client and the new value, nil to
+// delete the key or noChange. It must not change value in place
+type typeOpFunc func(value interface{}, args []interface{}) (reply, newValue interface{}, err error)
+
+// typeOpDef is a registered op; reads leave the value alone and are served
+// by the node asked, and renewing ops reset the key's expiry to their ttl
+type typeOpDef struct {
+	fn    typeOpFunc
+	read  bool
+	renew bool
+	same  bool // gives back the value it was given, so the key keeps its tags
+}
+
+// typeOps holds the ops of every type by name, registered by their files
+var typeOps = map[string]typeOpDef{}
+
+func registerTypeOps(ops map[string]typeOpDef) {
+	for name, def := range ops {
+		typeOps[name] = def
+	}
+}
+
+// typeResult is what applying a write op did, for the caller to answer with
+// and pass on
+type typeResult struct {
+	Reply   interface{}
+	Update  CacheUpdate
+	Changed bool // false when the key was neither there before nor after
+}
+
+// typeRequest is the body accepted by the type endpoints; each takes the
+// fields it needs
+type typeRequest struct {
+	Values          []interface{}          `json:"values"`
+	Members         []interface{}          `json:"members"`
+	Fields          map[string]interface{} `json:"fields"`
+	Value           interface{}            `json:"value"`
+	Scores          map[string]interface{} `json:"scores"`
+	Member          string                 `json:"member"`
+	Keys            []string               `json:"keys"`
+	Op              string                 `json:"op"`
+	Path            string                 `json:"path"`
+	By              *float64               `json:"by"`
+	Side            string                 `json:"side"`
+	Count           int                    `json:"count"`
+	Delay           int                    `json:"delay"`
+	Lease           int                    `json:"lease"`
+	Receipts        []interface{}          `json:"receipts"`
+	Locations       map[string]geoPoint    `json:"locations"`
+	Expiration      int                    `json:"expiration"`      // in seconds, for keys the op creates
+	FieldExpiration int                    `json:"fieldExpiration"` // in seconds, for the hash fields the op sets
+}
+
+// ttl is how long a key the op creates lives, as for POST /cache
+func (r typeRequest) ttl() time.Duration {
+	return setRequest{Expiration: r.Expiration}.ttl()
+}
+
+// readTypeRequest decodes the body, answering the request when it cannot
+func readTypeRequest(w http.ResponseWriter, r *http.Request) (typeRequest, bool) {
+	var data typeRequest
+	if err := readJSON(r, &data); err != nil {
+		bodyError(w, err)
+		return data, false
+	}
+	return data, true
+}
+
+// runTypeOp :: applies op to key: reads locally, writes through the raft log
+// in cluster mode and locally otherwise, publishing the change. A key the op
+// creates lives for ttl
+func runTypeOp(r *http.Request, key string, op typeOp, ttl time.Duration) (interface{}, error) {
+	def, ok := typeOps[op.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown op %q", op.Name)
+	}
+	if def.read {
+		value, err := cachedValue(key)
+		if err != nil {
+			return nil, err
+		}
+		reply, _, err := def.fn(value, op.Args)
+		return reply, err
+	}
+	if _, ok := writerFor(key); ok {
+		return nil, errWrittenThrough
+	}
+
+	requestID := requestID(r.Context())
+	var result typeResult
+	if raftCluster() {
+		cmd := raftCommand{Op: opType, Key: key, Type: &op, ExpiresAt: clock.Now().Add(ttl), RequestID: requestID}
+		response, err := applyCommandResponse(cmd)
+		if err != nil {
+			return nil, err
+		}
+		result, _ = response.(typeResult)
+	} else {
+		var err error
+		if result, err = applyTypeOp(key, op, ttl, requestID, ReasonRequest); err != nil {
+			return nil, err
+		}
+		if result.Changed {
+			publishInvalidation(key)
+		}
+	}
+	if result.Changed {
+		shipToRegions(result.Update)
+	}
+	return result.Reply, nil
+}
+
+// cachedValue returns the value of key for a read op, nil when it is not
+// cached
+func cachedValue(key string) (interface{}, error) {
+	value, err := cache.Get(key)
+	if err != nil && !errors.Is(err, lru.ErrNotFound) && !errors.Is(err, lru.ErrExpired) {
+		return nil, err
+	}
+	return value, nil
+}
+
+// applyTypeOp :: applies a write op to the cache and publishes the change
+func applyTypeOp(key string, op typeOp, ttl time.Duration, requestID, reason string) (typeResult, error) {
+	def, ok := typeOps[op.Name]
+	if !ok || def.read {
+		return typeResult{}, fmt.Errorf("unknown op %q", op.Name)
+	}
+	update := cache.Update
+	if def.renew {
+		update = cache.UpdateTTL
+	}
+	var result typeResult
+	item, err := update(key, ttl, func(value interface{}, found bool) (interface{}, error) {
+		reply, newValue, err := def.fn(value, op.Args)
+		if err == nil {
+			if invalid := validateValue(newValue); invalid != nil {
+				err = argError("%v", invalid)
+			}
+		}
+		result.Reply = reply
+		if err == nil && newValue == noChange {
+			return nil, errNoChange
+		}
+		result.Changed = found || newValue != nil
+		return newValue, err
+	})
+	if errors.Is(err, errNoChange) {
+		return result, nil
+	}
+	if err != nil || !result.Changed {
+		return result, err
+	}
+	if item.Key == "" || !def.same {
+		keyTags.remove(key)
+	}
+	if item.Key == "" {
+		result.Update = removal(key, EventDelete, reason, requestID)
+	} else {
+		result.Update = CacheUpdate{Type: EventSet, Reason: reason, Key: key, Value: item.Value, ExpiresAt: item.ExpiresAt, RequestID: requestID}
+	}
+	result.Update.Path = op.Path
+	publish(result.Update)
+	return result, nil
+}
+
+// typeOpError answers a failed op: 409 for values the op cannot take, such
+// as keys of another type, 400 for bad arguments, 404 for missing fields, as
+// cacheError does for the rest
+func typeOpError(w http.ResponseWriter, err error) {
+	var argErr *typeArgError
+	var conflict *conflictError
+	switch {
+	case errors.As(err, &conflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &argErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errFieldNotFound), errors.Is(err, errMemberNotFound), errors.Is(err, errPathNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, raft.ErrNotLeader), errors.Is(err, raft.ErrLeadershipLost):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		cacheError(w, err)
+	}
+}
+
+// typeArgError is an op given arguments it cannot use
+type typeArgError struct{ message string }
+
+func (e *typeArgError) Error() string { return e.message }
+
+func argError(format string, args ...interface{}) error {
+	return &typeArgError{fmt.Sprintf(format, args...)}
+}
+
+// conflictError is an op the value it finds cannot take
+type conflictError struct{ message string }
+
+func (e *conflictError) Error() string { return e.message }
+
+// argInt returns args[i] as an int; numbers come back from JSON as float64
+func argInt(args []interface{}, i int) (int, error) {
+	if i < len(args) {
+		switch n := args[i].(type) {
+		case int:
+			return n, nil
+		case int64:
+			return int(n), nil
+		case float64:
+			if n == float64(int(n)) {
+				return int(n), nil
+			}
+		}
+	}
+	return 0, argError("argument %d must be an integer", i+1)
+}
+
+// argFloat returns args[i] as a float64
+func argFloat(args []interface{}, i int) (float64, error) {
+	if i < len(args) {
+		switch n := args[i].(type) {
+		case int:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	}
+	return 0, argError("argument %d must be a number", i+1)
+}
+
+// asBytes returns the bytes held by a key as {tag: "<base64>"}, nil when it
+// is not cached; binary types are stored so, as values must be JSON
+func asBytes(value interface{}, tag string) ([]byte, error) {
+	if value == nil {
+		return nil, nil
+	}
+	wrapped, ok := value.(map[string]interface{})
+	if !ok || len(wrapped) != 1 {
+		return nil, errWrongType
+	}
+	encoded, ok := wrapped[tag].(string)
+	if !ok {
+		return nil, errWrongType
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errWrongType
+	}
+	return b, nil
+}
+
+// bytesValue returns b as the value asBytes reads
+func bytesValue(b []byte, tag string) map[string]interface{} {
+	return map[string]interface{}{tag: base64.StdEncoding.EncodeToString(b)}
+}
+
+// sourceArgs reads the keys an op combines into its own, which runs on that
+// key alone, for the op to take as args: each key's value under tag, checked
+// by check, or nil when the key is not cached. It answers the request when
+// the caller may not read a key or it holds another type
+func sourceArgs(w http.ResponseWriter, r *http.Request, keys []string, tag string, check func(interface{}) error) ([]interface{}, bool) {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if !canAccess(r.Context(), key, ScopeRead) {
+			http.Error(w, fmt.Sprintf("Not allowed to %s %q", ScopeRead, key), http.StatusForbidden)
+			return nil, false
+		}
+		value, err := cachedValue(key)
+		if err == nil && value != nil {
+			err = check(value)
+		}
+		if err != nil {
+			typeOpError(w, fmt.Errorf("%w: %q", err, key))
+			return nil, false
+		}
+		if value != nil {
+			args[i] = value.(map[string]interface{})[tag]
+		}
+	}
+	return args, true
+}
+
+// writeTypeReply answers a successful op
+func writeTypeReply(w http.ResponseWriter, key string, reply map[string]interface{}) {
+	reply["key"] = key
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, reply)
+}
+
+// registerTypeRoutes :: mounts the endpoints of the structured types under
+// /cache/{key}; writes go to the node taking them, as for POST /cache
+func registerTypeRoutes(r *mux.Router) {
+	registerListRoutes(r)
+	registerSetRoutes(r)
+	registerHashRoutes(r)
+	registerZSetRoutes(r)
+	registerHLLRoutes(r)
+	registerBitmapRoutes(r)
+	registerJSONRoutes(r)
+	registerQueueRoutes(r)
+	registerGeoSetRoutes(r)
+	registerTouchRoutes(r)
+}
+
+// typeWrite routes an op changing a value to the node taking writes
+func typeWrite(h http.HandlerFunc) http.Handler {
+	h = writableKey(h)
+	if raftCluster() {
+		return rejectWhileDraining(raftLeaderOnly(h))
+	}
+	return rejectWhileDraining(primaryWrite(h))
+}
+
+// writableKey refuses ops on keys clients may not write
+func writableKey(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := validateWriteKey(mux.Vars(r)["key"]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// raftLeaderOnly passes requests to the raft leader unless we are it
+func raftLeaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if raftNode.State() != raft.Leader {
+			forwardToLeader(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
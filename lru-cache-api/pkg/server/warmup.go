@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"lru-cache-api/pkg/lru"
+)
+
+// warmupProgressEvery is how many items go by between progress logs
+const warmupProgressEvery = 10000
+
+// warmup tracks loading CACHE_WARMUP_SOURCE; /readyz fails until it is done
+var warmup struct {
+	source string
+	done   atomic.Bool
+	total  atomic.Int64 // items received, 0 while still fetching
+	loaded atomic.Int64
+}
+
+// startWarmup :: fills the cache from CACHE_WARMUP_SOURCE in the
+// background, holding /readyz back until it is done
+func startWarmup(cfg *Config) {
+	warmup.source = cfg.WarmupSource
+	if u, err := url.Parse(cfg.WarmupSource); err == nil && u.User != nil {
+		warmup.source = u.Redacted()
+	}
+	addReadinessCheck("warmup", func() error {
+		if warmup.done.Load() {
+			return nil
+		}
+		if total := warmup.total.Load(); total > 0 {
+			return fmt.Errorf("warming up, loaded %d of %d items from %s", warmup.loaded.Load(), total, warmup.source)
+		}
+		return fmt.Errorf("warming up, fetching items from %s", warmup.source)
+	})
+
+	go func() {
+		defer warmup.done.Store(true)
+		start := time.Now()
+		slog.Info("warmup: fetching items", "source", warmup.source)
+		items, err := fetchWarmupItems(cfg)
+		if err != nil {
+			// A cold cache is better than a node that never becomes ready
+			slog.Error("warmup: failed, starting cold", "source", warmup.source, "err", err)
+			return
+		}
+		warmup.total.Store(int64(len(items)))
+		set := warmUp(items)
+		slog.Info("warmup: done", "source", warmup.source, "received", len(items), "set", set, "took", time.Since(start))
+	}()
+}
+
+// fetchWarmupItems reads the items of an export: from another instance's
+// GET /admin/cache/export when the source is its address, from the URL when
+// it has a path, and from the file otherwise, which may also be a snapshot
+func fetchWarmupItems(cfg *Config) ([]lru.CacheItem, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(cfg.WarmupSource, "http://") || strings.HasPrefix(cfg.WarmupSource, "https://") {
+		data, err = fetchWarmupURL(cfg)
+	} else {
+		data, err = readSnapshotFile(cfg.WarmupSource, cfg.SnapshotKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var items []lru.CacheItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	if err := openItems(items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func fetchWarmupURL(cfg *Config) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.WarmupTimeout)
+	defer cancel()
+
+	target, client := cfg.WarmupSource, http.DefaultClient
+	if u, err := url.Parse(target); err == nil && strings.Trim(u.Path, "/") == "" {
+		// Another instance, which knows the cluster key
+		target = strings.TrimRight(target, "/") + "/admin/cache/export"
+		client = &http.Client{Transport: clusterTransport{}}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("source returned %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// warmUp sets the items that have not expired and are not in the cache
+// already, having been written since the server started, and returns how
+// many it set
+func warmUp(items []lru.CacheItem) int {
+	set := 0
+	for i, item := range items {
+		if i > 0 && i%warmupProgressEvery == 0 {
+			slog.Info("warmup: loading", "loaded", i, "total", len(items))
+		}
+		warmup.loaded.Store(int64(i + 1))
+		if clock.Now().After(item.ExpiresAt) || validateKey(item.Key) != nil || validateValue(item.Value) != nil || cache.Add(item.Key, item.Value, item.ExpiresAt.Sub(clock.Now())) != nil {
+			continue
+		}
+		publish(CacheUpdate{Type: EventSet, Reason: ReasonWarmup, Key: item.Key, Value: item.Value, ExpiresAt: item.ExpiresAt})
+		set++
+	}
+	return set
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// POST /invalidate lets systems outside the cluster, such as a CMS when a
+// page is published or a CI pipeline after a deploy, purge what they
+// changed as soon as they change it. They sign the request with
+// CACHE_INVALIDATION_SECRET rather than holding an API key: X-Cache-Timestamp
+// is the time of sending in Unix seconds and X-Cache-Signature is
+// "sha256=" and the hex HMAC-SHA256 of the timestamp, a dot and the body.
+// Requests more than webhookTolerance old or ahead are refused, so a
+// captured one cannot be replayed later
+
+const (
+	webhookTolerance       = 5 * time.Minute
+	webhookSignatureHeader = "X-Cache-Signature"
+	webhookTimestampHeader = "X-Cache-Timestamp"
+)
+
+// webhookRequest is the body of POST /invalidate: the keys to remove, given
+// outright, by prefix or by the tags they were set with
+type webhookRequest struct {
+	Keys     []string `json:"keys"`
+	Prefixes []string `json:"prefixes"`
+	Tags     []string `json:"tags"`
+}
+
+// webhookSignature returns the X-Cache-Signature of body sent at timestamp
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhook checks the signature and age of a request with body
+func verifyWebhook(r *http.Request, body []byte) error {
+	timestamp := r.Header.Get(webhookTimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid " + webhookTimestampHeader)
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return errors.New("request timestamp outside the allowed window")
+	}
+	want := webhookSignature(config.InvalidationSecret, timestamp, body)
+	if !hmac.Equal([]byte(r.Header.Get(webhookSignatureHeader)), []byte(want)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// webhookHandler serves POST /invalidate, answering with how many keys were
+// invalidated
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		bodyError(w, err)
+		return
+	}
+	if err := verifyWebhook(r, body); err != nil {
+		loggerFrom(r.Context()).Warn("webhook: rejected", "client_ip", clientIP(r), "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var data webhookRequest
+	if err := jsonCodec.Unmarshal(body, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data.Keys)+len(data.Prefixes)+len(data.Tags) == 0 {
+		http.Error(w, "give keys, prefixes or tags to invalidate", http.StatusBadRequest)
+		return
+	}
+	for _, prefix := range data.Prefixes {
+		if prefix == "" {
+			http.Error(w, "prefixes must not be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	invalidated, err := removeKeys(webhookKeys(data), EventDelete, ReasonWebhook, requestID(r.Context()))
+	if err != nil {
+		loggerFrom(r.Context()).Error("webhook: invalidation failed", "invalidated", invalidated, "err", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	loggerFrom(r.Context()).Info("webhook: invalidated", "keys", len(data.Keys), "prefixes", len(data.Prefixes), "tags", len(data.Tags), "invalidated", invalidated)
+	writeJSON(w, map[string]int{"invalidated": invalidated})
+}
+
+// webhookKeys returns the keys data names, those given by prefix or tag
+// as cached now, each once and sorted
+func webhookKeys(data webhookRequest) []string {
+	found := make(map[string]struct{})
+	for _, key := range data.Keys {
+		found[key] = struct{}{}
+	}
+	for _, prefix := range data.Prefixes {
+		for _, key := range cache.Keys(escapePattern(prefix) + "*") {
+			found[key] = struct{}{}
+		}
+	}
+	for _, tag := range data.Tags {
+		for _, key := range keyTags.tagged(tag) {
+			found[key] = struct{}{}
+		}
+	}
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapePattern quotes the characters path.Match treats specially
+func escapePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(s)
+}
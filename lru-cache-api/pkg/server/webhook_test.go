@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	saved := config
+	config = &Config{InvalidationSecret: "s3cret"}
+	t.Cleanup(func() { config = saved })
+
+	body := []byte(`{"keys":["page:home"]}`)
+	at := func(d time.Duration) string { return strconv.FormatInt(time.Now().Add(d).Unix(), 10) }
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature func(timestamp string) string
+		body      []byte
+		ok        bool
+	}{
+		{"fresh", at(0), nil, body, true},
+		{"within the window", at(-webhookTolerance + time.Minute), nil, body, true},
+		{"slightly ahead", at(webhookTolerance - time.Minute), nil, body, true},
+		{"too old", at(-webhookTolerance - time.Minute), nil, body, false},
+		{"too far ahead", at(webhookTolerance + time.Minute), nil, body, false},
+		{"no timestamp", "", nil, body, false},
+		{"bad timestamp", "yesterday", nil, body, false},
+		{"other body", at(0), nil, []byte(`{"keys":["page:about"]}`), false},
+		{"other secret", at(0), func(ts string) string { return webhookSignature("guess", ts, body) }, body, false},
+		{"signed for another time", at(0), func(string) string { return webhookSignature("s3cret", at(-time.Minute), body) }, body, false},
+		{"bare hex", at(0), func(ts string) string { return strings.TrimPrefix(webhookSignature("s3cret", ts, body), "sha256=") }, body, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sign := tt.signature
+			if sign == nil {
+				sign = func(ts string) string { return webhookSignature("s3cret", ts, body) }
+			}
+			r := httptest.NewRequest("POST", "/invalidate", nil)
+			r.Header.Set(webhookTimestampHeader, tt.timestamp)
+			r.Header.Set(webhookSignatureHeader, sign(tt.timestamp))
+			if err := verifyWebhook(r, tt.body); (err == nil) != tt.ok {
+				t.Errorf("verifyWebhook = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
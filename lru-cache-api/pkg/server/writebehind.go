@@ -0,0 +1,269 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Writers marked Behind do not hold up the client: a set or delete of their
+// keys is queued and answered at once, and CACHE_WRITE_BEHIND_WORKERS
+// workers write the queue to the stores in batches of up to
+// writeBehindBatch, collected for up to writeBehindLinger. A key always goes
+// to the same worker, so its writes reach the store in order, and of
+// several writes of a key in a batch only the last is made. A store
+// implementing WriteBatcher gets each batch in one call, others a call per
+// write. A failed write is retried CACHE_WRITE_BEHIND_RETRIES times with
+// exponential backoff, then appended to CACHE_WRITE_BEHIND_DEAD_LETTER, or
+// logged, for someone to replay. When the queue is full, writes get 503
+const (
+	writeBehindBatch   = 100
+	writeBehindLinger  = 100 * time.Millisecond
+	writeBehindBackoff = 100 * time.Millisecond
+	writeBehindMaxWait = 30 * time.Second
+)
+
+// Write is a change a write-behind worker makes to a store
+type Write struct {
+	Key     string      `json:"key"`
+	Value   interface{} `json:"value,omitempty"`
+	Deleted bool        `json:"deleted,omitempty"`
+}
+
+// WriteBatcher is a WriteThrough that takes many writes at once, e.g. in one
+// transaction, failing or succeeding as a whole
+type WriteBatcher interface {
+	WriteBatch(ctx context.Context, writes []Write) error
+}
+
+// WriteBehindStats is the write-behind queue as GET /stats serves it
+type WriteBehindStats struct {
+	Queued       int    `json:"queued"`
+	Written      uint64 `json:"written"`
+	Retries      uint64 `json:"retries"`
+	DeadLettered uint64 `json:"deadLettered"`
+}
+
+// queuedWrite is a write waiting for a worker
+type queuedWrite struct {
+	Write
+	writer *Writer
+}
+
+// writeBehindQueue is the queue of the writers marked Behind
+type writeBehindQueue struct {
+	mutex  sync.RWMutex // held to send, and to close the queues
+	closed bool
+	queues []chan queuedWrite
+	stop   chan struct{} // closed on shutdown, cutting backoffs short
+	wg     sync.WaitGroup
+
+	written, retries, deadLettered atomic.Uint64
+	deadLetterMutex                sync.Mutex
+}
+
+// writeBehind is nil unless a writer is marked Behind
+var writeBehind *writeBehindQueue
+
+// startWriteBehind :: starts the workers of the write-behind queue
+func startWriteBehind(cfg *Config) {
+	q := &writeBehindQueue{
+		queues: make([]chan queuedWrite, cfg.WriteBehindWorkers),
+		stop:   make(chan struct{}),
+	}
+	for i := range q.queues {
+		q.queues[i] = make(chan queuedWrite, max(1, cfg.WriteBehindQueue/cfg.WriteBehindWorkers))
+		q.wg.Add(1)
+		go q.work(q.queues[i])
+	}
+	writeBehind = q
+}
+
+// enqueue queues a write for writer, reporting false when the queue of its
+// worker is full or closed
+func (q *writeBehindQueue) enqueue(writer *Writer, write Write) bool {
+	h := fnv.New32a()
+	h.Write([]byte(write.Key))
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.closed {
+		return false
+	}
+	select {
+	case q.queues[h.Sum32()%uint32(len(q.queues))] <- queuedWrite{write, writer}:
+		return true
+	default:
+		return false
+	}
+}
+
+// stats :: the counters and how many writes are queued
+func (q *writeBehindQueue) stats() *WriteBehindStats {
+	stats := &WriteBehindStats{
+		Written:      q.written.Load(),
+		Retries:      q.retries.Load(),
+		DeadLettered: q.deadLettered.Load(),
+	}
+	for _, queue := range q.queues {
+		stats.Queued += len(queue)
+	}
+	return stats
+}
+
+// work writes the batches of one queue until it is closed
+func (q *writeBehindQueue) work(queue chan queuedWrite) {
+	defer q.wg.Done()
+	for first := range queue {
+		batch := []queuedWrite{first}
+		linger := time.NewTimer(writeBehindLinger)
+	collect:
+		for len(batch) < writeBehindBatch {
+			select {
+			case write, ok := <-queue:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, write)
+			case <-linger.C:
+				break collect
+			}
+		}
+		linger.Stop()
+		q.flush(batch)
+	}
+}
+
+// flush writes a batch, the last write of each key, store by store
+func (q *writeBehindQueue) flush(batch []queuedWrite) {
+	last := make(map[string]int, len(batch))
+	for i, write := range batch {
+		last[write.Key] = i
+	}
+	var order []*Writer
+	byWriter := make(map[*Writer][]Write)
+	for i, write := range batch {
+		if last[write.Key] != i {
+			continue
+		}
+		if _, ok := byWriter[write.writer]; !ok {
+			order = append(order, write.writer)
+		}
+		byWriter[write.writer] = append(byWriter[write.writer], write.Write)
+	}
+	for _, writer := range order {
+		q.write(writer, byWriter[writer])
+	}
+}
+
+// write makes writes in store, retrying what fails with backoff and dead
+// lettering it when the retries run out
+func (q *writeBehindQueue) write(writer *Writer, writes []Write) {
+	for attempt := 1; ; attempt++ {
+		var done int
+		err := writer.breaker().do(func() (err error) {
+			done, err = writeTo(writer.Store, writes)
+			return err
+		})
+		q.written.Add(uint64(done))
+		writes = writes[done:]
+		if err == nil {
+			return
+		}
+		if attempt > config.WriteBehindRetries {
+			q.deadLetter(writes, err, attempt)
+			return
+		}
+		q.retries.Add(1)
+		wait := min(writeBehindBackoff<<(attempt-1), writeBehindMaxWait)
+		select {
+		case <-time.After(wait):
+		case <-q.stop:
+			q.deadLetter(writes, err, attempt)
+			return
+		}
+	}
+}
+
+// writeTo makes writes in store, returning how many were made before one
+// failed
+func writeTo(store WriteThrough, writes []Write) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fillClient.Timeout)
+	defer cancel()
+	if batcher, ok := store.(WriteBatcher); ok {
+		if err := batcher.WriteBatch(ctx, writes); err != nil {
+			return 0, err
+		}
+		return len(writes), nil
+	}
+	for i, write := range writes {
+		var err error
+		if write.Deleted {
+			err = store.Delete(ctx, write.Key)
+		} else {
+			err = store.Put(ctx, write.Key, write.Value)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(writes), nil
+}
+
+// deadLetter records writes given up on, as JSON lines in
+// CACHE_WRITE_BEHIND_DEAD_LETTER, or in the log without one
+func (q *writeBehindQueue) deadLetter(writes []Write, err error, attempts int) {
+	q.deadLettered.Add(uint64(len(writes)))
+	if config.WriteBehindDeadLetter == "" {
+		for _, write := range writes {
+			slog.Error("write-behind: giving up", "key", write.Key, "deleted", write.Deleted, "attempts", attempts, "err", err)
+		}
+		return
+	}
+
+	q.deadLetterMutex.Lock()
+	defer q.deadLetterMutex.Unlock()
+	file, openErr := os.OpenFile(config.WriteBehindDeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if openErr != nil {
+		slog.Error("write-behind: opening the dead letter file", "err", openErr, "writes", len(writes))
+		return
+	}
+	defer file.Close()
+	encoder := json.NewEncoder(file)
+	for _, write := range writes {
+		encoder.Encode(struct {
+			Write
+			Error    string    `json:"error"`
+			Attempts int       `json:"attempts"`
+			FailedAt time.Time `json:"failedAt"`
+		}{write, err.Error(), attempts, time.Now()})
+	}
+	slog.Warn("write-behind: dead lettered", "writes", len(writes), "err", err)
+}
+
+// shutdown stops taking writes and gives the workers until timeout to
+// write the queue, then has them stop retrying, dead lettering what fails
+func (q *writeBehindQueue) shutdown(timeout time.Duration) {
+	q.mutex.Lock()
+	q.closed = true
+	for _, queue := range q.queues {
+		close(queue)
+	}
+	q.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		close(q.stop)
+		<-done
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Keys matching a write-through pattern are written to their store before
+// the cache, and deleted from it before they are from the cache, so the
+// cache never holds a value the store does not: when the store fails, the
+// client gets 502 and the cache is left as it was. Only whole values are
+// written through, by sets and deletes: ops of the data types on such keys
+// are refused, and imports and flushes do not reach the store. Writers
+// marked Behind queue the write instead; see writebehind.go
+
+// WriteThrough is a store keys are written through to, such as a database
+// table the cache fronts
+type WriteThrough interface {
+	// Put stores the value of key, which decodes from JSON
+	Put(ctx context.Context, key string, value interface{}) error
+	// Delete removes key, doing nothing when the store does not have it
+	Delete(ctx context.Context, key string) error
+}
+
+// Writer writes the keys matching Pattern, a shell pattern such as
+// lookups:*, through to Store, or behind, after the client is answered,
+// when Behind is set
+type Writer struct {
+	Pattern string
+	Store   WriteThrough
+	Behind  bool
+}
+
+// writers are checked in order on a set or delete, the first matching
+// writing the key through; set up before serving and never changed after
+var writers []Writer
+
+// parseWriters :: parses writers such as "lookups:* http://db-api/{id}",
+// pattern url [behind]
+func parseWriters(specs []string) ([]Writer, error) {
+	var parsed []Writer
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "behind") {
+			return nil, fmt.Errorf("invalid write-through %q, expected pattern url [behind]", spec)
+		}
+		if err := (Loader{Pattern: fields[0], URL: fields[1]}).check(); err != nil {
+			return nil, fmt.Errorf("invalid write-through %q: %w", spec, err)
+		}
+		parsed = append(parsed, Writer{Pattern: fields[0], Store: HTTPStore{URL: fields[1]}, Behind: len(fields) == 3})
+	}
+	return parsed, nil
+}
+
+// setupWriters :: registers the writers of the embedding application, then
+// those of CACHE_WRITE_THROUGH
+func setupWriters(cfg *Config, opts Options) error {
+	writers = nil
+	for _, wr := range opts.Writers {
+		if _, err := path.Match(wr.Pattern, ""); err != nil || wr.Store == nil {
+			return fmt.Errorf("write-through %s: needs a valid pattern and a store", wr.Pattern)
+		}
+		writers = append(writers, wr)
+	}
+	writers = append(writers, cfg.Writers...)
+	return nil
+}
+
+// startWriters starts the write-behind queue if any writer writes behind
+func startWriters() {
+	writeBehind = nil
+	for _, wr := range writers {
+		if wr.Behind {
+			startWriteBehind(config)
+			break
+		}
+	}
+}
+
+// writerFor returns the writer of key, false when none matches
+func writerFor(key string) (*Writer, bool) {
+	for i := range writers {
+		if ok, _ := path.Match(writers[i].Pattern, key); ok {
+			return &writers[i], true
+		}
+	}
+	return nil, false
+}
+
+// breaker :: the breaker of the writer's store
+func (wr *Writer) breaker() *breaker {
+	return breakerFor("writer " + wr.Pattern)
+}
+
+// writeThrough :: stores key's new value, nil for a delete, in its store if
+// it has one, answering 502 and returning false when that fails. Writes
+// behind are queued, answering 503 when the queue is full
+func writeThrough(w http.ResponseWriter, r *http.Request, key string, value interface{}, deleted bool) bool {
+	writer, ok := writerFor(key)
+	if !ok {
+		return true
+	}
+	if writer.Behind {
+		if !writeBehind.enqueue(writer, Write{Key: key, Value: value, Deleted: deleted}) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Write-behind queue is full", http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	}
+	ctx, span := startSpan(r.Context(), "cache.write_through", key)
+	err := writer.breaker().do(func() error {
+		if deleted {
+			return writer.Store.Delete(ctx, key)
+		}
+		return writer.Store.Put(ctx, key, value)
+	})
+	endSpan(span, err)
+	if err != nil {
+		loggerFrom(r.Context()).Warn("write-through: store failed", "key", key, "err", err)
+		http.Error(w, "Write-through failed: "+err.Error(), http.StatusBadGateway)
+		return false
+	}
+	return true
+}
+
+// HTTPStore writes keys through to a service: PUT URL with the value as the
+// JSON body to store one, DELETE URL to remove it, where {key} in URL is
+// replaced by the key and {id} by the part after its namespace. Any status
+// but 2xx fails, except 404 for a delete
+type HTTPStore struct {
+	URL string
+}
+
+func (s HTTPStore) Put(ctx context.Context, key string, value interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.do(ctx, http.MethodPut, key, body)
+}
+
+func (s HTTPStore) Delete(ctx context.Context, key string) error {
+	return s.do(ctx, http.MethodDelete, key, nil)
+}
+
+func (s HTTPStore) do(ctx context.Context, method, key string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, originURL(s.URL, key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := fillClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 == 2 || (method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		return nil
+	}
+	return fmt.Errorf("store returned %s", resp.Status)
+}
+
+// SQLStore writes keys through to a database table, the value as JSON text,
+// for applications embedding the API with a driver of their own, e.g.
+//
+//	server.SQLStore{
+//		DB:        db,
+//		UpsertSQL: "INSERT INTO lookups (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = excluded.value",
+//		DeleteSQL: "DELETE FROM lookups WHERE key = $1",
+//	}
+//
+// UpsertSQL gets the key and the value, DeleteSQL the key
+type SQLStore struct {
+	DB        *sql.DB
+	UpsertSQL string
+	DeleteSQL string
+}
+
+func (s SQLStore) Put(ctx context.Context, key string, value interface{}) error {
+	text, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx, s.UpsertSQL, key, string(text))
+	return err
+}
+
+func (s SQLStore) Delete(ctx context.Context, key string) error {
+	_, err := s.DB.ExecContext(ctx, s.DeleteSQL, key)
+	return err
+}
+
+// WriteBatch makes the writes of a write-behind batch in one transaction
+func (s SQLStore) WriteBatch(ctx context.Context, writes []Write) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, write := range writes {
+		if write.Deleted {
+			_, err = tx.ExecContext(ctx, s.DeleteSQL, write.Key)
+		} else {
+			var text []byte
+			if text, err = json.Marshal(write.Value); err == nil {
+				_, err = tx.ExecContext(ctx, s.UpsertSQL, write.Key, string(text))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// errWrittenThrough refuses data type ops on keys written through
+var errWrittenThrough = &conflictError{"Key is written through to a store; set it whole"}
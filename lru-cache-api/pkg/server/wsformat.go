@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// wsProtocolMsgpack selects binary frames: each one is a MessagePack array
+// of messages, so a burst of updates costs one frame and no JSON encoding
+const wsProtocolMsgpack = "cache.v1.msgpack"
+
+// subprotocolHeader selects the first protocol the client offers that we
+// speak; gorilla's Upgrader would go by our order instead
+func subprotocolHeader(r *http.Request) http.Header {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if protocol == wsProtocol || protocol == wsProtocolMsgpack {
+			return http.Header{"Sec-Websocket-Protocol": {protocol}}
+		}
+	}
+	return nil
+}
+
+// maxFrameMessages bounds how many messages one binary frame carries
+const maxFrameMessages = 256
+
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.WriteExt = true // times as the MessagePack timestamp extension
+	h.RawToString = true
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil)) // values are sent on as JSON
+	return h
+}()
+
+// writeFrame sends messages, which must be a slice, as one binary frame.
+// Callers hold writeMutex
+func (c *wsClient) writeFrame(messages interface{}) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := codec.NewEncoder(buf, msgpackHandle).Encode(messages); err != nil {
+		return err
+	}
+	return c.writeMessage(websocket.BinaryMessage, buf.Bytes())
+}
+
+// writeMessage writes one frame, compressed if the client negotiated
+// permessage-deflate and it is at least CACHE_WS_COMPRESSION_MIN_SIZE bytes;
+// smaller ones cost more to deflate than they save
+func (c *wsClient) writeMessage(messageType int, data []byte) error {
+	c.conn.EnableWriteCompression(len(data) >= config.WSCompressionMinSize)
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// sendUpdates writes updates in order, batched into binary frames when the
+// client negotiated them and one JSON text frame each otherwise
+func (c *wsClient) sendUpdates(updates []CacheUpdate) error {
+	if !c.binary {
+		for _, update := range updates {
+			if err := c.send(onWire(update)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	for len(updates) > 0 {
+		n := min(len(updates), maxFrameMessages)
+		frame := make([]interface{}, n)
+		for i, update := range updates[:n] {
+			frame[i] = onWire(update)
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(config.WSWriteTimeout))
+		if err := c.writeFrame(frame); err != nil {
+			return err
+		}
+		updates = updates[n:]
+	}
+	return nil
+}
+
+// decodeClientMessage reads a message from the client, JSON in text frames
+// and MessagePack in binary ones
+func decodeClientMessage(messageType int, data []byte, v interface{}) error {
+	if messageType == websocket.BinaryMessage {
+		return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+	}
+	return json.Unmarshal(data, v)
+}
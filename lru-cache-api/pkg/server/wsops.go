@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// opMessage asks the server to change the cache, or publish Message to
+// Channel, on the client's behalf. ID is the client's own, echoed in the
+// reply
+type opMessage struct {
+	Type       string      `json:"type"` // set, delete or publish
+	ID         string      `json:"id"`
+	Key        string      `json:"key"`
+	Value      interface{} `json:"value"`
+	Expiration int         `json:"expiration"` // in seconds
+	Channel    string      `json:"channel"`
+	Message    interface{} `json:"message"`
+}
+
+// opReply answers an opMessage with what the HTTP API would have
+type opReply struct {
+	Type      string `json:"type"` // ack or error
+	ID        string `json:"id"`
+	Status    int    `json:"status"`
+	RequestID string `json:"requestId,omitempty"` // also on the change event
+	Error     string `json:"error,omitempty"`
+}
+
+// apiHandler serves the HTTP API with all its middleware. Ops from
+// WebSocket clients go through it too, so they are authorized, rate
+// limited, audited and routed to the primary like any other write
+var apiHandler http.Handler
+
+// wsCredentialHeaders are copied from the upgrade request onto the requests
+// made for a client's ops
+var wsCredentialHeaders = []string{"Authorization", apiKeyHeader, "X-Forwarded-For", "X-Real-IP"}
+
+// credentialHeader returns the credentials r was authenticated with as
+// headers, where authenticate looks first
+func credentialHeader(r *http.Request) http.Header {
+	header := http.Header{}
+	for _, name := range wsCredentialHeaders {
+		if value := r.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	token, secret := subprotocolCredentials(r)
+	if token == "" && secret == "" {
+		token, secret = r.URL.Query().Get("access_token"), r.URL.Query().Get("api_key")
+	}
+	if header.Get("Authorization") == "" && token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if header.Get(apiKeyHeader) == "" && secret != "" {
+		header.Set(apiKeyHeader, secret)
+	}
+	return header
+}
+
+// handleOp carries out a set, delete or publish sent over the socket and
+// replies with an ack or an error. The change event, or the message, may
+// arrive before or after
+func handleOp(client *wsClient, msg opMessage) {
+	name := msg.Key
+	if msg.Type == "publish" {
+		name = msg.Channel
+	}
+	if err := validateKey(name); err != nil {
+		client.send(opReply{Type: "error", ID: msg.ID, Status: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	req, err := client.opRequest(msg)
+	if err != nil {
+		client.send(opReply{Type: "error", ID: msg.ID, Status: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+
+	rec := &opRecorder{header: http.Header{}}
+	apiHandler.ServeHTTP(rec, req)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	reply := opReply{Type: "ack", ID: msg.ID, Status: rec.status, RequestID: rec.header.Get(requestIDHeader)}
+	if rec.status >= 300 {
+		reply.Type = "error"
+		reply.Error = strings.TrimSpace(rec.body.String())
+		if location := rec.header.Get("Location"); location != "" {
+			reply.Error = "Not the primary, send writes to " + location
+		} else if reply.Error == "" {
+			reply.Error = http.StatusText(rec.status)
+		}
+	}
+	client.send(reply)
+}
+
+// opRequest returns the HTTP request equivalent to msg, made with the
+// credentials the client connected with
+func (c *wsClient) opRequest(msg opMessage) (*http.Request, error) {
+	path := "/cache"
+	if c.cacheName != "" {
+		path = "/caches/" + url.PathEscape(c.cacheName) + path
+	}
+	var req *http.Request
+	switch msg.Type {
+	case "set":
+		body, err := json.Marshal(setRequest{Key: msg.Key, Value: msg.Value, Expiration: msg.Expiration})
+		if err != nil {
+			return nil, err
+		}
+		if req, err = http.NewRequest(http.MethodPost, path, bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	case "delete":
+		var err error
+		if req, err = http.NewRequest(http.MethodDelete, path+"/"+url.PathEscape(msg.Key), nil); err != nil {
+			return nil, err
+		}
+	case "publish":
+		body, err := json.Marshal(map[string]interface{}{"message": msg.Message})
+		if err != nil {
+			return nil, err
+		}
+		if req, err = http.NewRequest(http.MethodPost, "/publish/"+url.PathEscape(msg.Channel), bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, values := range c.credentials {
+		req.Header[name] = values
+	}
+	req.RemoteAddr = c.conn.RemoteAddr().String()
+	return req, nil
+}
+
+// opRecorder keeps the response to an op's request
+type opRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *opRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *opRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *opRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Sorted sets are JSON objects of member scores, {"alice": 120, "bob": 95},
+// ordered by score and then by member when read, for leaderboards and
+// indexes by time
+
+func init() {
+	registerTypeOps(map[string]typeOpDef{
+		"zadd":          {fn: zsetAdd},
+		"zincrby":       {fn: zsetIncrBy},
+		"zrange":        {fn: zsetRange, read: true},
+		"zrangebyscore": {fn: zsetRangeByScore, read: true},
+		"zrank":         {fn: zsetRank, read: true},
+	})
+}
+
+// zsetEntry is a member of a sorted set as read back
+type zsetEntry struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// asZSet returns the sorted set held by a key, nil when it is not cached
+func asZSet(value interface{}) (map[string]interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	zset, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errWrongType
+	}
+	for _, score := range zset {
+		if _, ok := score.(float64); !ok {
+			return nil, errWrongType
+		}
+	}
+	return zset, nil
+}
+
+// sortZSet returns the members by score, lowest first, or highest first
+// when rev is set; ties go by member
+func sortZSet(zset map[string]interface{}, rev bool) []zsetEntry {
+	entries := make([]zsetEntry, 0, len(zset))
+	for member, score := range zset {
+		entries = append(entries, zsetEntry{Member: member, Score: score.(float64)})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if rev {
+			a, b = b, a
+		}
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+		return a.Member < b.Member
+	})
+	return entries
+}
+
+// zsetAdd :: ZAdd: sets the scores of the members in the object in
+// args[0], replying with how many were new
+func zsetAdd(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	zset, err := asZSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	var scores map[string]interface{}
+	if len(args) == 1 {
+		scores, _ = args[0].(map[string]interface{})
+	}
+	if len(scores) == 0 {
+		return nil, nil, argError("no scores to set")
+	}
+	added := copyHash(zset, len(scores))
+	for member, score := range scores {
+		if _, ok := score.(float64); !ok {
+			return nil, nil, argError("score of %q must be a number", member)
+		}
+		added[member] = score
+	}
+	return len(added) - len(zset), added, nil
+}
+
+// zsetIncrBy :: ZIncrBy: adds args[1] to the score of member args[0],
+// which starts at 0, replying with the result
+func zsetIncrBy(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	zset, err := asZSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := argStrings(args[:min(len(args), 1)], "members")
+	if err != nil {
+		return nil, nil, err
+	}
+	by, err := argFloat(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	score, _ := zset[members[0]].(float64)
+	score += by
+	if math.IsInf(score, 0) {
+		return nil, nil, argError("score out of range")
+	}
+	incremented := copyHash(zset, 1)
+	incremented[members[0]] = score
+	return score, incremented, nil
+}
+
+// zsetRange :: ZRange: the members ranked args[0] to args[1], both
+// included, highest score first when args[2] is true; negative ranks count
+// from the last, -1 being the last
+func zsetRange(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	zset, err := asZSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	start, err := argInt(args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop, err := argInt(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	rev := len(args) > 2 && args[2] == true
+	if start < 0 {
+		start = max(len(zset)+start, 0)
+	}
+	if stop < 0 {
+		stop = len(zset) + stop
+	}
+	stop = min(stop, len(zset)-1)
+	if start > stop {
+		return []zsetEntry{}, value, nil
+	}
+	return sortZSet(zset, rev)[start : stop+1], value, nil
+}
+
+// zsetRangeByScore :: ZRangeByScore: the members scoring from args[0] to
+// args[1], both included, lowest first
+func zsetRangeByScore(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	zset, err := asZSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	lo, err := argFloat(args, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	hi, err := argFloat(args, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := []zsetEntry{}
+	for _, entry := range sortZSet(zset, false) {
+		if entry.Score >= lo && entry.Score <= hi {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, value, nil
+}
+
+// zsetRank :: ZRank: the rank of member args[0] from 0, counting from the
+// highest score when args[1] is true, or errMemberNotFound
+func zsetRank(value interface{}, args []interface{}) (interface{}, interface{}, error) {
+	zset, err := asZSet(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := argStrings(args[:min(len(args), 1)], "members")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := zset[members[0]]; !ok {
+		return nil, nil, errMemberNotFound
+	}
+	rev := len(args) > 1 && args[1] == true
+	for rank, entry := range sortZSet(zset, rev) {
+		if entry.Member == members[0] {
+			return map[string]interface{}{"rank": rank, "score": entry.Score}, value, nil
+		}
+	}
+	return nil, nil, errMemberNotFound
+}
+
+// registerZSetRoutes :: mounts /cache/{key}/zset
+func registerZSetRoutes(r *mux.Router) {
+	r.Handle("/cache/{key}/zset", withConsistency(zsetRangeHandler)).Methods("GET")
+	r.Handle("/cache/{key}/zset/byscore", withConsistency(zsetRangeByScoreHandler)).Methods("GET")
+	r.Handle("/cache/{key}/zset/rank", withConsistency(zsetRankHandler)).Methods("GET")
+	r.Handle("/cache/{key}/zset/add", typeWrite(zsetAddHandler)).Methods("POST")
+	r.Handle("/cache/{key}/zset/incr", typeWrite(zsetIncrHandler)).Methods("POST")
+}
+
+// zsetAddHandler serves POST /cache/{key}/zset/add: {"scores": {"alice": 120}}
+func zsetAddHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	added, err := runTypeOp(r, key, typeOp{Name: "zadd", Args: []interface{}{data.Scores}}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"added": added})
+}
+
+// zsetIncrHandler serves POST /cache/{key}/zset/incr: adds "by", 1 by
+// default, to the score of "member"
+func zsetIncrHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	data, ok := readTypeRequest(w, r)
+	if !ok {
+		return
+	}
+	if data.Member == "" {
+		http.Error(w, "member is required", http.StatusBadRequest)
+		return
+	}
+	by := 1.0
+	if data.By != nil {
+		by = *data.By
+	}
+	score, err := runTypeOp(r, key, typeOp{Name: "zincrby", Args: []interface{}{data.Member, by}}, data.ttl())
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"member": data.Member, "score": score})
+}
+
+// zsetRangeHandler serves GET /cache/{key}/zset?start=0&stop=-1&rev=true,
+// every member lowest first by default; a key not cached is an empty set
+func zsetRangeHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	start, stop := 0, -1
+	var err error
+	if s := r.URL.Query().Get("start"); s != "" {
+		if start, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "start must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.URL.Query().Get("stop"); s != "" {
+		if stop, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "stop must be an integer", http.StatusBadRequest)
+			return
+		}
+	}
+	rev := r.URL.Query().Get("rev") == "true"
+	members, err := runTypeOp(r, key, typeOp{Name: "zrange", Args: []interface{}{start, stop, rev}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"members": members})
+}
+
+// zsetRangeByScoreHandler serves GET /cache/{key}/zset/byscore?min=0&max=100;
+// either bound may be left out or given as -inf or +inf
+func zsetRangeByScoreHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	lo, hi := math.Inf(-1), math.Inf(1)
+	var err error
+	if s := r.URL.Query().Get("min"); s != "" {
+		if lo, err = strconv.ParseFloat(s, 64); err != nil {
+			http.Error(w, "min must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.URL.Query().Get("max"); s != "" {
+		if hi, err = strconv.ParseFloat(s, 64); err != nil {
+			http.Error(w, "max must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	members, err := runTypeOp(r, key, typeOp{Name: "zrangebyscore", Args: []interface{}{lo, hi}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	writeTypeReply(w, key, map[string]interface{}{"members": members})
+}
+
+// zsetRankHandler serves GET /cache/{key}/zset/rank?member=alice&rev=true
+func zsetRankHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	member := r.URL.Query().Get("member")
+	rev := r.URL.Query().Get("rev") == "true"
+	rank, err := runTypeOp(r, key, typeOp{Name: "zrank", Args: []interface{}{member, rev}}, 0)
+	if err != nil {
+		typeOpError(w, err)
+		return
+	}
+	reply := rank.(map[string]interface{})
+	reply["member"] = member
+	writeTypeReply(w, key, reply)
+}